@@ -22,6 +22,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// A updates .Queries, .AnsweredQueries, .AnsweredAQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredAQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -30,14 +31,17 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// A (non-existent) record updates .Queries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost non-existent.sslip.io +short -p "+strconv.Itoa(port), port)
 			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
 
-			// A blocked updates .Queries, .AnsweredQueries, .AnsweredBlockedQueries
+			// A blocked updates .Queries, .AnsweredQueries, .AnsweredBlockedQueries, .AnsweredBlockedAQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredBlockedQueries++
+			expectedMetrics.AnsweredBlockedAQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			dig("@localhost bank-of-raiffeisen.127.0.0.1.sslip.io +short -p " + strconv.Itoa(port))
 			actualMetrics = getMetrics(port)
@@ -45,20 +49,33 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// AAAA updates .Queries, .AnsweredQueries, .AnsweredAAAAQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredAAAAQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost 2600--.sslip.io aaaa +short -p "+strconv.Itoa(port), port)
 			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
 
+			// AAAA blocked updates .Queries, .AnsweredQueries, .AnsweredBlockedQueries, .AnsweredBlockedAAAAQueries
+			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
+			expectedMetrics.AnsweredQueries++
+			expectedMetrics.AnsweredBlockedQueries++
+			expectedMetrics.AnsweredBlockedAAAAQueries++
+			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
+			actualMetrics = digAndGetMetrics("@localhost bank-of-raiffeisen.2600--.sslip.io aaaa +short -p "+strconv.Itoa(port), port)
+			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
+
 			// AAAA (non-existent) updates .Queries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost non-existent.sslip.io aaaa +short -p "+strconv.Itoa(port), port)
 			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
 
 			// MX (customized) updates .Queries, .AnsweredQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost sslip.io mx +short -p "+strconv.Itoa(port), port)
@@ -66,6 +83,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// MX updates .Queries, AnsweredQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost non-existent.sslip.io mx +short -p "+strconv.Itoa(port), port)
@@ -73,6 +91,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// NS updates .Queries, AnsweredQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost non-existent.sslip.io ns +short -p "+strconv.Itoa(port), port)
@@ -80,6 +99,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// NS DNS-01 challenge record updates .Queries, .AnsweredNSDNS01ChallengeQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			// DNS-01 challenges don't count as successful because we're not authoritative; we're delegating
 			expectedMetrics.AnsweredNSDNS01ChallengeQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -88,6 +108,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// Always successful: SOA
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			dig("@localhost non-existent.sslip.io soa +short -p " + strconv.Itoa(port))
@@ -96,6 +117,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT sslip.io (customized) updates .Queries, .AnsweredQueries,
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost sslip.io txt +short -p "+strconv.Itoa(port), port)
@@ -103,12 +125,14 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT sslip.io (non-existent) updates .Queries, .AnsweredQueries,
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost non-existent.sslip.io txt +short -p "+strconv.Itoa(port), port)
 			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
 
 			// TXT ip.sslip.io updates .Queries, .AnsweredQueries, .AnsweredTXTSrcIPQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredTXTSrcIPQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -117,6 +141,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT version.sslip.io updates .Queries, .AnsweredQueries, .AnsweredTXTVersionQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredTXTVersionQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -125,6 +150,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT put.value.key.k-v.io updates .Queries, .AnsweredQueries, .AnsweredTXTPutKvQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredTXTPutKvQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -133,6 +159,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT key.k-v.io updates .Queries, .AnsweredQueries, .AnsweredTXTGetKvQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredTXTGetKvQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -142,6 +169,7 @@ var _ = Describe("IntegrationMetrics", func() {
 			// TXT delete.key.k-v.io updates .Queries, .AnsweredTXTDelKvQueries
 			// It doesn't count as an "answered" query because it returns no record
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredTXTDelKvQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost delete.key.k-v.io txt +short -p "+strconv.Itoa(port), port)
@@ -149,6 +177,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// PTR version.sslip.io updates .Queries, .AnsweredQueries, .AnsweredPTRQueriesIPv4
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredPTRQueriesIPv4++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -157,6 +186,7 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// PTR version.sslip.io updates .Queries, .AnsweredQueries, .AnsweredPTRQueriesIPv6
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredQueries++
 			expectedMetrics.AnsweredPTRQueriesIPv6++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
@@ -165,10 +195,21 @@ var _ = Describe("IntegrationMetrics", func() {
 
 			// TXT DNS-01 challenge record updates .Queries, .AnsweredNSDNS01ChallengeQueries
 			expectedMetrics.Queries++
+			expectedMetrics.QueriesUDP++
 			expectedMetrics.AnsweredNSDNS01ChallengeQueries++
 			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
 			actualMetrics = digAndGetMetrics("@localhost _acme-challenge.fe80--.sslip.io txt +short -p "+strconv.Itoa(port), port)
 			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
+
+			// A over TCP updates .Queries, .QueriesTCP, .AnsweredQueries, .AnsweredAQueries
+			expectedMetrics.Queries++
+			expectedMetrics.QueriesTCP++
+			expectedMetrics.TCPConnectionsAccepted++
+			expectedMetrics.AnsweredQueries++
+			expectedMetrics.AnsweredAQueries++
+			expectedMetrics = bumpExpectedToAccountForMetricsQuery(expectedMetrics)
+			actualMetrics = digAndGetMetrics("@localhost 127.0.0.1.sslip.io +tcp +short -p "+strconv.Itoa(port), port)
+			Expect(expectedMetrics.MostlyEquals(actualMetrics)).To(BeTrue())
 		})
 	})
 })
@@ -178,6 +219,7 @@ var _ = Describe("IntegrationMetrics", func() {
 // the Heisenberg uncertainty principle (observing changes the values)
 func bumpExpectedToAccountForMetricsQuery(metrics xip.Metrics) xip.Metrics {
 	metrics.Queries++
+	metrics.QueriesUDP++
 	metrics.AnsweredQueries++
 	return metrics
 }
@@ -214,7 +256,29 @@ func getMetrics(port int) (m xip.Metrics) {
 			"\"TXT KV GET/PUT/DEL: %d/%d/%d\"\n"+
 			"\"PTR IPv4/IPv6: %d/%d\"\n"+
 			"\"NS DNS-01: %d\"\n"+
-			"\"Blocked: %d\"\n",
+			"\"Blocked: %d\"\n"+
+			"\"Blocked A/AAAA: %d/%d\"\n"+
+			"\"KV Read-only Rejections: %d\"\n"+
+			"\"Queries UDP/TCP/DoH: %d/%d/%d\"\n"+
+			"\"Dropped Queries: %d\"\n"+
+			"\"TXT Trace: %d\"\n"+
+			"\"Slow etcd: %d\"\n"+
+			"\"Denied by Allowlist: %d\"\n"+
+			"\"TCP Connections Active/Accepted/Idle-closed: %d/%d/%d\"\n"+
+			"\"Refused without EDNS: %d\"\n"+
+			"\"Truncated KV PUTs: %d\"\n"+
+			"\"TXT Runtime: %d\"\n"+
+			"\"TXT Server ID: %d\"\n"+
+			"\"Timed-out Queries: %d\"\n"+
+			"\"KV Pool A/AAAA: %d\"\n"+
+			"\"Unsupported Class: %d\"\n"+
+			"\"Drained Queries: %d\"\n"+
+			"\"Malformed Queries: %d\"\n"+
+			"\"Denied by Policy: %d\"\n"+
+			"\"Evicted KV Entries: %d\"\n"+
+			"\"Refused too many labels: %d\"\n"+
+			"\"Answered from flood cache: %d\"\n"+
+			"\"CNAME/MX/NS/SOA: %d/%d/%d/%d\"\n",
 		&uptime,
 		&junk,
 		&junk, &junk, &junk,
@@ -228,6 +292,28 @@ func getMetrics(port int) (m xip.Metrics) {
 		&m.AnsweredPTRQueriesIPv4, &m.AnsweredPTRQueriesIPv6,
 		&m.AnsweredNSDNS01ChallengeQueries,
 		&m.AnsweredBlockedQueries,
+		&m.AnsweredBlockedAQueries, &m.AnsweredBlockedAAAAQueries,
+		&m.AnsweredReadOnlyRejections,
+		&m.QueriesUDP, &m.QueriesTCP, &m.QueriesDoH,
+		&m.DroppedQueries,
+		&m.AnsweredTXTTraceQueries,
+		&m.SlowEtcdQueries,
+		&m.DeniedByAllowlist,
+		&m.TCPConnectionsActive, &m.TCPConnectionsAccepted, &m.TCPConnectionsIdleClosed,
+		&m.RefusedWithoutEDNS,
+		&m.TruncatedKVPuts,
+		&m.AnsweredTXTRuntimeQueries,
+		&m.AnsweredServerIDQueries,
+		&m.TimedOutQueries,
+		&m.AnsweredKvPoolQueries,
+		&m.AnsweredUnsupportedClass,
+		&m.DrainedQueries,
+		&m.MalformedQueries,
+		&m.DeniedByPolicy,
+		&m.EvictedKVEntries,
+		&m.RefusedTooManyLabels,
+		&m.AnsweredFromFloodCache,
+		&m.AnsweredCNAMEQueries, &m.AnsweredMXQueries, &m.AnsweredNSQueries, &m.AnsweredSOAQueries,
 	)
 	Expect(err).ToNot(HaveOccurred())
 	m.Start = time.Now().Add(-time.Duration(uptime) * time.Second)
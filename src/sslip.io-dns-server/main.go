@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"xip/xip"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func main() {
 	var wg sync.WaitGroup
-	var etcdEndpoint = flag.String("etcdHost", "localhost:2379", "etcd client endpoint; falls back to builtin key-value store if unable to connect")
+	var etcdEndpoint = flag.String("etcdHost", "localhost:2379", "etcd client endpoint, or comma-separated endpoints of several clusters to shard the keys across; falls back to builtin key-value store if unable to connect")
 	var blocklistURL = flag.String("blocklistURL", "https://raw.githubusercontent.com/cunnie/sslip.io/main/etc/blocklist.txt", `URL containing a list of "forbidden" names/CIDRs`)
 	var nameservers = flag.String("nameservers", "ns-aws.sslip.io.,ns-azure.sslip.io.,ns-gce.sslip.io.", "comma-separated list of nameservers")
 	var addresses = flag.String("addresses",
@@ -31,13 +40,420 @@ func main() {
 			"ns-azure.sslip.io=52.187.42.158,"+
 			"ns-gce.sslip.io=104.155.144.4", "comma-separated list of hosts and corresponding IPv4 and/or IPv6 address(es). If unsure, add to the list rather than replace")
 	var bindPort = flag.Int("port", 53, "port the DNS server should bind to")
+	var debugWire = flag.Bool("debugWire", false, "log the hex-encoded query and response; verbose and may leak data")
+	var acmeMode = flag.String("acmeMode", xip.AcmeModeDelegate, `how to answer "_acme-challenge." TXT queries: "delegate" (NS to the stripped hostname) or "kv" (from the key-value store)`)
+	var ede = flag.Bool("ede", false, "include Extended DNS Errors (RFC 8914) in responses to EDNS queries, e.g. why a query was blocked")
+	var v6Separator = flag.String("v6Separator", "-", `character that stands in for ":" in IPv6 hostnames: "-" or one of "g"-"z", e.g. "x" → "2001xdb8xx1.sslip.io"`)
+	var httpPort = flag.Int("httpPort", 0, `port to serve the DoH JSON API (e.g. "/resolve?name=127-0-0-1.sslip.io&type=A") on; 0 disables it`)
+	var soaRefresh = flag.Uint("soaRefresh", uint(xip.DefaultSOATimers.Refresh), "SOA refresh, in seconds")
+	var soaRetry = flag.Uint("soaRetry", uint(xip.DefaultSOATimers.Retry), "SOA retry, in seconds; must be less than or equal to the refresh")
+	var soaExpire = flag.Uint("soaExpire", uint(xip.DefaultSOATimers.Expire), "SOA expire, in seconds; must be greater than or equal to the refresh")
+	var soaMinTTL = flag.Uint("soaMinTTL", uint(xip.DefaultSOATimers.MinTTL), "SOA minimum TTL (negative caching), in seconds")
+	var kvReadOnly = flag.Bool("kvReadOnly", false, `refuse k-v.io writes (put, delete) with a "403: read-only node" TXT; gets still work`)
+	var maxAnswers = flag.Int("maxAnswers", xip.DefaultMaxAnswers, "cap on the A, AAAA, or TXT records in an answer; 0 → no cap")
+	var maxLabels = flag.Int("maxLabels", xip.DefaultMaxLabels, "refuse queries for names with more labels, e.g. deep random-subdomain attacks; 0 → no cap")
+	var maxAnswersTruncate = flag.Bool("maxAnswersTruncate", false, "set TC (truncated) when an answer is capped by -maxAnswers")
+	var fullerOverTCP = flag.Bool("fullerOverTCP", false, "over UDP, trim NS answers' glue to the first nameserver's; over TCP, answer in full: all the glue, and no -maxAnswers cap")
+	var kvPTRPuts = flag.Bool("kvPTRPuts", false, `allow k-v.io puts & deletes of PTR records (the "ptr-<IP>" & "dhcp-<host>" keys, "dhcp.k-v.io" leases); otherwise they're refused with a "403: PTR writes are disabled" TXT`)
+	var kvListToken = flag.String("kvListToken", "", `enables the "list.<token>.<prefix>.k-v.io" TXT record (the keys starting with the prefix)`)
+	var kvExportToken = flag.String("kvExportToken", "", `enables the "<token>.export.k-v.io" TXT record (the key-value store's key count & checksum)`)
+	var exportKV = flag.String("exportKV", "", `export the key-value store as JSON to this file ("-" → stdout) and exit`)
+	var importKV = flag.String("importKV", "", `import the key-value store from this JSON file ("-" → stdin) and exit`)
+	var testLocalZone = flag.Bool("testLocalZone", false, `test-only: resolve ".local" names' embedded IPs, e.g. "10-0-0-1.local" (no mDNS multicast); don't use in production`)
+	var ipPositionStrict = flag.Bool("ipPositionStrict", false, `only match IPs that are the leading label(s), e.g. "10-0-0-1.sslip.io" but not "foo.10-0-0-1.sslip.io"`)
+	var zones = flag.String("zones", "", `comma-separated list of zones to serve in addition to "sslip.io", e.g. "example.com" → "ip.example.com" TXT returns the querier's IP`)
+	var zoneNameservers = flag.String("zoneNameservers", "", `comma-separated list of zones and the nameservers they advertise instead of -nameservers, e.g. "example.com=ns1.example.com,example.com=ns2.example.com"`)
+	var delegates = flag.String("delegates", "", `comma-separated list of subdomains and the nameservers we delegate them to, i.e. refer every query under them to, e.g. "dev.example.com=ns1.dev.example.com"`)
+	var zoneTTLs = flag.String("zoneTTLs", "", `comma-separated list of zones and the TTL of their A & AAAA answers instead of a week, e.g. "dev.example.com=60"`)
+	var noCacheSubdomain = flag.String("noCacheSubdomain", "", `subdomain, e.g. "nocache.sslip.io.", whose names' A & AAAA answers have TTL 0 so that resolvers don't cache them; "" → none`)
+	var chaosPool = flag.String("chaosPool", "", `comma-separated list of IPs; "chaos.sslip.io" returns a random one for resilience testing`)
+	var geoRegions = flag.String("geoRegions", "", `comma-separated list of CIDRs and corresponding regions for "geo.sslip.io", e.g. "10.0.0.0/8=eu,2001:db8::/32=na"`)
+	var geoAnswers = flag.String("geoAnswers", "", `comma-separated list of regions and corresponding IPs that "geo.sslip.io" returns, e.g. "eu=10.0.0.1,default=10.0.0.2"`)
+	var maxConcurrentQueries = flag.Int("maxConcurrentQueries", 0, "cap on the queries answered concurrently; queries over the cap are dropped; 0 → no cap")
+	var sixToFour = flag.Bool("sixToFour", false, `"<IPv4>.6to4.sslip.io" (or under another of the -zones) AAAA returns the IPv4's 6to4 address, e.g. "10-0-0-1.6to4.sslip.io" → 2002:a00:1::`)
+	var allowBase36IP = flag.Bool("allowBase36IP", false, `resolve Base36-encoded IPv4 addresses under "b36.sslip.io" (or "b36." under another of the -zones), e.g. "z8kflt.b36.sslip.io" → 127.0.0.1`)
+	var etcdRetryInterval = flag.Duration("etcdRetryInterval", 0, `if etcd is unavailable at startup, keep retrying at this interval (e.g. "30s") and switch to it once it's reachable; 0 → use the local key-value store until restarted`)
+	var answerOrder = flag.String("answerOrder", xip.AnswerOrderAsIs, `the order of an answer's A (AAAA) records: "asis" (as they're stored) or "closest" (those closest to the client's subnet or IP first)`)
+	var anyMode = flag.String("anyMode", xip.AnyModeNotImplemented, `how to answer ANY queries: "notimp" (NotImplemented) or "hinfo" (a single HINFO record, per RFC 8482)`)
+	var blocklistPrivateToo = flag.Bool("blocklistPrivateToo", false, "apply the blocklist to private IPs (e.g. 10.0.0.0/8) too, which are exempt by default")
+	var maintenanceWindows = flag.String("maintenanceWindows", "", `comma-separated list of hosts, daily UTC windows, and the IPs to return during them instead of the host's -addresses, e.g. "www.example.com=02:00-04:00=10.0.0.99"`)
+	var primaryNS = flag.String("primaryNS", "", `the SOA's MNAME (primary nameserver), e.g. "ns-aws.sslip.io."; default is the first of the -nameservers`)
+	var statsDAddr = flag.String("statsDAddr", "", `StatsD server to push the metrics to, e.g. "127.0.0.1:8125"; "" → disabled`)
+	var statsDInterval = flag.Duration("statsDInterval", xip.DefaultStatsDInterval, "how often to push the metrics to StatsD")
+	var floodInterval = flag.Duration("floodInterval", 0, `a source's identical query within this (e.g. "100ms") of its last answered one is answered from a cache rather than processed again; 0 → disabled`)
+	var queryTimeout = flag.Duration("queryTimeout", 0, `budget for answering a query, e.g. "1s", after which we answer SERVFAIL; 0 → no budget`)
+	var ddrTarget = flag.String("ddrTarget", "", `name of our encrypted endpoints, e.g. "ns-aws.sslip.io.", to advertise in "_dns.resolver.arpa" SVCB records (RFC 9462); "" → disabled`)
+	var ddrDoTPort = flag.Uint("ddrDoTPort", 0, "DNS-over-TLS port to advertise with -ddrTarget, e.g. 853; 0 → none")
+	var ddrDoHPath = flag.String("ddrDoHPath", "", `DNS-over-HTTPS URI template to advertise with -ddrTarget, e.g. "/dns-query{?dns}"; "" → none`)
+	var ddrDoHPort = flag.Uint("ddrDoHPort", 0, "DNS-over-HTTPS port to advertise with -ddrDoHPath if not 443")
+	var dnssecKey = flag.String("dnssecKey", "", `PEM file of the ECDSA P-256 private key that signs NSEC3 denials & answers NSEC3PARAM/DNSKEY queries; "" → DNSSEC disabled`)
+	var nsec3Iterations = flag.Uint("nsec3Iterations", 0, "NSEC3 additional hash iterations; RFC 9276 recommends 0")
+	var nsec3Salt = flag.String("nsec3Salt", "", `NSEC3 salt, hex-encoded, e.g. "aabbccdd"; RFC 9276 recommends none`)
+	var nsec3OptOut = flag.Bool("nsec3OptOut", false, "set the NSEC3 Opt-Out flag")
+	var apexTXT = flag.String("apexTXT", "", `comma-separated list of extra TXT records for "sslip.io", e.g. "google-site-verification=abc123"`)
+	var zoneApexTXT = flag.String("zoneApexTXT", "", `comma-separated list of zones and extra TXT records for their apexes, e.g. "example.com=Served by MyCorp"`)
+	var slowEtcdThreshold = flag.Duration("slowEtcdThreshold", 0, `log a warning (and count it in the metrics) when a key-value get/put/delete's etcd call takes longer than this, e.g. "250ms"; 0 → disabled`)
+	var allowlist = flag.String("allowlist", "", `comma-separated list of the only names to answer, exactly ("ns.example.com") or any name under a zone ("*.internal.example.com"); everything else is refused; "" → answer everything`)
+	var requireEDNS = flag.Bool("requireEDNS", false, "refuse queries without EDNS (an OPT record), to cut down on legacy spoofed traffic")
+	var unsupportedTypes = flag.String("unsupportedTypes", "3,4,38,253,254", `comma-separated list of the (obsolete) query types, by number, to answer NotImplemented rather than NODATA, e.g. "38" (A6); "" → none`)
+	var kvMaxPutBytes = flag.Int("kvMaxPutBytes", xip.DefaultKvMaxPutBytes, `cap on the value of "put.value.key.k-v.io"; longer values are truncated (and the answer says so)`)
+	var kvStrictPuts = flag.Bool("kvStrictPuts", false, `reject (413) a "put.value.key.k-v.io" whose value exceeds -kvMaxPutBytes rather than truncate it, and (507) a new key when the store has -kvMaxEntries keys rather than evict`)
+	var kvMaxEntries = flag.Int("kvMaxEntries", 0, "cap on the builtin key-value store's keys (not etcd's); a new key evicts the least recently put one; 0 → no cap")
+	var blockedTTL = flag.Uint("blockedTTL", xip.DefaultBlockedTTL, "TTL of blocked (sinkholed) A & AAAA answers, short so that unblocking propagates quickly")
+	var blockedTXT = flag.Bool("blockedTXT", false, `enables the "blocked.<name>.sslip.io" TXT record, under any of the -zones (whether & why <name> would be blocked), for debugging the blocklist`)
+	var disableVersionTXT = flag.Bool("disableVersionTXT", false, `"version.status.sslip.io" TXT returns no records, lest it fingerprint the server`)
+	var disableMetricsTXT = flag.Bool("disableMetricsTXT", false, `"metrics.status.sslip.io" TXT (& its pages & compact form) returns no records, lest it fingerprint the server`)
+	var reservedNames = flag.String("reservedNames", "", `comma-separated list of leftmost labels, e.g. "www,mail", whose hostnames never resolve to an embedded IP (NODATA unless customized)`)
+	var refuseOutOfZone = flag.Bool("refuseOutOfZone", false, `refuse queries for names outside our zones (-zones), e.g. "10-0-0-1.example.com", rather than white-label them`)
+	var ipWildcard = flag.Bool("ipWildcard", false, `"<anything>.ip.sslip.io" TXT, not just "ip.sslip.io", returns the querier's IP address`)
+	var whoamiAlias = flag.Bool("whoamiAlias", false, `"whoami.sslip.io" TXT returns the querier's IP address, as "ip.sslip.io" does, for scripts written for "whoami.cloudflare"`)
+	var serverID = flag.String("serverID", "", `identifies this server, e.g. "ns-aws-1", in the "id.server.sslip.io" TXT; default is none (no records)`)
+	var defaultCNAME = flag.String("defaultCNAME", "", `CNAME, e.g. "landing.example.com.", of the names under our zones that are neither customized nor embed an IP; default is NODATA`)
+	var configFile = flag.String("config", "", `YAML configuration file, e.g. "sslip.yml", whose keys are these flags' names, e.g. "nameservers: [ns-aws.sslip.io.]"; it replaces the flags (other than -exportKV & -importKV)`)
+	var logLevel = flag.String("logLevel", xip.LogLevelAll, `which queries to log: "all", "anomalies" (blocked, NotImplemented, etc.), or "errors"`)
 	flag.Parse()
-	log.Printf("etcd endpoint: %s, blocklist URL: %s, name servers: %s, bind port: %d",
-		*etcdEndpoint, *blocklistURL, *nameservers, *bindPort)
+	var x *xip.Xip
+	if *configFile != "" {
+		x = configuredXip(*configFile, bindPort, httpPort)
+	} else {
+		log.Printf("etcd endpoint: %s, blocklist URL: %s, name servers: %s, bind port: %d",
+			*etcdEndpoint, *blocklistURL, *nameservers, *bindPort)
 
-	x, logmessages := xip.NewXip(*etcdEndpoint, *blocklistURL, strings.Split(*nameservers, ","), strings.Split(*addresses, ","))
-	for _, logmessage := range logmessages {
-		log.Println(logmessage)
+		var logmessages []string
+		x, logmessages = xip.NewXip(*etcdEndpoint, *blocklistURL, strings.Split(*nameservers, ","), strings.Split(*addresses, ","))
+		for _, logmessage := range logmessages {
+			log.Println(logmessage)
+		}
+		if *etcdRetryInterval > 0 {
+			if strings.Contains(*etcdEndpoint, ",") {
+				log.Fatalf("-etcdRetryInterval: retrying isn't supported with sharded etcd (-etcdHost %s)", *etcdEndpoint)
+			}
+			x.RetryEtcd(xip.EtcdConnector(*etcdEndpoint), *etcdRetryInterval)
+		}
+		x.DebugWire = *debugWire
+		x.ExtendedDNSErrors = *ede
+		x.KVReadOnly = *kvReadOnly
+		x.SlowEtcdThreshold = *slowEtcdThreshold
+		if *allowlist != "" {
+			x.AllowlistOnly = true
+			x.Allowlist = strings.Split(*allowlist, ",")
+		}
+		x.RequireEDNS = *requireEDNS
+		x.BlocklistPrivateToo = *blocklistPrivateToo
+		x.BlockedTXT = *blockedTXT
+		x.DisableVersionTXT = *disableVersionTXT
+		x.DisableMetricsTXT = *disableMetricsTXT
+		x.ServerID = *serverID
+		x.IPWildcard = *ipWildcard
+		x.SetWhoamiAlias(*whoamiAlias)
+		x.RefuseOutOfZone = *refuseOutOfZone
+		if *primaryNS != "" {
+			mname, err := dnsmessage.NewName(*primaryNS)
+			if err != nil || !strings.HasSuffix(*primaryNS, ".") {
+				log.Fatalf("-primaryNS: %q must be a fully-qualified name, e.g. \"ns-aws.sslip.io.\"", *primaryNS)
+			}
+			x.PrimaryNS = mname
+		}
+		if *queryTimeout < 0 {
+			log.Fatalf("-queryTimeout: %s must not be negative", *queryTimeout)
+		}
+		x.QueryTimeout = *queryTimeout
+		if *floodInterval < 0 {
+			log.Fatalf("-floodInterval: %s must not be negative", *floodInterval)
+		}
+		x.FloodInterval = *floodInterval
+		if *reservedNames != "" {
+			x.ReservedNames = strings.Split(*reservedNames, ",")
+		}
+		if *noCacheSubdomain != "" {
+			if _, err := dnsmessage.NewName(*noCacheSubdomain); err != nil || !strings.HasSuffix(*noCacheSubdomain, ".") {
+				log.Fatalf("-noCacheSubdomain: %q must be a fully-qualified name, e.g. \"nocache.sslip.io.\"", *noCacheSubdomain)
+			}
+			x.NoCacheSubdomain = *noCacheSubdomain
+		}
+		if *defaultCNAME != "" {
+			cname, err := dnsmessage.NewName(*defaultCNAME)
+			if err != nil || !strings.HasSuffix(*defaultCNAME, ".") {
+				log.Fatalf("-defaultCNAME: %q must be a fully-qualified name, e.g. \"landing.example.com.\"", *defaultCNAME)
+			}
+			x.DefaultCNAME = cname
+		}
+		if *blockedTTL < 1 || *blockedTTL > math.MaxInt32 {
+			log.Fatalf("-blockedTTL: %d must be between 1 and %d", *blockedTTL, math.MaxInt32)
+		}
+		x.BlockedTTL = uint32(*blockedTTL)
+		for _, chaosIP := range strings.Split(*chaosPool, ",") {
+			if chaosIP == "" {
+				continue
+			}
+			ip := net.ParseIP(chaosIP)
+			if ip == nil {
+				log.Fatalf(`-chaosPool: "%s" isn't a valid IP`, chaosIP)
+			}
+			x.ChaosPool = append(x.ChaosPool, ip)
+		}
+		var geoResolver xip.CIDRGeoResolver
+		for _, geoRegion := range strings.Split(*geoRegions, ",") {
+			if geoRegion == "" {
+				continue
+			}
+			cidrRegion := strings.Split(geoRegion, "=")
+			if len(cidrRegion) != 2 || cidrRegion[1] == "" {
+				log.Fatalf(`-geoRegions: "%s" isn't a valid CIDR=region`, geoRegion)
+			}
+			_, ipNet, err := net.ParseCIDR(cidrRegion[0])
+			if err != nil {
+				log.Fatalf(`-geoRegions: "%s" isn't a valid CIDR=region`, geoRegion)
+			}
+			geoResolver = append(geoResolver, xip.CIDRRegion{CIDR: *ipNet, Region: cidrRegion[1]})
+		}
+		if len(geoResolver) > 0 {
+			x.GeoResolver = geoResolver
+		}
+		for _, geoAnswer := range strings.Split(*geoAnswers, ",") {
+			if geoAnswer == "" {
+				continue
+			}
+			regionIP := strings.Split(geoAnswer, "=")
+			if len(regionIP) != 2 || regionIP[0] == "" || net.ParseIP(regionIP[1]) == nil {
+				log.Fatalf(`-geoAnswers: "%s" isn't a valid region=IP`, geoAnswer)
+			}
+			if x.GeoAnswers == nil {
+				x.GeoAnswers = map[string][]net.IP{}
+			}
+			x.GeoAnswers[regionIP[0]] = append(x.GeoAnswers[regionIP[0]], net.ParseIP(regionIP[1]))
+		}
+		for _, zone := range strings.Split(*zones, ",") {
+			if zone == "" {
+				continue
+			}
+			if err := x.AddZone(zone); err != nil {
+				log.Fatalf("-zones: %s", err.Error())
+			}
+			log.Printf(`Adding zone "%s"`, zone)
+		}
+		for _, zoneNameserver := range strings.Split(*zoneNameservers, ",") {
+			if zoneNameserver == "" {
+				continue
+			}
+			zoneNS := strings.Split(zoneNameserver, "=")
+			if len(zoneNS) != 2 {
+				log.Fatalf(`-zoneNameservers: "%s" isn't a valid zone=nameserver`, zoneNameserver)
+			}
+			if err := x.AddZoneNameServer(zoneNS[0], zoneNS[1]); err != nil {
+				log.Fatalf("-zoneNameservers: %s", err.Error())
+			}
+			log.Printf(`Adding nameserver "%s" to zone "%s"`, zoneNS[1], zoneNS[0])
+		}
+		for _, delegate := range strings.Split(*delegates, ",") {
+			if delegate == "" {
+				continue
+			}
+			subdomainNS := strings.Split(delegate, "=")
+			if len(subdomainNS) != 2 {
+				log.Fatalf(`-delegates: "%s" isn't a valid subdomain=nameserver`, delegate)
+			}
+			if err := x.AddDelegate(subdomainNS[0], subdomainNS[1]); err != nil {
+				log.Fatalf("-delegates: %s", err.Error())
+			}
+			log.Printf(`Delegating "%s" to nameserver "%s"`, subdomainNS[0], subdomainNS[1])
+		}
+		for _, zoneTTL := range strings.Split(*zoneTTLs, ",") {
+			if zoneTTL == "" {
+				continue
+			}
+			zoneAndTTL := strings.Split(zoneTTL, "=")
+			if len(zoneAndTTL) != 2 {
+				log.Fatalf(`-zoneTTLs: "%s" isn't a valid zone=TTL`, zoneTTL)
+			}
+			ttl, err := strconv.ParseUint(zoneAndTTL[1], 10, 31)
+			if err != nil {
+				log.Fatalf(`-zoneTTLs: "%s" isn't a TTL between 0 and %d`, zoneAndTTL[1], math.MaxInt32)
+			}
+			if err := x.AddZoneTTL(zoneAndTTL[0], uint32(ttl)); err != nil {
+				log.Fatalf("-zoneTTLs: %s", err.Error())
+			}
+			log.Printf(`Setting zone "%s"'s TTL to %d`, zoneAndTTL[0], ttl)
+		}
+		maintenanceLogmessages, err := x.AddMaintenanceWindows(strings.Split(*maintenanceWindows, ","))
+		if err != nil {
+			log.Fatalf("-maintenanceWindows: %s", err.Error())
+		}
+		for _, logmessage := range maintenanceLogmessages {
+			log.Println(logmessage)
+		}
+		if *ddrTarget != "" {
+			target, err := dnsmessage.NewName(*ddrTarget)
+			if err != nil || !strings.HasSuffix(*ddrTarget, ".") {
+				log.Fatalf("-ddrTarget: %q must be a fully-qualified name, e.g. \"ns-aws.sslip.io.\"", *ddrTarget)
+			}
+			if *ddrDoTPort == 0 && *ddrDoHPath == "" {
+				log.Fatalf("-ddrTarget: requires -ddrDoTPort, -ddrDoHPath, or both")
+			}
+			if *ddrDoTPort > math.MaxUint16 || *ddrDoHPort > math.MaxUint16 {
+				log.Fatalf("-ddrDoTPort & -ddrDoHPort must be at most %d", math.MaxUint16)
+			}
+			x.DDR = &xip.DDR{Target: target, DoTPort: uint16(*ddrDoTPort), DoHPath: *ddrDoHPath, DoHPort: uint16(*ddrDoHPort)}
+		}
+		if *dnssecKey != "" {
+			pemBytes, err := os.ReadFile(*dnssecKey)
+			if err != nil {
+				log.Fatalf("-dnssecKey: %s", err.Error())
+			}
+			key, err := xip.ParseDNSSECKey(pemBytes)
+			if err != nil {
+				log.Fatalf(`-dnssecKey: "%s": %s`, *dnssecKey, err.Error())
+			}
+			if *nsec3Iterations > math.MaxUint16 {
+				log.Fatalf("-nsec3Iterations: %d must be less than or equal to %d", *nsec3Iterations, math.MaxUint16)
+			}
+			salt, err := hex.DecodeString(*nsec3Salt)
+			if err != nil || len(salt) > math.MaxUint8 {
+				log.Fatalf(`-nsec3Salt: "%s" isn't at most 255 hex-encoded bytes`, *nsec3Salt)
+			}
+			x.DNSSEC = &xip.DNSSEC{Key: key, Iterations: uint16(*nsec3Iterations), Salt: salt, OptOut: *nsec3OptOut}
+			log.Printf("DNSSEC signing mode, key tag %d", x.DNSSEC.KeyTag())
+		}
+		if *apexTXT != "" {
+			x.ApexTXT = strings.Split(*apexTXT, ",")
+		}
+		for _, zoneTXT := range strings.Split(*zoneApexTXT, ",") {
+			if zoneTXT == "" {
+				continue
+			}
+			zoneAndTXT := strings.SplitN(zoneTXT, "=", 2)
+			if len(zoneAndTXT) != 2 {
+				log.Fatalf(`-zoneApexTXT: "%s" isn't a valid zone=TXT`, zoneTXT)
+			}
+			if err := x.AddZoneApexTXT(zoneAndTXT[0], zoneAndTXT[1]); err != nil {
+				log.Fatalf("-zoneApexTXT: %s", err.Error())
+			}
+			log.Printf(`Adding TXT "%s" to zone "%s"'s apex`, zoneAndTXT[1], zoneAndTXT[0])
+		}
+		x.IPPositionStrict = *ipPositionStrict
+		x.TestLocalZone = *testLocalZone
+		x.AllowBase36IP = *allowBase36IP
+		x.SixToFour = *sixToFour
+		x.KVExportToken = *kvExportToken
+		x.KVListToken = *kvListToken
+		x.KVPTRPuts = *kvPTRPuts
+		if *kvMaxPutBytes < 1 {
+			log.Fatalf("-kvMaxPutBytes: %d must be positive", *kvMaxPutBytes)
+		}
+		x.KVMaxPutBytes = *kvMaxPutBytes
+		x.KVStrictPuts = *kvStrictPuts
+		if *kvMaxEntries < 0 {
+			log.Fatalf("-kvMaxEntries: %d must not be negative", *kvMaxEntries)
+		}
+		x.KVMaxEntries = *kvMaxEntries
+		x.MaxAnswers = *maxAnswers
+		if *maxConcurrentQueries < 0 {
+			log.Fatalf("-maxConcurrentQueries: %d must not be negative", *maxConcurrentQueries)
+		}
+		if *maxConcurrentQueries > 0 {
+			x.QuerySemaphore = make(chan struct{}, *maxConcurrentQueries)
+		}
+		x.MaxAnswersTruncate = *maxAnswersTruncate
+		if *maxLabels < 0 {
+			log.Fatalf("-maxLabels: %d must not be negative", *maxLabels)
+		}
+		x.MaxLabels = *maxLabels
+		x.FullerOverTCP = *fullerOverTCP
+		x.UnsupportedTypes = nil
+		for _, unsupportedType := range strings.Split(*unsupportedTypes, ",") {
+			if unsupportedType == "" {
+				continue
+			}
+			qType, err := strconv.ParseUint(unsupportedType, 10, 16)
+			if err != nil {
+				log.Fatalf(`-unsupportedTypes: "%s" isn't a query type number, e.g. "38"`, unsupportedType)
+			}
+			x.UnsupportedTypes = append(x.UnsupportedTypes, dnsmessage.Type(qType))
+		}
+		switch *acmeMode {
+		case xip.AcmeModeDelegate, xip.AcmeModeKV:
+			x.AcmeMode = *acmeMode
+		default:
+			log.Fatalf(`-acmeMode: "%s" isn't one of "delegate", "kv"`, *acmeMode)
+		}
+		switch *anyMode {
+		case xip.AnyModeNotImplemented, xip.AnyModeHINFO:
+			x.AnyMode = *anyMode
+		default:
+			log.Fatalf(`-anyMode: "%s" isn't one of "notimp", "hinfo"`, *anyMode)
+		}
+		switch *answerOrder {
+		case xip.AnswerOrderAsIs, xip.AnswerOrderClosestFirst:
+			x.AnswerOrder = *answerOrder
+		default:
+			log.Fatalf(`-answerOrder: "%s" isn't one of "asis", "closest"`, *answerOrder)
+		}
+		if err := xip.ValidV6Separator(*v6Separator); err != nil {
+			log.Fatalf("-v6Separator: %s", err.Error())
+		}
+		xip.V6Separator = *v6Separator
+		x.SOATimers = xip.SOATimers{
+			Refresh: uint32(*soaRefresh),
+			Retry:   uint32(*soaRetry),
+			Expire:  uint32(*soaExpire),
+			MinTTL:  uint32(*soaMinTTL),
+		}
+		if err := x.SOATimers.Validate(); err != nil {
+			log.Fatalf("-soaRefresh, -soaRetry, -soaExpire: %s", err.Error())
+		}
+		switch *logLevel {
+		case xip.LogLevelAll, xip.LogLevelAnomalies, xip.LogLevelErrors:
+			x.LogLevel = *logLevel
+		default:
+			log.Fatalf(`-logLevel: "%s" isn't one of "all", "anomalies", "errors"`, *logLevel)
+		}
+		if *statsDInterval <= 0 {
+			log.Fatalf("-statsDInterval: %s must be positive", *statsDInterval)
+		}
+		x.StatsDAddr = *statsDAddr
+		x.StatsDInterval = *statsDInterval
+	}
+	if *exportKV != "" {
+		exportKVAndExit(x, *exportKV)
+	}
+	if *importKV != "" {
+		importKVAndExit(x, *importKV)
+	}
+
+	if err := x.SelfTest(); err != nil {
+		log.Fatalf("I failed my self-test, so I'm exiting: %s", err.Error())
+	}
+	log.Printf("Passed self-test (A, AAAA, TXT queries)")
+	if x.StatsDAddr != "" {
+		// we push until we exit, hence the never-done context
+		if err := x.RunStatsD(context.Background()); err != nil {
+			log.Fatalf("-statsDAddr: %s", err.Error())
+		}
+		log.Printf("Pushing the metrics to StatsD at %s every %s", x.StatsDAddr, x.StatsDInterval)
+	}
+	// SIGUSR1 toggles draining (SERVFAIL for every query), e.g. for rolling
+	// deployments behind anycast
+	drainSignals := make(chan os.Signal, 1)
+	signal.Notify(drainSignals, syscall.SIGUSR1)
+	go func() {
+		for range drainSignals {
+			x.Drain(!x.Draining())
+			log.Printf("Draining: %t", x.Draining())
+		}
+	}()
+	// SIGHUP reloads the -config file's addresses & maintenance windows without dropping queries
+	if x.ConfigFile != "" {
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		go func() {
+			for range reloadSignals {
+				if err := x.ReloadCustomizations(); err != nil {
+					log.Printf(`couldn't reload "%s": %s`, x.ConfigFile, err.Error())
+					continue
+				}
+				log.Printf(`Reloaded the addresses & maintenance windows from "%s"`, x.ConfigFile)
+			}
+		}()
 	}
 
 	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *bindPort})
@@ -81,6 +497,21 @@ func main() {
 	default:
 		log.Fatal(err.Error())
 	}
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", *bindPort))
+	if err != nil {
+		log.Printf("I couldn't bind to TCP port %d, so I'll only answer UDP queries: %s", *bindPort, err.Error())
+	} else {
+		log.Printf("Successfully bound to TCP port %d.\n", *bindPort)
+		go func() { _ = x.ServeTCP(tcpListener) }()
+	}
+	if *httpPort > 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/resolve", x.DoHJSONHandler)
+		go func() {
+			log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), mux))
+		}()
+		log.Printf("Serving the DoH JSON API on port %d", *httpPort)
+	}
 	log.Printf("Ready to answer queries")
 	wg.Add(1)
 	readFrom(conn, &wg, x)
@@ -91,23 +522,85 @@ func readFrom(conn *net.UDPConn, wg *sync.WaitGroup, x *xip.Xip) {
 	defer wg.Done()
 	for {
 		query := make([]byte, 512)
-		_, addr, err := conn.ReadFromUDP(query)
+		n, addr, err := conn.ReadFromUDP(query)
 		if err != nil {
 			log.Println(err.Error())
 			continue
 		}
 		go func() {
-			response, logMessage, err := x.QueryResponse(query, addr.IP)
+			response, logMessage, err := x.QueryResponseVia(xip.TransportUDP, query[:n], addr.IP)
+			if errors.Is(err, xip.ErrQueryDropped) {
+				return // logging each dropped query would add to the load
+			}
 			if err != nil {
 				log.Println(err.Error())
 				return
 			}
 			_, err = conn.WriteToUDP(response, addr)
-			log.Printf("%v.%d %s", addr.IP, addr.Port, logMessage)
+			if logMessage != "" {
+				log.Printf("%v.%d %s", addr.IP, addr.Port, logMessage)
+			}
 		}()
 	}
 }
 
+// configuredXip returns the Xip that the -config file configures, and sets
+// the ports that it configures
+func configuredXip(configFile string, bindPort, httpPort *int) *xip.Xip {
+	config, err := xip.LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("-config: %s", err.Error())
+	}
+	x, logmessages, err := xip.NewXipFromConfig(config)
+	for _, logmessage := range logmessages {
+		log.Println(logmessage)
+	}
+	if err != nil {
+		log.Fatalf(`-config: "%s": %s`, configFile, err.Error())
+	}
+	x.ConfigFile = configFile
+	if config.Port != 0 {
+		*bindPort = config.Port
+	}
+	*httpPort = config.HTTPPort
+	log.Printf(`Configured by "%s": etcd endpoint: %s, blocklist URL: %s, name servers: %s, bind port: %d`,
+		configFile, config.EtcdHost, config.BlocklistURL, strings.Join(config.Nameservers, ","), *bindPort)
+	return x
+}
+
+func exportKVAndExit(x *xip.Xip, path string) {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		if out, err = os.Create(path); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if err := x.ExportKV(out); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := out.Close(); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Exported the key-value store to %s", path)
+	os.Exit(0)
+}
+
+func importKVAndExit(x *xip.Xip, path string) {
+	in := os.Stdin
+	if path != "-" {
+		var err error
+		if in, err = os.Open(path); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if err := x.ImportKV(in); err != nil {
+		log.Fatal(err.Error())
+	}
+	log.Printf("Imported the key-value store from %s", path)
+	os.Exit(0)
+}
+
 func listLocalIPCIDRs() []string {
 	var ifaces []net.Interface
 	var cidrStrings []string
@@ -0,0 +1,427 @@
+package xip
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the YAML configuration file's settings, see LoadConfig(); its keys
+// are the command-line flags', e.g. "etcdHost", "nameservers". A setting
+// that's absent (zero) gets the flag's default unless noted
+type Config struct {
+	// the key-value store & the blocklist
+	EtcdHost          string        `yaml:"etcdHost"`          // etcd client endpoint, or comma-separated endpoints of shards; "" → the local key-value store
+	EtcdRetryInterval time.Duration `yaml:"etcdRetryInterval"` // if etcd is unavailable, keep retrying at this interval, see RetryEtcd()
+	BlocklistURL      string        `yaml:"blocklistURL"`      // e.g. "https://raw.githubusercontent.com/cunnie/sslip.io/main/etc/blocklist.txt"; "" → no blocklist
+	KVReadOnly        bool          `yaml:"kvReadOnly"`
+	KVMaxPutBytes     int           `yaml:"kvMaxPutBytes"`
+	KVStrictPuts      bool          `yaml:"kvStrictPuts"`
+	KVMaxEntries      int           `yaml:"kvMaxEntries"`
+	KVListToken       string        `yaml:"kvListToken"`
+	KVPTRPuts         bool          `yaml:"kvPTRPuts"`
+	KVExportToken     string        `yaml:"kvExportToken"`
+	SlowEtcdThreshold time.Duration `yaml:"slowEtcdThreshold"`
+	AcmeMode          string        `yaml:"acmeMode"`
+
+	// the zones, their nameservers, delegates & TTLs
+	Nameservers      []string            `yaml:"nameservers"`      // e.g. "ns-aws.sslip.io."
+	Addresses        []string            `yaml:"addresses"`        // e.g. "ns-aws.sslip.io=52.0.56.137"
+	Zones            []string            `yaml:"zones"`            // in addition to "sslip.io", e.g. "example.com"
+	ZoneNameservers  map[string][]string `yaml:"zoneNameservers"`  // e.g. "example.com" → ["ns1.example.com"]
+	Delegates        map[string][]string `yaml:"delegates"`        // e.g. "dev.example.com" → ["ns1.dev.example.com"]
+	ZoneTTLs         map[string]uint32   `yaml:"zoneTTLs"`         // the zones' A & AAAA TTLs, e.g. "dev.example.com" → 60
+	ZoneApexTXT      map[string][]string `yaml:"zoneApexTXT"`      // the zones' apexes' extra TXT records, e.g. "example.com" → ["Served by MyCorp"]
+	NoCacheSubdomain string              `yaml:"noCacheSubdomain"` // its names' A & AAAA TTLs are 0, e.g. "nocache.sslip.io."
+	PrimaryNS        string              `yaml:"primaryNS"`
+	SOARefresh       uint32              `yaml:"soaRefresh"`
+	SOARetry         uint32              `yaml:"soaRetry"`
+	SOAExpire        uint32              `yaml:"soaExpire"`
+	SOAMinTTL        uint32              `yaml:"soaMinTTL"`
+	BlockedTTL       uint32              `yaml:"blockedTTL"`
+	DDRTarget        string              `yaml:"ddrTarget"` // e.g. "ns-aws.sslip.io."; "" → no "_dns.resolver.arpa" SVCB records
+	DDRDoTPort       uint16              `yaml:"ddrDoTPort"`
+	DDRDoHPath       string              `yaml:"ddrDoHPath"`
+	DDRDoHPort       uint16              `yaml:"ddrDoHPort"`
+	DNSSECKey        string              `yaml:"dnssecKey"` // PEM file of the ECDSA P-256 private key; "" → DNSSEC disabled
+	NSEC3Iterations  uint16              `yaml:"nsec3Iterations"`
+	NSEC3Salt        string              `yaml:"nsec3Salt"` // hex-encoded
+	NSEC3OptOut      bool                `yaml:"nsec3OptOut"`
+
+	// the listeners, which main() binds
+	Port     int `yaml:"port"`     // 0 → 53
+	HTTPPort int `yaml:"httpPort"` // the DoH JSON API's; 0 → disabled
+
+	// the answers
+	MaxAnswers           *int          `yaml:"maxAnswers"` // nil → DefaultMaxAnswers; 0 → no cap
+	MaxAnswersTruncate   bool          `yaml:"maxAnswersTruncate"`
+	MaxLabels            *int          `yaml:"maxLabels"` // nil → DefaultMaxLabels; 0 → no cap
+	FullerOverTCP        bool          `yaml:"fullerOverTCP"`
+	MaxConcurrentQueries int           `yaml:"maxConcurrentQueries"`
+	QueryTimeout         time.Duration `yaml:"queryTimeout"`
+	FloodInterval        time.Duration `yaml:"floodInterval"`
+	AnyMode              string        `yaml:"anyMode"`
+	AnswerOrder          string        `yaml:"answerOrder"`
+	EDE                  bool          `yaml:"ede"`
+	RequireEDNS          bool          `yaml:"requireEDNS"`
+	RefuseOutOfZone      bool          `yaml:"refuseOutOfZone"`
+	Allowlist            []string      `yaml:"allowlist"`
+	IPPositionStrict     bool          `yaml:"ipPositionStrict"`
+	TestLocalZone        bool          `yaml:"testLocalZone"` // test-only
+	IPWildcard           bool          `yaml:"ipWildcard"`
+	WhoamiAlias          bool          `yaml:"whoamiAlias"`
+	AllowBase36IP        bool          `yaml:"allowBase36IP"`
+	SixToFour            bool          `yaml:"sixToFour"`
+	BlocklistPrivateToo  bool          `yaml:"blocklistPrivateToo"`
+	BlockedTXT           bool          `yaml:"blockedTXT"`
+	DisableVersionTXT    bool          `yaml:"disableVersionTXT"`
+	DisableMetricsTXT    bool          `yaml:"disableMetricsTXT"`
+	ReservedNames        []string      `yaml:"reservedNames"`
+	DefaultCNAME         string        `yaml:"defaultCNAME"`
+	ApexTXT              []string      `yaml:"apexTXT"`
+	ChaosPool            []string      `yaml:"chaosPool"`
+	ServerID             string        `yaml:"serverID"`
+	V6Separator          string        `yaml:"v6Separator"`        // "" → "-"
+	UnsupportedTypes     *[]uint16     `yaml:"unsupportedTypes"`   // nil → DefaultUnsupportedTypes; [] → none
+	GeoRegions           []string      `yaml:"geoRegions"`         // e.g. "10.0.0.0/8=eu"; the first matching CIDR wins
+	GeoAnswers           []string      `yaml:"geoAnswers"`         // e.g. "eu=10.0.0.1", "default=10.0.0.2"
+	MaintenanceWindows   []string      `yaml:"maintenanceWindows"` // e.g. "www.example.com=02:00-04:00=10.0.0.99"
+
+	// the logs & metrics
+	LogLevel       string        `yaml:"logLevel"`
+	DebugWire      bool          `yaml:"debugWire"`
+	StatsDAddr     string        `yaml:"statsDAddr"`
+	StatsDInterval time.Duration `yaml:"statsDInterval"`
+}
+
+// LoadConfig reads the YAML configuration file; unknown keys are errors, for
+// they're likely typos
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	configBytes, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf(`config file "%s": %w`, path, err)
+	}
+	return config, nil
+}
+
+// NewXipFromConfig is NewXip() configured by a Config rather than by
+// arguments & fields; its error is the first invalid setting
+func NewXipFromConfig(config Config) (x *Xip, logmessages []string, err error) {
+	if err = config.validate(); err != nil {
+		return nil, nil, err
+	}
+	x, logmessages = NewXip(config.EtcdHost, config.BlocklistURL, config.Nameservers, config.Addresses)
+	if config.EtcdRetryInterval > 0 {
+		if strings.Contains(config.EtcdHost, ",") {
+			return nil, logmessages, fmt.Errorf(`etcdRetryInterval: retrying isn't supported with sharded etcd ("%s")`, config.EtcdHost)
+		}
+		x.RetryEtcd(EtcdConnector(config.EtcdHost), config.EtcdRetryInterval)
+	}
+	for _, zone := range config.Zones {
+		if err = x.AddZone(zone); err != nil {
+			return nil, logmessages, fmt.Errorf("zones: %w", err)
+		}
+		logmessages = append(logmessages, fmt.Sprintf(`Adding zone "%s"`, zone))
+	}
+	for zone, nameServers := range config.ZoneNameservers {
+		for _, nameServer := range nameServers {
+			if err = x.AddZoneNameServer(zone, nameServer); err != nil {
+				return nil, logmessages, fmt.Errorf("zoneNameservers: %w", err)
+			}
+			logmessages = append(logmessages, fmt.Sprintf(`Adding nameserver "%s" to zone "%s"`, nameServer, zone))
+		}
+	}
+	for subdomain, nameServers := range config.Delegates {
+		for _, nameServer := range nameServers {
+			if err = x.AddDelegate(subdomain, nameServer); err != nil {
+				return nil, logmessages, fmt.Errorf("delegates: %w", err)
+			}
+			logmessages = append(logmessages, fmt.Sprintf(`Delegating "%s" to nameserver "%s"`, subdomain, nameServer))
+		}
+	}
+	for zone, ttl := range config.ZoneTTLs {
+		if err = x.AddZoneTTL(zone, ttl); err != nil {
+			return nil, logmessages, fmt.Errorf("zoneTTLs: %w", err)
+		}
+		logmessages = append(logmessages, fmt.Sprintf(`Setting zone "%s"'s TTL to %d`, zone, ttl))
+	}
+	for zone, txts := range config.ZoneApexTXT {
+		for _, txt := range txts {
+			if err = x.AddZoneApexTXT(zone, txt); err != nil {
+				return nil, logmessages, fmt.Errorf("zoneApexTXT: %w", err)
+			}
+			logmessages = append(logmessages, fmt.Sprintf(`Adding TXT "%s" to zone "%s"'s apex`, txt, zone))
+		}
+	}
+	if config.PrimaryNS != "" {
+		x.PrimaryNS = dnsmessage.MustNewName(config.PrimaryNS)
+	}
+	x.NoCacheSubdomain = config.NoCacheSubdomain
+	if config.DefaultCNAME != "" {
+		x.DefaultCNAME = dnsmessage.MustNewName(config.DefaultCNAME)
+	}
+	if config.SOARefresh+config.SOARetry+config.SOAExpire+config.SOAMinTTL > 0 {
+		x.SOATimers = SOATimers{Refresh: config.SOARefresh, Retry: config.SOARetry, Expire: config.SOAExpire, MinTTL: config.SOAMinTTL}
+		// each absent timer keeps its default
+		if x.SOATimers.Refresh == 0 {
+			x.SOATimers.Refresh = DefaultSOATimers.Refresh
+		}
+		if x.SOATimers.Retry == 0 {
+			x.SOATimers.Retry = DefaultSOATimers.Retry
+		}
+		if x.SOATimers.Expire == 0 {
+			x.SOATimers.Expire = DefaultSOATimers.Expire
+		}
+		if x.SOATimers.MinTTL == 0 {
+			x.SOATimers.MinTTL = DefaultSOATimers.MinTTL
+		}
+		if err = x.SOATimers.Validate(); err != nil {
+			return nil, logmessages, fmt.Errorf("soaRefresh, soaRetry, soaExpire: %w", err)
+		}
+	}
+	for _, chaosIP := range config.ChaosPool {
+		x.ChaosPool = append(x.ChaosPool, net.ParseIP(chaosIP))
+	}
+	var geoResolver CIDRGeoResolver
+	for _, geoRegion := range config.GeoRegions {
+		cidrRegion := strings.Split(geoRegion, "=")
+		_, ipNet, _ := net.ParseCIDR(cidrRegion[0])
+		geoResolver = append(geoResolver, CIDRRegion{CIDR: *ipNet, Region: cidrRegion[1]})
+	}
+	if len(geoResolver) > 0 {
+		x.GeoResolver = geoResolver
+	}
+	for _, geoAnswer := range config.GeoAnswers {
+		regionIP := strings.Split(geoAnswer, "=")
+		if x.GeoAnswers == nil {
+			x.GeoAnswers = map[string][]net.IP{}
+		}
+		x.GeoAnswers[regionIP[0]] = append(x.GeoAnswers[regionIP[0]], net.ParseIP(regionIP[1]))
+	}
+	maintenanceLogmessages, err := x.AddMaintenanceWindows(config.MaintenanceWindows)
+	if err != nil {
+		return nil, logmessages, fmt.Errorf("maintenanceWindows: %w", err)
+	}
+	logmessages = append(logmessages, maintenanceLogmessages...)
+	if config.DDRTarget != "" {
+		x.DDR = &DDR{Target: dnsmessage.MustNewName(config.DDRTarget), DoTPort: config.DDRDoTPort, DoHPath: config.DDRDoHPath, DoHPort: config.DDRDoHPort}
+	}
+	if config.DNSSECKey != "" {
+		pemBytes, err := os.ReadFile(config.DNSSECKey)
+		if err != nil {
+			return nil, logmessages, fmt.Errorf("dnssecKey: %w", err)
+		}
+		key, err := ParseDNSSECKey(pemBytes)
+		if err != nil {
+			return nil, logmessages, fmt.Errorf(`dnssecKey: "%s": %w`, config.DNSSECKey, err)
+		}
+		salt, _ := hex.DecodeString(config.NSEC3Salt)
+		x.DNSSEC = &DNSSEC{Key: key, Iterations: config.NSEC3Iterations, Salt: salt, OptOut: config.NSEC3OptOut}
+		logmessages = append(logmessages, fmt.Sprintf("DNSSEC signing mode, key tag %d", x.DNSSEC.KeyTag()))
+	}
+	if config.UnsupportedTypes != nil {
+		x.UnsupportedTypes = nil
+		for _, unsupportedType := range *config.UnsupportedTypes {
+			x.UnsupportedTypes = append(x.UnsupportedTypes, dnsmessage.Type(unsupportedType))
+		}
+	}
+	if config.V6Separator != "" {
+		V6Separator = config.V6Separator
+	}
+	if config.MaxAnswers != nil {
+		x.MaxAnswers = *config.MaxAnswers
+	}
+	if config.MaxLabels != nil {
+		x.MaxLabels = *config.MaxLabels
+	}
+	if config.MaxConcurrentQueries > 0 {
+		x.QuerySemaphore = make(chan struct{}, config.MaxConcurrentQueries)
+	}
+	if len(config.Allowlist) > 0 {
+		x.AllowlistOnly = true
+		x.Allowlist = config.Allowlist
+	}
+	x.KVReadOnly = config.KVReadOnly
+	x.KVMaxPutBytes = config.KVMaxPutBytes
+	x.KVStrictPuts = config.KVStrictPuts
+	x.KVMaxEntries = config.KVMaxEntries
+	x.KVListToken = config.KVListToken
+	x.KVPTRPuts = config.KVPTRPuts
+	x.KVExportToken = config.KVExportToken
+	x.SlowEtcdThreshold = config.SlowEtcdThreshold
+	x.AcmeMode = config.AcmeMode
+	x.BlockedTTL = config.BlockedTTL
+	x.MaxAnswersTruncate = config.MaxAnswersTruncate
+	x.FullerOverTCP = config.FullerOverTCP
+	x.QueryTimeout = config.QueryTimeout
+	x.FloodInterval = config.FloodInterval
+	x.AnyMode = config.AnyMode
+	x.AnswerOrder = config.AnswerOrder
+	x.ExtendedDNSErrors = config.EDE
+	x.RequireEDNS = config.RequireEDNS
+	x.RefuseOutOfZone = config.RefuseOutOfZone
+	x.IPPositionStrict = config.IPPositionStrict
+	x.TestLocalZone = config.TestLocalZone
+	x.IPWildcard = config.IPWildcard
+	x.SetWhoamiAlias(config.WhoamiAlias)
+	x.AllowBase36IP = config.AllowBase36IP
+	x.SixToFour = config.SixToFour
+	x.BlocklistPrivateToo = config.BlocklistPrivateToo
+	x.BlockedTXT = config.BlockedTXT
+	x.DisableVersionTXT = config.DisableVersionTXT
+	x.DisableMetricsTXT = config.DisableMetricsTXT
+	x.ReservedNames = config.ReservedNames
+	x.ApexTXT = config.ApexTXT
+	x.ServerID = config.ServerID
+	x.LogLevel = config.LogLevel
+	x.DebugWire = config.DebugWire
+	x.StatsDAddr = config.StatsDAddr
+	x.StatsDInterval = config.StatsDInterval
+	return x, logmessages, nil
+}
+
+// ReloadCustomizations re-reads the ConfigFile's addresses & maintenance
+// windows and rebuilds the Customizations from them, the built-in ones, and
+// our Zones' "ip." & (if WhoamiAlias) "whoami." TXT records, then swaps them
+// in at once: a query sees either the old records or the new ones, never a
+// mix. It discards the customizations of SetCustomization(),
+// DeleteCustomization() & AddSchedule(), which aren't in the file. The other
+// settings take effect on restart. If the file is invalid, the
+// Customizations stay as they are.
+func (x *Xip) ReloadCustomizations() error {
+	if x.ConfigFile == "" {
+		return errors.New("there's no config file to reload")
+	}
+	config, err := LoadConfig(x.ConfigFile)
+	if err != nil {
+		return err
+	}
+	if err = config.validate(); err != nil {
+		return err
+	}
+	customizations := copyCustomizations(builtinCustomizations)
+	normalizeCustomizations(customizations)
+	for _, zone := range x.Zones {
+		addZoneCustomizations(customizations, zone, x.WhoamiAlias)
+	}
+	logmessages := addAddresses(customizations, config.Addresses)
+	maintenanceLogmessages, err := addMaintenanceWindows(customizations, config.MaintenanceWindows)
+	if err != nil {
+		return fmt.Errorf("maintenanceWindows: %w", err)
+	}
+	for _, logmessage := range append(logmessages, maintenanceLogmessages...) {
+		x.logger().Println(logmessage)
+	}
+	customizationsMutex.Lock()
+	Customizations = customizations
+	customizationsMutex.Unlock()
+	x.flushFloodCache()
+	return nil
+}
+
+// validate checks the settings that NewXip() & the fields don't, the way
+// main() checks the flags
+func (config Config) validate() error {
+	switch config.AcmeMode {
+	case "", AcmeModeDelegate, AcmeModeKV:
+	default:
+		return fmt.Errorf(`acmeMode: "%s" isn't one of "delegate", "kv"`, config.AcmeMode)
+	}
+	switch config.AnyMode {
+	case "", AnyModeNotImplemented, AnyModeHINFO:
+	default:
+		return fmt.Errorf(`anyMode: "%s" isn't one of "notimp", "hinfo"`, config.AnyMode)
+	}
+	switch config.AnswerOrder {
+	case "", AnswerOrderAsIs, AnswerOrderClosestFirst:
+	default:
+		return fmt.Errorf(`answerOrder: "%s" isn't one of "asis", "closest"`, config.AnswerOrder)
+	}
+	switch config.LogLevel {
+	case "", LogLevelAll, LogLevelAnomalies, LogLevelErrors:
+	default:
+		return fmt.Errorf(`logLevel: "%s" isn't one of "all", "anomalies", "errors"`, config.LogLevel)
+	}
+	for key, name := range map[string]string{"primaryNS": config.PrimaryNS, "defaultCNAME": config.DefaultCNAME, "noCacheSubdomain": config.NoCacheSubdomain, "ddrTarget": config.DDRTarget} {
+		if name == "" {
+			continue
+		}
+		if _, err := dnsmessage.NewName(name); err != nil || !strings.HasSuffix(name, ".") {
+			return fmt.Errorf(`%s: "%s" must be a fully-qualified name, e.g. "ns-aws.sslip.io."`, key, name)
+		}
+	}
+	for _, chaosIP := range config.ChaosPool {
+		if net.ParseIP(chaosIP) == nil {
+			return fmt.Errorf(`chaosPool: "%s" isn't a valid IP`, chaosIP)
+		}
+	}
+	for _, geoRegion := range config.GeoRegions {
+		cidrRegion := strings.Split(geoRegion, "=")
+		if len(cidrRegion) != 2 || cidrRegion[1] == "" {
+			return fmt.Errorf(`geoRegions: "%s" isn't a valid CIDR=region`, geoRegion)
+		}
+		if _, _, err := net.ParseCIDR(cidrRegion[0]); err != nil {
+			return fmt.Errorf(`geoRegions: "%s" isn't a valid CIDR=region`, geoRegion)
+		}
+	}
+	for _, geoAnswer := range config.GeoAnswers {
+		regionIP := strings.Split(geoAnswer, "=")
+		if len(regionIP) != 2 || regionIP[0] == "" || net.ParseIP(regionIP[1]) == nil {
+			return fmt.Errorf(`geoAnswers: "%s" isn't a valid region=IP`, geoAnswer)
+		}
+	}
+	if config.DDRTarget != "" && config.DDRDoTPort == 0 && config.DDRDoHPath == "" {
+		return errors.New("ddrTarget: requires ddrDoTPort, ddrDoHPath, or both")
+	}
+	if salt, err := hex.DecodeString(config.NSEC3Salt); err != nil || len(salt) > math.MaxUint8 {
+		return fmt.Errorf(`nsec3Salt: "%s" isn't at most 255 hex-encoded bytes`, config.NSEC3Salt)
+	}
+	if config.V6Separator != "" {
+		if err := ValidV6Separator(config.V6Separator); err != nil {
+			return fmt.Errorf("v6Separator: %w", err)
+		}
+	}
+	if config.Port < 0 || config.Port > 65535 || config.HTTPPort < 0 || config.HTTPPort > 65535 {
+		return fmt.Errorf("port, httpPort: %d, %d must be between 0 and 65535", config.Port, config.HTTPPort)
+	}
+	for zone, ttl := range config.ZoneTTLs {
+		if ttl > math.MaxInt32 {
+			return fmt.Errorf(`zoneTTLs: zone "%s"'s TTL %d must be at most %d`, zone, ttl, math.MaxInt32)
+		}
+	}
+	if config.MaxAnswers != nil && *config.MaxAnswers < 0 {
+		return fmt.Errorf("maxAnswers: %d must not be negative", *config.MaxAnswers)
+	}
+	if config.MaxLabels != nil && *config.MaxLabels < 0 {
+		return fmt.Errorf("maxLabels: %d must not be negative", *config.MaxLabels)
+	}
+	if config.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("maxConcurrentQueries: %d must not be negative", config.MaxConcurrentQueries)
+	}
+	if config.KVMaxPutBytes < 0 {
+		return fmt.Errorf("kvMaxPutBytes: %d must not be negative", config.KVMaxPutBytes)
+	}
+	if config.KVMaxEntries < 0 {
+		return fmt.Errorf("kvMaxEntries: %d must not be negative", config.KVMaxEntries)
+	}
+	if config.QueryTimeout < 0 || config.StatsDInterval < 0 || config.EtcdRetryInterval < 0 || config.SlowEtcdThreshold < 0 || config.FloodInterval < 0 {
+		return errors.New("queryTimeout, statsDInterval, etcdRetryInterval, slowEtcdThreshold, floodInterval: durations must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package xip_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("Config", func() {
+	var configPath string
+
+	// writeConfig writes the YAML to a config file & returns its path
+	writeConfig := func(yaml string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "sslip.yml")
+		Expect(os.WriteFile(path, []byte(yaml), 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		configPath = writeConfig(`
+etcdHost: localhost:2379
+blocklistURL: file:///
+nameservers: [ns-aws.sslip.io.]
+addresses:
+  - ns-aws.sslip.io=52.0.56.137
+zones: [example.com]
+zoneNameservers:
+  example.com: [ns1.example.com, ns2.example.com]
+zoneTTLs:
+  dev.example.com: 60
+soaRefresh: 1200
+soaMinTTL: 60
+port: 5353
+httpPort: 8080
+maxAnswers: 0
+queryTimeout: 1500ms
+anyMode: hinfo
+ede: true
+kvReadOnly: true
+kvPTRPuts: true
+apexTXT: ["google-site-verification=abc123"]
+unsupportedTypes: [38]
+geoAnswers: [default=10.0.0.9]
+ddrTarget: ns-aws.sslip.io.
+ddrDoTPort: 853
+`)
+	})
+
+	Describe("LoadConfig()", func() {
+		It("parses the keys, which are the flags' names", func() {
+			config, err := xip.LoadConfig(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.EtcdHost).To(Equal("localhost:2379"))
+			Expect(config.Nameservers).To(Equal([]string{"ns-aws.sslip.io."}))
+			Expect(config.ZoneNameservers).To(Equal(map[string][]string{"example.com": {"ns1.example.com", "ns2.example.com"}}))
+			Expect(config.SOARefresh).To(Equal(uint32(1200)))
+			Expect(config.Port).To(Equal(5353))
+			Expect(config.HTTPPort).To(Equal(8080))
+			Expect(*config.MaxAnswers).To(Equal(0))
+			Expect(config.QueryTimeout).To(Equal(1500 * time.Millisecond))
+			Expect(config.EDE).To(BeTrue())
+		})
+		It("leaves the absent keys zero", func() {
+			config, err := xip.LoadConfig(writeConfig("# nothing to see here\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config).To(Equal(xip.Config{}))
+		})
+		It("rejects an unknown key, which is likely a typo", func() {
+			_, err := xip.LoadConfig(writeConfig("nameserver: [ns-aws.sslip.io.]\n"))
+			Expect(err).To(MatchError(ContainSubstring("field nameserver not found")))
+		})
+		It("rejects malformed YAML", func() {
+			_, err := xip.LoadConfig(writeConfig("zones: [example.com\n"))
+			Expect(err).To(MatchError(ContainSubstring("sslip.yml")))
+		})
+		It("returns the error if it can't read the file", func() {
+			_, err := xip.LoadConfig(filepath.Join(GinkgoT().TempDir(), "non-existent.yml"))
+			Expect(err).To(MatchError(os.ErrNotExist))
+		})
+	})
+
+	Describe("NewXipFromConfig()", func() {
+		It("constructs a functioning Xip", func() {
+			config, err := xip.LoadConfig(configPath)
+			Expect(err).ToNot(HaveOccurred())
+			x, logmessages, err := xip.NewXipFromConfig(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logmessages).To(ContainElement(`Adding nameserver "ns-aws.sslip.io."`))
+			Expect(x.Zones).To(Equal([]string{"sslip.io.", "example.com.", "dev.example.com."}))
+			Expect(x.ZoneTTLs).To(Equal(map[string]uint32{"dev.example.com.": 60}))
+			Expect(x.SOATimers).To(Equal(xip.SOATimers{Refresh: 1200, Retry: 900, Expire: 1800, MinTTL: 60}))
+			Expect(x.MaxAnswers).To(Equal(0))
+			Expect(x.AnyMode).To(Equal(xip.AnyModeHINFO))
+			Expect(x.KVReadOnly).To(BeTrue())
+			Expect(x.KVPTRPuts).To(BeTrue())
+			Expect(x.UnsupportedTypes).To(Equal([]dnsmessage.Type{38}))
+			Expect(x.GeoAnswers).To(Equal(map[string][]net.IP{xip.GeoRegionDefault: {net.ParseIP("10.0.0.9")}}))
+			Expect(x.DDR).To(Equal(&xip.DDR{Target: dnsmessage.MustNewName("ns-aws.sslip.io."), DoTPort: 853}))
+
+			var response dnsmessage.Message
+			responseBytes, logMessage, err := x.QueryResponse(packedQuery("10-0-0-1.example.com.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logMessage).To(Equal("TypeA 10-0-0-1.example.com. ? 10.0.0.1"))
+			Expect(response.Unpack(responseBytes)).To(Succeed())
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}))
+
+			responseBytes, _, err = x.QueryResponse(packedQuery("example.com.", dnsmessage.TypeNS), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Unpack(responseBytes)).To(Succeed())
+			Expect(response.Answers).To(HaveLen(2))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns1.example.com.")}))
+
+			responseBytes, _, err = x.QueryResponse(packedQuery("sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Unpack(responseBytes)).To(Succeed())
+			Expect(response.Answers).To(ContainElement(HaveField("Body", Equal(&dnsmessage.TXTResource{TXT: []string{"google-site-verification=abc123"}}))))
+		})
+		It("keeps NewXip()'s defaults for the absent keys", func() {
+			x, _, err := xip.NewXipFromConfig(xip.Config{EtcdHost: "localhost:2379", BlocklistURL: "file:///"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(x.SOATimers).To(Equal(xip.DefaultSOATimers))
+			Expect(x.MaxAnswers).To(Equal(xip.DefaultMaxAnswers))
+			Expect(x.UnsupportedTypes).To(Equal(xip.DefaultUnsupportedTypes))
+		})
+		negative := -1
+		DescribeTable("rejects invalid settings",
+			func(config xip.Config, message string) {
+				_, _, err := xip.NewXipFromConfig(config)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("acmeMode", xip.Config{AcmeMode: "dns-01"}, `acmeMode: "dns-01" isn't one of`),
+			Entry("logLevel", xip.Config{LogLevel: "debug"}, `logLevel: "debug" isn't one of`),
+			Entry("answerOrder", xip.Config{AnswerOrder: "random"}, `answerOrder: "random" isn't one of`),
+			Entry("primaryNS", xip.Config{PrimaryNS: "ns-aws.sslip.io"}, "primaryNS: \"ns-aws.sslip.io\" must be a fully-qualified name"),
+			Entry("chaosPool", xip.Config{ChaosPool: []string{"10.0.0.256"}}, `chaosPool: "10.0.0.256" isn't a valid IP`),
+			Entry("maxLabels", xip.Config{MaxLabels: &negative}, "maxLabels: -1 must not be negative"),
+			Entry("kvMaxEntries", xip.Config{KVMaxEntries: -1}, "kvMaxEntries: -1 must not be negative"),
+			Entry("port", xip.Config{Port: 65536}, "port, httpPort"),
+			Entry("zoneTTLs", xip.Config{ZoneTTLs: map[string]uint32{"dev.example.com": 1 << 31}}, `zoneTTLs: zone "dev.example.com"'s TTL 2147483648 must be at most 2147483647`),
+			Entry("SOA timers", xip.Config{EtcdHost: "localhost:2379", BlocklistURL: "file:///", SOARetry: 3600}, "soaRefresh, soaRetry, soaExpire"),
+			Entry("v6Separator", xip.Config{V6Separator: "a"}, `v6Separator: the IPv6 separator "a" must be`),
+			Entry("geoRegions", xip.Config{GeoRegions: []string{"10.0.0.0/33=eu"}}, `geoRegions: "10.0.0.0/33=eu" isn't a valid CIDR=region`),
+			Entry("geoAnswers", xip.Config{GeoAnswers: []string{"eu"}}, `geoAnswers: "eu" isn't a valid region=IP`),
+			Entry("ddrTarget", xip.Config{DDRTarget: "ns-aws.sslip.io.", DDRDoHPort: 8443}, "ddrTarget: requires ddrDoTPort, ddrDoHPath, or both"),
+			Entry("nsec3Salt", xip.Config{NSEC3Salt: "xyz"}, `nsec3Salt: "xyz" isn't at most 255 hex-encoded bytes`),
+			Entry("maintenanceWindows", xip.Config{EtcdHost: "localhost:2379", BlocklistURL: "file:///", MaintenanceWindows: []string{"www.example.com=02:00=10.0.0.99"}}, `maintenanceWindows: "02:00" isn't a window`),
+			Entry("dnssecKey", xip.Config{EtcdHost: "localhost:2379", BlocklistURL: "file:///", DNSSECKey: "non-existent.pem"}, "dnssecKey: open non-existent.pem"),
+		)
+	})
+
+	Describe("ReloadCustomizations()", func() {
+		var x *xip.Xip
+		var saved xip.DomainCustomizations
+
+		// answer returns the A record of the name
+		answer := func(name string) string {
+			var response dnsmessage.Message
+			responseBytes, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response.Unpack(responseBytes)).To(Succeed())
+			if len(response.Answers) == 0 {
+				return ""
+			}
+			return net.IP(response.Answers[0].Body.(*dnsmessage.AResource).A[:]).String()
+		}
+		rewriteConfig := func(yaml string) {
+			Expect(os.WriteFile(configPath, []byte(yaml), 0600)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			saved = xip.DomainCustomizations{}
+			for key, domain := range xip.Customizations {
+				saved[key] = domain
+			}
+			configPath = writeConfig("addresses: [reloaded.sslip.io=10.0.0.1]\n")
+			x = &xip.Xip{SOATimers: xip.DefaultSOATimers, Zones: []string{"sslip.io.", "example.com."}, ConfigFile: configPath}
+			Expect(x.ReloadCustomizations()).To(Succeed())
+		})
+		AfterEach(func() {
+			xip.Customizations = saved
+		})
+
+		It("serves the changed addresses, and keeps the built-in customizations & our zones'", func() {
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.1"))
+			rewriteConfig("addresses: [reloaded.sslip.io=10.0.0.2, added.sslip.io=10.0.0.3]\n")
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.2"))
+			Expect(answer("added.sslip.io.")).To(Equal("10.0.0.3"))
+			Expect(xip.MXResources("sslip.io.")).To(HaveLen(2))
+			txtResources, err := x.TXTResources("ip.example.com.", net.IP{10, 9, 8, 7})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"10.9.8.7"}}}))
+		})
+		It("drops the addresses removed from the file", func() {
+			rewriteConfig("addresses: []\n")
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("reloaded.sslip.io.")).To(Equal(""))
+		})
+		It("keeps answering while it reloads", func() {
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 500; i++ {
+					Expect(answer("reloaded.sslip.io.")).To(Or(Equal("10.0.0.1"), Equal("10.0.0.2")))
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				rewriteConfig(fmt.Sprintf("addresses: [reloaded.sslip.io=10.0.0.%d]\n", i%2+1))
+				Expect(x.ReloadCustomizations()).To(Succeed())
+			}
+			Eventually(done).Should(BeClosed())
+		})
+		It("normalizes the addresses' keys", func() {
+			rewriteConfig("addresses: [Mixed.SSLIP.io=10.0.0.4]\n")
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("mixed.sslip.io.")).To(Equal("10.0.0.4"))
+		})
+		It("re-applies the maintenance windows, which follow the reloaded addresses", func() {
+			rewriteConfig("addresses: [reloaded.sslip.io=10.0.0.2]\nmaintenanceWindows: [reloaded.sslip.io=00:00-00:00=10.0.0.99]\n")
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.2")) // an empty window, never in it
+			now := time.Now().UTC()
+			rewriteConfig(fmt.Sprintf("addresses: [reloaded.sslip.io=10.0.0.2]\nmaintenanceWindows: [reloaded.sslip.io=%s-%s=10.0.0.99]\n",
+				now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")))
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.99"))
+		})
+		It("rejects invalid maintenance windows, keeping the customizations", func() {
+			rewriteConfig("addresses: [reloaded.sslip.io=10.0.0.2]\nmaintenanceWindows: [reloaded.sslip.io=02:00=10.0.0.99]\n")
+			Expect(x.ReloadCustomizations()).To(MatchError(ContainSubstring("maintenanceWindows: ")))
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.1"))
+		})
+		It("discards SetCustomization()'s customizations, which aren't in the file", func() {
+			xip.SetCustomization("programmatic.sslip.io", xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 5}}}})
+			Expect(answer("programmatic.sslip.io.")).To(Equal("10.0.0.5"))
+			Expect(x.ReloadCustomizations()).To(Succeed())
+			Expect(answer("programmatic.sslip.io.")).To(Equal(""))
+		})
+		It("keeps the customizations if the file is invalid", func() {
+			rewriteConfig("addresses: [reloaded.sslip.io=10.0.0.2\n")
+			Expect(x.ReloadCustomizations()).To(MatchError(ContainSubstring("sslip.yml")))
+			Expect(answer("reloaded.sslip.io.")).To(Equal("10.0.0.1"))
+		})
+		It("returns an error if there's no config file", func() {
+			x.ConfigFile = ""
+			Expect(x.ReloadCustomizations()).To(MatchError("there's no config file to reload"))
+		})
+	})
+})
@@ -0,0 +1,110 @@
+package xip
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DDR configures Discovery of Designated Resolvers (RFC 9462): we answer the
+// SVCB query for "_dns.resolver.arpa" with our encrypted endpoints, one
+// record for DoT & one for DoH, whichever are set, so that clients can
+// upgrade to them
+type DDR struct {
+	Target  dnsmessage.Name // the name of our encrypted endpoints, e.g. "ns-aws.sslip.io."
+	DoTPort uint16          // the DNS-over-TLS port, e.g. 853; 0 → no DoT record
+	DoHPath string          // the DNS-over-HTTPS URI template, e.g. "/dns-query{?dns}"; "" → no DoH record
+	DoHPort uint16          // the DNS-over-HTTPS port if not 443; 0 → 443
+}
+
+// DDRName is the special-use name (RFC 9462 section 4) whose SVCB records
+// designate the resolver's encrypted endpoints
+const DDRName = "_dns.resolver.arpa."
+
+// TypeSVCB is the SVCB record type (RFC 9460), which dnsmessage doesn't define
+const TypeSVCB = dnsmessage.Type(64)
+
+// SvcParamKeys (RFC 9460 section 14.3.2 & RFC 9461 section 5)
+const (
+	svcParamALPN    = 1
+	svcParamPort    = 3
+	svcParamDoHPath = 7
+)
+
+const ddrTTL = 3600 // 1 hour
+
+// SVCBs returns the RDATA of the SVCB records: DoT (priority 1), then DoH
+// (priority 2)
+func (d DDR) SVCBs() (rdatas [][]byte) {
+	if d.DoTPort != 0 {
+		rdatas = append(rdatas, d.svcb(1, []svcParam{
+			{svcParamALPN, alpn("dot")},
+			{svcParamPort, uint16Bytes(d.DoTPort)},
+		}))
+	}
+	if d.DoHPath != "" {
+		params := []svcParam{{svcParamALPN, alpn("h2")}}
+		if d.DoHPort != 0 {
+			params = append(params, svcParam{svcParamPort, uint16Bytes(d.DoHPort)})
+		}
+		params = append(params, svcParam{svcParamDoHPath, []byte(d.DoHPath)})
+		rdatas = append(rdatas, d.svcb(2, params))
+	}
+	return rdatas
+}
+
+// svcParam is a SvcParamKey & its value
+type svcParam struct {
+	key   uint16
+	value []byte
+}
+
+// svcb returns the RDATA of a ServiceMode SVCB record (RFC 9460 section
+// 2.2): the priority, the uncompressed target, and the params, which must be
+// in increasing order of key
+func (d DDR) svcb(priority uint16, params []svcParam) []byte {
+	rdata := append(uint16Bytes(priority), canonicalName(d.Target.String())...)
+	for _, param := range params {
+		rdata = append(rdata, uint16Bytes(param.key)...)
+		rdata = append(rdata, uint16Bytes(uint16(len(param.value)))...)
+		rdata = append(rdata, param.value...)
+	}
+	return rdata
+}
+
+// alpn returns the "alpn" SvcParamValue: length-prefixed protocol IDs
+func alpn(protocols ...string) (value []byte) {
+	for _, protocol := range protocols {
+		value = append(append(value, byte(len(protocol))), protocol...)
+	}
+	return value
+}
+
+// uint16Bytes returns the uint16 in network byte order, e.g. a port
+func uint16Bytes(u uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, u)
+	return b
+}
+
+// isDDRQuery is whether ddrResponse() answers the query
+func (x *Xip) isDDRQuery(q dnsmessage.Question) bool {
+	return x.DDR != nil && q.Type == TypeSVCB && strings.EqualFold(q.Name.String(), DDRName)
+}
+
+// ddrResponse answers the SVCB query for "_dns.resolver.arpa"
+func (x *Xip) ddrResponse(q dnsmessage.Question, response Response, logMessage string) (Response, string, error) {
+	rdatas := x.DDR.SVCBs()
+	if len(rdatas) > 0 {
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	}
+	var logMessages []string
+	for i, rdata := range rdatas {
+		response.Answers = append(response.Answers, unknownResourceBuilder(q.Name, TypeSVCB, ddrTTL, rdata))
+		logMessages = append(logMessages, strconv.Itoa(i+1)+" "+x.DDR.Target.String())
+	}
+	return response, logMessage + strings.Join(logMessages, ", "), nil
+}
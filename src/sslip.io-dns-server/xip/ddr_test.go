@@ -0,0 +1,60 @@
+package xip_test
+
+import (
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("DDR", func() {
+	var x xip.Xip
+
+	BeforeEach(func() {
+		x = xip.Xip{SOATimers: xip.DefaultSOATimers, DDR: &xip.DDR{
+			Target:  dnsmessage.MustNewName("ns-aws.sslip.io."),
+			DoTPort: 853,
+			DoHPath: "/dns-query{?dns}",
+		}}
+	})
+
+	target := []byte("\x06ns-aws\x05sslip\x02io\x00")
+
+	It("answers the SVCB query with our DoT & DoH endpoints", func() {
+		response, logMessage := unpackedResponse(&x, "_dns.resolver.arpa.", xip.TypeSVCB)
+		Expect(logMessage).To(Equal("64 _dns.resolver.arpa. ? 1 ns-aws.sslip.io., 2 ns-aws.sslip.io."))
+		Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+		Expect(response.Answers).To(HaveLen(2))
+		for _, answer := range response.Answers {
+			Expect(answer.Header.Type).To(Equal(xip.TypeSVCB))
+			Expect(answer.Header.Name.String()).To(Equal("_dns.resolver.arpa."))
+		}
+		// priority 1, the target, alpn "dot", port 853
+		dot := append(append([]byte{0, 1}, target...), 0, 1, 0, 4, 3, 'd', 'o', 't', 0, 3, 0, 2, 0x03, 0x55)
+		Expect(response.Answers[0].Body.(*dnsmessage.UnknownResource).Data).To(Equal(dot))
+		// priority 2, the target, alpn "h2", dohpath "/dns-query{?dns}"
+		doh := append(append([]byte{0, 2}, target...), 0, 1, 0, 3, 2, 'h', '2', 0, 7, 0, 16)
+		doh = append(doh, "/dns-query{?dns}"...)
+		Expect(response.Answers[1].Body.(*dnsmessage.UnknownResource).Data).To(Equal(doh))
+	})
+	It("advertises the DoH port if it isn't 443, and only the endpoints that are set", func() {
+		x.DDR.DoTPort = 0
+		x.DDR.DoHPort = 8443
+		response, _ := unpackedResponse(&x, "_DNS.Resolver.ARPA.", xip.TypeSVCB)
+		Expect(response.Answers).To(HaveLen(1))
+		doh := append(append([]byte{0, 2}, target...), 0, 1, 0, 3, 2, 'h', '2', 0, 3, 0, 2, 0x20, 0xfb, 0, 7, 0, 16)
+		doh = append(doh, "/dns-query{?dns}"...)
+		Expect(response.Answers[0].Body.(*dnsmessage.UnknownResource).Data).To(Equal(doh))
+	})
+	It("doesn't answer other types", func() {
+		response, _ := unpackedResponse(&x, "_dns.resolver.arpa.", dnsmessage.TypeA)
+		Expect(response.Answers).To(BeEmpty())
+		Expect(response.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+	})
+	It("is disabled by default", func() {
+		x.DDR = nil
+		response, _ := unpackedResponse(&x, "_dns.resolver.arpa.", xip.TypeSVCB)
+		Expect(response.Answers).To(BeEmpty())
+	})
+})
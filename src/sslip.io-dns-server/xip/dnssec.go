@@ -0,0 +1,356 @@
+package xip
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSSEC configures signing mode: our negative (NODATA) responses carry an
+// NSEC3 record (RFC 5155) & its RRSIG, and we answer NSEC3PARAM & DNSKEY
+// queries. As with the SOA, every name is its own zone apex, so the NSEC3s
+// are "white lies" (RFC 7129 appendix B) computed on the fly: they match the
+// queried name's hash and cover the range up to the next hash.
+type DNSSEC struct {
+	Key        *ecdsa.PrivateKey // ECDSA P-256 (algorithm 13) key; signs everything (a Combined Signing Key)
+	Iterations uint16            // NSEC3 additional hash iterations; RFC 9276 recommends 0
+	Salt       []byte            // NSEC3 salt; RFC 9276 recommends none
+	OptOut     bool              // set the NSEC3 Opt-Out flag (RFC 5155 section 6)
+}
+
+// DNSSEC record types that dnsmessage doesn't define
+const (
+	TypeRRSIG      = dnsmessage.Type(46)
+	TypeDNSKEY     = dnsmessage.Type(48)
+	TypeNSEC3      = dnsmessage.Type(50)
+	TypeNSEC3PARAM = dnsmessage.Type(51)
+)
+
+// ErrDNSSECKey is returned when the DNSSEC Key isn't ECDSA P-256
+var ErrDNSSECKey = errors.New("the DNSSEC key must be ECDSA P-256")
+
+const (
+	dnssecAlgorithm         = 13   // ECDSAP256SHA256, RFC 6605
+	nsec3HashAlgorithm      = 1    // SHA-1, the only one defined
+	nsec3OptOutFlag    byte = 1    // RFC 5155 section 3.1.2.1
+	dnskeyFlags             = 257  // Zone Key & Secure Entry Point
+	dnskeyProtocol          = 3    // RFC 4034 section 2.1.2
+	dnskeyTTL               = 3600 // 1 hour
+	rrsigInceptionSkew      = time.Hour
+	rrsigValidity           = 7 * 24 * time.Hour
+)
+
+// NSEC3Hash returns the NSEC3 hash (RFC 5155 section 5) of the name in
+// lowercase base32hex without padding, e.g. "example." with the salt
+// aabbccdd & 12 iterations → "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"
+func NSEC3Hash(name string, salt []byte, iterations uint16) string {
+	return strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(nsec3Hash(name, salt, iterations)))
+}
+
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.Sum(append(canonicalName(name), salt...))
+	for i := uint16(0); i < iterations; i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+// canonicalName returns the name in canonical (RFC 4034 section 6.2) wire
+// format: lowercase & uncompressed
+func canonicalName(name string) (wire []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		wire = append(wire, byte(len(label)))
+		wire = append(wire, label...)
+	}
+	return append(wire, 0)
+}
+
+// labelCount is the RRSIG's Labels field, e.g. "sslip.io." → 2
+func labelCount(name string) byte {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 0
+	}
+	return byte(strings.Count(name, ".") + 1)
+}
+
+// typeBitMap returns the NSEC3 Type Bit Maps field (RFC 4034 section 4.1.2)
+func typeBitMap(types []dnsmessage.Type) (bitMap []byte) {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	var window []byte
+	windowNumber := -1
+	for _, t := range types {
+		if int(t>>8) != windowNumber {
+			if len(window) > 0 {
+				bitMap = append(append(bitMap, byte(windowNumber), byte(len(window))), window...)
+			}
+			windowNumber = int(t >> 8)
+			window = nil
+		}
+		octet := int(t&0xff) / 8
+		for len(window) <= octet {
+			window = append(window, 0)
+		}
+		window[octet] |= 0x80 >> (t & 0xff % 8)
+	}
+	if len(window) > 0 {
+		bitMap = append(append(bitMap, byte(windowNumber), byte(len(window))), window...)
+	}
+	return bitMap
+}
+
+// Validate returns an error if we can't sign with the Key
+func (d DNSSEC) Validate() error {
+	if d.Key == nil || d.Key.Curve != elliptic.P256() {
+		return ErrDNSSECKey
+	}
+	return nil
+}
+
+// ParseDNSSECKey parses a PEM-encoded ECDSA P-256 private key, e.g. from
+// "openssl ecparam -name prime256v1 -genkey -noout", in either SEC 1 ("EC
+// PRIVATE KEY") or PKCS #8 ("PRIVATE KEY") form
+func ParseDNSSECKey(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM-encoded key found")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		pkcs8Key, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = pkcs8Key.(*ecdsa.PrivateKey); !ok {
+			return nil, ErrDNSSECKey
+		}
+	}
+	if err = (DNSSEC{Key: key}).Validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DNSKEY returns the DNSKEY RDATA (RFC 4034 section 2.1) of the Key
+func (d DNSSEC) DNSKEY() []byte {
+	rdata := []byte{dnskeyFlags >> 8, dnskeyFlags & 0xff, dnskeyProtocol, dnssecAlgorithm}
+	// RFC 6605 section 4: the public key is the uncompressed point, Q = (x,y), without the leading 0x04
+	publicKey := make([]byte, 64)
+	d.Key.X.FillBytes(publicKey[:32])
+	d.Key.Y.FillBytes(publicKey[32:])
+	return append(rdata, publicKey...)
+}
+
+// KeyTag returns the key tag (RFC 4034 appendix B) of the DNSKEY, which
+// the parent zone's DS record references
+func (d DNSSEC) KeyTag() uint16 {
+	var ac uint32
+	for i, b := range d.DNSKEY() {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac & 0xffff)
+}
+
+// NSEC3PARAM returns the NSEC3PARAM RDATA (RFC 5155 section 4.2); its Flags
+// are always 0, even when opting out
+func (d DNSSEC) NSEC3PARAM() []byte {
+	rdata := []byte{nsec3HashAlgorithm, 0, byte(d.Iterations >> 8), byte(d.Iterations), byte(len(d.Salt))}
+	return append(rdata, d.Salt...)
+}
+
+// NSEC3 returns the owner & RDATA (RFC 5155 section 3.2) of the NSEC3 that
+// matches the name and covers the range to the next hash, i.e. it denies
+// everything but the types
+func (d DNSSEC) NSEC3(name string, types []dnsmessage.Type) (owner string, rdata []byte) {
+	hash := nsec3Hash(name, d.Salt, d.Iterations)
+	next := make([]byte, len(hash))
+	copy(next, hash)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	var flags byte
+	if d.OptOut {
+		flags |= nsec3OptOutFlag
+	}
+	rdata = []byte{nsec3HashAlgorithm, flags, byte(d.Iterations >> 8), byte(d.Iterations), byte(len(d.Salt))}
+	rdata = append(rdata, d.Salt...)
+	rdata = append(rdata, byte(len(next)))
+	rdata = append(rdata, next...)
+	rdata = append(rdata, typeBitMap(types)...)
+	owner = NSEC3Hash(name, d.Salt, d.Iterations) + "." + name
+	return owner, rdata
+}
+
+// RRSIG returns the RRSIG RDATA (RFC 4034 section 3.1) over the RRset, signed
+// by the zone (signer), valid from an hour ago to a week from now
+func (d DNSSEC) RRSIG(owner, signer string, rrType dnsmessage.Type, ttl uint32, rdatas [][]byte) ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rdata := make([]byte, 18)
+	binary.BigEndian.PutUint16(rdata[0:], uint16(rrType))
+	rdata[2] = dnssecAlgorithm
+	rdata[3] = labelCount(owner)
+	binary.BigEndian.PutUint32(rdata[4:], ttl)
+	binary.BigEndian.PutUint32(rdata[8:], uint32(now.Add(rrsigValidity).Unix()))
+	binary.BigEndian.PutUint32(rdata[12:], uint32(now.Add(-rrsigInceptionSkew).Unix()))
+	binary.BigEndian.PutUint16(rdata[16:], d.KeyTag())
+	rdata = append(rdata, canonicalName(signer)...)
+
+	// RFC 4034 section 3.1.8.1: signature = sign(RRSIG_RDATA | RR(1) | RR(2)...),
+	// the RRs in canonical form & order
+	sorted := append([][]byte{}, rdatas...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	signed := append([]byte{}, rdata...)
+	for _, rr := range sorted {
+		rrHeader := make([]byte, 10)
+		binary.BigEndian.PutUint16(rrHeader[0:], uint16(rrType))
+		binary.BigEndian.PutUint16(rrHeader[2:], uint16(dnsmessage.ClassINET))
+		binary.BigEndian.PutUint32(rrHeader[4:], ttl)
+		binary.BigEndian.PutUint16(rrHeader[8:], uint16(len(rr)))
+		signed = append(signed, canonicalName(owner)...)
+		signed = append(signed, rrHeader...)
+		signed = append(signed, rr...)
+	}
+	digest := sha256.Sum256(signed)
+	r, s, err := ecdsa.Sign(cryptorand.Reader, d.Key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	// RFC 6605 section 4: the signature is r & s, each 32 bytes
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return append(rdata, signature...), nil
+}
+
+// apexTypes are the types every name has in signing mode, as every name is
+// its own zone apex
+var apexTypes = []dnsmessage.Type{dnsmessage.TypeNS, dnsmessage.TypeSOA, TypeRRSIG, TypeDNSKEY, TypeNSEC3PARAM}
+
+// dnssecResponse answers NSEC3PARAM & DNSKEY queries, signed
+func (x *Xip) dnssecResponse(q dnsmessage.Question, response Response, logMessage string) (Response, string, error) {
+	var rdata []byte
+	ttl := uint32(dnskeyTTL)
+	switch q.Type {
+	case TypeDNSKEY:
+		rdata = x.DNSSEC.DNSKEY()
+		logMessage += "DNSKEY " + strconv.Itoa(int(x.DNSSEC.KeyTag()))
+	case TypeNSEC3PARAM:
+		rdata = x.DNSSEC.NSEC3PARAM()
+		ttl = x.SOATimers.MinTTL // RFC 5155 section 4: the SOA's minimum, as with the NSEC3s
+		logMessage += "NSEC3PARAM"
+	}
+	rrsig, err := x.DNSSEC.RRSIG(q.Name.String(), q.Name.String(), q.Type, ttl, [][]byte{rdata})
+	if err != nil {
+		return response, "", err
+	}
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	response.Answers = append(response.Answers,
+		unknownResourceBuilder(q.Name, q.Type, ttl, rdata),
+		unknownResourceBuilder(q.Name, TypeRRSIG, ttl, rrsig))
+	return response, logMessage, nil
+}
+
+// answeredTypes returns the types of the name's records, which its NSEC3
+// lists: the apexTypes, MX (every name has one), and those its
+// customization, embedded IP, or reverse name answer. It doesn't look up the
+// key-value store, lest a denial put or delete a key
+func (x *Xip) answeredTypes(fqdn string, srcAddr net.IP) []dnsmessage.Type {
+	types := append([]dnsmessage.Type{dnsmessage.TypeMX}, apexTypes...)
+	if len(x.AResources(fqdn, srcAddr)) > 0 {
+		types = append(types, dnsmessage.TypeA)
+	}
+	if len(x.AAAAResources(fqdn, srcAddr)) > 0 {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	if CNAMEResource(fqdn) != nil || x.defaultCNAME(fqdn) != nil {
+		types = append(types, dnsmessage.TypeCNAME)
+	}
+	if domain, ok := customization(fqdn); ok {
+		if domain.TXT != nil || domain.TXTECS != nil {
+			types = append(types, dnsmessage.TypeTXT)
+		}
+		for rrType := range domain.Raw {
+			types = append(types, rrType)
+		}
+	}
+	if ipv4ReverseRE.MatchString(fqdn) || ipv6ReverseRE.MatchString(fqdn) {
+		types = append(types, dnsmessage.TypePTR)
+	}
+	return types
+}
+
+// signDenial adds the NSEC3 & its RRSIG to the Authorities of a negative
+// (NODATA) response, which has the SOA but no answers. The NSEC3 lists the
+// types the name answers, but never the query's, which it denies
+func (x *Xip) signDenial(q dnsmessage.Question, srcAddr net.IP, response Response) (Response, error) {
+	if !response.Header.Authoritative || response.Header.RCode != dnsmessage.RCodeSuccess || len(response.Authorities) == 0 {
+		return response, nil
+	}
+	var types []dnsmessage.Type
+	for _, t := range x.answeredTypes(q.Name.String(), srcAddr) {
+		if t != q.Type {
+			types = append(types, t)
+		}
+	}
+	owner, rdata := x.DNSSEC.NSEC3(q.Name.String(), types)
+	ownerName, err := dnsmessage.NewName(owner)
+	if err != nil {
+		return response, err
+	}
+	ttl := x.SOATimers.MinTTL // RFC 5155 section 3: the NSEC3's TTL is the SOA's minimum
+	rrsig, err := x.DNSSEC.RRSIG(owner, q.Name.String(), TypeNSEC3, ttl, [][]byte{rdata})
+	if err != nil {
+		return response, err
+	}
+	response.Authorities = append(response.Authorities,
+		unknownResourceBuilder(ownerName, TypeNSEC3, ttl, rdata),
+		unknownResourceBuilder(ownerName, TypeRRSIG, ttl, rrsig))
+	return response, nil
+}
+
+func unknownResourceBuilder(name dnsmessage.Name, rrType dnsmessage.Type, ttl uint32, rdata []byte) func(*dnsmessage.Builder) error {
+	return func(b *dnsmessage.Builder) error {
+		return b.UnknownResource(dnsmessage.ResourceHeader{
+			Name:  name,
+			Type:  rrType,
+			Class: dnsmessage.ClassINET,
+			TTL:   ttl,
+		}, dnsmessage.UnknownResource{Type: rrType, Data: rdata})
+	}
+}
+
+// isDNSSECType is whether dnssecResponse() answers the query type
+func isDNSSECType(qType dnsmessage.Type) bool {
+	return qType == TypeDNSKEY || qType == TypeNSEC3PARAM
+}
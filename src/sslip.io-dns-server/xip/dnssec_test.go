@@ -0,0 +1,207 @@
+package xip_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("DNSSEC", func() {
+	var x xip.Xip
+	var key *ecdsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		x = xip.Xip{SOATimers: xip.DefaultSOATimers, DNSSEC: &xip.DNSSEC{Key: key, Iterations: 1, Salt: []byte{0xaa, 0xbb}}}
+	})
+
+	// verifyRRSIG checks the RRSIG's signature over the (single-record) RRset
+	verifyRRSIG := func(rrsig []byte, rr dnsmessage.Resource) {
+		rdata := rr.Body.(*dnsmessage.UnknownResource).Data
+		signerEnd := 18
+		for rrsig[signerEnd] != 0 {
+			signerEnd += int(rrsig[signerEnd]) + 1
+		}
+		signerEnd++
+		signed := append([]byte{}, rrsig[:signerEnd]...)
+		signed = append(signed, canonicalWire(rr.Header.Name.String())...)
+		rrHeader := make([]byte, 10)
+		binary.BigEndian.PutUint16(rrHeader[0:], uint16(rr.Header.Type))
+		binary.BigEndian.PutUint16(rrHeader[2:], uint16(dnsmessage.ClassINET))
+		binary.BigEndian.PutUint32(rrHeader[4:], rr.Header.TTL)
+		binary.BigEndian.PutUint16(rrHeader[8:], uint16(len(rdata)))
+		signed = append(append(signed, rrHeader...), rdata...)
+		digest := sha256.Sum256(signed)
+		signature := rrsig[signerEnd:]
+		Expect(signature).To(HaveLen(64))
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		Expect(ecdsa.Verify(&key.PublicKey, digest[:], r, s)).To(BeTrue())
+		Expect(binary.BigEndian.Uint16(rrsig[0:])).To(Equal(uint16(rr.Header.Type)))
+		Expect(rrsig[2]).To(Equal(byte(13)))
+		Expect(binary.BigEndian.Uint16(rrsig[16:])).To(Equal(x.DNSSEC.KeyTag()))
+	}
+
+	Describe("NSEC3Hash()", func() {
+		It("matches RFC 5155 appendix A's hashes", func() {
+			salt, _ := hex.DecodeString("aabbccdd")
+			Expect(xip.NSEC3Hash("example.", salt, 12)).To(Equal("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"))
+			Expect(xip.NSEC3Hash("a.example.", salt, 12)).To(Equal("35mthgpgcu1qg68fab165klnsnk3dpvl"))
+			Expect(xip.NSEC3Hash("EXAMPLE", salt, 12)).To(Equal("0p9mhaveqvm6t7vbl5lop2u3t2rp3tom"))
+		})
+	})
+
+	Describe("ParseDNSSECKey()", func() {
+		It("parses SEC 1 & PKCS #8 keys", func() {
+			sec1, err := x509.MarshalECPrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			parsed, err := xip.ParseDNSSECKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.D).To(Equal(key.D))
+			pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			parsed, err = xip.ParseDNSSECKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed.D).To(Equal(key.D))
+		})
+		It("rejects other curves", func() {
+			p384Key, err := ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			sec1, err := x509.MarshalECPrivateKey(p384Key)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = xip.ParseDNSSECKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}))
+			Expect(err).To(MatchError(xip.ErrDNSSECKey))
+		})
+		It("rejects non-PEM input", func() {
+			_, err := xip.ParseDNSSECKey([]byte("not a key"))
+			Expect(err).To(MatchError("no PEM-encoded key found"))
+		})
+	})
+
+	When("querying NSEC3PARAM", func() {
+		It("returns the parameters, signed", func() {
+			response, _ := unpackedResponse(&x, "sslip.io.", xip.TypeNSEC3PARAM)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Answers).To(HaveLen(2))
+			Expect(response.Answers[0].Header.Type).To(Equal(xip.TypeNSEC3PARAM))
+			Expect(response.Answers[0].Header.TTL).To(Equal(xip.DefaultSOATimers.MinTTL))
+			// hash algorithm 1, flags 0, 1 iteration, salt "aabb"
+			Expect(response.Answers[0].Body.(*dnsmessage.UnknownResource).Data).To(Equal([]byte{1, 0, 0, 1, 2, 0xaa, 0xbb}))
+			Expect(response.Answers[1].Header.Type).To(Equal(xip.TypeRRSIG))
+			verifyRRSIG(response.Answers[1].Body.(*dnsmessage.UnknownResource).Data, response.Answers[0])
+		})
+	})
+
+	When("querying DNSKEY", func() {
+		It("returns the public key, signed", func() {
+			response, _ := unpackedResponse(&x, "sslip.io.", xip.TypeDNSKEY)
+			Expect(response.Answers).To(HaveLen(2))
+			dnskey := response.Answers[0].Body.(*dnsmessage.UnknownResource).Data
+			Expect(dnskey[:4]).To(Equal([]byte{1, 1, 3, 13})) // flags 257, protocol 3, algorithm 13
+			Expect(new(big.Int).SetBytes(dnskey[4:36])).To(Equal(key.X))
+			Expect(new(big.Int).SetBytes(dnskey[36:])).To(Equal(key.Y))
+			verifyRRSIG(response.Answers[1].Body.(*dnsmessage.UnknownResource).Data, response.Answers[0])
+		})
+	})
+
+	When("there's no answer", func() {
+		It("adds an NSEC3 covering the nonexistent name's hash, signed", func() {
+			name := random8ByteString() + ".sslip.io."
+			response, _ := unpackedResponse(&x, name, dnsmessage.TypeA)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Answers).To(BeEmpty())
+			Expect(response.Authorities).To(HaveLen(3))
+			Expect(response.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+			nsec3 := response.Authorities[1]
+			Expect(nsec3.Header.Type).To(Equal(xip.TypeNSEC3))
+			Expect(nsec3.Header.TTL).To(Equal(xip.DefaultSOATimers.MinTTL))
+			hash := xip.NSEC3Hash(name, []byte{0xaa, 0xbb}, 1)
+			Expect(nsec3.Header.Name.String()).To(Equal(hash + "." + name))
+
+			data := nsec3.Body.(*dnsmessage.UnknownResource).Data
+			Expect(data[:7]).To(Equal([]byte{1, 0, 0, 1, 2, 0xaa, 0xbb})) // no Opt-Out
+			Expect(data[7]).To(Equal(byte(20)))
+			// the range [owner hash, next hash) covers the name's hash
+			owner, _ := hex.DecodeString(base32HexToHex(hash))
+			next := new(big.Int).SetBytes(data[8:28])
+			Expect(next.Cmp(new(big.Int).SetBytes(owner))).To(Equal(1))
+			Expect(new(big.Int).Sub(next, new(big.Int).SetBytes(owner))).To(Equal(big.NewInt(1)))
+			// the type bitmap: window 0, NS (2) & SOA (6), MX (15), RRSIG (46), DNSKEY (48) & NSEC3PARAM (51), but not A
+			Expect(data[28:]).To(Equal([]byte{0, 7, 0x22, 0x01, 0, 0, 0, 0x02, 0x90}))
+
+			rrsig := response.Authorities[2]
+			Expect(rrsig.Header.Type).To(Equal(xip.TypeRRSIG))
+			Expect(rrsig.Header.Name.String()).To(Equal(nsec3.Header.Name.String()))
+			verifyRRSIG(rrsig.Body.(*dnsmessage.UnknownResource).Data, nsec3)
+		})
+		It("lists the types the name does answer, e.g. the A of a name that embeds an IPv4", func() {
+			response, _ := unpackedResponse(&x, "127-0-0-1.sslip.io.", dnsmessage.TypeAAAA)
+			Expect(response.Answers).To(BeEmpty())
+			data := response.Authorities[1].Body.(*dnsmessage.UnknownResource).Data
+			// A (1), NS (2) & SOA (6), MX (15), RRSIG (46), DNSKEY (48) & NSEC3PARAM (51), but not AAAA (28)
+			Expect(data[28:]).To(Equal([]byte{0, 7, 0x62, 0x01, 0, 0, 0, 0x02, 0x90}))
+		})
+		It("lists the customization's types, e.g. TXT", func() {
+			response, _ := unpackedResponse(&x, "sslip.io.", dnsmessage.TypeAAAA)
+			Expect(response.Answers).To(BeEmpty())
+			data := response.Authorities[1].Body.(*dnsmessage.UnknownResource).Data
+			// NS (2) & SOA (6), MX (15), TXT (16), RRSIG (46), DNSKEY (48) & NSEC3PARAM (51)
+			Expect(data[28:]).To(Equal([]byte{0, 7, 0x22, 0x01, 0x80, 0, 0, 0x02, 0x90}))
+		})
+		It("sets the Opt-Out flag if configured", func() {
+			x.DNSSEC.OptOut = true
+			response, _ := unpackedResponse(&x, random8ByteString()+".sslip.io.", dnsmessage.TypeAAAA)
+			Expect(response.Authorities[1].Body.(*dnsmessage.UnknownResource).Data[1]).To(Equal(byte(1)))
+		})
+	})
+
+	It("doesn't sign answers or delegations with NSEC3s", func() {
+		response, _ := unpackedResponse(&x, "127-0-0-1.sslip.io.", dnsmessage.TypeA)
+		Expect(response.Authorities).To(BeEmpty())
+		response, _ = unpackedResponse(&x, "_acme-challenge.127-0-0-1.sslip.io.", dnsmessage.TypeTXT)
+		for _, authority := range response.Authorities {
+			Expect(authority.Header.Type).To(Equal(dnsmessage.TypeNS))
+		}
+	})
+
+	It("is disabled by default", func() {
+		x.DNSSEC = nil
+		response, _ := unpackedResponse(&x, random8ByteString()+".sslip.io.", dnsmessage.TypeA)
+		Expect(response.Authorities).To(HaveLen(1))
+		response, _ = unpackedResponse(&x, "sslip.io.", xip.TypeDNSKEY)
+		Expect(response.Answers).To(BeEmpty())
+	})
+})
+
+// canonicalWire returns the name, lowercase, in uncompressed wire format
+func canonicalWire(name string) (wire []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(strings.ToLower(name), "."), ".") {
+		wire = append(append(wire, byte(len(label))), label...)
+	}
+	return append(wire, 0)
+}
+
+// base32HexToHex converts an NSEC3 hash label to hex
+func base32HexToHex(label string) string {
+	const alphabet = "0123456789abcdefghijklmnopqrstuv"
+	n := new(big.Int)
+	for _, c := range label {
+		n.Lsh(n, 5)
+		n.Or(n, big.NewInt(int64(strings.IndexRune(alphabet, c))))
+	}
+	return hex.EncodeToString(n.FillBytes(make([]byte, len(label)*5/8)))
+}
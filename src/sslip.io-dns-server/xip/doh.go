@@ -0,0 +1,251 @@
+package xip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DoHJSONResponse is the body of a DoH JSON API response, the de facto
+// standard popularized by Google & Cloudflare, e.g.
+// https://developers.google.com/speed/public-dns/docs/doh/json
+type DoHJSONResponse struct {
+	Status    int  // the RCODE, e.g. 0 → NOERROR, 4 → NOTIMP
+	TC        bool // truncated
+	RD        bool // recursion desired
+	RA        bool // recursion available
+	AD        bool // authenticated data (DNSSEC)
+	CD        bool // checking disabled (DNSSEC)
+	Question  []DoHJSONQuestion
+	Answer    []DoHJSONRecord `json:",omitempty"`
+	Authority []DoHJSONRecord `json:",omitempty"`
+}
+
+// DoHJSONQuestion is the question of a DoH JSON API response
+type DoHJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// DoHJSONRecord is a resource record of a DoH JSON API response. Data is in
+// presentation (zone file) format, e.g. "10 mail.protonmail.ch." for an MX record
+type DoHJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// DoHJSONTypes are the record types that the DoH JSON API answers
+var DoHJSONTypes = map[string]dnsmessage.Type{
+	"A":    dnsmessage.TypeA,
+	"AAAA": dnsmessage.TypeAAAA,
+	"TXT":  dnsmessage.TypeTXT,
+	"NS":   dnsmessage.TypeNS,
+	"MX":   dnsmessage.TypeMX,
+	"SOA":  dnsmessage.TypeSOA,
+}
+
+// DoHJSONMaxTypes is the most "type" parameters a DoH JSON API query may have;
+// each is a query of its own
+const DoHJSONMaxTypes = 4
+
+// DoHJSONHandler answers DoH JSON API queries, e.g.
+// "GET /resolve?name=127-0-0-1.sslip.io&type=A". The type may be a name or a
+// number, and defaults to "A". The query goes through QueryResponse() just
+// as a UDP query would, so blocklists, customizations & metrics all apply.
+// Several types, e.g. "&type=A&type=AAAA", are queried in turn & their
+// answers combined into one response.
+func (x *Xip) DoHJSONHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, `missing "name" parameter`, http.StatusBadRequest)
+		return
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qName, err := dnsmessage.NewName(name)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`invalid "name" parameter: %s`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	qTypes, err := dohJSONTypes(r.URL.Query()["type"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	srcAddr := net.ParseIP(r.RemoteAddr)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		srcAddr = net.ParseIP(host)
+	}
+	var dohJSONResponse DoHJSONResponse
+	for i, qType := range qTypes {
+		typeResponse, logMessage, err := x.DoHJSONQuery(dnsmessage.Question{Name: qName, Type: qType, Class: dnsmessage.ClassINET}, srcAddr)
+		if errors.Is(err, ErrQueryDropped) {
+			http.Error(w, "too many concurrent queries", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			x.logger().Println(err.Error())
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if logMessage != "" {
+			x.logger().Printf("%s DoH JSON %s", r.RemoteAddr, logMessage)
+		}
+		if i == 0 {
+			dohJSONResponse = typeResponse
+		} else {
+			dohJSONResponse = mergeDoHJSONResponses(dohJSONResponse, typeResponse)
+		}
+	}
+	w.Header().Set("Content-Type", "application/dns-json")
+	if err = json.NewEncoder(w).Encode(dohJSONResponse); err != nil {
+		x.logger().Println(err.Error())
+	}
+}
+
+// DoHJSONQuery packs the question into a DNS query, runs it through
+// QueryResponseVia(), and converts the DNS response into its DoH JSON equivalent
+func (x *Xip) DoHJSONQuery(q dnsmessage.Question, srcAddr net.IP) (dohJSONResponse DoHJSONResponse, logMessage string, err error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true})
+	if err = b.StartQuestions(); err != nil {
+		return dohJSONResponse, "", err
+	}
+	if err = b.Question(q); err != nil {
+		return dohJSONResponse, "", err
+	}
+	queryBytes, err := b.Finish()
+	if err != nil {
+		return dohJSONResponse, "", err
+	}
+	responseBytes, logMessage, err := x.QueryResponseVia(TransportDoH, queryBytes, srcAddr)
+	if err != nil {
+		return dohJSONResponse, "", err
+	}
+	var response dnsmessage.Message
+	if err = response.Unpack(responseBytes); err != nil {
+		return dohJSONResponse, "", err
+	}
+	dohJSONResponse = DoHJSONResponse{
+		Status: int(response.RCode),
+		TC:     response.Truncated,
+		RD:     response.RecursionDesired,
+		RA:     response.RecursionAvailable,
+		AD:     response.AuthenticData,
+		CD:     response.CheckingDisabled,
+	}
+	for _, question := range response.Questions {
+		dohJSONResponse.Question = append(dohJSONResponse.Question, DoHJSONQuestion{Name: question.Name.String(), Type: uint16(question.Type)})
+	}
+	for _, answer := range response.Answers {
+		dohJSONResponse.Answer = append(dohJSONResponse.Answer, dohJSONRecord(answer))
+	}
+	for _, authority := range response.Authorities {
+		dohJSONResponse.Authority = append(dohJSONResponse.Authority, dohJSONRecord(authority))
+	}
+	return dohJSONResponse, logMessage, nil
+}
+
+// mergeDoHJSONResponses combines the responses to the same name's different
+// types: the questions & answers of both, the first error status, and the
+// authorities (i.e. the SOA) only if there are no answers at all
+func mergeDoHJSONResponses(merged, response DoHJSONResponse) DoHJSONResponse {
+	if merged.Status == int(dnsmessage.RCodeSuccess) {
+		merged.Status = response.Status
+	}
+	merged.TC = merged.TC || response.TC
+	merged.AD = merged.AD && response.AD
+	merged.Question = append(merged.Question, response.Question...)
+	merged.Answer = append(merged.Answer, response.Answer...)
+	if len(merged.Answer) > 0 {
+		merged.Authority = nil
+	} else if len(merged.Authority) == 0 {
+		merged.Authority = response.Authority
+	}
+	return merged
+}
+
+// dohJSONTypes converts the "type" parameters to dnsmessage.Types, minus
+// duplicates; no parameters is an "A"
+func dohJSONTypes(typeParams []string) (qTypes []dnsmessage.Type, err error) {
+	if len(typeParams) > DoHJSONMaxTypes {
+		return nil, fmt.Errorf(`too many "type" parameters (%d); the most is %d`, len(typeParams), DoHJSONMaxTypes)
+	}
+	if len(typeParams) == 0 {
+		typeParams = []string{""}
+	}
+	seen := map[dnsmessage.Type]bool{}
+	for _, typeParam := range typeParams {
+		qType, err := dohJSONType(typeParam)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[qType] {
+			seen[qType] = true
+			qTypes = append(qTypes, qType)
+		}
+	}
+	return qTypes, nil
+}
+
+// dohJSONType converts the "type" parameter, e.g. "AAAA" or "28", to a
+// dnsmessage.Type; an empty parameter is an "A"
+func dohJSONType(typeParam string) (dnsmessage.Type, error) {
+	if typeParam == "" {
+		return dnsmessage.TypeA, nil
+	}
+	if qType, ok := DoHJSONTypes[strings.ToUpper(typeParam)]; ok {
+		return qType, nil
+	}
+	if typeNumber, err := strconv.ParseUint(typeParam, 10, 16); err == nil {
+		for _, qType := range DoHJSONTypes {
+			if qType == dnsmessage.Type(typeNumber) {
+				return qType, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf(`unsupported "type" parameter "%s"; supported types are A, AAAA, TXT, NS, MX, SOA`, typeParam)
+}
+
+// dohJSONRecord converts the resource record to its DoH JSON equivalent; its
+// Data is also QueryResult's Answers
+func dohJSONRecord(resource dnsmessage.Resource) DoHJSONRecord {
+	record := DoHJSONRecord{
+		Name: resource.Header.Name.String(),
+		Type: uint16(resource.Header.Type),
+		TTL:  resource.Header.TTL,
+	}
+	switch body := resource.Body.(type) {
+	case *dnsmessage.AResource:
+		record.Data = net.IP(body.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		record.Data = net.IP(body.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		record.Data = body.CNAME.String()
+	case *dnsmessage.NSResource:
+		record.Data = body.NS.String()
+	case *dnsmessage.PTRResource:
+		record.Data = body.PTR.String()
+	case *dnsmessage.MXResource:
+		record.Data = fmt.Sprintf("%d %s", body.Pref, body.MX.String())
+	case *dnsmessage.SOAResource:
+		record.Data = fmt.Sprintf("%s %s %d %d %d %d %d", body.NS.String(), body.MBox.String(),
+			body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+	case *dnsmessage.TXTResource:
+		var quoted []string
+		for _, txt := range body.TXT {
+			quoted = append(quoted, strconv.Quote(txt))
+		}
+		record.Data = strings.Join(quoted, " ")
+	}
+	return record
+}
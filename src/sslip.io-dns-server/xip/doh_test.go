@@ -0,0 +1,141 @@
+package xip_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("DoH JSON API", func() {
+	var x, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137"})
+	var recorder *httptest.ResponseRecorder
+
+	resolve := func(target string) {
+		recorder = httptest.NewRecorder()
+		x.DoHJSONHandler(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	dohJSONResponse := func() (response xip.DoHJSONResponse) {
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).To(Succeed())
+		return response
+	}
+
+	Describe("DoHJSONHandler()", func() {
+		It("answers an A query for 127-0-0-1.sslip.io", func() {
+			resolve("/resolve?name=127-0-0-1.sslip.io&type=A")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("application/dns-json"))
+			var body map[string]interface{}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			Expect(body).To(HaveKeyWithValue("Status", BeNumerically("==", 0)))
+			Expect(body).To(HaveKeyWithValue("Question", ConsistOf(map[string]interface{}{
+				"name": "127-0-0-1.sslip.io.",
+				"type": float64(1),
+			})))
+			Expect(body).To(HaveKeyWithValue("Answer", ConsistOf(map[string]interface{}{
+				"name": "127-0-0-1.sslip.io.",
+				"type": float64(1),
+				"TTL":  float64(604800),
+				"data": "127.0.0.1",
+			})))
+			Expect(body).ToNot(HaveKey("Authority"))
+		})
+		It("defaults to an A query", func() {
+			resolve("/resolve?name=127-0-0-1.sslip.io")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(dohJSONResponse().Answer[0].Data).To(Equal("127.0.0.1"))
+		})
+		It("accepts numeric types", func() {
+			resolve("/resolve?name=2600--.sslip.io.&type=28")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(dohJSONResponse().Answer[0].Data).To(Equal("2600::"))
+		})
+		It("quotes TXT records", func() {
+			resolve("/resolve?name=ip.sslip.io&type=txt")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(dohJSONResponse().Answer[0].Data).To(Equal(`"192.0.2.1"`))
+		})
+		It("formats MX records", func() {
+			resolve("/resolve?name=sslip.io&type=MX")
+			Expect(dohJSONResponse().Answer[0].Data).To(Equal("10 mail.protonmail.ch."))
+		})
+		It("formats SOA records", func() {
+			resolve("/resolve?name=sslip.io&type=SOA")
+			Expect(dohJSONResponse().Answer[0].Data).To(MatchRegexp(`^ns-aws\.sslip\.io\. briancunnie\.gmail\.com\. \d+ 900 900 1800 180$`))
+		})
+		It("returns the SOA as an Authority when there's no answer", func() {
+			resolve("/resolve?name=sslip.io&type=AAAA")
+			response := dohJSONResponse()
+			Expect(response.Answer).To(BeEmpty())
+			Expect(response.Authority).To(HaveLen(1))
+			Expect(response.Authority[0].Type).To(Equal(uint16(dnsmessage.TypeSOA)))
+		})
+		It("rejects a missing name", func() {
+			resolve("/resolve?type=A")
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+		It("answers several types at once, e.g. a dual-stack name's A & AAAA", func() {
+			xip.Customizations["dual-stack.sslip.io."] = xip.DomainCustomization{
+				A:    []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}},
+				AAAA: []dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}},
+			}
+			defer delete(xip.Customizations, "dual-stack.sslip.io.")
+			resolve("/resolve?name=dual-stack.sslip.io&type=A&type=AAAA")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			response := dohJSONResponse()
+			Expect(response.Status).To(Equal(0))
+			Expect(response.Question).To(Equal([]xip.DoHJSONQuestion{
+				{Name: "dual-stack.sslip.io.", Type: uint16(dnsmessage.TypeA)},
+				{Name: "dual-stack.sslip.io.", Type: uint16(dnsmessage.TypeAAAA)},
+			}))
+			Expect(response.Answer).To(HaveLen(2))
+			Expect(response.Answer[0].Data).To(Equal("10.0.0.1"))
+			Expect(response.Answer[1].Data).To(Equal("2001:db8::1"))
+			Expect(response.Authority).To(BeEmpty())
+		})
+		It("drops the SOA Authority when one of the types has answers", func() {
+			resolve("/resolve?name=127-0-0-1.sslip.io&type=AAAA&type=A")
+			response := dohJSONResponse()
+			Expect(response.Answer).To(HaveLen(1))
+			Expect(response.Answer[0].Data).To(Equal("127.0.0.1"))
+			Expect(response.Authority).To(BeEmpty())
+		})
+		It("keeps the SOA Authority when none of the types has answers", func() {
+			resolve("/resolve?name=sslip.io&type=AAAA&type=A")
+			response := dohJSONResponse()
+			Expect(response.Answer).To(BeEmpty())
+			Expect(response.Authority).To(HaveLen(1))
+			Expect(response.Authority[0].Type).To(Equal(uint16(dnsmessage.TypeSOA)))
+		})
+		It("queries a repeated type once", func() {
+			resolve("/resolve?name=127-0-0-1.sslip.io&type=A&type=1")
+			Expect(dohJSONResponse().Answer).To(HaveLen(1))
+		})
+		It("rejects too many types", func() {
+			resolve("/resolve?name=sslip.io&type=A&type=AAAA&type=TXT&type=NS&type=MX")
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring(`too many "type" parameters (5); the most is 4`))
+		})
+		It("rejects unsupported types", func() {
+			resolve("/resolve?name=sslip.io&type=SRV")
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(recorder.Body.String()).To(ContainSubstring("supported types are A, AAAA, TXT, NS, MX, SOA"))
+		})
+	})
+
+	Describe("DoHJSONQuery()", func() {
+		It("answers NS queries", func() {
+			name := dnsmessage.MustNewName("127-0-0-1.sslip.io.")
+			response, logMessage, err := x.DoHJSONQuery(dnsmessage.Question{Name: name, Type: dnsmessage.TypeNS, Class: dnsmessage.ClassINET}, net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logMessage).To(ContainSubstring("NS 127-0-0-1.sslip.io."))
+			Expect(response.Answer).To(HaveLen(1))
+			Expect(response.Answer[0].Data).To(Equal("ns-aws.sslip.io."))
+		})
+	})
+})
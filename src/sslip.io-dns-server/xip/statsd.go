@@ -0,0 +1,107 @@
+package xip
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultStatsDInterval is how often we push the Metrics to StatsD
+const DefaultStatsDInterval = 10 * time.Second
+
+// statsDMaxPacket keeps each StatsD packet within a typical MTU
+const statsDMaxPacket = 1432
+
+// statsDGauges are the Metrics that are levels, not counts
+var statsDGauges = map[string]bool{"TCPConnectionsActive": true}
+
+// RunStatsD pushes the Metrics to the StatsD server at StatsDAddr every
+// StatsDInterval, in the background, until the context is done: the counters'
+// increase since the previous push, e.g. "sslip.AnsweredAQueries:12|c", and
+// the gauges' levels, e.g. "sslip.TCPConnectionsActive:3|g". If there's no
+// StatsDAddr, it does nothing.
+func (x *Xip) RunStatsD(ctx context.Context) error {
+	if x.StatsDAddr == "" {
+		return nil
+	}
+	conn, err := net.Dial("udp", x.StatsDAddr)
+	if err != nil {
+		return err
+	}
+	interval := x.StatsDInterval
+	if interval == 0 {
+		interval = DefaultStatsDInterval
+	}
+	previous := x.statsDMetrics()
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current := x.statsDMetrics()
+				for _, packet := range statsDPackets(previous, current) {
+					if _, err := conn.Write([]byte(packet)); err != nil {
+						x.logger().Println("couldn't push the metrics to StatsD: " + err.Error())
+						break
+					}
+				}
+				previous = current
+			}
+		}
+	}()
+	return nil
+}
+
+// statsDMetrics returns the Metrics' counters & gauges by name, e.g.
+// "AnsweredAQueries"
+func (x *Xip) statsDMetrics() map[string]int64 {
+	metrics := map[string]int64{}
+	value := reflect.ValueOf(x.Metrics.Snapshot())
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() == reflect.Int64 {
+			metrics[value.Type().Field(i).Name] = field.Int()
+		}
+	}
+	return metrics
+}
+
+// statsDPackets returns the StatsD lines, sorted, batched into packets: a
+// counter's line if it has increased, and every gauge's
+func statsDPackets(previous, current map[string]int64) (packets []string) {
+	var names []string
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		switch {
+		case statsDGauges[name]:
+			lines = append(lines, "sslip."+name+":"+strconv.FormatInt(current[name], 10)+"|g")
+		case current[name] > previous[name]:
+			lines = append(lines, "sslip."+name+":"+strconv.FormatInt(current[name]-previous[name], 10)+"|c")
+		}
+	}
+	var packet []string
+	size := 0
+	for _, line := range lines {
+		if size+len(line)+1 > statsDMaxPacket && len(packet) > 0 {
+			packets = append(packets, strings.Join(packet, "\n"))
+			packet, size = nil, 0
+		}
+		packet = append(packet, line)
+		size += len(line) + 1
+	}
+	if len(packet) > 0 {
+		packets = append(packets, strings.Join(packet, "\n"))
+	}
+	return packets
+}
@@ -0,0 +1,92 @@
+package xip_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("RunStatsD()", func() {
+	var x *xip.Xip
+	var statsD net.PacketConn
+	var lines chan string
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		var err error
+		// a fake StatsD server, which passes along the lines it receives
+		statsD, err = net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		lines = make(chan string, 1000)
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := statsD.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				for _, line := range strings.Split(string(buf[:n]), "\n") {
+					lines <- line
+				}
+			}
+		}()
+		x = &xip.Xip{SOATimers: xip.DefaultSOATimers, StatsDAddr: statsD.LocalAddr().String(), StatsDInterval: 20 * time.Millisecond}
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+	AfterEach(func() {
+		cancel()
+		Expect(statsD.Close()).To(Succeed())
+	})
+
+	It("pushes the counters' increases & the gauges", func() {
+		Expect(x.RunStatsD(ctx)).To(Succeed())
+		for i := 0; i < 3; i++ {
+			_, _, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+		}
+		// the increase may span pushes
+		var received []string
+		answeredAQueries := func() (sum int) {
+			for len(lines) > 0 {
+				received = append(received, <-lines)
+			}
+			for _, line := range received {
+				var n int
+				if _, err := fmt.Sscanf(line, "sslip.AnsweredAQueries:%d|c", &n); err == nil {
+					sum += n
+				}
+			}
+			return sum
+		}
+		Eventually(answeredAQueries).Should(Equal(3))
+		Expect(received).To(ContainElement("sslip.TCPConnectionsActive:0|g"))
+	})
+	It("doesn't push counters that haven't increased", func() {
+		Expect(x.RunStatsD(ctx)).To(Succeed())
+		Eventually(lines).Should(Receive(Equal("sslip.TCPConnectionsActive:0|g")))
+		Consistently(lines, 100*time.Millisecond).ShouldNot(Receive(HaveSuffix("|c")))
+	})
+	It("stops when the context is done", func() {
+		Expect(x.RunStatsD(ctx)).To(Succeed())
+		Eventually(lines).Should(Receive())
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		for len(lines) > 0 {
+			<-lines
+		}
+		Consistently(lines, 100*time.Millisecond).ShouldNot(Receive())
+	})
+	It("does nothing without a StatsDAddr", func() {
+		x.StatsDAddr = ""
+		Expect(x.RunStatsD(ctx)).To(Succeed())
+		Consistently(lines, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,82 @@
+package xip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTCPIdleTimeout is how long we wait for the next query on a TCP
+// connection before closing it; RFC 7766 recommends "on the order of seconds"
+const DefaultTCPIdleTimeout = 10 * time.Second
+
+// ServeTCP accepts connections on the listener and answers their queries,
+// counting the connections in the Metrics, until the listener is closed
+func (x *Xip) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			x.logger().Println(err.Error())
+			continue
+		}
+		// the connections are served concurrently, hence atomic
+		atomic.AddInt64(&x.Metrics.TCPConnectionsAccepted, 1)
+		atomic.AddInt64(&x.Metrics.TCPConnectionsActive, 1)
+		go func() {
+			defer atomic.AddInt64(&x.Metrics.TCPConnectionsActive, -1)
+			x.readFromTCP(conn)
+		}()
+	}
+}
+
+// readFromTCP answers the queries on the connection until the client closes it
+// or it's idle. Each TCP query & response is prefixed by its two-byte length
+// (RFC 1035 section 4.2.2), and a client may send several (RFC 7766).
+func (x *Xip) readFromTCP(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().(*net.TCPAddr)
+	idleTimeout := x.TCPIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultTCPIdleTimeout
+	}
+	for {
+		if err := conn.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
+			x.logger().Println(err.Error())
+			return
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				atomic.AddInt64(&x.Metrics.TCPConnectionsIdleClosed, 1)
+			}
+			return // typically io.EOF: the client has closed the connection
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			x.logger().Println(err.Error())
+			return
+		}
+		response, logMessage, err := x.QueryResponseVia(TransportTCP, query, addr.IP)
+		if errors.Is(err, ErrQueryDropped) {
+			return
+		}
+		if err != nil {
+			x.logger().Println(err.Error())
+			return
+		}
+		if _, err = conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...)); err != nil {
+			x.logger().Println(err.Error())
+			return
+		}
+		if logMessage != "" {
+			x.logger().Printf("%v.%d %s", addr.IP, addr.Port, logMessage)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package xip_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+	"xip/xip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var _ = Describe("ServeTCP()", func() {
+	var x *xip.Xip
+	var listener net.Listener
+	var served chan error
+
+	BeforeEach(func() {
+		var err error
+		x = &xip.Xip{SOATimers: xip.DefaultSOATimers, TCPIdleTimeout: 100 * time.Millisecond}
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		served = make(chan error, 1)
+		go func() { served <- x.ServeTCP(listener) }()
+	})
+	AfterEach(func() {
+		Expect(listener.Close()).To(Succeed())
+		Eventually(served).Should(Receive(MatchError(net.ErrClosed)))
+	})
+
+	active := func() int64 { return atomic.LoadInt64(&x.Metrics.TCPConnectionsActive) }
+	accepted := func() int64 { return atomic.LoadInt64(&x.Metrics.TCPConnectionsAccepted) }
+	idleClosed := func() int64 { return atomic.LoadInt64(&x.Metrics.TCPConnectionsIdleClosed) }
+
+	It("answers length-prefixed queries", func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		query := packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+		_, err = conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...))
+		Expect(err).ToNot(HaveOccurred())
+		var length uint16
+		Expect(binary.Read(conn, binary.BigEndian, &length)).To(Succeed())
+		response := make([]byte, length)
+		_, err = io.ReadFull(conn, response)
+		Expect(err).ToNot(HaveOccurred())
+		var m dnsmessage.Message
+		Expect(m.Unpack(response)).To(Succeed())
+		Expect(m.Answers[0].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{127, 0, 0, 1}))
+		Expect(atomic.LoadInt64(&x.Metrics.QueriesTCP)).To(Equal(int64(1)))
+	})
+
+	It("counts the connections as they're opened & closed", func() {
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			conns = append(conns, conn)
+		}
+		Eventually(accepted).Should(Equal(int64(3)))
+		Eventually(active).Should(Equal(int64(3)))
+		for _, conn := range conns[:2] {
+			Expect(conn.Close()).To(Succeed())
+		}
+		Eventually(active).Should(Equal(int64(1)))
+		Expect(accepted()).To(Equal(int64(3)))
+		Expect(idleClosed()).To(Equal(int64(0)))
+		Expect(conns[2].Close()).To(Succeed())
+		Eventually(active).Should(Equal(int64(0)))
+	})
+
+	It("counts the connections it closes because they're idle", func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Eventually(active).Should(Equal(int64(1)))
+		// we don't send a query, so the server gives up on us
+		Eventually(idleClosed).Should(Equal(int64(1)))
+		Eventually(active).Should(Equal(int64(0)))
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(MatchError(io.EOF))
+	})
+})
@@ -6,22 +6,37 @@ package xip
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/bits"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
 	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
 )
 
 //go:generate go run github.com/maxbrunsfeld/counterfeiter/v6 -generate
@@ -34,35 +49,299 @@ type V3client interface {
 	Close() error
 }
 
+// GeoResolver maps the querier's IP to a region, e.g. "eu" or "na", for
+// GeoDNS ("geo.sslip.io"); the IP may be nil (e.g. for NS glue records)
+//
+//counterfeiter:generate . GeoResolver
+type GeoResolver interface {
+	Region(ip net.IP) string
+}
+
+// Logger is what we log errors & warnings through, e.g. an adapter for a
+// structured logger (zap, slog); the standard library's *log.Logger is one
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// DefaultLogger is the Logger of an Xip without one; it's the standard
+// library's logger
+var DefaultLogger Logger = log.Default()
+
 // Xip is meant to be a singleton that holds global state for the DNS server
 type Xip struct {
-	Etcd                        V3client                // etcd client for `k-v.io`
-	DnsAmplificationAttackDelay chan struct{}           // for throttling metrics.status.sslip.io
-	Metrics                     Metrics                 // DNS server metrics
-	BlocklistStrings            []string                // list of blacklisted strings that shouldn't appear in public hostnames
-	BlocklistCDIRs              []net.IPNet             // list of blacklisted strings that shouldn't appear in public hostnames
-	BlocklistUpdated            time.Time               // The most recent time the Blocklist was updated
-	NameServers                 []dnsmessage.NSResource // The list of authoritative name servers (NS)
+	Etcd                        V3client                           // etcd client for `k-v.io`
+	EtcdShards                  []V3client                         // etcd clients (clusters) to shard `k-v.io`'s keys across, see ShardFor(); if empty, Etcd has every key
+	DnsAmplificationAttackDelay chan struct{}                      // for throttling metrics.status.sslip.io
+	Metrics                     Metrics                            // DNS server metrics
+	BlocklistStrings            []string                           // list of blacklisted strings that shouldn't appear in public hostnames
+	BlocklistCDIRs              []net.IPNet                        // list of blacklisted strings that shouldn't appear in public hostnames
+	ServerID                    string                             // identifies this server, e.g. "ns-aws-1", in the "id.server.sslip.io" TXT; empty → no records
+	DefaultCNAME                dnsmessage.Name                    // the CNAME (e.g. a landing page) of names under our Zones that are neither customized nor embed an IP; zero → NODATA
+	ReservedNames               []string                           // leftmost labels, e.g. "www", "mail", whose hostnames never resolve to an embedded IP (NODATA unless customized)
+	RefuseOutOfZone             bool                               // refuse (REFUSED) the names outside our Zones rather than white-label them, e.g. "10-0-0-1.example.com"
+	IPWildcard                  bool                               // "<anything>.ip.sslip.io" TXT, not just "ip.sslip.io", returns the querier's IP
+	WhoamiAlias                 bool                               // "whoami.sslip.io" TXT returns the querier's IP, as "ip.sslip.io" does, à la "whoami.cloudflare"; see SetWhoamiAlias()
+	BlockedTXT                  bool                               // enables "blocked.<name>.sslip.io" TXT (whether & why <name> is blocked), for debugging the blocklist
+	DisableVersionTXT           bool                               // "version.status.sslip.io" TXT returns no records (NODATA), lest it fingerprint the server
+	DisableMetricsTXT           bool                               // likewise "metrics.status.sslip.io" TXT, its pages & "compact.metrics.status.sslip.io"
+	BlockedTTL                  uint32                             // TTL of blocked (sinkholed) A & AAAA answers; 0 → DefaultBlockedTTL
+	BlocklistUpdated            time.Time                          // The most recent time the Blocklist was updated
+	NameServers                 []dnsmessage.NSResource            // The list of authoritative name servers (NS)
+	PrimaryNS                   dnsmessage.Name                    // the SOA's MNAME, e.g. "ns-aws.sslip.io."; zero → the first of the NameServers (or of the zone's)
+	ZoneNameServers             map[string][]dnsmessage.NSResource // per-zone NS, e.g. "example.com." → "ns1.example.com."; see AddZoneNameServer()
+	Delegates                   map[string][]dnsmessage.NSResource // delegated subdomains' NS, e.g. "dev.example.com." → "ns1.dev.example.com."; we refer every query under them; see AddDelegate()
+	ZoneTTLs                    map[string]uint32                  // per-zone TTL of our A & AAAA answers, e.g. "dev.example.com." → 60; see AddZoneTTL(); the other zones' is AddressTTL
+	NoCacheSubdomain            string                             // e.g. "nocache.sslip.io."; the A & AAAA answers of the names under it have TTL 0, lest resolvers cache them; "" → none
+	DebugWire                   bool                               // log the raw (hex) query & response; verbose, may leak data
+	LogLevel                    string                             // LogLevelAll (default), LogLevelAnomalies, or LogLevelErrors
+	AcmeMode                    string                             // AcmeModeDelegate (default) or AcmeModeKV
+	ExtendedDNSErrors           bool                               // include RFC 8914 Extended DNS Errors in EDNS responses
+	SOATimers                   SOATimers                          // Refresh, Retry, Expire & MinTTL of our SOA records
+	KVReadOnly                  bool                               // refuse `k-v.io` writes (put, delete); gets still work
+	MaxAnswers                  int                                // cap on the A, AAAA, or TXT records in an answer; 0 → no cap
+	MaxAnswersTruncate          bool                               // set TC (truncated) when we cap the answer
+	MaxLabels                   int                                // refuse queries for names with more labels; 0 → no cap
+	FullerOverTCP               bool                               // over UDP, trim NS answers' glue to the first nameserver's, to curb amplification; over TCP, answer in full: all the glue, & no MaxAnswers cap
+	IPPositionStrict            bool                               // only match IPs that are the leading label(s), e.g. not "foo.10-0-0-1.sslip.io"
+	TestLocalZone               bool                               // test-only: resolve ".local" names' embedded IPs, e.g. "10-0-0-1.local" (no mDNS multicast); off → NODATA
+	ChaosPool                   []net.IP                           // "chaos.sslip.io" returns a random IP from the pool
+	Zones                       []string                           // the zones we serve, e.g. "sslip.io."; see AddZone()
+	KVExportToken               string                             // enables "<token>.export.k-v.io" TXT (key count & checksum); "" → disabled
+	KVMaxPutBytes               int                                // cap on the value of "put.value.key.k-v.io"; 0 → DefaultKvMaxPutBytes
+	KVStrictPuts                bool                               // reject (413) a put whose value exceeds KVMaxPutBytes rather than truncate it, & (507) a new key when the store has KVMaxEntries rather than evict
+	KVMaxEntries                int                                // cap on the builtin key-value store's keys (not etcd's); a new key evicts the least recently put one; 0 → no cap
+	KVListToken                 string                             // enables "list.<token>.<prefix>.k-v.io" TXT (the keys starting with the prefix); "" → disabled
+	KVPTRPuts                   bool                               // allow `k-v.io` puts & deletes of PTR records ("ptr-<IP>" & "dhcp-<host>" keys, "dhcp.k-v.io" leases), lest any client repoint any IP's PTR; off → 403
+	GeoResolver                 GeoResolver                        // maps the querier's IP to a region for "geo.sslip.io"; nil → GeoRegionDefault
+	GeoAnswers                  map[string][]net.IP                // "geo.sslip.io"'s IPs by region, e.g. "eu" → 10.0.0.1
+	RandIntn                    func(n int) int                    // a random int in [0, n), e.g. to pick from a weighted pool; nil → rand.Intn
+	QuerySemaphore              chan struct{}                      // bounds the queries answered concurrently (its capacity); nil → unbounded
+	AllowBase36IP               bool                               // "<base36>.b36.sslip.io" resolves to the Base36-encoded IPv4, e.g. "1z141z3.b36.sslip.io" → 255.255.255.255
+	SixToFour                   bool                               // "<IPv4>.6to4.sslip.io" AAAA returns the IPv4's 6to4 address (RFC 3056), e.g. "10-0-0-1.6to4.sslip.io" → 2002:a00:1::
+	AnyMode                     string                             // AnyModeNotImplemented (default) or AnyModeHINFO
+	AnswerOrder                 string                             // AnswerOrderAsIs (default) or AnswerOrderClosestFirst, of the A & AAAA records
+	BlocklistPrivateToo         bool                               // apply the blocklist to private IPs too, e.g. to block a management subnet
+	ApexTXT                     []string                           // extra TXT records for the apex ("sslip.io"), e.g. domain verification tokens
+	ZoneApexTXT                 map[string][]string                // per-zone extra TXT records for the zones' apexes, e.g. "example.com." → "Served by MyCorp"; see AddZoneApexTXT()
+	AllowlistOnly               bool                               // refuse queries for names that don't match the Allowlist
+	Allowlist                   []string                           // with AllowlistOnly, the names we answer: "host.example.com" (exactly) or "*.example.com" (any name under it)
+	QueryPolicy                 func(name string, ip net.IP) bool  // operator-defined policy on embedded IPs, e.g. only RFC 1918's: we refuse A & AAAA queries for names whose IP it returns false for; nil → any IP
+	TCPIdleTimeout              time.Duration                      // how long ServeTCP() waits for the next query on a connection; 0 → DefaultTCPIdleTimeout
+	SlowEtcdThreshold           time.Duration                      // log a warning & count SlowEtcdQueries when a KV get/put/delete's etcd call takes longer; 0 → disabled
+	StatsDAddr                  string                             // the StatsD server to push the Metrics to, e.g. "127.0.0.1:8125", see RunStatsD(); "" → disabled
+	StatsDInterval              time.Duration                      // how often to push the Metrics to StatsD; 0 → DefaultStatsDInterval
+	QueryTimeout                time.Duration                      // the budget for answering a query, after which we cancel its etcd calls & answer SERVFAIL; 0 → no budget
+	FloodInterval               time.Duration                      // a source's identical query within this of its last answered one is a flood: we answer it from the flood cache; 0 → disabled
+	DDR                         *DDR                               // Discovery of Designated Resolvers: "_dns.resolver.arpa" SVCB answers; nil → disabled
+	DNSSEC                      *DNSSEC                            // signing mode: NSEC3 & RRSIG in negative responses, NSEC3PARAM & DNSKEY answers; nil → disabled
+	UnsupportedTypes            []dnsmessage.Type                  // query types we explicitly don't implement (NotImplemented, not NODATA); NewXip() sets DefaultUnsupportedTypes
+	RequireEDNS                 bool                               // refuse queries without an OPT record (EDNS0), which are likelier legacy spoofed traffic
+	Logger                      Logger                             // where we log errors & warnings; nil → DefaultLogger
+	ConfigFile                  string                             // the YAML configuration file that ReloadCustomizations() re-reads; "" → nothing to reload
+	etcdMutex                   sync.RWMutex                       // guards Etcd once RetryEtcd() may switch it over in the background
+	etcdRetrying                bool                               // RetryEtcd() hasn't connected yet
+	draining                    int32                              // 1 while Drain()ed; accessed atomically, for e.g. a signal handler may Drain() mid-query
+	floodCache                  map[string]floodEntry              // each source's (transport & IP's) last answered query, see floodCachedResponse()
+	floodMutex                  sync.Mutex                         // guards floodCache
+}
+
+// QuerySemaphoreWait is how long a query waits for a slot in the
+// QuerySemaphore before we drop it
+const QuerySemaphoreWait = 100 * time.Millisecond
+
+// ErrQueryDropped is returned by QueryResponseVia() when the QuerySemaphore
+// is full; there's no response to send
+var ErrQueryDropped = errors.New("dropped the query: too many concurrent queries")
+
+// The key-value store's errors, which its callers can tell apart with
+// errors.Is(), e.g. a missing key from an etcd outage
+var (
+	ErrKVNotFound           = errors.New("key not found")
+	ErrKVBackendUnavailable = errors.New("the key-value store is unavailable")
+	ErrKVInvalidKey         = errors.New("invalid key")
+)
+
+// kvBackendError is an etcd error; it's ErrKVBackendUnavailable, but its
+// message & chain are etcd's, e.g. context.DeadlineExceeded
+type kvBackendError struct {
+	err error
+}
+
+func (e kvBackendError) Error() string        { return e.err.Error() }
+func (e kvBackendError) Unwrap() error        { return e.err }
+func (e kvBackendError) Is(target error) bool { return target == ErrKVBackendUnavailable }
+
+// GeoRegionDefault is the region whose GeoAnswers "geo.sslip.io" returns when
+// there's no GeoResolver or the querier's region has no GeoAnswers
+const GeoRegionDefault = "default"
+
+// SOATimers are the SOA record's timers (RFC 1035 section 3.3.13), in seconds
+type SOATimers struct {
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	MinTTL  uint32
+}
+
+// DefaultZone is the zone NewXip() serves; AddZone() serves more
+const DefaultZone = "sslip.io."
+
+// KVZone is the key-value store's zone. It isn't one of our Zones, but its
+// apex is ours all the same: it answers SOA & NS like our Zones' apexes do
+const KVZone = "k-v.io."
+
+// IPv4ReverseZone & IPv6ReverseZone are the reverse zones whose PTR records
+// we synthesize. Like KVZone, they aren't among our Zones, but their apexes
+// answer SOA & NS like our Zones' apexes do
+const (
+	IPv4ReverseZone = "in-addr.arpa."
+	IPv6ReverseZone = "ip6.arpa."
+)
+
+// LocalZone is mDNS's (RFC 6762). Its names' embedded IPs resolve only in
+// the TestLocalZone mode, e.g. "10-0-0-1.local"
+const LocalZone = "local."
+
+// DefaultMaxAnswers is high enough that it doesn't cap any of our answers,
+// but low enough to bound a misconfigured customization
+const DefaultMaxAnswers = 100
+
+// ednsUDPSize is the UDP payload size we advertise in our OPT records, &
+// the most we answer over UDP: https://www.dnsflagday.net/2020/
+const ednsUDPSize = 1232
+
+// DefaultMaxLabels is the most labels a name can have (RFC 1035's 255 bytes,
+// each label at least 2), i.e. no cap unless it's lowered
+const DefaultMaxLabels = 127
+
+// DefaultUnsupportedTypes are obsolete query types we answer NotImplemented
+// rather than NODATA: MD (3) & MF (4) (RFC 973), A6 (38) (RFC 6563), and
+// MAILB (253) & MAILA (254)
+var DefaultUnsupportedTypes = []dnsmessage.Type{3, 4, 38, 253, 254}
+
+// DefaultSOATimers — cribbed the Refresh/Retry/Expire from google.com.
+// MinTTL was 300, but I dropped to 180 for faster key-value propagation
+var DefaultSOATimers = SOATimers{
+	Refresh: 900,
+	Retry:   900,
+	Expire:  1800,
+	MinTTL:  180,
 }
 
-// Metrics contains the counters of the important/interesting queries
+// The AcmeMode determines how we answer "_acme-challenge." TXT queries for
+// hostnames with embedded IPs: AcmeModeDelegate → delegate (NS) to the
+// stripped hostname, e.g. "_acme-challenge.127-0-0-1.sslip.io" → NS
+// "127-0-0-1.sslip.io"; AcmeModeKV → answer authoritatively with the value
+// stored in the key-value store under the stripped hostname, e.g.
+// "127-0-0-1.sslip.io" (lowercase, no trailing dot).
+const (
+	AcmeModeDelegate = "delegate"
+	AcmeModeKV       = "kv"
+)
+
+// The AnyMode determines how we answer queries of type ANY: AnyModeNotImplemented
+// → NotImplemented, like Cloudflare; AnyModeHINFO → a single synthesized HINFO
+// record whose CPU is "RFC8482", as RFC 8482 section 4.2 recommends.
+const (
+	AnyModeNotImplemented = "notimp"
+	AnyModeHINFO          = "hinfo"
+)
+
+// The AnswerOrder determines the order of an answer's A (AAAA) records, e.g.
+// a customization's or a pool's: AnswerOrderAsIs → as they're stored;
+// AnswerOrderClosestFirst → those sharing the longest prefix with the client
+// (its EDNS Client Subnet, if any, else the querier) first, a crude take on
+// RFC 6724's destination address selection.
+const (
+	AnswerOrderAsIs         = "asis"
+	AnswerOrderClosestFirst = "closest"
+)
+
+// The LogLevel determines which queries QueryResponse returns a log message for:
+// LogLevelAll → every query; LogLevelAnomalies → only queries that were blocked
+// or whose response wasn't a plain success (e.g. NotImplemented, truncated);
+// LogLevelErrors → none (errors are returned, not logged, so they still surface).
+const (
+	LogLevelAll       = "all"
+	LogLevelAnomalies = "anomalies"
+	LogLevelErrors    = "errors"
+)
+
+// Metrics contains the counters of the important/interesting queries. The
+// counters are int64s, updated atomically: queries update them concurrently,
+// so read them atomically, too, e.g. via Snapshot()
 type Metrics struct {
 	Start                           time.Time
-	Queries                         int
-	AnsweredQueries                 int
-	AnsweredAQueries                int
-	AnsweredAAAAQueries             int
-	AnsweredTXTSrcIPQueries         int
-	AnsweredTXTVersionQueries       int
-	AnsweredTXTGetKvQueries         int
-	AnsweredTXTPutKvQueries         int
-	AnsweredTXTDelKvQueries         int
-	AnsweredNSDNS01ChallengeQueries int
-	AnsweredBlockedQueries          int
-	AnsweredPTRQueriesIPv4          int
-	AnsweredPTRQueriesIPv6          int
+	Queries                         int64
+	AnsweredQueries                 int64
+	AnsweredAQueries                int64
+	AnsweredAAAAQueries             int64
+	AnsweredTXTSrcIPQueries         int64
+	AnsweredTXTVersionQueries       int64
+	AnsweredTXTGetKvQueries         int64
+	AnsweredTXTPutKvQueries         int64
+	AnsweredTXTDelKvQueries         int64
+	AnsweredNSDNS01ChallengeQueries int64
+	AnsweredBlockedQueries          int64
+	AnsweredBlockedAQueries         int64
+	AnsweredBlockedAAAAQueries      int64
+	AnsweredPTRQueriesIPv4          int64
+	AnsweredPTRQueriesIPv6          int64
+	AnsweredReadOnlyRejections      int64
+	AnsweredTXTTraceQueries         int64
+	SlowEtcdQueries                 int64
+	DeniedByAllowlist               int64
+	RefusedWithoutEDNS              int64
+	TruncatedKVPuts                 int64
+	AnsweredTXTRuntimeQueries       int64
+	AnsweredServerIDQueries         int64
+	TimedOutQueries                 int64
+	AnsweredKvPoolQueries           int64
+	AnsweredUnsupportedClass        int64
+	DrainedQueries                  int64
+	MalformedQueries                int64
+	DeniedByPolicy                  int64
+	EvictedKVEntries                int64
+	RefusedTooManyLabels            int64
+	AnsweredFromFloodCache          int64
+	AnsweredCNAMEQueries            int64
+	AnsweredMXQueries               int64
+	AnsweredNSQueries               int64
+	AnsweredSOAQueries              int64
+	QueriesUDP                      int64
+	QueriesTCP                      int64
+	QueriesDoH                      int64
+	DroppedQueries                  int64
+	TCPConnectionsAccepted          int64
+	TCPConnectionsActive            int64
+	TCPConnectionsIdleClosed        int64
+}
+
+// Snapshot returns a copy of the metrics whose counters are each read
+// atomically, e.g. to report them while queries update them
+func (m *Metrics) Snapshot() (snapshot Metrics) {
+	snapshot.Start = m.Start
+	value, snapshotValue := reflect.ValueOf(m).Elem(), reflect.ValueOf(&snapshot).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if counter, ok := value.Field(i).Addr().Interface().(*int64); ok {
+			snapshotValue.Field(i).SetInt(atomic.LoadInt64(counter))
+		}
+	}
+	return snapshot
 }
 
+// The transports over which we receive queries, for the per-transport Metrics
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportDoH = "doh" // DoH JSON API
+)
+
+// transportSelfTest is SelfTest()'s pseudo-transport, whose queries are
+// exempt from the Allowlist & the QueryPolicy
+const transportSelfTest = "self-test"
+
 // DomainCustomization is a value that is returned for a specific query.
 // The map key is the domain in question, e.g. "sslip.io." (always include trailing dot).
 // For example, when querying for MX records for "sslip.io", return the protonmail servers,
@@ -72,20 +351,32 @@ type Metrics struct {
 // Noticeably absent are the NS records and SOA records. They don't need to be customized
 // because they are always the same, regardless of the domain being queried.
 type DomainCustomization struct {
-	A     []dnsmessage.AResource
-	AAAA  []dnsmessage.AAAAResource
-	CNAME dnsmessage.CNAMEResource
-	MX    []dnsmessage.MXResource
-	TXT   func(*Xip, net.IP) ([]dnsmessage.TXTResource, error)
+	A        []dnsmessage.AResource
+	AAAA     []dnsmessage.AAAAResource
+	CNAME    dnsmessage.CNAMEResource
+	MX       []dnsmessage.MXResource
+	TXT      func(*Xip, net.IP) ([]dnsmessage.TXTResource, error)
+	AFunc    func(*Xip, net.IP) []dnsmessage.AResource
+	AAAAFunc func(*Xip, net.IP) []dnsmessage.AAAAResource
+	TXTECS   func(*Xip, net.IP, *net.IPNet) ([]dnsmessage.TXTResource, error)
+	Class    dnsmessage.Class             // if set, e.g. ClassCHAOS, the TXT records also answer queries of that class
+	Raw      map[dnsmessage.Type][][]byte // records of the types we don't otherwise answer, e.g. SMIMEA (53), TLSA (52): their RDATA (wire format) by type
 	// Unlike the other record types, TXT is a function in order to enable more complex behavior
-	// e.g. IP address of the query's source
+	// e.g. IP address of the query's source. Likewise, AFunc & AAAAFunc, if set,
+	// are used instead of A & AAAA to compute the addresses based on the querier
+	// (whose IP may be nil, e.g. for NS glue records) or the time, e.g. a random
+	// IP from the ChaosPool. TXTECS, if set, is used instead of TXT when the
+	// records depend on the query's EDNS Client Subnet (RFC 7871), if any (nil).
+	// Raw serves the records of service names, e.g. SMIMEA at
+	// "<hash>._smimecert.example.com."; their underscore labels aren't special
 }
 
 // DomainCustomizations is a lookup table for specially-crafted records
 // e.g. MX records for sslip.io.
-// The string key should always be lower-cased
-// DomainCustomizations{"sslip.io": ...} NOT DomainCustomizations{"sSLip.iO": ...}
-// DNS hostnames are technically case-insensitive
+// The string key should always be lower-cased and absolute (end in ".")
+// DomainCustomizations{"sslip.io.": ...} NOT DomainCustomizations{"sSLip.iO": ...}
+// DNS hostnames are technically case-insensitive; NormalizeCustomizations() fixes the keys
+// A leading "*" label is a wildcard, e.g. "*.alias.sslip.io." (RFC 4592)
 type DomainCustomizations map[string]DomainCustomization
 
 // KvCustomizations is a lookup table for custom TXT records
@@ -94,18 +385,64 @@ type DomainCustomizations map[string]DomainCustomization
 // It's used when there's no etcd server running
 type KvCustomizations map[string][]dnsmessage.TXTResource
 
+// A stored key-value value containing KvRecordSeparator is returned as
+// multiple TXT records, e.g. "one\x00two" → two TXT records, "one" & "two".
+// The records are capped at KvMaxTXTBytes cumulatively; records past the
+// cap are dropped (to bound the size of the response).
+const (
+	KvRecordSeparator = "\x00"
+	KvMaxTXTBytes     = 4096
+	KvMaxListKeys     = 20
+)
+
+// DefaultKvMaxPutBytes caps the values of "put.value.key.k-v.io": too-long
+// TXT records can be used in DNS amplification attacks
+const DefaultKvMaxPutBytes = 63
+
+// KvPTRPrefix is the key-value namespace of custom PTR records: the value
+// stored under "ptr-" & the IP with dashes for its dots or colons is the
+// hostname a PTR query for that IP returns instead of the synthesized one,
+// e.g. "put.myhost.example.com.ptr-10-0-0-1.k-v.io" → "1.0.0.10.in-addr.arpa"
+// PTR "myhost.example.com."
+const KvPTRPrefix = "ptr-"
+
+// The DHCP-lease-style namespace pairs forward & reverse records: a single
+// "put.10.0.0.5.myhost.dhcp.k-v.io" stores 10.0.0.5 under "dhcp-myhost",
+// which "myhost.dhcp.k-v.io" A returns, and "myhost.dhcp.k-v.io." under
+// KvPTRPrefix, which "5.0.0.10.in-addr.arpa" PTR returns
+const (
+	KvDHCPNamespace = "dhcp"
+	KvDHCPPrefix    = "dhcp-"
+)
+
 // There's nothing like global variables to make my heart pound with joy.
 // Some of these are global because they are, in essence, constants which
 // I don't want to waste time recreating with every function call.
 var (
+	// Go's regexp is leftmost-first, and the boundaries "(^|[.-])" & "($|[.-])"
+	// keep us from matching the middle of a label, so when there's more than one
+	// embedded IP (e.g. "1.2.3.4.5.6.7.8.sslip.io") we always get the leftmost one
 	ipv4REDots   = regexp.MustCompile(`(^|[.-])(((25[0-5]|(2[0-4]|1?\d)?\d)\.){3}(25[0-5]|(2[0-4]|1?\d)?\d))($|[.-])`)
 	ipv4REDashes = regexp.MustCompile(`(^|[.-])(((25[0-5]|(2[0-4]|1?\d)?\d)-){3}(25[0-5]|(2[0-4]|1?\d)?\d))($|[.-])`)
 	// https://stackoverflow.com/questions/53497/regular-expression-that-matches-valid-ipv6-addresses
 	ipv6RE           = regexp.MustCompile(`(^|[.-])(([[:xdigit:]]{1,4}-){7}[[:xdigit:]]{1,4}|([[:xdigit:]]{1,4}-){1,7}-|([[:xdigit:]]{1,4}-){1,6}-[[:xdigit:]]{1,4}|([[:xdigit:]]{1,4}-){1,5}(-[[:xdigit:]]{1,4}){1,2}|([[:xdigit:]]{1,4}-){1,4}(-[[:xdigit:]]{1,4}){1,3}|([[:xdigit:]]{1,4}-){1,3}(-[[:xdigit:]]{1,4}){1,4}|([[:xdigit:]]{1,4}-){1,2}(-[[:xdigit:]]{1,4}){1,5}|[[:xdigit:]]{1,4}-((-[[:xdigit:]]{1,4}){1,6})|-((-[[:xdigit:]]{1,4}){1,7}|-)|fe80-(-[[:xdigit:]]{0,4}){0,4}%[\da-zA-Z]+|--(ffff(-0{1,4})?-)?((25[0-5]|(2[0-4]|1?\d)?\d)\.){3}(25[0-5]|(2[0-4]|1?\d)?\d)|([[:xdigit:]]{1,4}-){1,4}-((25[0-5]|(2[0-4]|1?\d)?\d)\.){3}(25[0-5]|(2[0-4]|1?\d)?\d))($|[.-])`)
+	base36RE         = regexp.MustCompile(`^([0-9a-z]{1,7})\.b36$`) // 7 Base36 characters hold 32 bits; matched against the subdomain of the zone (see zoneSubdomain()), as are the next 4
+	sixToFourRE      = regexp.MustCompile(`(^|\.)6to4$`)
 	ipv4ReverseRE    = regexp.MustCompile(`^(.*)\.in-addr\.arpa\.$`)
 	ipv6ReverseRE    = regexp.MustCompile(`^(([[:xdigit:]]\.){32})ip6\.arpa\.`)
 	dns01ChallengeRE = regexp.MustCompile(`(?i)_acme-challenge\.`) // (?i) → non-capturing case insensitive
 	kvRE             = regexp.MustCompile(`\.k-v\.io\.$`)
+	kvPoolRE         = regexp.MustCompile(`^([^.]+)\.k-v\.io\.$`)
+	kvDHCPRE         = regexp.MustCompile(`^([^.]+)\.dhcp\.k-v\.io\.$`)
+	metricsPageRE    = regexp.MustCompile(`^metrics\.(\d{1,4})\.status\.sslip\.io\.$`)
+	ttlRE            = regexp.MustCompile(`^ttl\.(.+)$`)
+	blockedRE        = regexp.MustCompile(`^blocked\.(.+)$`)
+	netRE            = regexp.MustCompile(`^net\.([^.]+)$`)
+
+	// IPv6 with the last 32 bits as a dotted IPv4 (RFC 4291 section 2.2), e.g.
+	// "1-2-3-4-5-6-1.2.3.4", "2001-db8--1.2.3.4", "--ffff-1.2.3.4"; ipv6RE
+	// only matches some of these forms
+	ipv6MixedRE = regexp.MustCompile(`(^|[.-])((([[:xdigit:]]{1,4}-){6}|([[:xdigit:]]{1,4}-){1,5}-([[:xdigit:]]{1,4}-){0,4}|--([[:xdigit:]]{1,4}-){0,5})((25[0-5]|(2[0-4]|1?\d)?\d)\.){3}(25[0-5]|(2[0-4]|1?\d)?\d))($|[.-])`)
 
 	mbox, _  = dnsmessage.NewName("briancunnie.gmail.com.")
 	mx1, _   = dnsmessage.NewName("mail.protonmail.ch.")
@@ -118,6 +455,12 @@ var (
 	VersionDate     = "0001/01/01-99:99:99-0800"
 	VersionGitHash  = "cafexxx"
 
+	// V6Separator stands in for ":" in IPv6 hostnames, e.g. "2001-db8--1.sslip.io".
+	// Set it (after checking ValidV6Separator) to e.g. "x" for "2001xdb8xx1.sslip.io";
+	// dashes continue to work.
+	V6Separator = "-"
+
+	MetricsPageSize   = 8   // metrics per page of "metrics.<page>.status.sslip.io"
 	MetricsBufferSize = 200 // big enough to run our tests, and small enough to prevent DNS amplification attacks
 
 	// etcdContextTimeout — the duration (context) that we wait for etcd to get back to us
@@ -128,6 +471,9 @@ var (
 	//   within the 5000 milliseconds
 	etcdContextTimeout = 1928 * time.Millisecond
 
+	// Customizations & TxtKvCustomizations may be modified directly until we
+	// answer queries; after that, queries read them concurrently: use
+	// SetCustomization() & DeleteCustomization(), and the k-v.io puts & deletes
 	TxtKvCustomizations = KvCustomizations{}
 	Customizations      = DomainCustomizations{
 		"sslip.io.": {
@@ -141,7 +487,7 @@ var (
 					MX:   mx2,
 				},
 			},
-			TXT: TXTSslipIoSPF,
+			TXT: TXTWithApexTXT(TXTSslipIoSPF),
 		},
 		// don't let people procure *.k-v.io TLS certs via ACME DNS-01 challenge
 		"_acme-challenge.k-v.io.": {
@@ -166,13 +512,10 @@ var (
 				CNAME: dkim3,
 			},
 		},
-		// Special-purpose TXT records
-		"ip.sslip.io.": {
-			TXT: TXTIp,
-		},
+		// Special-purpose TXT records; "ip.sslip.io." is registered by AddZone()
 		"version.status.sslip.io.": {
 			TXT: func(x *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
-				x.Metrics.AnsweredTXTVersionQueries++
+				atomic.AddInt64(&x.Metrics.AnsweredTXTVersionQueries, 1)
 				return []dnsmessage.TXTResource{
 					{TXT: []string{VersionSemantic}}, // e.g. "2.2.1'
 					{TXT: []string{VersionDate}},     // e.g. "2021/10/03-15:08:54+0100"
@@ -180,12 +523,51 @@ var (
 				}, nil
 			},
 		},
+		"chaos.sslip.io.": {
+			AFunc:    AChaos,
+			AAAAFunc: AAAAChaos,
+		},
+		"geo.sslip.io.": {
+			AFunc:    AGeo,
+			AAAAFunc: AAAAGeo,
+		},
 		"metrics.status.sslip.io.": {
 			TXT: TXTMetrics,
 		},
+		"compact.metrics.status.sslip.io.": {
+			TXT: TXTMetricsCompact,
+		},
+		"runtime.status.sslip.io.": {
+			TXT: TXTRuntime,
+		},
+		"id.server.sslip.io.": {
+			TXT: TXTServerID,
+		},
+		"trace.sslip.io.": {
+			TXTECS: TXTTrace,
+		},
 	}
 )
 
+// Extended DNS Error (RFC 8914) info-codes that we return
+const (
+	EDEFiltered         = 17 // the queried name is on the blocklist
+	EDEProhibited       = 18 // the queried name isn't on the Allowlist (AllowlistOnly), or its IP is against the QueryPolicy
+	EDENotAuthoritative = 20 // we're not authoritative for the queried name
+	EDENotSupported     = 21 // e.g. queries of type ANY
+)
+
+// hinfoRFC8482 is the RDATA of the HINFO record we answer ANY queries with in
+// AnyModeHINFO: two <character-string>s, CPU "RFC8482" & an empty OS
+var hinfoRFC8482 = append([]byte{byte(len("RFC8482"))}, append([]byte("RFC8482"), 0)...)
+
+// ExtendedDNSError is an RFC 8914 Extended DNS Error, which we return in the
+// OPT record of responses to EDNS queries when ExtendedDNSErrors is set.
+type ExtendedDNSError struct {
+	InfoCode  uint16
+	ExtraText string
+}
+
 // Response Why do I have a crazy struct of fields of arrays of functions?
 // It's because I can't use dnsmessage.Builder as I had hoped; specifically
 // I need to set the Header _after_ I process the message, but Builder expects
@@ -198,15 +580,205 @@ type Response struct {
 	Answers     []func(*dnsmessage.Builder) error
 	Authorities []func(*dnsmessage.Builder) error
 	Additionals []func(*dnsmessage.Builder) error
+	EDE         *ExtendedDNSError // why we blocked/refused the query, if we did
+	Full        bool              // answer in full, e.g. over TCP (FullerOverTCP): all the glue, & no MaxAnswers cap
+	SelfTest    bool              // a SelfTest() query, exempt from the Allowlist & the QueryPolicy, which needn't cover its names
+}
+
+// QueryResult is a structured summary of a query & its response, returned by
+// QueryResponseResult(), for embedders (dashboards, tests) that would rather
+// not regex-match the log message
+type QueryResult struct {
+	SrcIP   net.IP
+	QType   dnsmessage.Type
+	QName   string
+	RCode   dnsmessage.RCode
+	Answers []string // in presentation format, e.g. "127.0.0.1", "10 mail.protonmail.ch."
+}
+
+// AddZone serves the zone (e.g. "example.com"), i.e. "ip.example.com" TXT
+// returns the querier's IP address, as "ip.sslip.io" does, and so does
+// "whoami.example.com" if WhoamiAlias is set
+func (x *Xip) AddZone(zone string) error {
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	if _, err := dnsmessage.NewName("ip." + zone); err != nil {
+		return fmt.Errorf(`invalid zone "%s": %w`, zone, err)
+	}
+	for _, existingZone := range x.Zones {
+		if existingZone == zone {
+			return nil
+		}
+	}
+	x.Zones = append(x.Zones, zone)
+	updateCustomizations(func(customizations DomainCustomizations) {
+		addZoneCustomizations(customizations, zone, x.WhoamiAlias)
+	})
+	return nil
+}
+
+// SetWhoamiAlias sets WhoamiAlias and adds (or removes) the "whoami." TXT
+// records of the zones we already serve; AddZone() adds the later zones'
+func (x *Xip) SetWhoamiAlias(whoamiAlias bool) {
+	x.WhoamiAlias = whoamiAlias
+	updateCustomizations(func(customizations DomainCustomizations) {
+		for _, zone := range x.Zones {
+			addZoneCustomizations(customizations, zone, whoamiAlias)
+		}
+	})
+}
+
+// addZoneCustomizations adds the zone's "ip." TXT records, and, if whoami,
+// its "whoami." TXT records (if not, it removes them), which return the
+// querier's IP address, to the customizations
+func addZoneCustomizations(customizations DomainCustomizations, zone string, whoami bool) {
+	ipHost := customizations["ip."+zone]
+	ipHost.TXT = TXTIp
+	customizations["ip."+zone] = ipHost
+	whoamiHost := customizations["whoami."+zone]
+	whoamiHost.TXT = nil
+	if whoami {
+		whoamiHost.TXT = TXTWhoami
+	}
+	if reflect.DeepEqual(whoamiHost, DomainCustomization{}) {
+		delete(customizations, "whoami."+zone)
+		return
+	}
+	customizations["whoami."+zone] = whoamiHost
+}
+
+// AddZoneNameServer serves the zone (see AddZone()) and adds the nameserver
+// to the NS records it advertises instead of the global NameServers, e.g.
+// "example.com" & "ns1.example.com" → "foo.example.com" NS "ns1.example.com"
+func (x *Xip) AddZoneNameServer(zone, nameServer string) error {
+	if err := x.AddZone(zone); err != nil {
+		return err
+	}
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	if !strings.HasSuffix(nameServer, ".") {
+		nameServer += "."
+	}
+	nsName, err := dnsmessage.NewName(nameServer)
+	if err != nil {
+		return fmt.Errorf(`invalid nameserver "%s": %w`, nameServer, err)
+	}
+	if x.ZoneNameServers == nil {
+		x.ZoneNameServers = map[string][]dnsmessage.NSResource{}
+	}
+	x.ZoneNameServers[zone] = append(x.ZoneNameServers[zone], dnsmessage.NSResource{NS: nsName})
+	return nil
+}
+
+// AddZoneTTL serves the zone (see AddZone()) and sets the TTL of its A &
+// AAAA answers instead of AddressTTL, e.g. a short TTL for a dynamic zone,
+// "dev.example.com" & 60 → "10-0-0-1.dev.example.com" A's TTL is 60
+func (x *Xip) AddZoneTTL(zone string, ttl uint32) error {
+	if err := x.AddZone(zone); err != nil {
+		return err
+	}
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	if x.ZoneTTLs == nil {
+		x.ZoneTTLs = map[string]uint32{}
+	}
+	x.ZoneTTLs[zone] = ttl
+	return nil
+}
+
+// AddZoneApexTXT serves the zone (see AddZone()) and adds the TXT record
+// to its apex's, after any built-in ones, e.g. "example.com" & "Served by
+// MyCorp" → "example.com" TXT "Served by MyCorp"
+func (x *Xip) AddZoneApexTXT(zone, txt string) error {
+	if err := x.AddZone(zone); err != nil {
+		return err
+	}
+	zone = strings.ToLower(zone)
+	if !strings.HasSuffix(zone, ".") {
+		zone += "."
+	}
+	if len(txt) > 255 {
+		return fmt.Errorf(`zone "%s"'s apex TXT "%s" is longer than 255 bytes`, zone, txt)
+	}
+	if x.ZoneApexTXT == nil {
+		x.ZoneApexTXT = map[string][]string{}
+	}
+	x.ZoneApexTXT[zone] = append(x.ZoneApexTXT[zone], txt)
+	return nil
+}
+
+// AddDelegate delegates the subdomain (e.g. "dev.example.com") to the
+// nameserver (e.g. "ns1.dev.example.com"): every query under it gets a
+// referral to its nameservers rather than an answer
+func (x *Xip) AddDelegate(subdomain, nameServer string) error {
+	subdomain = strings.ToLower(subdomain)
+	if !strings.HasSuffix(subdomain, ".") {
+		subdomain += "."
+	}
+	if _, err := dnsmessage.NewName(subdomain); err != nil {
+		return fmt.Errorf(`invalid delegated subdomain "%s": %w`, subdomain, err)
+	}
+	if !strings.HasSuffix(nameServer, ".") {
+		nameServer += "."
+	}
+	nsName, err := dnsmessage.NewName(nameServer)
+	if err != nil {
+		return fmt.Errorf(`invalid nameserver "%s": %w`, nameServer, err)
+	}
+	if x.Delegates == nil {
+		x.Delegates = map[string][]dnsmessage.NSResource{}
+	}
+	x.Delegates[subdomain] = append(x.Delegates[subdomain], dnsmessage.NSResource{NS: nsName})
+	return nil
+}
+
+// delegate returns the most specific delegated subdomain in Delegates the
+// hostname falls under, if any ("" otherwise)
+func (x *Xip) delegate(fqdnString string) string {
+	fqdn := strings.ToLower(fqdnString)
+	matchedSubdomain := ""
+	for subdomain := range x.Delegates {
+		if (fqdn == subdomain || strings.HasSuffix(fqdn, "."+subdomain)) && len(subdomain) > len(matchedSubdomain) {
+			matchedSubdomain = subdomain
+		}
+	}
+	return matchedSubdomain
+}
+
+// nameServers returns the NS records of the most specific zone in
+// ZoneNameServers the hostname falls under, or the global NameServers
+func (x *Xip) nameServers(fqdnString string) []dnsmessage.NSResource {
+	fqdn := strings.ToLower(fqdnString)
+	matchedZone := ""
+	for zone := range x.ZoneNameServers {
+		if (fqdn == zone || strings.HasSuffix(fqdn, "."+zone)) && len(zone) > len(matchedZone) {
+			matchedZone = zone
+		}
+	}
+	if matchedZone == "" {
+		return x.NameServers
+	}
+	return x.ZoneNameServers[matchedZone]
 }
 
 // NewXip follows convention for constructors: https://go.dev/doc/effective_go#allocation_new
 func NewXip(etcdEndpoint, blocklistURL string, nameservers []string, addresses []string) (x *Xip, logmessages []string) {
 	var err error
-	x = &Xip{Metrics: Metrics{Start: time.Now()}}
+	x = &Xip{Metrics: Metrics{Start: time.Now()}, SOATimers: DefaultSOATimers, MaxAnswers: DefaultMaxAnswers, MaxLabels: DefaultMaxLabels, UnsupportedTypes: DefaultUnsupportedTypes}
 	// connect to `etcd`; if there's an error, set etcdCli to `nil` and that to
-	// determine whether to use a local key-value store instead
-	x.Etcd, err = clientv3New(etcdEndpoint)
+	// determine whether to use a local key-value store instead. Several
+	// comma-separated endpoints are separate clusters, each a shard.
+	if etcdEndpoints := strings.Split(etcdEndpoint, ","); len(etcdEndpoints) > 1 {
+		x.EtcdShards, err = clientv3NewShards(etcdEndpoints)
+	} else {
+		x.Etcd, err = clientv3New(etcdEndpoint)
+	}
 	if err != nil {
 		logmessages = append(logmessages, fmt.Sprintf("failed to connect to etcd at %s, using local key-value store instead: %s", etcdEndpoint, err.Error()))
 	} else {
@@ -225,6 +797,12 @@ func NewXip(etcdEndpoint, blocklistURL string, nameservers []string, addresses [
 		}
 	}()
 
+	NormalizeCustomizations()
+	// Serve our zone, e.g. "ip.sslip.io" TXT returns the querier's IP
+	if err = x.AddZone(DefaultZone); err != nil {
+		logmessages = append(logmessages, err.Error())
+	}
+
 	// Parse and set our nameservers
 	for _, ns := range nameservers {
 		if len(ns) == 0 {
@@ -246,52 +824,9 @@ func NewXip(etcdEndpoint, blocklistURL string, nameservers []string, addresses [
 		logmessages = append(logmessages, fmt.Sprintf(`Adding nameserver "%s"`, ns))
 	}
 	// Parse and set our addresses
-	for _, address := range addresses {
-		hostAddr := strings.Split(address, "=")
-		if len(hostAddr) != 2 {
-			logmessages = append(logmessages, fmt.Sprintf(`-addresses: arguments should be in the format "host=ip", not "%s"`, address))
-			continue
-		}
-		host := hostAddr[0]
-		ip := net.ParseIP(hostAddr[1])
-		// all hosts must be absolute (end in ".")
-		if host[len(host)-1] != '.' {
-			host += "."
-		}
-		if ip == nil { // bad IP address
-			logmessages = append(logmessages, fmt.Sprintf(`-addresses: "%s" is not assigned a valid IP "%s"`, hostAddr, ip.String()))
-			continue
-		}
-		if ip.To4() != nil { // we have an IPv4
-			var ABytes [4]byte
-			// copy the _last_ four bytes of the 16-byte IP, not the first four bytes. Cost me 2 hours.
-			copy(ABytes[0:4], ip[12:])
-			// Thanks https://stackoverflow.com/questions/42605337/cannot-assign-to-struct-field-in-a-map
-			var hostEntry = DomainCustomization{}
-			if _, ok := Customizations[host]; ok {
-				hostEntry = Customizations[host]
-			}
-			hostEntry.A = append(hostEntry.A, dnsmessage.AResource{A: ABytes})
-			Customizations[host] = hostEntry
-		} else {
-			// We're pretty sure it's IPv6 at this point, but we check anyway
-			if ip.To16() == nil { // it's not IPv6, and I don't know what it is
-				logmessages = append(logmessages, fmt.Sprintf(`-addresses: "%s" is not IPv4 or IPv6 "%s"`, hostAddr, ip.String()))
-				continue
-			}
-			var AAAABytes [16]byte
-			copy(AAAABytes[0:16], ip)
-			// Thanks https://stackoverflow.com/questions/42605337/cannot-assign-to-struct-field-in-a-map
-			var hostEntry = DomainCustomization{}
-			if _, ok := Customizations[host]; ok {
-				hostEntry = Customizations[host]
-			}
-			hostEntry.AAAA = append(hostEntry.AAAA, dnsmessage.AAAAResource{AAAA: AAAABytes})
-			Customizations[host] = hostEntry
-		}
-		// print out the added records in a manner similar to the way they're set on the cmdline
-		logmessages = append(logmessages, fmt.Sprintf(`Adding record "%s=%s"`, host, ip))
-	}
+	updateCustomizations(func(customizations DomainCustomizations) {
+		logmessages = append(logmessages, addAddresses(customizations, addresses)...)
+	})
 
 	// We want to make sure that our DNS server isn't used in a DNS amplification attack.
 	// The endpoint we're worried about is metrics.status.sslip.io, whose reply is
@@ -318,6 +853,14 @@ func NewXip(etcdEndpoint, blocklistURL string, nameservers []string, addresses [
 	return x, logmessages
 }
 
+// logger returns the Logger to log through: the Xip's, if it has one
+func (x *Xip) logger() Logger {
+	if x.Logger == nil {
+		return DefaultLogger
+	}
+	return x.Logger
+}
+
 // QueryResponse takes in a raw (packed) DNS query and returns a raw (packed)
 // DNS response, a string (for logging) that describes the query and the
 // response, and an error. It takes in the raw data to offload as much as
@@ -331,7 +874,31 @@ func NewXip(etcdEndpoint, blocklistURL string, nameservers []string, addresses [
 //	78.46.204.247.33654: TypeNS www.example.com ? NS
 //	78.46.204.247.33654: TypeSOA www.example.com ? SOA
 //	2600::.33654: TypeAAAA --1.sslip.io ? ::1
+//
+// The log string is empty ("") if the LogLevel filters it out.
+//
+// When DebugWire is set, the embedded IP's form & label (see embeddedIPLog)
+// and the hex-encoded query and response are appended:
+//
+//	78.46.204.247.33654: TypeA 127-0-0-1.sslip.io ? 127.0.0.1 (dash form at label 0) query: 1f2e... response: 1f2e...
 func (x *Xip) QueryResponse(queryBytes []byte, srcAddr net.IP) (responseBytes []byte, logMessage string, err error) {
+	return x.queryResponse("", queryBytes, srcAddr)
+}
+
+// queryResponse is QueryResponse, but the transport (e.g. TransportTCP), if
+// known ("" if not), may shape the answer, see FullerOverTCP, and if there's
+// a FloodInterval, a flood's queries are answered from the flood cache, but
+// not while we're Drain()ed, nor the `k-v.io` queries, whose answers a put or
+// delete may change at any moment
+func (x *Xip) queryResponse(transport string, queryBytes []byte, srcAddr net.IP) (responseBytes []byte, logMessage string, err error) {
+	if x.FloodInterval > 0 && srcAddr != nil && len(queryBytes) > 2 && !x.Draining() && !kvQuery(queryBytes) {
+		return x.floodCachedResponse(transport, queryBytes, srcAddr)
+	}
+	return x.answerQuery(transport, queryBytes, srcAddr)
+}
+
+// answerQuery is queryResponse without the flood cache
+func (x *Xip) answerQuery(transport string, queryBytes []byte, srcAddr net.IP) (responseBytes []byte, logMessage string, err error) {
 	var queryHeader dnsmessage.Header
 	var p dnsmessage.Parser
 	var response Response
@@ -343,15 +910,48 @@ func (x *Xip) QueryResponse(queryBytes []byte, srcAddr net.IP) (responseBytes []
 	// we only answer the first question even though there technically may be more than one;
 	// de facto there's one and only one question
 	if q, err = p.Question(); err != nil {
-		return nil, "", err
+		// the header parsed, so we can still tell the querier it's malformed
+		atomic.AddInt64(&x.Metrics.MalformedQueries, 1)
+		if responseBytes, err = formErrResponse(queryHeader); err != nil {
+			return nil, "", err
+		}
+		if x.LogLevel != LogLevelErrors {
+			logMessage = "? FormErr (truncated question)"
+		}
+		return responseBytes, logMessage, nil
 	}
-	response, logMessage, err = x.processQuestion(q, srcAddr)
-	if err != nil {
+	queryOPT, udpSize := ednsOPT(&p)
+	if compressedQuestion(queryBytes) {
+		atomic.AddInt64(&x.Metrics.MalformedQueries, 1)
+		response = Response{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeFormatError}}
+		logMessage = q.Type.String() + " " + q.Name.String() + " ? FormErr (compressed question)"
+	} else if x.Draining() {
+		atomic.AddInt64(&x.Metrics.DrainedQueries, 1)
+		response = Response{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}}
+		logMessage = q.Type.String() + " " + q.Name.String() + " ? ServFail (draining)"
+	} else if x.RequireEDNS && queryOPT == nil {
+		atomic.AddInt64(&x.Metrics.RefusedWithoutEDNS, 1)
+		response = Response{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused}}
+		logMessage = q.Type.String() + " " + q.Name.String() + " ? Refused (no EDNS)"
+	} else if x.MaxLabels > 0 && int(labelCount(q.Name.String())) > x.MaxLabels {
+		// deep names, e.g. "a.a.a.…", are a staple of random-subdomain attacks
+		atomic.AddInt64(&x.Metrics.RefusedTooManyLabels, 1)
+		response = Response{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeRefused}}
+		logMessage = q.Type.String() + " " + q.Name.String() + fmt.Sprintf(" ? Refused (%d labels)", labelCount(q.Name.String()))
+	} else if response, logMessage, err = x.processQuestionWithin(q, srcAddr, clientSubnet(queryOPT), transport); err != nil {
 		return nil, "", err
 	}
+	if name := q.Name.String(); x.redactedName(name) != name {
+		logMessage = strings.Replace(logMessage, name, x.redactedName(name), 1)
+	}
+	if x.DNSSEC != nil && q.Class == dnsmessage.ClassINET {
+		if response, err = x.signDenial(q, srcAddr, response); err != nil {
+			return nil, "", err
+		}
+	}
 	response.Header.ID = queryHeader.ID
 	response.Header.RecursionDesired = queryHeader.RecursionDesired
-	x.Metrics.Queries++
+	atomic.AddInt64(&x.Metrics.Queries, 1)
 
 	b := dnsmessage.NewBuilder(nil, response.Header)
 	b.EnableCompression()
@@ -385,95 +985,550 @@ func (x *Xip) QueryResponse(queryBytes []byte, srcAddr net.IP) (responseBytes []
 			return nil, "", err
 		}
 	}
+	if x.ExtendedDNSErrors && queryOPT != nil {
+		if err = buildOPT(&b, response.EDE); err != nil {
+			return nil, "", err
+		}
+	}
 	if responseBytes, err = b.Finish(); err != nil {
 		return nil, "", err
 	}
+	if transport == TransportUDP && len(responseBytes) > maxUDPResponse(queryOPT, udpSize) {
+		// e.g. "metrics.status.sslip.io", lest it overflow the querier's buffer or amplify an attack
+		response.Header.Truncated = true
+		if responseBytes, err = x.truncatedResponse(response, q, queryOPT); err != nil {
+			return nil, "", err
+		}
+		logMessage += " (truncated)"
+	}
+	if x.DebugWire {
+		logMessage += " query: " + hex.EncodeToString(queryBytes) + " response: " + hex.EncodeToString(responseBytes)
+	}
+	switch x.LogLevel {
+	case LogLevelErrors:
+		logMessage = ""
+	case LogLevelAnomalies:
+		if response.Header.RCode == dnsmessage.RCodeSuccess && !response.Header.Truncated && !x.blocklist(q.Name.String()) {
+			logMessage = ""
+		}
+	}
 	return responseBytes, logMessage, nil
 }
 
-func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response Response, logMessage string, err error) {
-	logMessage = q.Type.String() + " " + q.Name.String() + " ? "
-	response = Response{
-		Header: dnsmessage.Header{
-			ID:                 0, // this will later be replaced with query.ID
-			Response:           true,
-			OpCode:             0,
-			Authoritative:      true, // We're able to white label domains by always being authoritative
-			Truncated:          false,
-			RecursionDesired:   false,                   // this will later be replaced with query.RecursionDesired
-			RecursionAvailable: false,                   // We are not recursing servers, so recursion is never available. Prevents DDOS
-			RCode:              dnsmessage.RCodeSuccess, // assume success, may be replaced later
-		},
+// FloodCacheSize is the most sources the flood cache tracks; past it, we
+// answer the new sources' queries in full until their entries age out
+const FloodCacheSize = 10000
+
+// floodEntry is a source's last answered query (minus its ID), when, and
+// the response & log message
+type floodEntry struct {
+	query      string
+	answered   time.Time
+	response   []byte
+	logMessage string
+}
+
+// flushFloodCache forgets the cached answers, e.g. once they may be stale
+func (x *Xip) flushFloodCache() {
+	x.floodMutex.Lock()
+	defer x.floodMutex.Unlock()
+	x.floodCache = nil
+}
+
+// kvQuery returns true if the query's question is a `k-v.io` name
+func kvQuery(queryBytes []byte) bool {
+	var p dnsmessage.Parser
+	if _, err := p.Start(queryBytes); err != nil {
+		return false
 	}
-	if IsAcmeChallenge(q.Name.String()) && !x.blocklist(q.Name.String()) {
-		// thanks, @NormanR
-		// delegate everything to its stripped (remove "_acme-challenge.") address, e.g.
-		// dig _acme-challenge.127-0-0-1.sslip.io mx → NS 127-0-0-1.sslip.io
-		response.Header.Authoritative = false // we're delegating, so we're not authoritative
-		return x.NSResponse(q.Name, response, logMessage)
+	q, err := p.Question()
+	if err != nil {
+		return false
 	}
-	switch q.Type {
-	case dnsmessage.TypeA:
-		{
-			return x.nameToAwithBlocklist(q, response, logMessage)
+	name := strings.ToLower(q.Name.String())
+	return name == KVZone || strings.HasSuffix(name, "."+KVZone)
+}
+
+// floodCachedResponse answers the query from the flood cache if the source
+// sent the same query (ignoring the ID) less than FloodInterval after the
+// one we last answered in full; the response carries the query's ID. If not,
+// it answers the query in full & caches the answer. The cache spares e.g.
+// retry storms, whose identical queries would otherwise each be processed in
+// full.
+func (x *Xip) floodCachedResponse(transport string, queryBytes []byte, srcAddr net.IP) (responseBytes []byte, logMessage string, err error) {
+	source := transport + " " + srcAddr.String()
+	query := string(queryBytes[2:])
+	x.floodMutex.Lock()
+	entry, ok := x.floodCache[source]
+	x.floodMutex.Unlock()
+	if ok && entry.query == query && time.Since(entry.answered) < x.FloodInterval {
+		atomic.AddInt64(&x.Metrics.Queries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredFromFloodCache, 1)
+		responseBytes = append([]byte{queryBytes[0], queryBytes[1]}, entry.response[2:]...)
+		if entry.logMessage != "" {
+			logMessage = entry.logMessage + " (flood cache)"
 		}
-	case dnsmessage.TypeAAAA:
-		{
-			return x.nameToAAAAwithBlocklist(q, response, logMessage)
+		return responseBytes, logMessage, nil
+	}
+	if responseBytes, logMessage, err = x.answerQuery(transport, queryBytes, srcAddr); err != nil {
+		return nil, "", err
+	}
+	x.floodMutex.Lock()
+	defer x.floodMutex.Unlock()
+	if x.floodCache == nil {
+		x.floodCache = map[string]floodEntry{}
+	}
+	if _, ok = x.floodCache[source]; !ok && len(x.floodCache) >= FloodCacheSize {
+		for staleSource, staleEntry := range x.floodCache {
+			if time.Since(staleEntry.answered) >= x.FloodInterval {
+				delete(x.floodCache, staleSource)
+			}
 		}
-	case dnsmessage.TypeALL:
-		{
-			// We don't implement type ANY, so return "NotImplemented" like CloudFlare (1.1.1.1)
-			// https://blog.cloudflare.com/rfc8482-saying-goodbye-to-any/
-			// Google (8.8.8.8) returns every record they can find (A, AAAA, SOA, NS, MX, ...).
-			response.Header.RCode = dnsmessage.RCodeNotImplemented
-			return response, logMessage + "NotImplemented", nil
+		if len(x.floodCache) >= FloodCacheSize {
+			return responseBytes, logMessage, nil
 		}
-	case dnsmessage.TypeCNAME:
-		{
-			// If there is a CNAME, there can only be 1, and only from Customizations
-			var cname *dnsmessage.CNAMEResource
-			cname = CNAMEResource(q.Name.String())
-			if cname == nil {
-				// No Answers, only 1 Authorities
-				soaHeader, soaResource := SOAAuthority(q.Name)
-				response.Authorities = append(response.Authorities,
-					func(b *dnsmessage.Builder) error {
-						if err = b.SOAResource(soaHeader, soaResource); err != nil {
-							return err
-						}
-						return nil
-					})
-				return response, logMessage + "nil, SOA " + soaLogMessage(soaResource), nil
-			}
-			x.Metrics.AnsweredQueries++
-			response.Answers = append(response.Answers,
-				// 1 CNAME record, via Customizations
-				func(b *dnsmessage.Builder) error {
-					err = b.CNAMEResource(dnsmessage.ResourceHeader{
-						Name:   q.Name,
-						Type:   dnsmessage.TypeCNAME,
-						Class:  dnsmessage.ClassINET,
-						TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
-						Length: 0,
-					}, *cname)
-					if err != nil {
-						return err
-					}
-					return nil
-				})
-			return response, logMessage + cname.CNAME.String(), nil
+	}
+	x.floodCache[source] = floodEntry{query: query, answered: time.Now(), response: responseBytes, logMessage: logMessage}
+	return responseBytes, logMessage, nil
+}
+
+// processQuestionWithin is processQuestion, but if it takes longer than the
+// QueryTimeout, we cancel its context and answer SERVFAIL rather than keep
+// the querier waiting. The late processQuestion runs on, and its answer is
+// discarded; its etcd calls fail, and it doesn't write to the builtin
+// key-value store (puts, deletes, DHCP leases), lest a querier told SERVFAIL
+// find its write stored after all. It may still bump the (atomic) Metrics
+func (x *Xip) processQuestionWithin(q dnsmessage.Question, srcAddr net.IP, ecs *net.IPNet, transport string) (Response, string, error) {
+	if x.QueryTimeout <= 0 {
+		return x.processQuestion(context.Background(), q, srcAddr, ecs, transport)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), x.QueryTimeout)
+	defer cancel()
+	type result struct {
+		response   Response
+		logMessage string
+		err        error
+	}
+	results := make(chan result, 1) // buffered, lest a late processQuestion block forever
+	go func() {
+		response, logMessage, err := x.processQuestion(ctx, q, srcAddr, ecs, transport)
+		results <- result{response, logMessage, err}
+	}()
+	select {
+	case r := <-results:
+		return r.response, r.logMessage, r.err
+	case <-ctx.Done():
+		atomic.AddInt64(&x.Metrics.TimedOutQueries, 1)
+		return Response{
+			Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure},
+		}, q.Type.String() + " " + q.Name.String() + " ? ServFail (timed out)", nil
+	}
+}
+
+// QueryResponseResult is QueryResponse, but it also returns a QueryResult
+// summarizing the query & response
+func (x *Xip) QueryResponseResult(queryBytes []byte, srcAddr net.IP) (responseBytes []byte, result QueryResult, logMessage string, err error) {
+	if responseBytes, logMessage, err = x.QueryResponse(queryBytes, srcAddr); err != nil {
+		return nil, result, "", err
+	}
+	var response dnsmessage.Message
+	if err = response.Unpack(responseBytes); err != nil {
+		return nil, result, "", err
+	}
+	result = QueryResult{SrcIP: srcAddr, RCode: response.RCode}
+	if len(response.Questions) > 0 {
+		result.QType = response.Questions[0].Type
+		result.QName = response.Questions[0].Name.String()
+	}
+	for _, answer := range response.Answers {
+		result.Answers = append(result.Answers, dohJSONRecord(answer).Data)
+	}
+	return responseBytes, result, logMessage, nil
+}
+
+// QueryResponseVia is QueryResponse, but it also counts the query towards
+// its transport's Metrics (e.g. QueriesTCP), even if we can't parse it. If
+// there's a QuerySemaphore, the query waits for a slot, and if none frees up
+// in time, we drop it (ErrQueryDropped) rather than pile up goroutines.
+func (x *Xip) QueryResponseVia(transport string, queryBytes []byte, srcAddr net.IP) (responseBytes []byte, logMessage string, err error) {
+	if x.QuerySemaphore != nil {
+		select {
+		case x.QuerySemaphore <- struct{}{}:
+			defer func() { <-x.QuerySemaphore }()
+		case <-time.After(QuerySemaphoreWait):
+			atomic.AddInt64(&x.Metrics.DroppedQueries, 1)
+			return nil, "", ErrQueryDropped
+		}
+	}
+	switch transport {
+	case TransportUDP:
+		atomic.AddInt64(&x.Metrics.QueriesUDP, 1)
+	case TransportTCP:
+		atomic.AddInt64(&x.Metrics.QueriesTCP, 1)
+	case TransportDoH:
+		atomic.AddInt64(&x.Metrics.QueriesDoH, 1)
+	}
+	return x.queryResponse(transport, queryBytes, srcAddr)
+}
+
+// SelfTest runs a few queries through the query path and returns an error if
+// any of the answers aren't what we expect. Run it before going live to catch
+// a broken build or deployment. The queries carry EDNS, lest RequireEDNS
+// refuse them, and are exempt from the Allowlist & the QueryPolicy; like any
+// others, they count towards the Metrics.
+func (x *Xip) SelfTest() error {
+	for _, check := range []struct {
+		name     string
+		qType    dnsmessage.Type
+		expected string // in presentation format, e.g. `"0.0.0"` for TXT
+	}{
+		{"127-0-0-1.sslip.io.", dnsmessage.TypeA, "127.0.0.1"},
+		{"--1.sslip.io.", dnsmessage.TypeAAAA, "::1"},
+		{"version.status.sslip.io.", dnsmessage.TypeTXT, strconv.Quote(VersionSemantic)},
+	} {
+		if check.qType == dnsmessage.TypeTXT && x.withheldTXT(check.name) {
+			continue // e.g. DisableVersionTXT
+		}
+		q := dnsmessage.Question{Name: dnsmessage.MustNewName(check.name), Type: check.qType, Class: dnsmessage.ClassINET}
+		response, err := x.selfTestQuery(q)
+		if err != nil {
+			return fmt.Errorf("self-test: %s %s: %w", check.qType, check.name, err)
+		}
+		var answers []string
+		for _, answer := range response.Answers {
+			answers = append(answers, dohJSONRecord(answer).Data)
+		}
+		if len(answers) == 0 || answers[0] != check.expected {
+			return fmt.Errorf(`self-test: %s %s: expected [%s], got [%s]`, check.qType, check.name, check.expected, strings.Join(answers, ", "))
+		}
+	}
+	return nil
+}
+
+// selfTestQuery sends the question, with EDNS, through the query path as a
+// SelfTest() query, and returns the unpacked response
+func (x *Xip) selfTestQuery(q dnsmessage.Question) (response dnsmessage.Message, err error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true})
+	if err = b.StartQuestions(); err != nil {
+		return response, err
+	}
+	if err = b.Question(q); err != nil {
+		return response, err
+	}
+	if err = b.StartAdditionals(); err != nil {
+		return response, err
+	}
+	if err = buildOPT(&b, nil); err != nil {
+		return response, err
+	}
+	queryBytes, err := b.Finish()
+	if err != nil {
+		return response, err
+	}
+	responseBytes, _, err := x.queryResponse(transportSelfTest, queryBytes, net.IPv6loopback)
+	if err != nil {
+		return response, err
+	}
+	err = response.Unpack(responseBytes)
+	return response, err
+}
+
+// compressedQuestion returns true if the query's (first) question's name has
+// a compression pointer. dnsmessage follows it, but there's no earlier name
+// for a question's to point to, so it's a crafted query, e.g. to confuse
+// parsers
+func compressedQuestion(queryBytes []byte) bool {
+	for i := 12; i < len(queryBytes); i += int(queryBytes[i]) + 1 { // the question follows the 12-byte header
+		switch {
+		case queryBytes[i] == 0:
+			return false
+		case queryBytes[i]&0xC0 != 0: // 0xC0 is a pointer; 0x40 & 0x80 are obsolete or reserved label types
+			return true
+		}
+	}
+	return false
+}
+
+// formErrResponse returns a header-only FORMERR response, for a query whose
+// question we can't parse: no question to echo, only the ID & the RD bit
+func formErrResponse(queryHeader dnsmessage.Header) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               queryHeader.ID,
+		Response:         true,
+		RecursionDesired: queryHeader.RecursionDesired,
+		RCode:            dnsmessage.RCodeFormatError,
+	})
+	return b.Finish()
+}
+
+// ednsOPT returns the query's OPT record (EDNS, RFC 6891) & the UDP payload
+// size it advertises, or nil if there isn't one (or if we can't parse it).
+// The Parser must be positioned after the first Question.
+func ednsOPT(p *dnsmessage.Parser) (*dnsmessage.OPTResource, uint16) {
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return nil, 0
+	}
+	for {
+		header, err := p.AdditionalHeader()
+		if err != nil {
+			return nil, 0 // includes dnsmessage.ErrSectionDone
+		}
+		if header.Type != dnsmessage.TypeOPT {
+			if p.SkipAdditional() != nil {
+				return nil, 0
+			}
+			continue
+		}
+		opt, err := p.OPTResource()
+		if err != nil {
+			return nil, 0
+		}
+		return &opt, uint16(header.Class) // RFC 6891 section 6.1.2: the CLASS is the UDP payload size
+	}
+}
+
+// maxUDPResponse returns the most bytes we answer a UDP query with: 512 (RFC
+// 1035 section 4.2.1), or, if the query has EDNS, the UDP payload size it
+// advertises, but no more than the ednsUDPSize we advertise
+func maxUDPResponse(queryOPT *dnsmessage.OPTResource, udpSize uint16) int {
+	switch {
+	case queryOPT == nil || udpSize <= 512:
+		return 512
+	case udpSize > ednsUDPSize:
+		return ednsUDPSize
+	}
+	return int(udpSize)
+}
+
+// truncatedResponse returns the header (with TC set) & the question, but
+// none of the records, of a response too big for UDP; the querier retries
+// over TCP (RFC 7766 section 5)
+func (x *Xip) truncatedResponse(response Response, q dnsmessage.Question, queryOPT *dnsmessage.OPTResource) ([]byte, error) {
+	response.Header.Truncated = true
+	b := dnsmessage.NewBuilder(nil, response.Header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if x.ExtendedDNSErrors && queryOPT != nil {
+		if err := buildOPT(&b, response.EDE); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// clientSubnet returns the EDNS Client Subnet (RFC 7871) of the query's OPT
+// record, or nil if there isn't one (or if it's malformed)
+func clientSubnet(opt *dnsmessage.OPTResource) *net.IPNet {
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Options {
+		// https://www.rfc-editor.org/rfc/rfc7871#section-6: FAMILY (2 bytes),
+		// SOURCE PREFIX-LENGTH (1), SCOPE PREFIX-LENGTH (1), ADDRESS (truncated)
+		if option.Code != 8 || len(option.Data) < 4 {
+			continue
+		}
+		var ip net.IP
+		switch binary.BigEndian.Uint16(option.Data) {
+		case 1:
+			ip = make(net.IP, net.IPv4len)
+		case 2:
+			ip = make(net.IP, net.IPv6len)
+		default:
+			return nil
+		}
+		sourcePrefixLength := int(option.Data[2])
+		address := option.Data[4:]
+		if sourcePrefixLength > len(ip)*8 || len(address) != (sourcePrefixLength+7)/8 {
+			return nil
+		}
+		copy(ip, address)
+		mask := net.CIDRMask(sourcePrefixLength, len(ip)*8)
+		return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return nil
+}
+
+// buildOPT adds our OPT record to the response's additional section, including
+// the Extended DNS Error, if any
+func buildOPT(b *dnsmessage.Builder, ede *ExtendedDNSError) error {
+	var optHeader dnsmessage.ResourceHeader
+	if err := optHeader.SetEDNS0(ednsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return err
+	}
+	var opt dnsmessage.OPTResource
+	if ede != nil {
+		opt.Options = append(opt.Options, dnsmessage.Option{
+			Code: 15, // EDE, https://www.rfc-editor.org/rfc/rfc8914.html#section-2
+			Data: append([]byte{byte(ede.InfoCode >> 8), byte(ede.InfoCode)}, ede.ExtraText...),
+		})
+	}
+	return b.OPTResource(optHeader, opt)
+}
+
+func (x *Xip) processQuestion(ctx context.Context, q dnsmessage.Question, srcAddr net.IP, ecs *net.IPNet, transport string) (response Response, logMessage string, err error) {
+	logMessage = q.Type.String() + " " + q.Name.String() + " ? "
+	response = Response{
+		Header: dnsmessage.Header{
+			ID:                 0, // this will later be replaced with query.ID
+			Response:           true,
+			OpCode:             0,
+			Authoritative:      true, // We're able to white label domains by always being authoritative
+			Truncated:          false,
+			RecursionDesired:   false,                   // this will later be replaced with query.RecursionDesired
+			RecursionAvailable: false,                   // We are not recursing servers, so recursion is never available. Prevents DDOS
+			RCode:              dnsmessage.RCodeSuccess, // assume success, may be replaced later
+		},
+		Full:     x.FullerOverTCP && transport == TransportTCP, // TCP queries can't be spoofed for amplification
+		SelfTest: transport == transportSelfTest,
+	}
+	if q.Name.String() == "." {
+		// The root (".") is a common probe, e.g. "dig . ns". We're not authoritative
+		// for the root, and we don't want to be mistaken for a root server, so refuse
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+		response.EDE = &ExtendedDNSError{InfoCode: EDENotAuthoritative, ExtraText: "root"}
+		return response, logMessage + "Refused", nil
+	}
+	if q.Class == dnsmessage.ClassANY || q.Class == ClassNONE {
+		// QCLASS ANY & NONE are meta-classes; no customization can opt into them,
+		// and we mustn't mistake them for INET
+		atomic.AddInt64(&x.Metrics.AnsweredUnsupportedClass, 1)
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+		response.EDE = &ExtendedDNSError{InfoCode: EDENotSupported, ExtraText: q.Class.String()}
+		return response, logMessage + q.Class.String() + " Refused", nil
+	}
+	if q.Class != dnsmessage.ClassINET {
+		return x.nonINETResponse(q, srcAddr, response, logMessage)
+	}
+	if x.AllowlistOnly && !response.SelfTest && !x.allowlisted(q.Name.String()) {
+		atomic.AddInt64(&x.Metrics.DeniedByAllowlist, 1)
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+		response.EDE = &ExtendedDNSError{InfoCode: EDEProhibited, ExtraText: "allowlist"}
+		return response, logMessage + "Refused (allowlist)", nil
+	}
+	// As an authoritative-only server, we answer the names in our zones
+	// authoritatively whether or not the query desires recursion (RD), and never
+	// offer it (RA=0). If RefuseOutOfZone, we refuse the names outside our
+	// zones, again whether or not RD is set, rather than white-label them
+	if x.RefuseOutOfZone && !x.inZone(q.Name.String()) {
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+		response.EDE = &ExtendedDNSError{InfoCode: EDENotAuthoritative, ExtraText: "out of zone"}
+		return response, logMessage + "Refused (out of zone)", nil
+	}
+	if subdomain := x.delegate(q.Name.String()); subdomain != "" {
+		// we've delegated it, so the delegate's nameservers answer, whatever the type
+		return x.referralResponse(dnsmessage.MustNewName(subdomain), response, logMessage)
+	}
+	if IsAcmeChallenge(q.Name.String()) && !x.blocklist(q.Name.String()) && !x.isAcmeChallengeFromKV(q) {
+		// thanks, @NormanR
+		// delegate everything to its stripped (remove "_acme-challenge.") address, e.g.
+		// dig _acme-challenge.127-0-0-1.sslip.io mx → NS 127-0-0-1.sslip.io
+		response.Header.Authoritative = false // we're delegating, so we're not authoritative
+		return x.NSResponse(q.Name, response, logMessage)
+	}
+	if x.DNSSEC != nil && isDNSSECType(q.Type) {
+		return x.dnssecResponse(q, response, logMessage)
+	}
+	if x.isDDRQuery(q) {
+		return x.ddrResponse(q, response, logMessage)
+	}
+	for _, unsupportedType := range x.UnsupportedTypes {
+		if q.Type == unsupportedType {
+			// NODATA would claim the name merely has no such record
+			response.Header.RCode = dnsmessage.RCodeNotImplemented
+			response.EDE = &ExtendedDNSError{InfoCode: EDENotSupported, ExtraText: "unsupported type"}
+			return response, logMessage + "NotImplemented", nil
+		}
+	}
+	if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA {
+		if ip := x.kvPoolIP(ctx, q); ip != nil {
+			return x.kvPoolResponse(q, ip, response, logMessage)
+		}
+		if ip := x.kvDHCPIP(ctx, q); ip != nil {
+			return x.kvAddressResponse(q, ip, response, logMessage)
+		}
+	}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		{
+			return x.nameToAwithBlocklist(q, srcAddr, ecs, response, logMessage)
+		}
+	case dnsmessage.TypeAAAA:
+		{
+			return x.nameToAAAAwithBlocklist(q, srcAddr, ecs, response, logMessage)
+		}
+	case dnsmessage.TypeALL:
+		{
+			if x.AnyMode == AnyModeHINFO {
+				// https://www.rfc-editor.org/rfc/rfc8482.html#section-4.2
+				atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+				response.Answers = append(response.Answers,
+					func(b *dnsmessage.Builder) error {
+						return b.UnknownResource(dnsmessage.ResourceHeader{
+							Name:  q.Name,
+							Type:  dnsmessage.TypeHINFO,
+							Class: dnsmessage.ClassINET,
+							TTL:   3600,
+						}, dnsmessage.UnknownResource{
+							Type: dnsmessage.TypeHINFO,
+							Data: hinfoRFC8482,
+						})
+					})
+				return response, logMessage + `HINFO "RFC8482" ""`, nil
+			}
+			// We don't implement type ANY, so return "NotImplemented" like CloudFlare (1.1.1.1)
+			// https://blog.cloudflare.com/rfc8482-saying-goodbye-to-any/
+			// Google (8.8.8.8) returns every record they can find (A, AAAA, SOA, NS, MX, ...).
+			response.Header.RCode = dnsmessage.RCodeNotImplemented
+			response.EDE = &ExtendedDNSError{InfoCode: EDENotSupported, ExtraText: "RFC 8482"}
+			return response, logMessage + "NotImplemented", nil
+		}
+	case dnsmessage.TypeCNAME:
+		{
+			// If there is a CNAME, there can only be 1, and only from Customizations (or DefaultCNAME)
+			var cname *dnsmessage.CNAMEResource
+			cname = CNAMEResource(q.Name.String())
+			if cname == nil {
+				cname = x.defaultCNAME(q.Name.String())
+			}
+			if cname == nil {
+				// No Answers, only 1 Authorities
+				soaHeader, soaResource := x.SOAAuthority(q.Name)
+				response.Authorities = append(response.Authorities,
+					func(b *dnsmessage.Builder) error {
+						if err = b.SOAResource(soaHeader, soaResource); err != nil {
+							return err
+						}
+						return nil
+					})
+				return response, logMessage + "nil, SOA " + soaLogMessage(soaResource), nil
+			}
+			atomic.AddInt64(&x.Metrics.AnsweredCNAMEQueries, 1)
+			return x.cnameResponse(q, *cname, response, logMessage)
 		}
 	case dnsmessage.TypeMX:
 		{
-			mailExchangers := MXResources(q.Name.String())
+			mailExchangers := uniqueMXResources(MXResources(q.Name.String()))
 			var logMessages []string
 
 			// We can be sure that len(mailExchangers) > 1, but we check anyway
 			if len(mailExchangers) == 0 {
 				return response, "", errors.New("no MX records, but there should be one")
 			}
-			x.Metrics.AnsweredQueries++
+			atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+			atomic.AddInt64(&x.Metrics.AnsweredMXQueries, 1)
 			response.Answers = append(response.Answers,
 				// 1 or more A records; A records > 1 only available via Customizations
 				func(b *dnsmessage.Builder) error {
@@ -498,12 +1553,14 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 		}
 	case dnsmessage.TypeNS:
 		{
+			atomic.AddInt64(&x.Metrics.AnsweredNSQueries, 1)
 			return x.NSResponse(q.Name, response, logMessage)
 		}
 	case dnsmessage.TypeSOA:
 		{
-			x.Metrics.AnsweredQueries++
-			soaResource := SOAResource(q.Name)
+			atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+			atomic.AddInt64(&x.Metrics.AnsweredSOAQueries, 1)
+			soaResource := x.SOAResource(q.Name)
 			response.Answers = append(response.Answers,
 				func(b *dnsmessage.Builder) error {
 					err = b.SOAResource(dnsmessage.ResourceHeader{
@@ -525,7 +1582,7 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 			// if it's an "_acme-challenge." TXT, we return no answer but an NS authority & not authoritative
 			// if it's customized records, we return them in the Answers
 			// otherwise we return no Answers and Authorities SOA
-			if IsAcmeChallenge(q.Name.String()) {
+			if IsAcmeChallenge(q.Name.String()) && !x.isAcmeChallengeFromKV(q) {
 				// No Answers, Not Authoritative, Authorities contain NS records
 				response.Header.Authoritative = false
 				nameServers := x.NSResources(q.Name.String())
@@ -551,12 +1608,17 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 				return response, logMessage + "nil, NS " + strings.Join(logMessages, ", "), nil
 			}
 			var txts []dnsmessage.TXTResource
-			txts, err = x.TXTResources(q.Name.String(), srcAddr)
+			if x.isAcmeChallengeFromKV(q) {
+				txts, err = x.kvErrorTXTResources(x.getKv(ctx, acmeChallengeKey(q.Name.String())))
+			} else {
+				txts, err = x.txtResources(ctx, q.Name.String(), srcAddr, ecs)
+			}
 			if err != nil {
 				return response, "", err
 			}
+			txts = txts[:x.answerCap(len(txts), &response)]
 			if len(txts) > 0 {
-				x.Metrics.AnsweredQueries++
+				atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
 			}
 			response.Answers = append(response.Answers,
 				// 1 or more TXT records via Customizations
@@ -586,17 +1648,17 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 				logMessageTXTss = append(logMessageTXTss, `["`+strings.Join(logMessageTXTs, `", "`)+`"]`)
 			}
 			if len(logMessageTXTss) == 0 {
-				return response, logMessage + "nil, SOA " + soaLogMessage(SOAResource(q.Name)), nil
+				return response, logMessage + "nil, SOA " + soaLogMessage(x.SOAResource(q.Name)), nil
 			}
 			return response, logMessage + strings.Join(logMessageTXTss, ", "), nil
 		}
 	case dnsmessage.TypePTR:
 		{
 			var ptr *dnsmessage.PTRResource
-			ptr = x.PTRResource([]byte(q.Name.String()))
+			ptr = x.ptrResource(ctx, []byte(q.Name.String()))
 			if ptr == nil {
 				// No Answers, only 1 Authorities
-				soaHeader, soaResource := SOAAuthority(dnsmessage.MustNewName("sslip.io."))
+				soaHeader, soaResource := x.SOAAuthority(q.Name) // the reverse zone's, e.g. "in-addr.arpa."
 				response.Authorities = append(response.Authorities,
 					func(b *dnsmessage.Builder) error {
 						if err = b.SOAResource(soaHeader, soaResource); err != nil {
@@ -606,7 +1668,7 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 					})
 				return response, logMessage + "nil, SOA " + soaLogMessage(soaResource), nil
 			}
-			//x.Metrics.AnsweredQueries++
+			//atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
 			response.Answers = append(response.Answers,
 				// 1 CNAME record, via Customizations
 				func(b *dnsmessage.Builder) error {
@@ -626,10 +1688,13 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 		}
 	default:
 		{
+			if rdatas := RawResources(q.Name.String(), q.Type); len(rdatas) > 0 {
+				return x.rawResponse(q, rdatas, response, logMessage)
+			}
 			// default is the same case as an A/AAAA record which is not found,
 			// i.e. we return no answers, but we return an authority section
 			// No Answers, only 1 Authorities
-			soaHeader, soaResource := SOAAuthority(q.Name)
+			soaHeader, soaResource := x.SOAAuthority(q.Name)
 			response.Authorities = append(response.Authorities,
 				func(b *dnsmessage.Builder) error {
 					if err = b.SOAResource(soaHeader, soaResource); err != nil {
@@ -646,13 +1711,13 @@ func (x *Xip) processQuestion(q dnsmessage.Question, srcAddr net.IP) (response R
 // (whether it's an "_acme-challenge." domain or not). Either way, it supplies the Additionals
 // (IP addresses of the nameservers).
 func (x *Xip) NSResponse(name dnsmessage.Name, response Response, logMessage string) (Response, string, error) {
-	nameServers := x.NSResources(name.String())
+	nameServers := uniqueNSResources(x.NSResources(name.String()))
 	var logMessages []string
 	if response.Header.Authoritative {
 		// we're authoritative, so we reply with the answers
 		response.Answers = append(response.Answers,
 			func(b *dnsmessage.Builder) error {
-				return buildNSRecords(b, name, x.NameServers)
+				return buildNSRecords(b, name, uniqueNSResources(x.nameServers(name.String())))
 			})
 	} else {
 		// we're NOT authoritative, so we reply who is authoritative
@@ -662,40 +1727,67 @@ func (x *Xip) NSResponse(name dnsmessage.Name, response Response, logMessage str
 			})
 		logMessage += "nil, NS " // we're not supplying an answer; we're supplying the NS record that's authoritative
 	}
-	response.Additionals = append(response.Additionals,
+	glueNameServers := nameServers
+	if x.FullerOverTCP && !response.Full && len(glueNameServers) > 1 {
+		glueNameServers = glueNameServers[:1] // the rest of the glue only over TCP
+	}
+	response.Additionals = append(response.Additionals, x.glue(glueNameServers))
+	for _, nameServer := range nameServers {
+		logMessages = append(logMessages, nameServer.NS.String())
+	}
+	return response, logMessage + strings.Join(logMessages, ", "), nil
+}
+
+// referralResponse refers the query to the delegated subdomain's
+// nameservers (RFC 1034 section 4.3.2): not authoritative, no Answers, the
+// nameservers in the Authorities, and their glue in the Additionals
+func (x *Xip) referralResponse(subdomain dnsmessage.Name, response Response, logMessage string) (Response, string, error) {
+	nameServers := uniqueNSResources(x.Delegates[subdomain.String()])
+	response.Header.Authoritative = false
+	response.Authorities = append(response.Authorities,
 		func(b *dnsmessage.Builder) error {
-			for _, nameServer := range nameServers {
-				for _, aResource := range NameToA(nameServer.NS.String()) {
-					err := b.AResource(dnsmessage.ResourceHeader{
-						Name:   nameServer.NS,
-						Type:   dnsmessage.TypeA,
-						Class:  dnsmessage.ClassINET,
-						TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
-						Length: 0,
-					}, aResource)
-					if err != nil {
-						return err
-					}
-				}
-				for _, aaaaResource := range NameToAAAA(nameServer.NS.String()) {
-					err := b.AAAAResource(dnsmessage.ResourceHeader{
-						Name:   nameServer.NS,
-						Type:   dnsmessage.TypeAAAA,
-						Class:  dnsmessage.ClassINET,
-						TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
-						Length: 0,
-					}, aaaaResource)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			return nil
+			return buildNSRecords(b, subdomain, nameServers)
 		})
+	response.Additionals = append(response.Additionals, x.glue(nameServers))
+	var logMessages []string
 	for _, nameServer := range nameServers {
 		logMessages = append(logMessages, nameServer.NS.String())
 	}
-	return response, logMessage + strings.Join(logMessages, ", "), nil
+	return response, logMessage + "nil, NS " + strings.Join(logMessages, ", "), nil
+}
+
+// glue returns the builder of the nameservers' A & AAAA records, if we have
+// any, e.g. from -addresses
+func (x *Xip) glue(nameServers []dnsmessage.NSResource) func(*dnsmessage.Builder) error {
+	return func(b *dnsmessage.Builder) error {
+		for _, nameServer := range nameServers {
+			for _, aResource := range uniqueAResources(x.AResources(nameServer.NS.String(), nil)) {
+				err := b.AResource(dnsmessage.ResourceHeader{
+					Name:   nameServer.NS,
+					Type:   dnsmessage.TypeA,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					Length: 0,
+				}, aResource)
+				if err != nil {
+					return err
+				}
+			}
+			for _, aaaaResource := range uniqueAAAAResources(x.AAAAResources(nameServer.NS.String(), nil)) {
+				err := b.AAAAResource(dnsmessage.ResourceHeader{
+					Name:   nameServer.NS,
+					Type:   dnsmessage.TypeAAAA,
+					Class:  dnsmessage.ClassINET,
+					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					Length: 0,
+				}, aaaaResource)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
 }
 
 func buildNSRecords(b *dnsmessage.Builder, name dnsmessage.Name, nameServers []dnsmessage.NSResource) error {
@@ -714,64 +1806,485 @@ func buildNSRecords(b *dnsmessage.Builder, name dnsmessage.Name, nameServers []d
 	return nil
 }
 
-// NameToA returns an []AResource that matched the hostname; it returns an
-// array of zero-or-one records
-func NameToA(fqdnString string) []dnsmessage.AResource {
-	fqdn := []byte(fqdnString)
-	// is it a customized A record? If so, return early
-	if domain, ok := Customizations[strings.ToLower(fqdnString)]; ok && len(domain.A) > 0 {
-		return domain.A
+// AResources returns the A records of the hostname for the querier: the
+// customization's AFunc if it has one (e.g. GeoDNS-lite, failover),
+// otherwise NameToA (the customization's A records or the embedded IP)
+func (x *Xip) AResources(fqdnString string, srcAddr net.IP) []dnsmessage.AResource {
+	if domain, ok := customization(fqdnString); ok && domain.AFunc != nil {
+		return domain.AFunc(x, srcAddr)
 	}
-	for _, ipv4RE := range []*regexp.Regexp{ipv4REDashes, ipv4REDots} {
-		if ipv4RE.Match(fqdn) {
-			match := string(ipv4RE.FindSubmatch(fqdn)[2])
-			match = strings.Replace(match, "-", ".", -1)
-			ipv4address := net.ParseIP(match).To4()
-			// We shouldn't reach here because `match` should always be valid, but we're not optimists
-			if ipv4address == nil {
-				// e.g. "ubuntu20.04.235.249.181-notify.sslip.io."
-				log.Printf("----> Should be valid A but isn't: %s\n", fqdn) // TODO: delete this
+	if x.reserved(fqdnString) || x.unservedLocal(fqdnString) || reverseName(fqdnString) {
+		return []dnsmessage.AResource{}
+	}
+	if subdomain, _, ok := x.zoneSubdomain(fqdnString); ok && x.AllowBase36IP {
+		if match := base36RE.FindStringSubmatch(subdomain); match != nil {
+			ipv4, err := DecodeBase36IP(match[1])
+			if err != nil {
 				return []dnsmessage.AResource{}
 			}
-			return []dnsmessage.AResource{
-				{A: [4]byte{ipv4address[0], ipv4address[1], ipv4address[2], ipv4address[3]}},
-			}
+			var aResource dnsmessage.AResource
+			copy(aResource.A[:], ipv4)
+			return []dnsmessage.AResource{aResource}
 		}
 	}
-	return []dnsmessage.AResource{}
+	return nameToA(fqdnString, x.IPPositionStrict)
 }
 
-// NameToAAAA returns an []AAAAResource that matched the hostname
-func NameToAAAA(fqdnString string) []dnsmessage.AAAAResource {
-	fqdn := []byte(fqdnString)
-	// is it a customized AAAA record? If so, return early
-	if domain, ok := Customizations[strings.ToLower(fqdnString)]; ok && len(domain.AAAA) > 0 {
-		return domain.AAAA
-	}
-	if !ipv6RE.Match(fqdn) {
-		return []dnsmessage.AAAAResource{}
+// unservedLocal returns true if the hostname is under LocalZone, e.g.
+// "10-0-0-1.local", and it isn't customized, unless we're in the
+// TestLocalZone mode: it doesn't resolve to its embedded IP
+func (x *Xip) unservedLocal(fqdnString string) bool {
+	if x.TestLocalZone || !strings.HasSuffix(strings.ToLower(fqdnString), "."+LocalZone) {
+		return false
 	}
+	_, ok := customization(fqdnString)
+	return !ok
+}
 
-	ipv6RE.Longest()
-	match := string(ipv6RE.FindSubmatch(fqdn)[2])
-	match = strings.Replace(match, "-", ":", -1)
-	ipv16address := net.ParseIP(match).To16()
-	if ipv16address == nil {
-		// We shouldn't reach here because `match` should always be valid, but we're not optimists
-		log.Printf("----> Should be valid AAAA but isn't: %s\n", fqdn) // TODO: delete this
-		return []dnsmessage.AAAAResource{}
+// reserved returns true if the hostname's leftmost label is one of the
+// ReservedNames (e.g. "www" → "www.10-0-0-1.sslip.io") and it isn't
+// customized: it doesn't resolve to its embedded IP
+func (x *Xip) reserved(fqdnString string) bool {
+	if len(x.ReservedNames) == 0 {
+		return false
 	}
-
-	AAAAR := dnsmessage.AAAAResource{}
-	for i := range ipv16address {
-		AAAAR.AAAA[i] = ipv16address[i]
+	if _, ok := customization(fqdnString); ok {
+		return false // the customization's records are the reserved name's fixed records
 	}
-	return []dnsmessage.AAAAResource{AAAAR}
-}
-
+	leftmostLabel := strings.ToLower(strings.Split(fqdnString, ".")[0])
+	for _, reservedName := range x.ReservedNames {
+		if strings.ToLower(reservedName) == leftmostLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// DecodeBase36IP decodes a Base36 label, e.g. "1z141z3", to the IPv4 address
+// it encodes, e.g. 255.255.255.255. Labels that are longer than 7 characters,
+// aren't Base36, or overflow 32 bits are errors.
+func DecodeBase36IP(label string) (net.IP, error) {
+	if len(label) < 1 || len(label) > 7 {
+		return nil, fmt.Errorf(`Base36 IP "%s" must be 1-7 characters`, label)
+	}
+	n, err := strconv.ParseUint(label, 36, 64)
+	if err != nil {
+		return nil, fmt.Errorf(`Base36 IP "%s" isn't Base36`, label)
+	}
+	if n > math.MaxUint32 {
+		return nil, fmt.Errorf(`Base36 IP "%s" is greater than 255.255.255.255`, label)
+	}
+	ipv4 := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ipv4, uint32(n))
+	return ipv4, nil
+}
+
+// EncodeBase36IP encodes the IPv4 address in Base36, e.g. 127.0.0.1 →
+// "z8kflt"; it's the inverse of DecodeBase36IP
+func EncodeBase36IP(ip net.IP) string {
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip.To4())), 36)
+}
+
+// AAAAResources is AResources for AAAA records
+func (x *Xip) AAAAResources(fqdnString string, srcAddr net.IP) []dnsmessage.AAAAResource {
+	if domain, ok := customization(fqdnString); ok && domain.AAAAFunc != nil {
+		return domain.AAAAFunc(x, srcAddr)
+	}
+	if x.reserved(fqdnString) || x.unservedLocal(fqdnString) || reverseName(fqdnString) {
+		return []dnsmessage.AAAAResource{}
+	}
+	if subdomain, _, ok := x.zoneSubdomain(fqdnString); ok && x.SixToFour && sixToFourRE.MatchString(subdomain) {
+		return sixToFourAAAAResources(nameToA(fqdnString, x.IPPositionStrict))
+	}
+	return nameToAAAA(fqdnString, x.IPPositionStrict)
+}
+
+// sixToFourAAAAResources returns the IPv4 addresses' 6to4 addresses (RFC
+// 3056): 2002::/16 followed by the IPv4, e.g. 10.0.0.1 → 2002:a00:1::
+func sixToFourAAAAResources(aResources []dnsmessage.AResource) []dnsmessage.AAAAResource {
+	aaaaResources := []dnsmessage.AAAAResource{}
+	for _, aResource := range aResources {
+		var aaaaResource dnsmessage.AAAAResource
+		aaaaResource.AAAA[0], aaaaResource.AAAA[1] = 0x20, 0x02
+		copy(aaaaResource.AAAA[2:6], aResource.A[:])
+		aaaaResources = append(aaaaResources, aaaaResource)
+	}
+	return aaaaResources
+}
+
+// NameToA returns an []AResource that matched the hostname; it returns an
+// array of zero-or-one records. It doesn't call the customization's AFunc
+// (it has no querier); AResources does.
+func NameToA(fqdnString string) []dnsmessage.AResource {
+	return nameToA(fqdnString, false)
+}
+
+// nameToA is NameToA, but if ipPositionStrict, the IP must be the leading
+// label(s), e.g. "10-0-0-1.sslip.io" & "10.0.0.1.sslip.io" match, but
+// "foo.10-0-0-1.sslip.io" & "foo-10-0-0-1.sslip.io" don't
+func nameToA(fqdnString string, ipPositionStrict bool) []dnsmessage.AResource {
+	fqdn := []byte(fqdnString)
+	// is it a customized A record? If so, return early
+	if domain, ok := customization(fqdnString); ok && len(domain.A) > 0 {
+		return domain.A
+	}
+	loc, _ := matchIPv4(fqdn, ipPositionStrict)
+	if loc == nil {
+		return []dnsmessage.AResource{}
+	}
+	match := string(fqdn[loc[4]:loc[5]])
+	match = strings.Replace(match, "-", ".", -1)
+	ipv4address := net.ParseIP(match).To4()
+	// We shouldn't reach here because `match` should always be valid, but we're not optimists
+	if ipv4address == nil {
+		// e.g. "ubuntu20.04.235.249.181-notify.sslip.io."
+		return []dnsmessage.AResource{}
+	}
+	return []dnsmessage.AResource{
+		{A: [4]byte{ipv4address[0], ipv4address[1], ipv4address[2], ipv4address[3]}},
+	}
+}
+
+// matchIPv4 locates (FindSubmatchIndex) the hostname's embedded IPv4 and
+// returns which form matched: "dash" (e.g. "127-0-0-1"), which wins, or
+// "dot" (e.g. "127.0.0.1"); the loc is nil if there's none
+func matchIPv4(fqdn []byte, ipPositionStrict bool) (loc []int, form string) {
+	for _, ipv4RE := range []struct {
+		re   *regexp.Regexp
+		form string
+	}{{ipv4REDashes, "dash"}, {ipv4REDots, "dot"}} {
+		if ipv4RE.re.Match(fqdn) {
+			loc = ipv4RE.re.FindSubmatchIndex(fqdn)
+			if ipPositionStrict && !isLeading(fqdn, loc) {
+				continue
+			}
+			return loc, ipv4RE.form
+		}
+	}
+	return nil, ""
+}
+
+// NameToAAAA returns an []AAAAResource that matched the hostname. Like
+// NameToA, it doesn't call the customization's AAAAFunc; AAAAResources does.
+func NameToAAAA(fqdnString string) []dnsmessage.AAAAResource {
+	return nameToAAAA(fqdnString, false)
+}
+
+// nameToAAAA is NameToAAAA, but if ipPositionStrict, the IP must be the
+// leading label, e.g. "2001-db8--1.sslip.io" matches, but
+// "foo.2001-db8--1.sslip.io" doesn't
+func nameToAAAA(fqdnString string, ipPositionStrict bool) []dnsmessage.AAAAResource {
+	fqdn := []byte(fqdnString)
+	// is it a customized AAAA record? If so, return early
+	if domain, ok := customization(fqdnString); ok && len(domain.AAAA) > 0 {
+		return domain.AAAA
+	}
+	if V6Separator != "-" {
+		// the separator is a letter, and hostnames are case-insensitive
+		fqdn = []byte(strings.ReplaceAll(strings.ToLower(fqdnString), V6Separator, "-"))
+	}
+	loc, _ := matchIPv6(fqdn, ipPositionStrict)
+	if loc == nil {
+		return []dnsmessage.AAAAResource{}
+	}
+	match := string(fqdn[loc[4]:loc[5]])
+	match = strings.Replace(match, "-", ":", -1)
+	ipv16address := net.ParseIP(match).To16()
+	if ipv16address == nil {
+		// We shouldn't reach here because `match` should always be valid, but we're not optimists
+		return []dnsmessage.AAAAResource{}
+	}
+
+	AAAAR := dnsmessage.AAAAResource{}
+	for i := range ipv16address {
+		AAAAR.AAAA[i] = ipv16address[i]
+	}
+	return []dnsmessage.AAAAResource{AAAAR}
+}
+
+// matchIPv6 locates (FindSubmatchIndex) the hostname's embedded IPv6, its
+// separators already dashes, and returns which form matched: "mixed" (the
+// last 32 bits dotted, e.g. "--ffff-1.2.3.4"), which wins, or "dash" (e.g.
+// "2001-db8--1"); the loc is nil if there's none
+func matchIPv6(fqdn []byte, ipPositionStrict bool) (loc []int, form string) {
+	// try the mixed dash/dot forms first: ipv6RE would stop at the dotted IPv4's
+	// first dot, e.g. "1-2-3-4-5-6--1.2.3.4" → 1:2:3:4:5:6::1
+	if loc = ipv6MixedRE.FindSubmatchIndex(fqdn); loc != nil && (!ipPositionStrict || isLeading(fqdn, loc)) {
+		// the regexp doesn't count the groups, e.g. "1-2-3-4-5--6-1.2.3.4" has too many
+		if net.ParseIP(strings.ReplaceAll(string(fqdn[loc[4]:loc[5]]), "-", ":")) != nil {
+			return loc, "mixed"
+		}
+	}
+	if !ipv6RE.Match(fqdn) {
+		return nil, ""
+	}
+	ipv6RE.Longest()
+	loc = ipv6RE.FindSubmatchIndex(fqdn)
+	if ipPositionStrict && !isLeading(fqdn, loc) {
+		return nil, ""
+	}
+	return loc, "dash"
+}
+
+// embeddedIPLog returns, for DebugWire's log, which form of the hostname's
+// embedded IP the answer came from & the label it starts at, counting from
+// 0, e.g. " (dash form at label 6)" for "nono.io.127.0.0.1.192-168-0-1.sslip.io.";
+// it's "" if the answer came from a customization or there's no embedded IP
+func (x *Xip) embeddedIPLog(fqdnString string, qType dnsmessage.Type) string {
+	fqdn := []byte(fqdnString)
+	var loc []int
+	var form string
+	domain, customized := customization(fqdnString)
+	switch {
+	case qType == dnsmessage.TypeA && !(customized && len(domain.A) > 0):
+		loc, form = matchIPv4(fqdn, x.IPPositionStrict)
+	case qType == dnsmessage.TypeAAAA && !(customized && len(domain.AAAA) > 0):
+		if V6Separator != "-" {
+			fqdn = []byte(strings.ReplaceAll(strings.ToLower(fqdnString), V6Separator, "-"))
+		}
+		loc, form = matchIPv6(fqdn, x.IPPositionStrict)
+	}
+	if loc == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%s form at label %d)", form, strings.Count(string(fqdn[:loc[4]]), "."))
+}
+
+// isLeading returns true if the IP (the regexp's 2nd capture group, located
+// by FindSubmatchIndex) is the leading label(s) of the hostname: nothing
+// before it, and a "." (or nothing) after it
+func isLeading(fqdn []byte, loc []int) bool {
+	return loc[4] == 0 && (loc[5] == len(fqdn) || fqdn[loc[5]] == '.')
+}
+
+// ValidV6Separator returns an error if the separator can't stand in for ":"
+// in IPv6 hostnames: it must be a single character that's legal in a DNS label
+// (RFC 1123: letter, digit, hyphen) and that can't be confused with the
+// address itself, which rules out the digits and the hex letters "a"-"f".
+func ValidV6Separator(separator string) error {
+	if separator == "-" {
+		return nil
+	}
+	if len(separator) != 1 || separator[0] < 'g' || separator[0] > 'z' {
+		return fmt.Errorf(`the IPv6 separator "%s" must be "-" or one of the letters "g"-"z"`, separator)
+	}
+	return nil
+}
+
+// addAddresses adds the addresses, e.g. "ns-aws.sslip.io=52.0.56.137", to the
+// customizations' A & AAAA records, skipping (and saying so in the log
+// messages) the malformed ones
+func addAddresses(customizations DomainCustomizations, addresses []string) (logmessages []string) {
+	for _, address := range addresses {
+		hostAddr := strings.Split(address, "=")
+		if len(hostAddr) != 2 {
+			logmessages = append(logmessages, fmt.Sprintf(`-addresses: arguments should be in the format "host=ip", not "%s"`, address))
+			continue
+		}
+		host := customizationKey(hostAddr[0]) // e.g. "NS-AWS.sslip.io" → "ns-aws.sslip.io."
+		ip := net.ParseIP(hostAddr[1])
+		if ip == nil { // bad IP address
+			logmessages = append(logmessages, fmt.Sprintf(`-addresses: "%s" is not assigned a valid IP "%s"`, hostAddr, ip.String()))
+			continue
+		}
+		if ip.To4() != nil { // we have an IPv4
+			var ABytes [4]byte
+			// copy the _last_ four bytes of the 16-byte IP, not the first four bytes. Cost me 2 hours.
+			copy(ABytes[0:4], ip[12:])
+			// Thanks https://stackoverflow.com/questions/42605337/cannot-assign-to-struct-field-in-a-map
+			var hostEntry = DomainCustomization{}
+			if _, ok := customizations[host]; ok {
+				hostEntry = customizations[host]
+			}
+			hostEntry.A = append(hostEntry.A, dnsmessage.AResource{A: ABytes})
+			customizations[host] = hostEntry
+		} else {
+			// We're pretty sure it's IPv6 at this point, but we check anyway
+			if ip.To16() == nil { // it's not IPv6, and I don't know what it is
+				logmessages = append(logmessages, fmt.Sprintf(`-addresses: "%s" is not IPv4 or IPv6 "%s"`, hostAddr, ip.String()))
+				continue
+			}
+			var AAAABytes [16]byte
+			copy(AAAABytes[0:16], ip)
+			// Thanks https://stackoverflow.com/questions/42605337/cannot-assign-to-struct-field-in-a-map
+			var hostEntry = DomainCustomization{}
+			if _, ok := customizations[host]; ok {
+				hostEntry = customizations[host]
+			}
+			hostEntry.AAAA = append(hostEntry.AAAA, dnsmessage.AAAAResource{AAAA: AAAABytes})
+			customizations[host] = hostEntry
+		}
+		// print out the added records in a manner similar to the way they're set on the cmdline
+		logmessages = append(logmessages, fmt.Sprintf(`Adding record "%s=%s"`, host, ip))
+	}
+	return logmessages
+}
+
+// customizationKey normalizes the hostname to the form of the Customizations
+// keys: lower-cased & absolute (ending in "."), e.g. "sSLip.iO" → "sslip.io."
+func customizationKey(fqdn string) string {
+	fqdn = strings.ToLower(fqdn)
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	return fqdn
+}
+
+// NormalizeCustomizations normalizes the Customizations keys (see
+// customizationKey()), e.g. an embedder's "My.Example.com" → "my.example.com.",
+// so that lookups, which are normalized, don't miss them. If two keys
+// normalize to the same key, the one that was already normalized wins.
+// NewXip() calls it; call it again after adding Customizations.
+func NormalizeCustomizations() {
+	updateCustomizations(normalizeCustomizations)
+}
+
+// normalizeCustomizations is NormalizeCustomizations, but of the customizations
+func normalizeCustomizations(customizations DomainCustomizations) {
+	for key, domain := range customizations {
+		normalizedKey := customizationKey(key)
+		if normalizedKey == key {
+			continue
+		}
+		delete(customizations, key)
+		if _, ok := customizations[normalizedKey]; !ok {
+			customizations[normalizedKey] = domain
+		}
+	}
+}
+
+// customizationsMutex guards the Customizations variable. We never modify
+// a map once queries may read it: we modify a copy & swap it in (see
+// updateCustomizations()), as ReloadCustomizations() does
+var customizationsMutex sync.RWMutex
+
+// builtinCustomizations are the Customizations before NewXip() adds our
+// addresses & zones' to them, from which ReloadCustomizations() rebuilds them
+var builtinCustomizations = copyCustomizations(Customizations)
+
+// currentCustomizations returns the Customizations map. It's never modified
+// once it's swapped in, so reading it unlocked is safe
+func currentCustomizations() DomainCustomizations {
+	customizationsMutex.RLock()
+	defer customizationsMutex.RUnlock()
+	return Customizations
+}
+
+// updateCustomizations applies the update to a copy of the Customizations,
+// then swaps the copy in, so that queries never read a map mid-update
+func updateCustomizations(update func(customizations DomainCustomizations)) {
+	customizationsMutex.Lock()
+	defer customizationsMutex.Unlock()
+	customizations := copyCustomizations(Customizations)
+	update(customizations)
+	Customizations = customizations
+}
+
+// SetCustomization customizes the host's records, e.g. "www.example.com" →
+// its A records. Unlike assigning to Customizations, it's safe while we're
+// answering queries
+func SetCustomization(host string, domain DomainCustomization) {
+	updateCustomizations(func(customizations DomainCustomizations) {
+		customizations[customizationKey(host)] = domain
+	})
+}
+
+// DeleteCustomization deletes the host's customized records. Unlike deleting
+// from Customizations, it's safe while we're answering queries
+func DeleteCustomization(host string) {
+	updateCustomizations(func(customizations DomainCustomizations) {
+		delete(customizations, customizationKey(host))
+	})
+}
+
+// copyCustomizations returns a copy of the map; the entries' records are
+// shared, but we only ever append to them, and appending copies a full slice
+func copyCustomizations(customizations DomainCustomizations) DomainCustomizations {
+	customizationsCopy := make(DomainCustomizations, len(customizations))
+	for key, domain := range customizations {
+		customizationsCopy[key] = domain
+	}
+	return customizationsCopy
+}
+
+// customization returns the Customizations entry for the hostname. If there's
+// no exact match, it looks for a wildcard entry (e.g. "*.alias.sslip.io.") in
+// the manner of RFC 4592: starting with the parent, it walks up the tree, and
+// the first wildcard it finds matches ("a.b.alias.sslip.io." matches
+// "*.alias.sslip.io."). An existing name stops the walk: if "b.alias.sslip.io."
+// is customized, "a.b.alias.sslip.io." won't match "*.alias.sslip.io.". A
+// wildcard never matches its own parent ("alias.sslip.io.").
+func customization(fqdnString string) (DomainCustomization, bool) {
+	fqdn := customizationKey(fqdnString)
+	customizations := currentCustomizations()
+	if domain, ok := customizations[fqdn]; ok {
+		return domain, true
+	}
+	labels := strings.Split(fqdn, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		ancestor := strings.Join(labels[i:], ".")
+		if domain, ok := customizations["*."+ancestor]; ok {
+			return domain, true
+		}
+		if _, ok := customizations[ancestor]; ok {
+			break // the closest encloser exists but has no wildcard
+		}
+	}
+	return DomainCustomization{}, false
+}
+
+// ClassNONE is the NONE class (RFC 2136), which dnsmessage doesn't define
+const ClassNONE = dnsmessage.Class(254)
+
+// nonINETResponse answers queries whose class isn't INET, e.g. CHAOS. Our
+// records are INET, so we refuse rather than answer with INET records unless
+// a customization opted into the class, in which case we answer with its
+// TXT records (of the query's class)
+func (x *Xip) nonINETResponse(q dnsmessage.Question, srcAddr net.IP, response Response, logMessage string) (Response, string, error) {
+	domain, ok := customization(q.Name.String())
+	if !ok || domain.Class != q.Class {
+		response.Header.Authoritative = false
+		response.Header.RCode = dnsmessage.RCodeRefused
+		response.EDE = &ExtendedDNSError{InfoCode: EDENotAuthoritative, ExtraText: q.Class.String()}
+		return response, logMessage + q.Class.String() + " Refused", nil
+	}
+	if q.Type != dnsmessage.TypeTXT || domain.TXT == nil {
+		// NODATA; no SOA because our SOA is INET
+		return response, logMessage + q.Class.String() + " nil", nil
+	}
+	txts, err := domain.TXT(x, srcAddr)
+	if err != nil {
+		return response, "", err
+	}
+	txts = txts[:x.answerCap(len(txts), &response)]
+	if len(txts) > 0 {
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	}
+	response.Answers = append(response.Answers,
+		func(b *dnsmessage.Builder) error {
+			for _, txt := range txts {
+				err := b.TXTResource(dnsmessage.ResourceHeader{
+					Name:  q.Name,
+					Type:  dnsmessage.TypeTXT,
+					Class: q.Class,
+					TTL:   0, // e.g. CHAOS records describe the server, so don't cache them
+				}, txt)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	var logMessageTXTs []string
+	for _, txt := range txts {
+		logMessageTXTs = append(logMessageTXTs, `["`+strings.Join(txt.TXT, `", "`)+`"]`)
+	}
+	return response, logMessage + q.Class.String() + " " + strings.Join(logMessageTXTs, ", "), nil
+}
+
 // CNAMEResource returns the CNAME via Customizations, otherwise nil
 func CNAMEResource(fqdnString string) *dnsmessage.CNAMEResource {
-	if domain, ok := Customizations[strings.ToLower(fqdnString)]; ok && domain.CNAME != (dnsmessage.CNAMEResource{}) {
+	if domain, ok := customization(fqdnString); ok && domain.CNAME != (dnsmessage.CNAMEResource{}) {
 		return &domain.CNAME
 	}
 	return nil
@@ -780,7 +2293,7 @@ func CNAMEResource(fqdnString string) *dnsmessage.CNAMEResource {
 // MXResources returns either 1 or more MX records set via Customizations or
 // an MX record pointing to the queried record
 func MXResources(fqdnString string) []dnsmessage.MXResource {
-	if domain, ok := Customizations[strings.ToLower(fqdnString)]; ok && len(domain.MX) > 0 {
+	if domain, ok := customization(fqdnString); ok && len(domain.MX) > 0 {
 		return domain.MX
 	}
 	mx, _ := dnsmessage.NewName(fqdnString)
@@ -792,6 +2305,28 @@ func MXResources(fqdnString string) []dnsmessage.MXResource {
 	}
 }
 
+// RawResources returns the RDATA of the Raw records of the type set via
+// Customizations, if any
+func RawResources(fqdnString string, qType dnsmessage.Type) [][]byte {
+	if domain, ok := customization(fqdnString); ok {
+		return domain.Raw[qType]
+	}
+	return nil
+}
+
+// rawResponse answers with the Raw records, which we log in the generic
+// format (RFC 3597 section 5), e.g. `\# 3 010203`
+func (x *Xip) rawResponse(q dnsmessage.Question, rdatas [][]byte, response Response, logMessage string) (Response, string, error) {
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	var logMessages []string
+	for _, rdata := range rdatas {
+		// 60 * 60 * 24 * 7 == 1 week; long TTL, like the other Customizations
+		response.Answers = append(response.Answers, unknownResourceBuilder(q.Name, q.Type, 604800, rdata))
+		logMessages = append(logMessages, `\# `+strconv.Itoa(len(rdata))+" "+hex.EncodeToString(rdata))
+	}
+	return response, logMessage + strings.Join(logMessages, ", "), nil
+}
+
 func IsAcmeChallenge(fqdnString string) bool {
 	if dns01ChallengeRE.MatchString(fqdnString) {
 		ipv4s := NameToA(fqdnString)
@@ -803,65 +2338,266 @@ func IsAcmeChallenge(fqdnString string) bool {
 	return false
 }
 
+// isAcmeChallengeFromKV is true when we answer the "_acme-challenge." TXT
+// query from the key-value store rather than delegating it
+func (x *Xip) isAcmeChallengeFromKV(q dnsmessage.Question) bool {
+	return x.AcmeMode == AcmeModeKV &&
+		q.Type == dnsmessage.TypeTXT &&
+		IsAcmeChallenge(q.Name.String()) &&
+		!x.blocklist(q.Name.String())
+}
+
+// acmeChallengeKey returns the key-value store's key for an "_acme-challenge." hostname,
+// e.g. "_acme-challenge.127-0-0-1.sslip.io." → "127-0-0-1.sslip.io"
+func acmeChallengeKey(fqdnString string) string {
+	return strings.TrimSuffix(strings.ToLower(dns01ChallengeRE.ReplaceAllString(fqdnString, "")), ".")
+}
+
 func (x *Xip) NSResources(fqdnString string) []dnsmessage.NSResource {
 	if x.blocklist(fqdnString) {
-		x.Metrics.AnsweredQueries++
-		x.Metrics.AnsweredBlockedQueries++
-		return x.NameServers
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredBlockedQueries, 1)
+		return x.nameServers(fqdnString)
 	}
 	if IsAcmeChallenge(fqdnString) {
-		x.Metrics.AnsweredNSDNS01ChallengeQueries++
+		atomic.AddInt64(&x.Metrics.AnsweredNSDNS01ChallengeQueries, 1)
 		strippedFqdn := dns01ChallengeRE.ReplaceAllString(fqdnString, "")
 		ns, _ := dnsmessage.NewName(strippedFqdn)
 		return []dnsmessage.NSResource{{NS: ns}}
 	}
-	x.Metrics.AnsweredQueries++
-	return x.NameServers
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	return x.nameServers(fqdnString)
 }
 
 // TXTResources returns TXT records from Customizations or KvCustomizations
 func (x *Xip) TXTResources(fqdn string, ip net.IP) ([]dnsmessage.TXTResource, error) {
-	if domain, ok := Customizations[strings.ToLower(fqdn)]; ok {
-		// Customizations[strings.ToLower(fqdn)] returns a _function_,
+	return x.txtResources(context.Background(), fqdn, ip, nil)
+}
+
+// withheldTXT returns true if the hostname's TXT records are informational,
+// e.g. "version.status.sslip.io", and we've disabled them
+func (x *Xip) withheldTXT(fqdnString string) bool {
+	fqdn := strings.ToLower(fqdnString)
+	if x.DisableVersionTXT && fqdn == "version.status.sslip.io." {
+		return true
+	}
+	return x.DisableMetricsTXT && (fqdn == "metrics.status.sslip.io." ||
+		fqdn == "compact.metrics.status.sslip.io." || metricsPageRE.MatchString(fqdn))
+}
+
+// txtResources is TXTResources, but with the query's EDNS Client Subnet, if any
+func (x *Xip) txtResources(ctx context.Context, fqdn string, ip net.IP, ecs *net.IPNet) ([]dnsmessage.TXTResource, error) {
+	if x.withheldTXT(fqdn) {
+		return nil, nil
+	}
+	if match := metricsPageRE.FindStringSubmatch(strings.ToLower(fqdn)); match != nil {
+		page, _ := strconv.Atoi(match[1]) // the regexp guarantees it's a number
+		return TXTMetricsPage(x, page)
+	}
+	if subdomain, zone, ok := x.zoneSubdomain(fqdn); ok {
+		if match := ttlRE.FindStringSubmatch(subdomain); match != nil {
+			return TXTTTL(x, match[1]+"."+zone, ip)
+		}
+		if match := netRE.FindStringSubmatch(subdomain); match != nil {
+			return TXTNet(x, match[1])
+		}
+		if match := blockedRE.FindStringSubmatch(subdomain); match != nil && x.BlockedTXT {
+			return TXTBlocked(x, match[1]+"."+zone)
+		}
+	}
+	if x.IPWildcard && x.underIP(fqdn) {
+		return TXTIp(x, ip)
+	}
+	if domain, ok := customization(fqdn); ok {
+		// customization(fqdn) returns a _function_,
 		// we call that function, which has the same return signature as this method
+		if domain.TXTECS != nil {
+			return domain.TXTECS(x, ip, ecs)
+		}
 		if domain.TXT != nil {
-			return domain.TXT(x, ip)
+			txts, err := domain.TXT(x, ip)
+			if err != nil {
+				return nil, err
+			}
+			return append(txts, x.zoneApexTXT(fqdn)...), nil
 		}
 	}
+	if txts := x.zoneApexTXT(fqdn); txts != nil {
+		return txts, nil
+	}
 	if kvRE.MatchString(fqdn) {
-		return x.kvTXTResources(fqdn)
+		return x.kvTXTResources(ctx, fqdn)
 	}
 	return nil, nil
 }
 
-func SOAAuthority(name dnsmessage.Name) (dnsmessage.ResourceHeader, dnsmessage.SOAResource) {
+// inZone returns true if we're authoritative for the hostname: it's in one
+// of our Zones, it's customized, or it's one of the special-purpose names we
+// answer, i.e. "k-v.io", PTR names, and DDR's
+func (x *Xip) inZone(fqdnString string) bool {
+	fqdn := strings.ToLower(fqdnString)
+	for _, zone := range x.Zones {
+		if fqdn == zone || strings.HasSuffix(fqdn, "."+zone) {
+			return true
+		}
+	}
+	if _, ok := customization(fqdn); ok {
+		return true
+	}
+	if x.TestLocalZone && strings.HasSuffix(fqdn, "."+LocalZone) {
+		return true
+	}
+	return fqdn == KVZone || kvRE.MatchString(fqdn) || reverseZone(fqdn) != "" ||
+		(x.DDR != nil && fqdn == DDRName)
+}
+
+// reverseZone returns the reverse zone (IPv4ReverseZone or IPv6ReverseZone)
+// that the hostname is, or falls under, e.g. "1.0.0.10.in-addr.arpa." →
+// "in-addr.arpa.", otherwise ""
+func reverseZone(fqdnString string) string {
+	fqdn := strings.ToLower(fqdnString)
+	for _, zone := range []string{IPv4ReverseZone, IPv6ReverseZone} {
+		if fqdn == zone || strings.HasSuffix(fqdn, "."+zone) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// reverseName returns true if the hostname is in a reverse zone, e.g.
+// "1.0.0.10.in-addr.arpa", and it isn't customized: its labels are a
+// reversed IP for PTR, not an embedded IP for A & AAAA
+func reverseName(fqdnString string) bool {
+	if reverseZone(fqdnString) == "" {
+		return false
+	}
+	_, ok := customization(fqdnString)
+	return !ok
+}
+
+// underIP returns true if the hostname is a subdomain of "ip." + one of our
+// Zones, e.g. "foo.ip.sslip.io."
+func (x *Xip) underIP(fqdn string) bool {
+	fqdn = strings.ToLower(fqdn)
+	for _, zone := range x.Zones {
+		if strings.HasSuffix(fqdn, ".ip."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneSubdomain returns the (lowercase) fqdn's subdomain of the longest of
+// our Zones it's under, and the zone, e.g. "ttl.foo" & "sslip.io." for
+// "TTL.foo.sslip.io."; ok is false if it's under none (or is one)
+func (x *Xip) zoneSubdomain(fqdn string) (subdomain, zone string, ok bool) {
+	fqdn = strings.ToLower(fqdn)
+	for _, candidate := range x.Zones {
+		if strings.HasSuffix(fqdn, "."+candidate) && len(candidate) > len(zone) {
+			zone = candidate
+		}
+	}
+	if zone == "" {
+		return "", "", false
+	}
+	return strings.TrimSuffix(fqdn, "."+zone), zone, true
+}
+
+// SOAAuthority returns the SOA for the Authority section of negative
+// (NODATA/NXDOMAIN) responses. Resolvers cache negative responses for
+// min(SOA TTL, SOA MINIMUM) (RFC 2308 section 5), so we set the TTL to the
+// MINIMUM lest they cache them for a week. Its owner is the apex of the
+// enclosing zone (see zoneApex()).
+func (x *Xip) SOAAuthority(name dnsmessage.Name) (dnsmessage.ResourceHeader, dnsmessage.SOAResource) {
+	soaResource := x.SOAResource(name)
 	return dnsmessage.ResourceHeader{
-		Name:   name,
+		Name:   x.zoneApex(name),
 		Type:   dnsmessage.TypeSOA,
 		Class:  dnsmessage.ClassINET,
-		TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; it's not gonna change
+		TTL:    soaResource.MinTTL,
 		Length: 0,
-	}, SOAResource(name)
+	}, soaResource
+}
+
+// zoneApex returns the apex of the most specific zone we serve (Zones) that
+// the name falls under, e.g. "nonexistent.sslip.io." & "10-0-0-1.sslip.io." →
+// "sslip.io.", or else of the reverse zone, e.g. "1.0.0.10.in-addr.arpa." →
+// "in-addr.arpa.", otherwise the name itself, e.g. "10-0-0-1.example.com.". In
+// DNSSEC's signing mode every name is its own apex, lest the SOA disagree
+// with the NSEC3's signer.
+func (x *Xip) zoneApex(name dnsmessage.Name) dnsmessage.Name {
+	if x.DNSSEC != nil {
+		return name
+	}
+	fqdn := strings.ToLower(name.String())
+	matchedZone := ""
+	for _, zone := range x.Zones {
+		if (fqdn == zone || strings.HasSuffix(fqdn, "."+zone)) && len(zone) > len(matchedZone) {
+			matchedZone = zone
+		}
+	}
+	if matchedZone == "" {
+		matchedZone = reverseZone(fqdn)
+	}
+	if matchedZone == "" {
+		return name
+	}
+	apex, err := dnsmessage.NewName(matchedZone)
+	if err != nil {
+		return name
+	}
+	return apex
 }
 
-// SOAResource returns the hard-coded (except MNAME) SOA
-func SOAResource(name dnsmessage.Name) dnsmessage.SOAResource {
+// SOAResource returns the SOA, hard-coded except for MNAME and the SOATimers
+func (x *Xip) SOAResource(name dnsmessage.Name) dnsmessage.SOAResource {
 	return dnsmessage.SOAResource{
-		NS:     name,
-		MBox:   mbox,
-		Serial: 2022110900,
-		// cribbed the Refresh/Retry/Expire from google.com.
-		// MinTTL was 300, but I dropped to 180 for faster
-		// key-value propagation
-		Refresh: 900,
-		Retry:   900,
-		Expire:  1800,
-		MinTTL:  180,
+		NS:      x.primaryNS(name),
+		MBox:    mbox,
+		Serial:  2022110900,
+		Refresh: x.SOATimers.Refresh,
+		Retry:   x.SOATimers.Retry,
+		Expire:  x.SOATimers.Expire,
+		MinTTL:  x.SOATimers.MinTTL,
+	}
+}
+
+// primaryNS returns the SOA's MNAME, the primary nameserver: the PrimaryNS,
+// or else the first of the name's nameservers (see nameServers()), or else,
+// if we have none, the name itself
+func (x *Xip) primaryNS(name dnsmessage.Name) dnsmessage.Name {
+	if x.PrimaryNS.Length > 0 {
+		return x.PrimaryNS
 	}
+	if nameServers := x.nameServers(name.String()); len(nameServers) > 0 {
+		return nameServers[0].NS
+	}
+	return name
+}
+
+// Validate returns an error if the timers are nonsensical: a secondary
+// should retry no less often than it refreshes, and shouldn't expire the
+// zone before it's had a chance to refresh it
+func (t SOATimers) Validate() error {
+	switch {
+	case t.Refresh == 0 || t.Retry == 0 || t.Expire == 0:
+		return fmt.Errorf("the SOA refresh (%d), retry (%d), and expire (%d) must be greater than 0", t.Refresh, t.Retry, t.Expire)
+	case t.Retry > t.Refresh:
+		return fmt.Errorf("the SOA retry (%d) must be less than or equal to the refresh (%d)", t.Retry, t.Refresh)
+	case t.Expire < t.Refresh:
+		return fmt.Errorf("the SOA expire (%d) must be greater than or equal to the refresh (%d)", t.Expire, t.Refresh)
+	}
+	return nil
 }
 
 // PTRResource returns the PTR record, otherwise nil
 func (x *Xip) PTRResource(fqdn []byte) *dnsmessage.PTRResource {
+	return x.ptrResource(context.Background(), fqdn)
+}
+
+// ptrResource is PTRResource, but the key-value store's lookup of a custom
+// PTR is canceled with the context
+func (x *Xip) ptrResource(ctx context.Context, fqdn []byte) *dnsmessage.PTRResource {
 	// "reverse", for example, means "1.0.0.127", as in "1.0.0.127.in-addr.arpa"
 	// the regular IP would be "127.0.0.1"
 	if ipv4ReverseRE.Match(fqdn) {
@@ -876,12 +2612,12 @@ func (x *Xip) PTRResource(fqdn []byte) *dnsmessage.PTRResource {
 			reversedIPv4address[1],
 			reversedIPv4address[0],
 		})
-		ptrName, err := dnsmessage.NewName(strings.ReplaceAll(ip.String(), ".", "-") + ".sslip.io.")
+		ptrName, err := x.ptrName(ctx, net.IP(ip.AsSlice()))
 		if err != nil {
 			return nil
 		}
-		x.Metrics.AnsweredQueries++
-		x.Metrics.AnsweredPTRQueriesIPv4++
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredPTRQueriesIPv4, 1)
 		return &dnsmessage.PTRResource{
 			PTR: ptrName,
 		}
@@ -902,12 +2638,12 @@ func (x *Xip) PTRResource(fqdn []byte) *dnsmessage.PTRResource {
 		if ip == nil {
 			return nil
 		}
-		ptrName, err := dnsmessage.NewName(strings.ReplaceAll(ip.String(), ":", "-") + ".sslip.io.")
+		ptrName, err := x.ptrName(ctx, ip)
 		if err != nil {
 			return nil
 		}
-		x.Metrics.AnsweredQueries++
-		x.Metrics.AnsweredPTRQueriesIPv6++
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredPTRQueriesIPv6, 1)
 		return &dnsmessage.PTRResource{
 			PTR: ptrName,
 		}
@@ -915,6 +2651,47 @@ func (x *Xip) PTRResource(fqdn []byte) *dnsmessage.PTRResource {
 	return nil
 }
 
+// ptrName returns the hostname of the IP's PTR record: the custom one stored
+// in the key-value store (KvPTRPrefix), if any, otherwise the synthesized
+// one, e.g. 10.0.0.1 → "10-0-0-1.sslip.io."
+func (x *Xip) ptrName(ctx context.Context, ip net.IP) (dnsmessage.Name, error) {
+	hostname, ok, err := x.kvValue(ctx, KvPTRPrefix+ipWithDashes(ip))
+	if err != nil {
+		x.logger().Println(err.Error()) // fall back to the synthesized hostname
+	}
+	if ok && ValidHostname(hostname) {
+		return dnsmessage.NewName(strings.TrimSuffix(hostname, ".") + ".")
+	}
+	return dnsmessage.NewName(ipWithDashes(ip) + ".sslip.io.")
+}
+
+// ipWithDashes returns the IP with dashes for its dots or colons, e.g.
+// 10.0.0.1 → "10-0-0-1", as in "10-0-0-1.sslip.io"
+func ipWithDashes(ip net.IP) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+}
+
+// ValidHostname returns true if the name is a legal hostname (RFC 1123): at
+// most 253 characters of dot-separated labels of 1-63 letters, digits & hyphens
+// that neither start nor end with a hyphen, e.g. "myhost.example.com"
+func ValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // TXTSslipIoSPF SFP records for sslio.io
 func TXTSslipIoSPF(_ *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
 	// Although multiple TXT records with multiple strings are allowed, we're sticking
@@ -926,140 +2703,1169 @@ func TXTSslipIoSPF(_ *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
 	}, nil // Sender Policy Framework
 }
 
+// TXTWithApexTXT wraps the apex's TXT function, appending the Xip's
+// ApexTXT records to its built-in ones, one string apiece
+func TXTWithApexTXT(txt func(*Xip, net.IP) ([]dnsmessage.TXTResource, error)) func(*Xip, net.IP) ([]dnsmessage.TXTResource, error) {
+	return func(x *Xip, srcAddr net.IP) ([]dnsmessage.TXTResource, error) {
+		txts, err := txt(x, srcAddr)
+		if err != nil {
+			return nil, err
+		}
+		for _, apexTXT := range x.ApexTXT {
+			txts = append(txts, dnsmessage.TXTResource{TXT: []string{apexTXT}})
+		}
+		return txts, nil
+	}
+}
+
+// zoneApexTXT returns the ZoneApexTXT records, one string apiece, if the
+// hostname is the apex of a zone that has them, else nil
+func (x *Xip) zoneApexTXT(fqdn string) (txts []dnsmessage.TXTResource) {
+	for _, apexTXT := range x.ZoneApexTXT[strings.ToLower(fqdn)] {
+		txts = append(txts, dnsmessage.TXTResource{TXT: []string{apexTXT}})
+	}
+	return txts
+}
+
 // TXTIp when TXT for "ip.sslip.io" is queried, return the IP address of the querier
 func TXTIp(x *Xip, srcAddr net.IP) ([]dnsmessage.TXTResource, error) {
-	x.Metrics.AnsweredTXTSrcIPQueries++
+	atomic.AddInt64(&x.Metrics.AnsweredTXTSrcIPQueries, 1)
 	return []dnsmessage.TXTResource{{TXT: []string{srcAddr.String()}}}, nil
 }
 
-// TXTMetrics when TXT for "metrics.sslip.io" is queried, return the cumulative metrics
-func TXTMetrics(x *Xip, _ net.IP) (txtResources []dnsmessage.TXTResource, err error) {
-	<-x.DnsAmplificationAttackDelay
-	var metrics []string
-	uptime := time.Since(x.Metrics.Start)
-	metrics = append(metrics, fmt.Sprintf("Uptime: %.0f", uptime.Seconds()))
-	keyValueStore := "etcd"
-	if x.isEtcdNil() {
-		keyValueStore = "builtin"
-	}
-	metrics = append(metrics, "KV Store: "+keyValueStore)
-	metrics = append(metrics, fmt.Sprintf("Blocklist: %s %d,%d",
-		x.BlocklistUpdated.Format("2006-01-02 15:04:05-07"),
-		len(x.BlocklistStrings),
-		len(x.BlocklistCDIRs)))
-	metrics = append(metrics, fmt.Sprintf("Queries: %d (%.1f/s)", x.Metrics.Queries, float64(x.Metrics.Queries)/uptime.Seconds()))
-	metrics = append(metrics, fmt.Sprintf("Answered Queries: %d (%.1f/s)", x.Metrics.AnsweredQueries, float64(x.Metrics.AnsweredQueries)/uptime.Seconds()))
-	metrics = append(metrics, fmt.Sprintf("A: %d", x.Metrics.AnsweredAQueries))
-	metrics = append(metrics, fmt.Sprintf("AAAA: %d", x.Metrics.AnsweredAAAAQueries))
-	metrics = append(metrics, fmt.Sprintf("TXT Source: %d", x.Metrics.AnsweredTXTSrcIPQueries))
-	metrics = append(metrics, fmt.Sprintf("TXT Version: %d", x.Metrics.AnsweredTXTVersionQueries))
-	metrics = append(metrics, fmt.Sprintf("TXT KV GET/PUT/DEL: %d/%d/%d", x.Metrics.AnsweredTXTGetKvQueries, x.Metrics.AnsweredTXTPutKvQueries, x.Metrics.AnsweredTXTDelKvQueries))
-	metrics = append(metrics, fmt.Sprintf("PTR IPv4/IPv6: %d/%d", x.Metrics.AnsweredPTRQueriesIPv4, x.Metrics.AnsweredPTRQueriesIPv6))
-	metrics = append(metrics, fmt.Sprintf("NS DNS-01: %d", x.Metrics.AnsweredNSDNS01ChallengeQueries))
-	metrics = append(metrics, fmt.Sprintf("Blocked: %d", x.Metrics.AnsweredBlockedQueries))
-	for _, metric := range metrics {
-		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{metric}})
+// TXTWhoami when TXT for "whoami.sslip.io" is queried, return the IP
+// address of the querier, as TXTIp does, if WhoamiAlias is set, for the
+// scripts written for "whoami.cloudflare"; otherwise, no records
+func TXTWhoami(x *Xip, srcAddr net.IP) ([]dnsmessage.TXTResource, error) {
+	if !x.WhoamiAlias {
+		return nil, nil
+	}
+	return TXTIp(x, srcAddr)
+}
+
+// TXTTrace when TXT for "trace.sslip.io" is queried, return the resolver's
+// IP (the querier) and the client subnet it passed along (EDNS Client Subnet),
+// if any, to help users understand their resolver path
+func TXTTrace(x *Xip, srcAddr net.IP, ecs *net.IPNet) ([]dnsmessage.TXTResource, error) {
+	atomic.AddInt64(&x.Metrics.AnsweredTXTTraceQueries, 1)
+	clientSubnet := "none"
+	if ecs != nil {
+		clientSubnet = ecs.String()
+	}
+	return []dnsmessage.TXTResource{{TXT: []string{"resolver=" + srcAddr.String(), "client-subnet=" + clientSubnet}}}, nil
+}
+
+// AChaos returns a random IPv4 address from the ChaosPool, if any, so that
+// clients of "chaos.sslip.io" see changing answers (resilience testing)
+func AChaos(x *Xip, _ net.IP) []dnsmessage.AResource {
+	var ipv4s []net.IP
+	for _, ip := range x.ChaosPool {
+		if ip.To4() != nil {
+			ipv4s = append(ipv4s, ip.To4())
+		}
+	}
+	if len(ipv4s) == 0 {
+		return []dnsmessage.AResource{}
+	}
+	var aResource dnsmessage.AResource
+	copy(aResource.A[:], ipv4s[rand.Intn(len(ipv4s))])
+	return []dnsmessage.AResource{aResource}
+}
+
+// AAAAChaos is AChaos for IPv6 addresses
+func AAAAChaos(x *Xip, _ net.IP) []dnsmessage.AAAAResource {
+	var ipv6s []net.IP
+	for _, ip := range x.ChaosPool {
+		if ip.To4() == nil {
+			ipv6s = append(ipv6s, ip.To16())
+		}
+	}
+	if len(ipv6s) == 0 {
+		return []dnsmessage.AAAAResource{}
+	}
+	var aaaaResource dnsmessage.AAAAResource
+	copy(aaaaResource.AAAA[:], ipv6s[rand.Intn(len(ipv6s))])
+	return []dnsmessage.AAAAResource{aaaaResource}
+}
+
+// WeightedIP is an IP of a weighted pool & how often we pick it relative to
+// the pool's other IPs
+type WeightedIP struct {
+	IP     net.IP
+	Weight int
+}
+
+// KvMaxPoolWeight caps each weight of a weighted pool
+const KvMaxPoolWeight = 1000
+
+// ParseWeightedPool parses a weighted pool, e.g. "10.0.0.1=3,10.0.0.2=1" →
+// 10.0.0.1 three times as often as 10.0.0.2; each weight is between 1 and
+// KvMaxPoolWeight
+func ParseWeightedPool(pool string) ([]WeightedIP, error) {
+	var weightedIPs []WeightedIP
+	for _, ipWeight := range strings.Split(pool, ",") {
+		ipAndWeight := strings.Split(ipWeight, "=")
+		if len(ipAndWeight) != 2 {
+			return nil, fmt.Errorf(`"%s" isn't in the format "ip=weight"`, ipWeight)
+		}
+		ip := net.ParseIP(ipAndWeight[0])
+		if ip == nil {
+			return nil, fmt.Errorf(`"%s" isn't a valid IP`, ipAndWeight[0])
+		}
+		weight, err := strconv.Atoi(ipAndWeight[1])
+		if err != nil || weight < 1 || weight > KvMaxPoolWeight {
+			return nil, fmt.Errorf(`"%s" isn't a weight between 1 and %d`, ipAndWeight[1], KvMaxPoolWeight)
+		}
+		weightedIPs = append(weightedIPs, WeightedIP{IP: ip, Weight: weight})
+	}
+	return weightedIPs, nil
+}
+
+// PickWeighted returns one of the pool's IPv4 (or, if not v4, IPv6)
+// addresses, chosen by weight, or nil if the pool has none
+func (x *Xip) PickWeighted(pool []WeightedIP, v4 bool) net.IP {
+	var candidates []WeightedIP
+	total := 0
+	for _, weightedIP := range pool {
+		if (weightedIP.IP.To4() != nil) == v4 {
+			candidates = append(candidates, weightedIP)
+			total += weightedIP.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	randIntn := x.RandIntn
+	if randIntn == nil {
+		randIntn = rand.Intn
+	}
+	pick := randIntn(total)
+	for _, candidate := range candidates {
+		if pick < candidate.Weight {
+			return candidate.IP
+		}
+		pick -= candidate.Weight
+	}
+	return nil // unreachable: pick < total
+}
+
+// kvPoolIP returns the IP, of the query's type's family, picked from the
+// weighted pool stored under the key, e.g. "pool.k-v.io" A → 10.0.0.1 if
+// "put.10.0.0.1=3,10.0.0.2=1.pool.k-v.io", or nil if the key doesn't hold a
+// valid weighted pool
+func (x *Xip) kvPoolIP(ctx context.Context, q dnsmessage.Question) net.IP {
+	match := kvPoolRE.FindStringSubmatch(strings.ToLower(q.Name.String()))
+	if match == nil || !ValidKVKey(match[1]) {
+		return nil
+	}
+	value, ok, err := x.kvValue(ctx, match[1])
+	if err != nil {
+		x.logger().Println(err.Error())
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	pool, err := ParseWeightedPool(value)
+	if err != nil {
+		return nil // it's a plain value, not a pool
+	}
+	return x.PickWeighted(pool, q.Type == dnsmessage.TypeA)
+}
+
+// kvPoolResponse answers with the IP picked from the weighted pool; its TTL
+// is 0 because each query picks anew
+func (x *Xip) kvPoolResponse(q dnsmessage.Question, ip net.IP, response Response, logMessage string) (Response, string, error) {
+	atomic.AddInt64(&x.Metrics.AnsweredKvPoolQueries, 1)
+	return x.kvAddressResponse(q, ip, response, logMessage)
+}
+
+// kvDHCPIP returns the IP leased to the host, e.g. "myhost.dhcp.k-v.io" A →
+// 10.0.0.5 if "put.10.0.0.5.myhost.dhcp.k-v.io", or nil if there's no lease
+// (or it's of the other IP version)
+func (x *Xip) kvDHCPIP(ctx context.Context, q dnsmessage.Question) net.IP {
+	match := kvDHCPRE.FindStringSubmatch(strings.ToLower(q.Name.String()))
+	if match == nil {
+		return nil
+	}
+	value, ok, err := x.kvValue(ctx, KvDHCPPrefix+match[1])
+	if err != nil {
+		x.logger().Println(err.Error())
+		return nil
+	}
+	ip := net.ParseIP(value)
+	if !ok || ip == nil || (ip.To4() != nil) != (q.Type == dnsmessage.TypeA) {
+		return nil
+	}
+	return ip
+}
+
+// kvAddressResponse answers with the IP stored in the key-value store; its
+// TTL is 0 because the value may change at any time
+func (x *Xip) kvAddressResponse(q dnsmessage.Question, ip net.IP, response Response, logMessage string) (Response, string, error) {
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 0}
+	response.Answers = append(response.Answers,
+		func(b *dnsmessage.Builder) error {
+			if q.Type == dnsmessage.TypeA {
+				var aResource dnsmessage.AResource
+				copy(aResource.A[:], ip.To4())
+				return b.AResource(header, aResource)
+			}
+			var aaaaResource dnsmessage.AAAAResource
+			copy(aaaaResource.AAAA[:], ip.To16())
+			return b.AAAAResource(header, aaaaResource)
+		})
+	return response, logMessage + ip.String(), nil
+}
+
+// AGeo returns the IPv4 addresses of the querier's region (GeoDNS), falling
+// back to those of GeoRegionDefault
+func AGeo(x *Xip, srcAddr net.IP) []dnsmessage.AResource {
+	return ipsToAResources(x.geoAnswers(srcAddr))
+}
+
+// AAAAGeo is AGeo for IPv6 addresses
+func AAAAGeo(x *Xip, srcAddr net.IP) []dnsmessage.AAAAResource {
+	return ipsToAAAAResources(x.geoAnswers(srcAddr))
+}
+
+// ipsToAResources returns the A records of the IPv4 addresses, skipping the IPv6
+func ipsToAResources(ips []net.IP) []dnsmessage.AResource {
+	aResources := []dnsmessage.AResource{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			var aResource dnsmessage.AResource
+			copy(aResource.A[:], ip.To4())
+			aResources = append(aResources, aResource)
+		}
+	}
+	return aResources
+}
+
+// ipsToAAAAResources is ipsToAResources for IPv6 addresses
+func ipsToAAAAResources(ips []net.IP) []dnsmessage.AAAAResource {
+	aaaaResources := []dnsmessage.AAAAResource{}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			var aaaaResource dnsmessage.AAAAResource
+			copy(aaaaResource.AAAA[:], ip.To16())
+			aaaaResources = append(aaaaResources, aaaaResource)
+		}
+	}
+	return aaaaResources
+}
+
+// Schedule selects between two sets of addresses by the time of day, e.g. a
+// maintenance page's IP during a maintenance window, the usual IP otherwise
+type Schedule struct {
+	Start     time.Duration    // the time of day the window starts, e.g. 2 * time.Hour → 02:00
+	End       time.Duration    // the time of day the window ends; if it's before Start, the window spans midnight
+	Location  *time.Location   // the time zone of Start & End; nil → UTC
+	During    []net.IP         // the addresses during the window
+	Otherwise []net.IP         // the addresses outside the window
+	Now       func() time.Time // the clock; nil → time.Now
+}
+
+// InWindow is whether it's currently within the Schedule's window, which
+// includes Start but not End
+func (s Schedule) InWindow() bool {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	location := s.Location
+	if location == nil {
+		location = time.UTC
+	}
+	t := now().In(location)
+	timeOfDay := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if s.Start <= s.End {
+		return s.Start <= timeOfDay && timeOfDay < s.End
+	}
+	return s.Start <= timeOfDay || timeOfDay < s.End
+}
+
+// IPs returns the addresses for the current time of day
+func (s Schedule) IPs() []net.IP {
+	if s.InWindow() {
+		return s.During
+	}
+	return s.Otherwise
+}
+
+// AddSchedule customizes the host's A & AAAA records to follow the Schedule
+func (x *Xip) AddSchedule(host string, schedule Schedule) {
+	updateCustomizations(func(customizations DomainCustomizations) {
+		addSchedule(customizations, host, schedule)
+	})
+}
+
+// addSchedule is AddSchedule, but to the customizations
+func addSchedule(customizations DomainCustomizations, host string, schedule Schedule) {
+	key := customizationKey(host)
+	domain := customizations[key]
+	domain.AFunc = func(_ *Xip, _ net.IP) []dnsmessage.AResource {
+		return ipsToAResources(schedule.IPs())
+	}
+	domain.AAAAFunc = func(_ *Xip, _ net.IP) []dnsmessage.AAAAResource {
+		return ipsToAAAAResources(schedule.IPs())
+	}
+	customizations[key] = domain
+}
+
+// AddMaintenanceWindows parses maintenance windows, e.g.
+// "www.example.com=02:00-04:00=10.0.0.99", and schedules each host to return
+// the maintenance IPs during its window and its addresses otherwise; its error
+// is the first invalid window, and nothing is scheduled
+func (x *Xip) AddMaintenanceWindows(maintenanceWindows []string) (logmessages []string, err error) {
+	updateCustomizations(func(customizations DomainCustomizations) {
+		logmessages, err = addMaintenanceWindows(customizations, maintenanceWindows)
+	})
+	return logmessages, err
+}
+
+// addMaintenanceWindows is AddMaintenanceWindows, but to the customizations
+func addMaintenanceWindows(customizations DomainCustomizations, maintenanceWindows []string) (logmessages []string, err error) {
+	schedules := map[string]*Schedule{}
+	var hosts []string // in order, for logging
+	for _, maintenanceWindow := range maintenanceWindows {
+		if maintenanceWindow == "" {
+			continue
+		}
+		hostWindowIP := strings.Split(maintenanceWindow, "=")
+		if len(hostWindowIP) != 3 {
+			return nil, fmt.Errorf(`"%s" isn't in the format "host=HH:MM-HH:MM=ip"`, maintenanceWindow)
+		}
+		host := customizationKey(strings.TrimSuffix(hostWindowIP[0], ".") + ".")
+		startEnd := strings.Split(hostWindowIP[1], "-")
+		if len(startEnd) != 2 {
+			return nil, fmt.Errorf(`"%s" isn't a window in the format "HH:MM-HH:MM"`, hostWindowIP[1])
+		}
+		start, err := time.Parse("15:04", startEnd[0])
+		if err != nil {
+			return nil, fmt.Errorf(`"%s" isn't a time in the format "HH:MM"`, startEnd[0])
+		}
+		end, err := time.Parse("15:04", startEnd[1])
+		if err != nil {
+			return nil, fmt.Errorf(`"%s" isn't a time in the format "HH:MM"`, startEnd[1])
+		}
+		ip := net.ParseIP(hostWindowIP[2])
+		if ip == nil {
+			return nil, fmt.Errorf(`"%s" isn't a valid IP`, hostWindowIP[2])
+		}
+		schedule, ok := schedules[host]
+		if !ok {
+			schedule = &Schedule{}
+			domain := customizations[host]
+			for _, aResource := range domain.A {
+				schedule.Otherwise = append(schedule.Otherwise, net.IP(aResource.A[:]))
+			}
+			for _, aaaaResource := range domain.AAAA {
+				schedule.Otherwise = append(schedule.Otherwise, net.IP(aaaaResource.AAAA[:]))
+			}
+			schedules[host] = schedule
+			hosts = append(hosts, host)
+		}
+		schedule.Start = start.Sub(start.Truncate(24 * time.Hour))
+		schedule.End = end.Sub(end.Truncate(24 * time.Hour))
+		schedule.During = append(schedule.During, ip)
+	}
+	for _, host := range hosts {
+		addSchedule(customizations, host, *schedules[host])
+		logmessages = append(logmessages, fmt.Sprintf(`Scheduling "%s" to return %v daily from %s to %s UTC`, host, schedules[host].During,
+			time.Time{}.Add(schedules[host].Start).Format("15:04"), time.Time{}.Add(schedules[host].End).Format("15:04")))
+	}
+	return logmessages, nil
+}
+
+// geoAnswers returns the GeoAnswers of the querier's region
+func (x *Xip) geoAnswers(srcAddr net.IP) []net.IP {
+	if x.GeoResolver != nil {
+		if ips, ok := x.GeoAnswers[x.GeoResolver.Region(srcAddr)]; ok {
+			return ips
+		}
+	}
+	return x.GeoAnswers[GeoRegionDefault]
+}
+
+// CIDRGeoResolver is a GeoResolver that's a simple CIDR → region table, e.g.
+// 10.0.0.0/8 → "eu"; the first matching CIDR wins. Those who need a
+// MaxMind-style database can inject their own GeoResolver instead.
+type CIDRGeoResolver []CIDRRegion
+
+// CIDRRegion is a row of a CIDRGeoResolver
+type CIDRRegion struct {
+	CIDR   net.IPNet
+	Region string
+}
+
+// Region returns the region of the first CIDR containing the IP, or
+// GeoRegionDefault if none do
+func (c CIDRGeoResolver) Region(ip net.IP) string {
+	if ip == nil {
+		return GeoRegionDefault
+	}
+	for _, cidrRegion := range c {
+		if cidrRegion.CIDR.Contains(ip) {
+			return cidrRegion.Region
+		}
+	}
+	return GeoRegionDefault
+}
+
+// TXTMetrics when TXT for "metrics.status.sslip.io" is queried, return the
+// cumulative metrics. They're over 1 kB, so over UDP they're truncated (TC)
+// unless the querier advertises the room (EDNS); see also TXTMetricsPage()
+func TXTMetrics(x *Xip, _ net.IP) (txtResources []dnsmessage.TXTResource, err error) {
+	<-x.DnsAmplificationAttackDelay
+	for _, metric := range x.metricsStrings() {
+		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{metric}})
+	}
+	return txtResources, nil
+}
+
+// TXTMetricsCompact when TXT for "compact.metrics.status.sslip.io" is
+// queried, return the main metrics as a single, machine-parseable string of
+// key=value pairs, e.g. "up=3600;q=1234;aq=1200;a=800;aaaa=400;blk=3;...".
+// It's one small record, no bigger than the query's amplification of an
+// "A" answer, so unlike the full metrics it isn't throttled.
+func TXTMetricsCompact(x *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+	m := x.Metrics.Snapshot()
+	var pairs []string
+	for _, pair := range []struct {
+		key   string
+		value int64
+	}{
+		{"up", int64(time.Since(m.Start).Seconds())},
+		{"q", m.Queries},
+		{"aq", m.AnsweredQueries},
+		{"a", m.AnsweredAQueries},
+		{"aaaa", m.AnsweredAAAAQueries},
+		{"blk", m.AnsweredBlockedQueries},
+		{"ptr", m.AnsweredPTRQueriesIPv4 + m.AnsweredPTRQueriesIPv6},
+		{"kvg", m.AnsweredTXTGetKvQueries},
+		{"kvp", m.AnsweredTXTPutKvQueries},
+		{"kvd", m.AnsweredTXTDelKvQueries},
+		{"udp", m.QueriesUDP},
+		{"tcp", m.QueriesTCP},
+		{"doh", m.QueriesDoH},
+		{"drop", m.DroppedQueries},
+		{"tcpa", m.TCPConnectionsActive},
+	} {
+		pairs = append(pairs, pair.key+"="+strconv.FormatInt(pair.value, 10))
+	}
+	return []dnsmessage.TXTResource{{TXT: []string{strings.Join(pairs, ";")}}}, nil
+}
+
+// TXTMetricsPage when TXT for "metrics.<page>.status.sslip.io" is queried,
+// return that page of the metrics (MetricsPageSize per page), preceded by the
+// page number & count, e.g. "Page: 2/3". As we add metrics, the pages keep each
+// response small enough not to be truncated or to amplify an attack. An
+// out-of-range page has no records.
+func TXTMetricsPage(x *Xip, page int) (txtResources []dnsmessage.TXTResource, err error) {
+	<-x.DnsAmplificationAttackDelay
+	metrics := x.metricsStrings()
+	pages := (len(metrics) + MetricsPageSize - 1) / MetricsPageSize
+	if page < 1 || page > pages {
+		return nil, nil
+	}
+	txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{fmt.Sprintf("Page: %d/%d", page, pages)}})
+	end := page * MetricsPageSize
+	if end > len(metrics) {
+		end = len(metrics)
+	}
+	for _, metric := range metrics[(page-1)*MetricsPageSize : end] {
+		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{metric}})
+	}
+	return txtResources, nil
+}
+
+// TXTRuntime when TXT for "runtime.status.sslip.io" is queried, return the Go
+// runtime's health: goroutines, heap, and garbage collection, e.g.
+// "Goroutines: 12", "Heap Alloc: 3145728" (bytes), "GC Runs: 7", "GC Last
+// Pause: 112.5µs", "GC Total Pause: 1.2ms". Like the metrics, it's throttled.
+func TXTRuntime(x *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+	<-x.DnsAmplificationAttackDelay
+	atomic.AddInt64(&x.Metrics.AnsweredTXTRuntimeQueries, 1)
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	var lastPause time.Duration
+	if memStats.NumGC > 0 {
+		lastPause = time.Duration(memStats.PauseNs[(memStats.NumGC+255)%256])
+	}
+	var txtResources []dnsmessage.TXTResource
+	for _, stat := range []string{
+		fmt.Sprintf("Goroutines: %d", runtime.NumGoroutine()),
+		fmt.Sprintf("Heap Alloc: %d", memStats.HeapAlloc),
+		fmt.Sprintf("Heap Sys: %d", memStats.HeapSys),
+		fmt.Sprintf("GC Runs: %d", memStats.NumGC),
+		fmt.Sprintf("GC Last Pause: %s", lastPause),
+		fmt.Sprintf("GC Total Pause: %s", time.Duration(memStats.PauseTotalNs)),
+	} {
+		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{stat}})
+	}
+	return txtResources, nil
+}
+
+// TXTServerID when TXT for "id.server.sslip.io" is queried, return the
+// ServerID, e.g. "ns-aws-1", to identify which (anycast) server answered;
+// it's the INET-class counterpart of CHAOS "id.server" for clients & tools
+// that can't query CHAOS. If the ServerID isn't set, return no records
+// (NODATA), lest we leak the hostname.
+func TXTServerID(x *Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+	if x.ServerID == "" {
+		return nil, nil
+	}
+	atomic.AddInt64(&x.Metrics.AnsweredServerIDQueries, 1)
+	return []dnsmessage.TXTResource{{TXT: []string{x.ServerID}}}, nil
+}
+
+// metricsStrings returns the metrics, one string each, e.g. "Uptime: 3600"
+func (x *Xip) metricsStrings() (metrics []string) {
+	m := x.Metrics.Snapshot()
+	uptime := time.Since(m.Start)
+	metrics = append(metrics, fmt.Sprintf("Uptime: %.0f", uptime.Seconds()))
+	keyValueStore := "etcd"
+	if x.isEtcdNil() {
+		keyValueStore = "builtin"
+	}
+	metrics = append(metrics, "KV Store: "+keyValueStore)
+	metrics = append(metrics, fmt.Sprintf("Blocklist: %s %d,%d",
+		x.BlocklistUpdated.Format("2006-01-02 15:04:05-07"),
+		len(x.BlocklistStrings),
+		len(x.BlocklistCDIRs)))
+	metrics = append(metrics, fmt.Sprintf("Queries: %d (%.1f/s)", m.Queries, float64(m.Queries)/uptime.Seconds()))
+	metrics = append(metrics, fmt.Sprintf("Answered Queries: %d (%.1f/s)", m.AnsweredQueries, float64(m.AnsweredQueries)/uptime.Seconds()))
+	metrics = append(metrics, fmt.Sprintf("A: %d", m.AnsweredAQueries))
+	metrics = append(metrics, fmt.Sprintf("AAAA: %d", m.AnsweredAAAAQueries))
+	metrics = append(metrics, fmt.Sprintf("TXT Source: %d", m.AnsweredTXTSrcIPQueries))
+	metrics = append(metrics, fmt.Sprintf("TXT Version: %d", m.AnsweredTXTVersionQueries))
+	metrics = append(metrics, fmt.Sprintf("TXT KV GET/PUT/DEL: %d/%d/%d", m.AnsweredTXTGetKvQueries, m.AnsweredTXTPutKvQueries, m.AnsweredTXTDelKvQueries))
+	metrics = append(metrics, fmt.Sprintf("PTR IPv4/IPv6: %d/%d", m.AnsweredPTRQueriesIPv4, m.AnsweredPTRQueriesIPv6))
+	metrics = append(metrics, fmt.Sprintf("NS DNS-01: %d", m.AnsweredNSDNS01ChallengeQueries))
+	metrics = append(metrics, fmt.Sprintf("Blocked: %d", m.AnsweredBlockedQueries))
+	metrics = append(metrics, fmt.Sprintf("Blocked A/AAAA: %d/%d", m.AnsweredBlockedAQueries, m.AnsweredBlockedAAAAQueries))
+	metrics = append(metrics, fmt.Sprintf("KV Read-only Rejections: %d", m.AnsweredReadOnlyRejections))
+	metrics = append(metrics, fmt.Sprintf("Queries UDP/TCP/DoH: %d/%d/%d",
+		m.QueriesUDP,
+		m.QueriesTCP,
+		m.QueriesDoH))
+	metrics = append(metrics, fmt.Sprintf("Dropped Queries: %d", m.DroppedQueries))
+	metrics = append(metrics, fmt.Sprintf("TXT Trace: %d", m.AnsweredTXTTraceQueries))
+	metrics = append(metrics, fmt.Sprintf("Slow etcd: %d", m.SlowEtcdQueries))
+	metrics = append(metrics, fmt.Sprintf("Denied by Allowlist: %d", m.DeniedByAllowlist))
+	metrics = append(metrics, fmt.Sprintf("TCP Connections Active/Accepted/Idle-closed: %d/%d/%d",
+		m.TCPConnectionsActive,
+		m.TCPConnectionsAccepted,
+		m.TCPConnectionsIdleClosed))
+	metrics = append(metrics, fmt.Sprintf("Refused without EDNS: %d", m.RefusedWithoutEDNS))
+	metrics = append(metrics, fmt.Sprintf("Truncated KV PUTs: %d", m.TruncatedKVPuts))
+	metrics = append(metrics, fmt.Sprintf("TXT Runtime: %d", m.AnsweredTXTRuntimeQueries))
+	metrics = append(metrics, fmt.Sprintf("TXT Server ID: %d", m.AnsweredServerIDQueries))
+	metrics = append(metrics, fmt.Sprintf("Timed-out Queries: %d", m.TimedOutQueries))
+	metrics = append(metrics, fmt.Sprintf("KV Pool A/AAAA: %d", m.AnsweredKvPoolQueries))
+	metrics = append(metrics, fmt.Sprintf("Unsupported Class: %d", m.AnsweredUnsupportedClass))
+	metrics = append(metrics, fmt.Sprintf("Drained Queries: %d", m.DrainedQueries))
+	metrics = append(metrics, fmt.Sprintf("Malformed Queries: %d", m.MalformedQueries))
+	metrics = append(metrics, fmt.Sprintf("Denied by Policy: %d", m.DeniedByPolicy))
+	metrics = append(metrics, fmt.Sprintf("Evicted KV Entries: %d", m.EvictedKVEntries))
+	metrics = append(metrics, fmt.Sprintf("Refused too many labels: %d", m.RefusedTooManyLabels))
+	metrics = append(metrics, fmt.Sprintf("Answered from flood cache: %d", m.AnsweredFromFloodCache))
+	metrics = append(metrics, fmt.Sprintf("CNAME/MX/NS/SOA: %d/%d/%d/%d", m.AnsweredCNAMEQueries, m.AnsweredMXQueries, m.AnsweredNSQueries, m.AnsweredSOAQueries))
+	return metrics
+}
+
+// redactedName is name, but with the export token in "<token>.export.k-v.io"
+// or the list token in "list.<token>.<prefix>.k-v.io" masked, lest the log
+// lines leak them
+func (x *Xip) redactedName(name string) string {
+	if !kvRE.MatchString(strings.ToLower(name)) {
+		return name
+	}
+	labels := strings.Split(name, ".")
+	labels = labels[:len(labels)-3] // strip ".k-v.io."
+	switch {
+	case len(labels) < 2:
+		return name
+	case x.KVExportToken != "" && strings.ToLower(labels[len(labels)-1]) == "export":
+		// the token is in the verb's position, as in kvTXTResources
+		return "<token>." + strings.Join(labels[1:], ".") + "." + KVZone
+	case x.KVListToken != "" && strings.ToLower(labels[0]) == "list" && len(labels) > 2:
+		// the token is in the value's position, which may span labels
+		return "list.<token>." + labels[len(labels)-1] + "." + KVZone
+	}
+	return name
+}
+
+// when TXT for "k-v.io" is queried, return the key-value pair
+func (x *Xip) kvTXTResources(ctx context.Context, fqdn string) ([]dnsmessage.TXTResource, error) {
+	// "labels" => official RFC 1035 term
+	// k-v.io. => ["k-v", "io"] are labels
+	var (
+		verb  string // i.e. "get", "put", "delete"
+		key   string // e.g. "my-key" as in "my-key.k-v.io"
+		value string // e.g. "my-value" as in "put.my-value.my-key.k-v.io"
+	)
+	labels := strings.Split(fqdn, ".")
+	labels = labels[:len(labels)-3] // strip ".k-v.io"
+	// key is always present, always first subdomain of "k-v.io"
+	key = strings.ToLower(labels[len(labels)-1])
+	switch {
+	case len(labels) == 1:
+		verb = "get" // default action if only key, not verb, is not present
+	case len(labels) == 2:
+		verb = strings.ToLower(labels[0]) // verb, if present, is leftmost, "put.value.key.k-v.io"
+	case len(labels) > 2:
+		verb = strings.ToLower(labels[0])
+		// concatenate multiple labels to create value, especially useful for version numbers
+		value = strings.Join(labels[1:len(labels)-1], ".") // e.g. "put.94.0.2.firefox-version.k-v.io"
+	}
+	if key == "export" && x.KVExportToken != "" {
+		// the token is in the verb's position: "<token>.export.k-v.io"
+		if subtle.ConstantTimeCompare([]byte(verb), []byte(strings.ToLower(x.KVExportToken))) != 1 {
+			return []dnsmessage.TXTResource{{TXT: []string{"403: invalid export token"}}}, nil
+		}
+		return x.exportKvSummary()
+	}
+	if verb == "list" {
+		// the token is in the value's position: "list.<token>.<prefix>.k-v.io"
+		if x.KVListToken == "" {
+			return []dnsmessage.TXTResource{{TXT: []string{"403: listing is disabled"}}}, nil
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(value)), []byte(strings.ToLower(x.KVListToken))) != 1 {
+			return []dnsmessage.TXTResource{{TXT: []string{"403: invalid list token"}}}, nil
+		}
+		return x.listKv(ctx, key)
+	}
+	if x.KVReadOnly && verb != "get" {
+		atomic.AddInt64(&x.Metrics.AnsweredReadOnlyRejections, 1)
+		return []dnsmessage.TXTResource{{TXT: []string{"403: read-only node"}}}, nil
+	}
+	if verb != "get" && !x.KVPTRPuts && (key == KvDHCPNamespace || strings.HasPrefix(key, KvPTRPrefix) || strings.HasPrefix(key, KvDHCPPrefix)) {
+		// puts & deletes alike: anyone could otherwise repoint or wipe a lease
+		return []dnsmessage.TXTResource{{TXT: []string{"403: PTR writes are disabled"}}}, nil
+	}
+	if key == KvDHCPNamespace && verb == "put" && len(labels) > 2 {
+		return x.putKvDHCPLease(ctx, value)
+	}
+	// prepare to query etcd:
+	switch verb {
+	case "get":
+		if len(labels) > 2 {
+			return x.kvErrorTXTResources(x.getKvField(ctx, key, value)) // e.g. "get.owner.email.key.k-v.io"
+		}
+		return x.kvErrorTXTResources(x.getKv(ctx, key))
+	case "put":
+		if len(labels) == 2 {
+			return []dnsmessage.TXTResource{{[]string{"422: missing a value: put.value.key.k-v.io"}}}, nil
+		}
+		return x.kvErrorTXTResources(x.putKv(ctx, key, value))
+	case "delete":
+		return x.kvErrorTXTResources(x.deleteKv(ctx, key))
+	}
+	return []dnsmessage.TXTResource{{[]string{"422: valid verbs are get, put, delete, list"}}}, nil
+}
+
+// kvErrorTXTResources maps the key-value store's errors to TXT records: a
+// missing key has none, an invalid key is a 422, and an unavailable etcd is
+// a 503 (which we log); other errors are returned as-is
+func (x *Xip) kvErrorTXTResources(txtResources []dnsmessage.TXTResource, err error) ([]dnsmessage.TXTResource, error) {
+	switch {
+	case err == nil:
+		return txtResources, nil
+	case errors.Is(err, ErrKVNotFound):
+		return []dnsmessage.TXTResource{}, nil
+	case errors.Is(err, ErrKVInvalidKey):
+		return []dnsmessage.TXTResource{{TXT: []string{"422: invalid key"}}}, nil
+	case errors.Is(err, ErrKVBackendUnavailable):
+		x.logger().Println(err.Error())
+		return []dnsmessage.TXTResource{{TXT: []string{"503: the key-value store is unavailable"}}}, nil
+	}
+	return nil, err
+}
+
+// ValidKVKey returns true if the key can be stored, i.e. it's not empty and
+// has no control characters (e.g. "\000"), which would garble the logs &
+// exports
+func ValidKVKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// GetKV returns the value stored under the key, ErrKVNotFound if there's
+// none, ErrKVInvalidKey, or ErrKVBackendUnavailable if etcd is down. A value
+// with multiple TXT records has them joined by KvRecordSeparator.
+func (x *Xip) GetKV(key string) (string, error) {
+	if !ValidKVKey(key) {
+		return "", fmt.Errorf(`couldn't GET "%s": %w`, key, ErrKVInvalidKey)
+	}
+	value, ok, err := x.kvValue(context.Background(), key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf(`couldn't GET "%s": %w`, key, ErrKVNotFound)
+	}
+	return value, nil
+}
+
+func (x *Xip) getKv(ctx context.Context, key string) ([]dnsmessage.TXTResource, error) {
+	if !ValidKVKey(key) {
+		return nil, fmt.Errorf(`couldn't GET "%s": %w`, key, ErrKVInvalidKey)
+	}
+	if x.isEtcdNil() {
+		kvMutex.RLock()
+		txtRecord, ok := TxtKvCustomizations[key]
+		kvMutex.RUnlock()
+		if ok {
+			atomic.AddInt64(&x.Metrics.AnsweredTXTGetKvQueries, 1)
+			return txtRecord, nil
+		}
+		return nil, fmt.Errorf(`couldn't GET "%s": %w`, key, ErrKVNotFound)
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdContextTimeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := x.ShardFor(key).Get(ctx, key)
+	x.checkEtcdLatency("GET", key, start)
+	if err != nil {
+		return nil, fmt.Errorf(`couldn't GET "%s": %w`, key, kvBackendError{err})
+	}
+	if len(resp.Kvs) > 0 {
+		atomic.AddInt64(&x.Metrics.AnsweredTXTGetKvQueries, 1)
+		return kvValueToTXTResources(string(resp.Kvs[0].Value)), nil
+	}
+	return nil, fmt.Errorf(`couldn't GET "%s": %w`, key, ErrKVNotFound)
+}
+
+// getKvField returns the field of the JSON value stored under the key; the
+// field is a dotted path whose elements are object keys (case-insensitive
+// if there's no exact match, as resolvers may randomize the case) or array
+// indices, e.g. "owner.email" or "aliases.0"
+func (x *Xip) getKvField(ctx context.Context, key, path string) ([]dnsmessage.TXTResource, error) {
+	value, ok, err := x.kvValue(ctx, key)
+	if err != nil || !ok {
+		return []dnsmessage.TXTResource{}, err
+	}
+	var field interface{}
+	if err = json.Unmarshal([]byte(value), &field); err != nil {
+		return []dnsmessage.TXTResource{{TXT: []string{"422: the value isn't JSON"}}}, nil
+	}
+	for _, element := range strings.Split(path, ".") {
+		var found bool
+		switch container := field.(type) {
+		case map[string]interface{}:
+			if field, found = container[element]; !found {
+				for name, child := range container {
+					if strings.EqualFold(name, element) {
+						field, found = child, true
+						break
+					}
+				}
+			}
+		case []interface{}:
+			if i, err := strconv.Atoi(element); err == nil && i >= 0 && i < len(container) {
+				field, found = container[i], true
+			}
+		}
+		if !found {
+			return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf(`404: no field "%s"`, path)}}}, nil
+		}
+	}
+	fieldString, ok := field.(string)
+	if !ok {
+		fieldBytes, err := json.Marshal(field) // numbers, booleans, null, objects & arrays
+		if err != nil {
+			return nil, err
+		}
+		fieldString = string(fieldBytes)
+	}
+	if len(fieldString) > KvMaxTXTBytes {
+		fieldString = fieldString[:KvMaxTXTBytes]
+	}
+	// a TXT record's strings are at most 255 bytes apiece
+	var txtStrings []string
+	for len(fieldString) > 255 {
+		txtStrings = append(txtStrings, fieldString[:255])
+		fieldString = fieldString[255:]
+	}
+	atomic.AddInt64(&x.Metrics.AnsweredTXTGetKvQueries, 1)
+	return []dnsmessage.TXTResource{{TXT: append(txtStrings, fieldString)}}, nil
+}
+
+// kvValue returns the raw value stored under the key, and whether there is one
+func (x *Xip) kvValue(ctx context.Context, key string) (value string, ok bool, err error) {
+	if x.isEtcdNil() {
+		kvMutex.RLock()
+		txtRecords, ok := TxtKvCustomizations[key]
+		kvMutex.RUnlock()
+		if !ok {
+			return "", false, nil
+		}
+		var records []string
+		for _, txtRecord := range txtRecords {
+			records = append(records, strings.Join(txtRecord.TXT, ""))
+		}
+		return strings.Join(records, KvRecordSeparator), true, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdContextTimeout)
+	defer cancel()
+	start := time.Now()
+	resp, err := x.ShardFor(key).Get(ctx, key)
+	x.checkEtcdLatency("GET", key, start)
+	if err != nil {
+		return "", false, fmt.Errorf(`couldn't GET "%s": %w`, key, kvBackendError{err})
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(resp.Kvs[0].Value), true, nil
+}
+
+// kvValueToTXTResources splits the stored value into TXT records on
+// KvRecordSeparator, up to KvMaxTXTBytes, and the records into strings of at
+// most 255 bytes apiece, e.g. an imported value's
+func kvValueToTXTResources(value string) (txtResources []dnsmessage.TXTResource) {
+	size := 0
+	for _, record := range strings.Split(value, KvRecordSeparator) {
+		size += len(record)
+		if size > KvMaxTXTBytes {
+			break
+		}
+		var txtStrings []string
+		for len(record) > 255 {
+			txtStrings = append(txtStrings, record[:255])
+			record = record[255:]
+		}
+		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: append(txtStrings, record)})
+	}
+	return txtResources
+}
+
+// kvPutSequence & kvPutOrder track when the builtin key-value store's keys
+// were last put (or imported), for KVMaxEntries's eviction; keys stored
+// otherwise (e.g. the config file's) count as the oldest. kvMutex guards
+// them & TxtKvCustomizations,
+// which queries' puts & deletes modify while other queries read it
+var (
+	kvPutSequence uint64
+	kvPutOrder    = map[string]uint64{}
+	kvMutex       sync.RWMutex
+)
+
+// putKv stores the value under the key. If the value exceeds KVMaxPutBytes,
+// we truncate it, and say so in an extra TXT record, e.g. "stored (truncated
+// to 63 bytes)", unless KVStrictPuts, in which case we refuse it. If the
+// builtin store has KVMaxEntries keys, a new key evicts the least recently
+// put one, unless KVStrictPuts, in which case we refuse it, too.
+func (x *Xip) putKv(ctx context.Context, key, value string) ([]dnsmessage.TXTResource, error) {
+	if !ValidKVKey(key) {
+		return nil, fmt.Errorf("couldn't PUT (%s: %s): %w", key, value, ErrKVInvalidKey)
+	}
+	maxPutBytes := x.KVMaxPutBytes
+	if maxPutBytes == 0 {
+		maxPutBytes = DefaultKvMaxPutBytes
+	}
+	truncated := len(value) > maxPutBytes
+	if truncated {
+		if x.KVStrictPuts {
+			return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf("413: the value exceeds %d bytes", maxPutBytes)}}}, nil
+		}
+		value = value[:maxPutBytes]
+	}
+	if strings.HasPrefix(key, KvPTRPrefix) && !ValidHostname(value) {
+		return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf(`422: "%s" isn't a valid hostname for a PTR record`, value)}}}, nil
+	}
+	if x.isEtcdNil() {
+		if err := ctx.Err(); err != nil {
+			// we've answered SERVFAIL (see processQuestionWithin), so we mustn't store it
+			return nil, fmt.Errorf("couldn't PUT (%s: %s): %w", key, value, err)
+		}
+		if !x.putBuiltinKv(key, value) {
+			return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf("507: the key-value store is full (%d keys)", x.KVMaxEntries)}}}, nil
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, etcdContextTimeout)
+		defer cancel()
+		start := time.Now()
+		_, err := x.ShardFor(key).Put(ctx, key, value)
+		x.checkEtcdLatency("PUT", key, start)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't PUT (%s: %s): %w", key, value, kvBackendError{err})
+		}
+	}
+	atomic.AddInt64(&x.Metrics.AnsweredTXTPutKvQueries, 1)
+	txtResources := kvValueToTXTResources(value)
+	if truncated {
+		atomic.AddInt64(&x.Metrics.TruncatedKVPuts, 1)
+		txtResources = append(txtResources, dnsmessage.TXTResource{TXT: []string{fmt.Sprintf("stored (truncated to %d bytes)", maxPutBytes)}})
+	}
+	return txtResources, nil
+}
+
+// putBuiltinKv stores the value under the key in the builtin key-value
+// store. If the store has KVMaxEntries keys, a new key evicts the least
+// recently put one, unless KVStrictPuts, in which case it returns false
+func (x *Xip) putBuiltinKv(key, value string) bool {
+	kvMutex.Lock()
+	defer kvMutex.Unlock()
+	if _, ok := TxtKvCustomizations[key]; !ok && x.KVMaxEntries > 0 {
+		if x.KVStrictPuts && len(TxtKvCustomizations) >= x.KVMaxEntries {
+			return false
+		}
+		for len(TxtKvCustomizations) >= x.KVMaxEntries {
+			x.evictOldestKv()
+		}
+	}
+	TxtKvCustomizations[key] = kvValueToTXTResources(value)
+	kvPutSequence++
+	kvPutOrder[key] = kvPutSequence
+	return true
+}
+
+// evictOldestKv deletes the builtin key-value store's least recently put key
+// (of equally old keys, the first alphabetically). It scans every key, but
+// the store is capped at KVMaxEntries keys. The caller holds kvMutex
+func (x *Xip) evictOldestKv() {
+	var oldestKey string
+	var oldestSequence uint64
+	found := false
+	for key := range TxtKvCustomizations {
+		sequence := kvPutOrder[key]
+		if !found || sequence < oldestSequence || (sequence == oldestSequence && key < oldestKey) {
+			oldestKey, oldestSequence, found = key, sequence, true
+		}
+	}
+	if !found {
+		return
+	}
+	delete(TxtKvCustomizations, oldestKey)
+	delete(kvPutOrder, oldestKey)
+	atomic.AddInt64(&x.Metrics.EvictedKVEntries, 1)
+}
+
+// putKvDHCPLease stores the lease, e.g. "10.0.0.5.myhost" (or
+// "fe80--5.myhost"): the host's IP & the IP's hostname, i.e. the PTR record,
+// "myhost.dhcp.k-v.io.". If the host had leased another IP, that IP's PTR
+// record is stale, so we delete it; likewise, if another host had leased
+// this IP, that host's lease is stale, so we delete it, too
+func (x *Xip) putKvDHCPLease(ctx context.Context, value string) ([]dnsmessage.TXTResource, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return []dnsmessage.TXTResource{{TXT: []string{"422: missing an IP: put.10.0.0.5.myhost.dhcp.k-v.io"}}}, nil
+	}
+	host := strings.ToLower(value[i+1:])
+	ip := net.ParseIP(value[:i])
+	if ip == nil {
+		ip = net.ParseIP(strings.ReplaceAll(value[:i], "-", ":"))
+	}
+	hostname := host + "." + KvDHCPNamespace + "." + KVZone
+	if ip == nil || !ValidHostname(hostname) {
+		return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf(`422: "%s" isn't an IP & a hostname`, value)}}}, nil
+	}
+	previous, ok, err := x.kvValue(ctx, KvDHCPPrefix+host)
+	if err != nil {
+		return x.kvErrorTXTResources(nil, err)
+	}
+	if previousIP := net.ParseIP(previous); ok && previousIP != nil && !previousIP.Equal(ip) {
+		if _, err = x.deleteKv(ctx, KvPTRPrefix+ipWithDashes(previousIP)); err != nil && !errors.Is(err, ErrKVNotFound) {
+			return x.kvErrorTXTResources(nil, err)
+		}
+	}
+	owner, ok, err := x.kvValue(ctx, KvPTRPrefix+ipWithDashes(ip))
+	if err != nil {
+		return x.kvErrorTXTResources(nil, err)
+	}
+	if ownerHost := strings.TrimSuffix(owner, "."+KvDHCPNamespace+"."+KVZone); ok && ownerHost != owner && ownerHost != host {
+		if _, err = x.deleteKv(ctx, KvDHCPPrefix+ownerHost); err != nil && !errors.Is(err, ErrKVNotFound) {
+			return x.kvErrorTXTResources(nil, err)
+		}
+	}
+	if _, err = x.putKv(ctx, KvDHCPPrefix+host, ip.String()); err != nil {
+		return x.kvErrorTXTResources(nil, err)
+	}
+	return x.kvErrorTXTResources(x.putKv(ctx, KvPTRPrefix+ipWithDashes(ip), hostname))
+}
+
+// ExportKV writes every key-value pair in the key-value store (etcd or
+// builtin) to w as a JSON object, e.g. {"my-key":"my-value"}. A value with
+// multiple TXT records has them joined by KvRecordSeparator.
+func (x *Xip) ExportKV(w io.Writer) error {
+	kvs, err := x.allKvs()
+	if err != nil {
+		return err
 	}
-	return txtResources, nil
+	return json.NewEncoder(w).Encode(kvs)
 }
 
-// when TXT for "k-v.io" is queried, return the key-value pair
-func (x *Xip) kvTXTResources(fqdn string) ([]dnsmessage.TXTResource, error) {
-	// "labels" => official RFC 1035 term
-	// k-v.io. => ["k-v", "io"] are labels
-	var (
-		verb  string // i.e. "get", "put", "delete"
-		key   string // e.g. "my-key" as in "my-key.k-v.io"
-		value string // e.g. "my-value" as in "put.my-value.my-key.k-v.io"
-	)
-	labels := strings.Split(fqdn, ".")
-	labels = labels[:len(labels)-3] // strip ".k-v.io"
-	// key is always present, always first subdomain of "k-v.io"
-	key = strings.ToLower(labels[len(labels)-1])
-	switch {
-	case len(labels) == 1:
-		verb = "get" // default action if only key, not verb, is not present
-	case len(labels) == 2:
-		verb = strings.ToLower(labels[0]) // verb, if present, is leftmost, "put.value.key.k-v.io"
-	case len(labels) > 2:
-		verb = strings.ToLower(labels[0])
-		// concatenate multiple labels to create value, especially useful for version numbers
-		value = strings.Join(labels[1:len(labels)-1], ".") // e.g. "put.94.0.2.firefox-version.k-v.io"
+// ImportKV reads a JSON object of key-value pairs (the output of ExportKV)
+// from r and puts them into the key-value store (etcd or builtin),
+// overwriting existing keys. Unlike "put.value.key.k-v.io", it doesn't
+// truncate the values, but the builtin store's KVMaxEntries cap applies.
+func (x *Xip) ImportKV(r io.Reader) error {
+	var kvs map[string]string
+	if err := json.NewDecoder(r).Decode(&kvs); err != nil {
+		return fmt.Errorf("couldn't decode the key-value JSON: %w", err)
 	}
-	// prepare to query etcd:
-	switch verb {
-	case "get":
-		return x.getKv(key)
-	case "put":
-		if len(labels) == 2 {
-			return []dnsmessage.TXTResource{{[]string{"422: missing a value: put.value.key.k-v.io"}}}, nil
+	for key, value := range kvs {
+		if x.isEtcdNil() {
+			if !x.putBuiltinKv(key, value) {
+				return fmt.Errorf("couldn't PUT (%s: %s): the key-value store is full (%d keys)", key, value, x.KVMaxEntries)
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), etcdContextTimeout)
+		_, err := x.ShardFor(key).Put(ctx, key, value)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("couldn't PUT (%s: %s): %w", key, value, kvBackendError{err})
 		}
-		return x.putKv(key, value)
-	case "delete":
-		return x.deleteKv(key)
 	}
-	return []dnsmessage.TXTResource{{[]string{"422: valid verbs are get, put, delete"}}}, nil
+	return nil
 }
 
-func (x *Xip) getKv(key string) ([]dnsmessage.TXTResource, error) {
+// allKvs returns every key-value pair in the key-value store
+func (x *Xip) allKvs() (map[string]string, error) {
+	kvs := map[string]string{}
 	if x.isEtcdNil() {
-		if txtRecord, ok := TxtKvCustomizations[key]; ok {
-			x.Metrics.AnsweredTXTGetKvQueries++
-			return txtRecord, nil
+		kvMutex.RLock()
+		defer kvMutex.RUnlock()
+		for key, txtResources := range TxtKvCustomizations {
+			var records []string
+			for _, txtResource := range txtResources {
+				records = append(records, strings.Join(txtResource.TXT, ""))
+			}
+			kvs[key] = strings.Join(records, KvRecordSeparator)
 		}
-		return nil, nil
+		return kvs, nil
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), etcdContextTimeout)
 	defer cancel()
-	resp, err := x.Etcd.Get(ctx, key)
+	for _, shard := range x.etcdShards() {
+		// the empty prefix is every key
+		resp, err := shard.Get(ctx, "", clientv3.WithPrefix())
+		if err != nil {
+			return nil, fmt.Errorf("couldn't GET all keys: %w", err)
+		}
+		for _, kv := range resp.Kvs {
+			kvs[string(kv.Key)] = string(kv.Value)
+		}
+	}
+	return kvs, nil
+}
+
+// exportKvSummary returns the number of keys & the SHA-256 of the ExportKV
+// output, e.g. to check that an import on another node matches. We don't
+// return the contents: they may be sensitive, and they'd be a fine DNS
+// amplification attack.
+func (x *Xip) exportKvSummary() ([]dnsmessage.TXTResource, error) {
+	kvs, err := x.allKvs()
 	if err != nil {
-		return nil, fmt.Errorf(`couldn't GET "%s": %w`, key, err)
+		return nil, err
 	}
-	if len(resp.Kvs) > 0 {
-		x.Metrics.AnsweredTXTGetKvQueries++
-		return []dnsmessage.TXTResource{{[]string{string(resp.Kvs[0].Value)}}}, nil
+	hash := sha256.New()
+	if err = json.NewEncoder(hash).Encode(kvs); err != nil {
+		return nil, err
 	}
-	return []dnsmessage.TXTResource{}, nil
+	return []dnsmessage.TXTResource{
+		{TXT: []string{fmt.Sprintf("keys: %d", len(kvs))}},
+		{TXT: []string{"sha256: " + hex.EncodeToString(hash.Sum(nil))}},
+	}, nil
 }
 
-func (x *Xip) putKv(key, value string) ([]dnsmessage.TXTResource, error) {
-	if len(value) > 63 { // too-long TXT records can be used in DNS amplification attacks; Truncate!
-		value = value[:63]
-	}
+// listKv returns the keys that start with the prefix, sorted, as the strings
+// of a TXT record, at most KvMaxListKeys of them; if there are more, the last
+// string says so, e.g. "my-key-1", "my-key-2", "(truncated)"
+func (x *Xip) listKv(ctx context.Context, prefix string) ([]dnsmessage.TXTResource, error) {
+	var keys []string
 	if x.isEtcdNil() {
-		TxtKvCustomizations[key] = []dnsmessage.TXTResource{
-			{
-				[]string{value},
-			},
+		kvMutex.RLock()
+		for key := range TxtKvCustomizations {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		kvMutex.RUnlock()
+		sort.Strings(keys)
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, etcdContextTimeout)
+		defer cancel()
+		start := time.Now()
+		for _, shard := range x.etcdShards() {
+			// etcd sorts the range by key; one more than the cap tells us to truncate
+			resp, err := shard.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(), clientv3.WithLimit(KvMaxListKeys+1))
+			if err != nil {
+				return nil, fmt.Errorf(`couldn't LIST "%s": %w`, prefix, err)
+			}
+			for _, kv := range resp.Kvs {
+				keys = append(keys, string(kv.Key))
+			}
 		}
-		x.Metrics.AnsweredTXTPutKvQueries++
-		return TxtKvCustomizations[key], nil
+		x.checkEtcdLatency("LIST", prefix, start)
+		sort.Strings(keys) // each shard's keys are sorted, but not all of them
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), etcdContextTimeout)
-	defer cancel()
-	_, err := x.Etcd.Put(ctx, key, value)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't PUT (%s: %s): %w", key, value, err)
+	atomic.AddInt64(&x.Metrics.AnsweredTXTGetKvQueries, 1)
+	if len(keys) == 0 {
+		return []dnsmessage.TXTResource{}, nil
+	}
+	if len(keys) > KvMaxListKeys {
+		keys = append(keys[:KvMaxListKeys], "(truncated)")
+	}
+	return []dnsmessage.TXTResource{{TXT: keys}}, nil
+}
+
+// checkEtcdLatency logs a warning and counts a SlowEtcdQueries if the etcd
+// call that began at start exceeded the SlowEtcdThreshold: early warning of a
+// degrading etcd cluster, before the etcdContextTimeout starts firing
+func (x *Xip) checkEtcdLatency(operation, key string, start time.Time) {
+	if x.SlowEtcdThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > x.SlowEtcdThreshold {
+		atomic.AddInt64(&x.Metrics.SlowEtcdQueries, 1)
+		x.logger().Printf(`slow etcd: %s "%s" took %s, more than the %s threshold`, operation, key, elapsed.Round(time.Millisecond), x.SlowEtcdThreshold)
 	}
-	x.Metrics.AnsweredTXTPutKvQueries++
-	return []dnsmessage.TXTResource{{[]string{value}}}, nil
 }
 
-func (x *Xip) deleteKv(key string) ([]dnsmessage.TXTResource, error) {
+func (x *Xip) deleteKv(ctx context.Context, key string) ([]dnsmessage.TXTResource, error) {
+	if !ValidKVKey(key) {
+		return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, ErrKVInvalidKey)
+	}
 	if x.isEtcdNil() {
-		if _, ok := TxtKvCustomizations[key]; ok {
-			x.Metrics.AnsweredTXTDelKvQueries++
-			delete(TxtKvCustomizations, key)
+		if err := ctx.Err(); err != nil {
+			// we've answered SERVFAIL (see processQuestionWithin), so we mustn't delete it
+			return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, err)
 		}
+		kvMutex.Lock()
+		defer kvMutex.Unlock()
+		if _, ok := TxtKvCustomizations[key]; !ok {
+			return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, ErrKVNotFound)
+		}
+		atomic.AddInt64(&x.Metrics.AnsweredTXTDelKvQueries, 1)
+		delete(TxtKvCustomizations, key)
+		delete(kvPutOrder, key)
 		return nil, nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), etcdContextTimeout)
+	ctx, cancel := context.WithTimeout(ctx, etcdContextTimeout)
 	defer cancel()
-	_, err := x.Etcd.Delete(ctx, key)
+	start := time.Now()
+	resp, err := x.ShardFor(key).Delete(ctx, key)
+	x.checkEtcdLatency("DELETE", key, start)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, err)
+		return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, kvBackendError{err})
+	}
+	atomic.AddInt64(&x.Metrics.AnsweredTXTDelKvQueries, 1)
+	if resp != nil && resp.Deleted == 0 {
+		return nil, fmt.Errorf("couldn't DELETE (key %s): %w", key, ErrKVNotFound)
 	}
-	x.Metrics.AnsweredTXTDelKvQueries++
 	return nil, nil
 }
 
@@ -1088,7 +3894,36 @@ func (a Metrics) MostlyEquals(b Metrics) bool {
 		a.AnsweredPTRQueriesIPv4 == b.AnsweredPTRQueriesIPv4 &&
 		a.AnsweredPTRQueriesIPv6 == b.AnsweredPTRQueriesIPv6 &&
 		a.AnsweredNSDNS01ChallengeQueries == b.AnsweredNSDNS01ChallengeQueries &&
-		a.AnsweredBlockedQueries == b.AnsweredBlockedQueries {
+		a.AnsweredBlockedQueries == b.AnsweredBlockedQueries &&
+		a.AnsweredBlockedAQueries == b.AnsweredBlockedAQueries &&
+		a.AnsweredBlockedAAAAQueries == b.AnsweredBlockedAAAAQueries &&
+		a.AnsweredReadOnlyRejections == b.AnsweredReadOnlyRejections &&
+		a.QueriesUDP == b.QueriesUDP &&
+		a.QueriesTCP == b.QueriesTCP &&
+		a.QueriesDoH == b.QueriesDoH &&
+		a.DroppedQueries == b.DroppedQueries &&
+		a.AnsweredTXTTraceQueries == b.AnsweredTXTTraceQueries &&
+		a.SlowEtcdQueries == b.SlowEtcdQueries &&
+		a.DeniedByAllowlist == b.DeniedByAllowlist &&
+		a.TCPConnectionsAccepted == b.TCPConnectionsAccepted &&
+		a.TCPConnectionsIdleClosed == b.TCPConnectionsIdleClosed &&
+		a.RefusedWithoutEDNS == b.RefusedWithoutEDNS &&
+		a.TruncatedKVPuts == b.TruncatedKVPuts &&
+		a.AnsweredTXTRuntimeQueries == b.AnsweredTXTRuntimeQueries &&
+		a.AnsweredServerIDQueries == b.AnsweredServerIDQueries &&
+		a.TimedOutQueries == b.TimedOutQueries &&
+		a.AnsweredKvPoolQueries == b.AnsweredKvPoolQueries &&
+		a.AnsweredUnsupportedClass == b.AnsweredUnsupportedClass &&
+		a.DrainedQueries == b.DrainedQueries &&
+		a.MalformedQueries == b.MalformedQueries &&
+		a.DeniedByPolicy == b.DeniedByPolicy &&
+		a.EvictedKVEntries == b.EvictedKVEntries &&
+		a.RefusedTooManyLabels == b.RefusedTooManyLabels &&
+		a.AnsweredFromFloodCache == b.AnsweredFromFloodCache &&
+		a.AnsweredCNAMEQueries == b.AnsweredCNAMEQueries &&
+		a.AnsweredMXQueries == b.AnsweredMXQueries &&
+		a.AnsweredNSQueries == b.AnsweredNSQueries &&
+		a.AnsweredSOAQueries == b.AnsweredSOAQueries {
 		return true
 	}
 	return false
@@ -1127,11 +3962,15 @@ func (x *Xip) downloadBlockList(blocklistURL string) string {
 	x.BlocklistStrings = blocklistStrings
 	x.BlocklistCDIRs = blocklistCIDRs
 	x.BlocklistUpdated = time.Now()
+	x.flushFloodCache() // lest it answer with the old blocklist
 	return fmt.Sprintf("Successfully downloaded blocklist from %s: %v, %v", blocklistURL, x.BlocklistStrings, x.BlocklistCDIRs)
 }
 
 // ReadBlocklist "sanitizes" the block list, removing comments, invalid characters
-// and lowercasing the names to be blocked.
+// and lowercasing the names to be blocked. Besides our format (one name or
+// CIDR per line), it reads threat feeds' formats, detected per line: hosts
+// files ("0.0.0.0 bad.example.com") and domain lists ("bad.example.com"),
+// whose domains are blocked wherever they appear in the hostname.
 // public to make testing easier
 func ReadBlocklist(blocklist io.Reader) (stringBlocklists []string, cidrBlocklists []net.IPNet, err error) {
 	scanner := bufio.NewScanner(blocklist)
@@ -1142,7 +3981,21 @@ func ReadBlocklist(blocklist io.Reader) (stringBlocklists []string, cidrBlocklis
 	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.ToLower(line)
-		line = comments.ReplaceAllString(line, "")                                // strip comments
+		line = comments.ReplaceAllString(line, "") // strip comments
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			// hosts file: the IP, then the hostname(s)
+			for _, hostname := range fields[1:] {
+				if isBlocklistDomain(hostname) {
+					stringBlocklists = append(stringBlocklists, strings.TrimSuffix(hostname, "."))
+				}
+			}
+			continue
+		}
+		if len(fields) == 1 && isBlocklistDomain(fields[0]) {
+			stringBlocklists = append(stringBlocklists, strings.TrimSuffix(fields[0], "."))
+			continue
+		}
 		line = invalidDNScharsWithSlashesDotsAndColons.ReplaceAllString(line, "") // strip invalid characters
 		_, ipcidr, err := net.ParseCIDR(line)
 		if err != nil {
@@ -1161,16 +4014,165 @@ func ReadBlocklist(blocklist io.Reader) (stringBlocklists []string, cidrBlocklis
 	return stringBlocklists, cidrBlocklists, nil
 }
 
+// isBlocklistDomain returns true if the hosts file's or domain list's entry
+// is a domain to block, e.g. "bad.example.com", but not an IP (e.g. "0.0.0.0")
+// or a single label (e.g. "localhost"), which would block far too much
+func isBlocklistDomain(entry string) bool {
+	return strings.Contains(strings.TrimSuffix(entry, "."), ".") && ValidHostname(entry) && net.ParseIP(entry) == nil
+}
+
 func (x *Xip) isEtcdNil() bool {
+	if len(x.EtcdShards) > 0 {
+		return false
+	}
+	etcdCli := x.etcdClient()
 	// comparing interfaces to nil are tricky: interfaces contain both a type
 	// and a value, and although the value is nil the type isn't, so we need the following
-	if x.Etcd == nil || reflect.ValueOf(x.Etcd).IsNil() {
+	if etcdCli == nil || reflect.ValueOf(etcdCli).IsNil() {
 		return true
 	}
 	return false
 }
 
+// etcdClient returns Etcd; use it rather than Etcd, which RetryEtcd() may
+// switch over in the background
+func (x *Xip) etcdClient() V3client {
+	x.etcdMutex.RLock()
+	defer x.etcdMutex.RUnlock()
+	return x.Etcd
+}
+
+// ShardFor returns the etcd client whose cluster holds the key: one of the
+// EtcdShards, by rendezvous (highest random weight) hashing, so adding a
+// shard moves only its share of the keys; or Etcd, if we don't shard
+func (x *Xip) ShardFor(key string) V3client {
+	if len(x.EtcdShards) == 0 {
+		return x.etcdClient()
+	}
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(key))
+	keyHash := hash.Sum64()
+	var shard V3client
+	var maxWeight uint64
+	for i, candidate := range x.EtcdShards {
+		if weight := mix64(keyHash ^ uint64(i+1)*0x9e3779b97f4a7c15); shard == nil || weight > maxWeight {
+			shard, maxWeight = candidate, weight
+		}
+	}
+	return shard
+}
+
+// mix64 is SplitMix64's finalizer; it scrambles the bits of the key's hash &
+// the shard's index thoroughly enough that every shard is equally likely to
+// have the highest weight, which FNV alone isn't
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// etcdShards returns every etcd client, for the operations that span the
+// keys, e.g. listing them
+func (x *Xip) etcdShards() []V3client {
+	if len(x.EtcdShards) == 0 {
+		return []V3client{x.etcdClient()}
+	}
+	return x.EtcdShards
+}
+
+// RetryEtcd calls connect every interval, in the background, until it
+// connects, and then switches from the builtin key-value store to etcd. It's
+// for when etcd is briefly unavailable when we start, so that we needn't
+// restart once it's back. Until it connects, Ready() is false. If we're
+// already connected to etcd, it does nothing.
+func (x *Xip) RetryEtcd(connect func() (V3client, error), interval time.Duration) {
+	if !x.isEtcdNil() {
+		return
+	}
+	x.etcdMutex.Lock()
+	x.etcdRetrying = true
+	x.etcdMutex.Unlock()
+	go func() {
+		for attempt := 1; ; attempt++ {
+			time.Sleep(interval)
+			etcdCli, err := connect()
+			if err != nil {
+				x.logger().Printf("failed to connect to etcd (attempt %d), will retry in %s: %s", attempt, interval, err.Error())
+				continue
+			}
+			x.etcdMutex.Lock()
+			x.Etcd = etcdCli
+			x.etcdRetrying = false
+			x.etcdMutex.Unlock()
+			x.logger().Printf("Successfully connected to etcd (attempt %d), switching from the local key-value store", attempt)
+			return
+		}
+	}()
+}
+
+// Ready is whether the intended key-value store is connected: false while
+// RetryEtcd() is still trying to connect to etcd, true otherwise
+func (x *Xip) Ready() bool {
+	x.etcdMutex.RLock()
+	defer x.etcdMutex.RUnlock()
+	return !x.etcdRetrying
+}
+
+// Drain makes us answer every query SERVFAIL (true), e.g. so that resolvers
+// fail over to another anycast node during a rolling deployment, or answer
+// normally again (false)
+func (x *Xip) Drain(draining bool) {
+	var d int32
+	if draining {
+		d = 1
+	}
+	atomic.StoreInt32(&x.draining, d)
+}
+
+// Draining is whether we're Drain()ed
+func (x *Xip) Draining() bool {
+	return atomic.LoadInt32(&x.draining) == 1
+}
+
+// EtcdConnector returns a function that connects to etcd at the endpoint,
+// for RetryEtcd()
+func EtcdConnector(etcdEndpoint string) func() (V3client, error) {
+	return func() (V3client, error) {
+		etcdCli, err := clientv3New(etcdEndpoint)
+		if err != nil {
+			return nil, err // not the typed nil *clientv3.Client
+		}
+		return etcdCli, nil
+	}
+}
+
+// allowlisted returns true if the hostname matches a pattern in the
+// Allowlist, e.g. "*.example.com" matches "10-0-0-1.example.com" but not
+// "example.com" itself
+func (x *Xip) allowlisted(hostname string) bool {
+	hostname = customizationKey(hostname)
+	for _, pattern := range x.Allowlist {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(hostname, customizationKey(pattern[1:])) {
+				return true
+			}
+			continue
+		}
+		if hostname == customizationKey(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
 func (x *Xip) blocklist(hostname string) bool {
+	_, blocked := x.blocklistRule(hostname)
+	return blocked
+}
+
+// blocklistRule returns the blocklist rule the hostname matches, if any,
+// e.g. "string raiffeisen" or "cidr 43.134.66.0/24"
+func (x *Xip) blocklistRule(hostname string) (rule string, blocked bool) {
 	aResources := NameToA(hostname)
 	aaaaResources := NameToAAAA(hostname)
 	var ip net.IP
@@ -1181,30 +4183,126 @@ func (x *Xip) blocklist(hostname string) bool {
 		ip = aaaaResources[0].AAAA[:]
 	}
 	if len(aResources) == 0 && len(aaaaResources) == 0 {
-		return false
+		return "", false
 	}
-	if ip.IsPrivate() {
-		return false
+	if ip.IsPrivate() && !x.BlocklistPrivateToo {
+		return "", false
 	}
+	// match the decoded form, too, lest internationalized spellings evade us
+	decodedHostname := unicodeHostname(hostname)
 	for _, blockstring := range x.BlocklistStrings {
-		if strings.Contains(hostname, blockstring) {
-			return true
+		if strings.Contains(hostname, blockstring) || strings.Contains(decodedHostname, blockstring) {
+			return "string " + blockstring, true
 		}
 	}
 	for _, blockCDIR := range x.BlocklistCDIRs {
 		if blockCDIR.Contains(ip) {
+			return "cidr " + blockCDIR.String(), true
+		}
+	}
+	return "", false
+}
+
+// defaultCNAME returns the DefaultCNAME if the hostname should have it: it's
+// under a zone we serve, it isn't customized, it doesn't embed an IP (even
+// one we wouldn't resolve, e.g. a reserved name's), and it isn't the
+// DefaultCNAME itself; otherwise nil
+func (x *Xip) defaultCNAME(fqdnString string) *dnsmessage.CNAMEResource {
+	if x.DefaultCNAME.Length == 0 || strings.EqualFold(fqdnString, x.DefaultCNAME.String()) {
+		return nil
+	}
+	if _, ok := customization(fqdnString); ok {
+		return nil
+	}
+	if len(NameToA(fqdnString)) > 0 || len(NameToAAAA(fqdnString)) > 0 {
+		return nil
+	}
+	fqdn := strings.ToLower(fqdnString)
+	for _, zone := range x.Zones {
+		if strings.HasSuffix(fqdn, "."+zone) {
+			return &dnsmessage.CNAMEResource{CNAME: x.DefaultCNAME}
+		}
+	}
+	return nil // it's not under a zone we serve (or it's the zone's apex)
+}
+
+// cnameResponse answers with the CNAME, whatever the query's type; the
+// resolver follows it
+func (x *Xip) cnameResponse(q dnsmessage.Question, cname dnsmessage.CNAMEResource, response Response, logMessage string) (Response, string, error) {
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	response.Answers = append(response.Answers,
+		// 1 CNAME record, via Customizations (or DefaultCNAME)
+		func(b *dnsmessage.Builder) error {
+			return b.CNAMEResource(dnsmessage.ResourceHeader{
+				Name:   q.Name,
+				Type:   dnsmessage.TypeCNAME,
+				Class:  dnsmessage.ClassINET,
+				TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+				Length: 0,
+			}, cname)
+		})
+	return response, logMessage + cname.CNAME.String(), nil
+}
+
+// unicodeHostname returns the hostname with its punycode ("xn--") labels
+// decoded to Unicode & NFKC-normalized, lowercase, e.g.
+// "xn---bank-cp33a2aaha5ad0e5bv.1.2.3.4.sslip.io." (a fullwidth
+// "ｒａｉｆｆｅｉｓｅｎ-bank") → "raiffeisen-bank.1.2.3.4.sslip.io."
+func unicodeHostname(hostname string) string {
+	labels := strings.Split(strings.ToLower(hostname), ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(label, "xn--") {
+			continue
+		}
+		if decoded, err := idna.Punycode.ToUnicode(label); err == nil {
+			labels[i] = strings.ToLower(norm.NFKC.String(decoded))
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// deniedByPolicy returns true if the QueryPolicy denies any of the hostname's
+// IPs. Customized hostnames' IPs are the operator's own, so they're exempt
+func (x *Xip) deniedByPolicy(fqdn string, ips []net.IP) bool {
+	if x.QueryPolicy == nil {
+		return false
+	}
+	if _, ok := customization(fqdn); ok {
+		return false
+	}
+	for _, ip := range ips {
+		if !x.QueryPolicy(fqdn, ip) {
 			return true
 		}
 	}
 	return false
 }
 
-func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, response Response, logMessage string) (_ Response, _ string, err error) {
+// policyRefusal refuses the query, whose IP the QueryPolicy denied
+func (x *Xip) policyRefusal(response Response, logMessage string) (Response, string, error) {
+	atomic.AddInt64(&x.Metrics.DeniedByPolicy, 1)
+	response.Header.Authoritative = false
+	response.Header.RCode = dnsmessage.RCodeRefused
+	response.EDE = &ExtendedDNSError{InfoCode: EDEProhibited, ExtraText: "policy"}
+	return response, logMessage + "Refused (policy)", nil
+}
+
+func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, srcAddr net.IP, ecs *net.IPNet, response Response, logMessage string) (_ Response, _ string, err error) {
 	var nameToAs []dnsmessage.AResource
-	nameToAs = NameToA(q.Name.String())
+	nameToAs = uniqueAResources(x.AResources(q.Name.String(), srcAddr))
+	if x.AnswerOrder == AnswerOrderClosestFirst {
+		client := answerClient(srcAddr, ecs)
+		sort.SliceStable(nameToAs, func(i, j int) bool {
+			return proximity(client, nameToAs[i].A[:]) > proximity(client, nameToAs[j].A[:])
+		})
+	}
+	nameToAs = nameToAs[:x.answerCap(len(nameToAs), &response)]
+	if cname := x.defaultCNAME(q.Name.String()); len(nameToAs) == 0 && cname != nil {
+		return x.cnameResponse(q, *cname, response, logMessage)
+	}
 	if len(nameToAs) == 0 {
 		// No Answers, only 1 Authorities
-		soaHeader, soaResource := SOAAuthority(q.Name)
+		soaHeader, soaResource := x.SOAAuthority(q.Name)
 		response.Authorities = append(response.Authorities,
 			func(b *dnsmessage.Builder) error {
 				if err = b.SOAResource(soaHeader, soaResource); err != nil {
@@ -1214,9 +4312,19 @@ func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, response Response, log
 			})
 		return response, logMessage + "nil, SOA " + soaLogMessage(soaResource), nil
 	}
+	var ips []net.IP
+	for _, nameToA := range nameToAs {
+		ips = append(ips, nameToA.A[:])
+	}
+	if !response.SelfTest && x.deniedByPolicy(q.Name.String(), ips) {
+		return x.policyRefusal(response, logMessage)
+	}
 	if x.blocklist(q.Name.String()) {
-		x.Metrics.AnsweredQueries++
-		x.Metrics.AnsweredBlockedQueries++
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredBlockedQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredBlockedAQueries, 1)
+		blockedA := currentCustomizations()["ns-aws.sslip.io."].A[0]
+		response.EDE = &ExtendedDNSError{InfoCode: EDEFiltered, ExtraText: "blocklist"}
 		response.Answers = append(response.Answers,
 			// 1 or more A records; A records > 1 only available via Customizations
 			func(b *dnsmessage.Builder) error {
@@ -1224,18 +4332,18 @@ func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, response Response, log
 					Name:   q.Name,
 					Type:   dnsmessage.TypeA,
 					Class:  dnsmessage.ClassINET,
-					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					TTL:    x.blockedTTL(),
 					Length: 0,
-				}, Customizations["ns-aws.sslip.io."].A[0])
+				}, blockedA)
 				if err != nil {
 					return err
 				}
 				return nil
 			})
-		return response, logMessage + net.IP(Customizations["ns-aws.sslip.io."].A[0].A[:]).String(), nil
+		return response, logMessage + net.IP(blockedA.A[:]).String(), nil
 	}
-	x.Metrics.AnsweredQueries++
-	x.Metrics.AnsweredAQueries++
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	atomic.AddInt64(&x.Metrics.AnsweredAQueries, 1)
 	response.Answers = append(response.Answers,
 		// 1 or more A records; A records > 1 only available via Customizations
 		func(b *dnsmessage.Builder) error {
@@ -1244,7 +4352,7 @@ func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, response Response, log
 					Name:   q.Name,
 					Type:   dnsmessage.TypeA,
 					Class:  dnsmessage.ClassINET,
-					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					TTL:    x.addressTTL(q.Name.String()),
 					Length: 0,
 				}, nameToA)
 				if err != nil {
@@ -1258,15 +4366,28 @@ func (x *Xip) nameToAwithBlocklist(q dnsmessage.Question, response Response, log
 		ip := net.IP(nameToA.A[:])
 		logMessages = append(logMessages, ip.String())
 	}
+	if x.DebugWire {
+		logMessages[len(logMessages)-1] += x.embeddedIPLog(q.Name.String(), q.Type)
+	}
 	return response, logMessage + strings.Join(logMessages, ", "), nil
 }
 
-func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, response Response, logMessage string) (_ Response, _ string, err error) {
+func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, srcAddr net.IP, ecs *net.IPNet, response Response, logMessage string) (_ Response, _ string, err error) {
 	var nameToAAAAs []dnsmessage.AAAAResource
-	nameToAAAAs = NameToAAAA(q.Name.String())
+	nameToAAAAs = uniqueAAAAResources(x.AAAAResources(q.Name.String(), srcAddr))
+	if x.AnswerOrder == AnswerOrderClosestFirst {
+		client := answerClient(srcAddr, ecs)
+		sort.SliceStable(nameToAAAAs, func(i, j int) bool {
+			return proximity(client, nameToAAAAs[i].AAAA[:]) > proximity(client, nameToAAAAs[j].AAAA[:])
+		})
+	}
+	nameToAAAAs = nameToAAAAs[:x.answerCap(len(nameToAAAAs), &response)]
+	if cname := x.defaultCNAME(q.Name.String()); len(nameToAAAAs) == 0 && cname != nil {
+		return x.cnameResponse(q, *cname, response, logMessage)
+	}
 	if len(nameToAAAAs) == 0 {
 		// No Answers, only 1 Authorities
-		soaHeader, soaResource := SOAAuthority(q.Name)
+		soaHeader, soaResource := x.SOAAuthority(q.Name)
 		response.Authorities = append(response.Authorities,
 			func(b *dnsmessage.Builder) error {
 				if err = b.SOAResource(soaHeader, soaResource); err != nil {
@@ -1276,9 +4397,19 @@ func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, response Response,
 			})
 		return response, logMessage + "nil, SOA " + soaLogMessage(soaResource), nil
 	}
+	var ips []net.IP
+	for _, nameToAAAA := range nameToAAAAs {
+		ips = append(ips, nameToAAAA.AAAA[:])
+	}
+	if !response.SelfTest && x.deniedByPolicy(q.Name.String(), ips) {
+		return x.policyRefusal(response, logMessage)
+	}
 	if x.blocklist(q.Name.String()) {
-		x.Metrics.AnsweredQueries++
-		x.Metrics.AnsweredBlockedQueries++
+		atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredBlockedQueries, 1)
+		atomic.AddInt64(&x.Metrics.AnsweredBlockedAAAAQueries, 1)
+		blockedAAAA := currentCustomizations()["ns-aws.sslip.io."].AAAA[0]
+		response.EDE = &ExtendedDNSError{InfoCode: EDEFiltered, ExtraText: "blocklist"}
 		response.Answers = append(response.Answers,
 			// 1 or more A records; A records > 1 only available via Customizations
 			func(b *dnsmessage.Builder) error {
@@ -1286,18 +4417,18 @@ func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, response Response,
 					Name:   q.Name,
 					Type:   dnsmessage.TypeA,
 					Class:  dnsmessage.ClassINET,
-					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					TTL:    x.blockedTTL(),
 					Length: 0,
-				}, Customizations["ns-aws.sslip.io."].AAAA[0])
+				}, blockedAAAA)
 				if err != nil {
 					return err
 				}
 				return nil
 			})
-		return response, logMessage + net.IP(Customizations["ns-aws.sslip.io."].AAAA[0].AAAA[:]).String(), nil
+		return response, logMessage + net.IP(blockedAAAA.AAAA[:]).String(), nil
 	}
-	x.Metrics.AnsweredQueries++
-	x.Metrics.AnsweredAAAAQueries++
+	atomic.AddInt64(&x.Metrics.AnsweredQueries, 1)
+	atomic.AddInt64(&x.Metrics.AnsweredAAAAQueries, 1)
 	response.Answers = append(response.Answers,
 		// 1 or more AAAA records; AAAA records > 1 only available via Customizations
 		func(b *dnsmessage.Builder) error {
@@ -1306,7 +4437,7 @@ func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, response Response,
 					Name:   q.Name,
 					Type:   dnsmessage.TypeAAAA,
 					Class:  dnsmessage.ClassINET,
-					TTL:    604800, // 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+					TTL:    x.addressTTL(q.Name.String()),
 					Length: 0,
 				}, nameToAAAA)
 				if err != nil {
@@ -1320,9 +4451,243 @@ func (x *Xip) nameToAAAAwithBlocklist(q dnsmessage.Question, response Response,
 		ip := net.IP(nameToAAAA.AAAA[:])
 		logMessages = append(logMessages, ip.String())
 	}
+	if x.DebugWire {
+		logMessages[len(logMessages)-1] += x.embeddedIPLog(q.Name.String(), q.Type)
+	}
 	return response, logMessage + strings.Join(logMessages, ", "), nil
 }
 
+// AddressTTL is the TTL of our A & AAAA answers unless their zone has its own
+// (ZoneTTLs): 60 * 60 * 24 * 7 == 1 week; long TTL, these IP addrs don't change
+const AddressTTL = 604800
+
+// addressTTL returns the TTL of the A & AAAA answers for the hostname: 0 under
+// the NoCacheSubdomain, else its zone's (ZoneTTLs) or AddressTTL; every
+// A & AAAA answer builder (and "ttl.<name>.sslip.io") gets the TTL from here,
+// except the blocked answers' (blockedTTL())
+func (x *Xip) addressTTL(fqdnString string) uint32 {
+	fqdn := strings.ToLower(fqdnString)
+	if noCache := strings.ToLower(x.NoCacheSubdomain); noCache != "" && (fqdn == noCache || strings.HasSuffix(fqdn, "."+noCache)) {
+		return 0 // for testing resolvers' caching
+	}
+	ttl, matchedZone := uint32(AddressTTL), ""
+	// the most specific zone in ZoneTTLs the hostname falls under
+	for zone, zoneTTL := range x.ZoneTTLs {
+		if (fqdn == zone || strings.HasSuffix(fqdn, "."+zone)) && len(zone) > len(matchedZone) {
+			ttl, matchedZone = zoneTTL, zone
+		}
+	}
+	return ttl
+}
+
+// DefaultBlockedTTL is the TTL of our blocked (sinkholed) A & AAAA answers:
+// short, so that unblocking a name propagates quickly
+const DefaultBlockedTTL = 60
+
+// blockedTTL returns the TTL of the blocked A & AAAA answers
+func (x *Xip) blockedTTL() uint32 {
+	if x.BlockedTTL == 0 {
+		return DefaultBlockedTTL
+	}
+	return x.BlockedTTL
+}
+
+// TXTTTL when TXT for "ttl.<name>.sslip.io" is queried, return the TTLs that
+// we'd assign to the A & AAAA answers for "<name>.sslip.io", e.g. "A 604800",
+// or, if there'd be no answer, the negative-caching TTL, e.g. "AAAA nil, SOA 180"
+func TXTTTL(x *Xip, fqdn string, srcAddr net.IP) ([]dnsmessage.TXTResource, error) {
+	var ttls []string
+	for _, qType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		var n int
+		if qType == dnsmessage.TypeA {
+			n = len(x.AResources(fqdn, srcAddr))
+		} else {
+			n = len(x.AAAAResources(fqdn, srcAddr))
+		}
+		recordType := strings.TrimPrefix(qType.String(), "Type")
+		if n == 0 {
+			soaHeader, _ := x.SOAAuthority(dnsmessage.MustNewName(fqdn))
+			ttls = append(ttls, fmt.Sprintf("%s nil, SOA %d", recordType, soaHeader.TTL))
+			continue
+		}
+		ttl := x.addressTTL(fqdn)
+		if x.blocklist(fqdn) {
+			ttl = x.blockedTTL()
+		}
+		ttls = append(ttls, fmt.Sprintf("%s %d", recordType, ttl))
+	}
+	return []dnsmessage.TXTResource{{TXT: ttls}}, nil
+}
+
+// TXTBlocked when TXT for "blocked.<name>.sslip.io" is queried, return whether
+// we'd block "<name>.sslip.io" and by which rule, e.g. "blocked: cidr
+// 43.134.66.0/24", or "allowed", without answering with the blocked address
+func TXTBlocked(x *Xip, fqdn string) ([]dnsmessage.TXTResource, error) {
+	if rule, blocked := x.blocklistRule(fqdn); blocked {
+		return []dnsmessage.TXTResource{{TXT: []string{"blocked: " + rule}}}, nil
+	}
+	return []dnsmessage.TXTResource{{TXT: []string{"allowed"}}}, nil
+}
+
+// TXTNet when TXT for "net.<prefix>.sslip.io" is queried, e.g.
+// "net.10-0-0-0-24.sslip.io", return the IPv4 prefix's network address,
+// broadcast address & usable (host) range, e.g. "network 10.0.0.0",
+// "broadcast 10.0.0.255", "usable 10.0.0.1-10.0.0.254", "hosts 254"; for
+// teaching subnetting. /31s (RFC 3021) & /32s have no network or broadcast
+// address to set aside, so every address is usable
+func TXTNet(x *Xip, prefix string) ([]dnsmessage.TXTResource, error) {
+	var ipNet *net.IPNet
+	var err error
+	if i := strings.LastIndex(prefix, "-"); i > 0 {
+		_, ipNet, err = net.ParseCIDR(strings.ReplaceAll(prefix[:i], "-", ".") + "/" + prefix[i+1:])
+	}
+	if ipNet == nil || err != nil || ipNet.IP.To4() == nil {
+		return []dnsmessage.TXTResource{{TXT: []string{fmt.Sprintf(`error: "%s" isn't an IPv4 prefix, e.g. "10-0-0-0-24"`, prefix)}}}, nil
+	}
+	network := ipNet.IP.To4()
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range network {
+		broadcast[i] = network[i] | ^ipNet.Mask[i]
+	}
+	ones, _ := ipNet.Mask.Size()
+	first, last, hosts := network, broadcast, 1<<(32-ones)
+	if ones < 31 {
+		first, last, hosts = nextIP(network, 1), nextIP(broadcast, -1), hosts-2
+	}
+	return []dnsmessage.TXTResource{{TXT: []string{
+		"network " + network.String(),
+		"broadcast " + broadcast.String(),
+		"usable " + first.String() + "-" + last.String(),
+		"hosts " + strconv.Itoa(hosts),
+	}}}, nil
+}
+
+// nextIP returns the IPv4 address delta addresses after (or before) the IP
+func nextIP(ip net.IP, delta int) net.IP {
+	n := int64(ip[0])<<24 | int64(ip[1])<<16 | int64(ip[2])<<8 | int64(ip[3])
+	n += int64(delta)
+	return net.IP{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+// answerCap returns the number of records (of one type) that the answer may
+// contain, i.e. n capped at MaxAnswers, setting TC if we cap & MaxAnswersTruncate,
+// unless we answer in full
+func (x *Xip) answerCap(n int, response *Response) int {
+	if x.MaxAnswers > 0 && n > x.MaxAnswers && !response.Full {
+		if x.MaxAnswersTruncate {
+			response.Header.Truncated = true
+		}
+		return x.MaxAnswers
+	}
+	return n
+}
+
+// answerClient returns the client that AnswerOrderClosestFirst orders the
+// answers by: its subnet (EDNS Client Subnet), if the resolver passed it
+// along, otherwise the querier, i.e. the resolver
+func answerClient(srcAddr net.IP, ecs *net.IPNet) *net.IPNet {
+	if ecs != nil {
+		return ecs
+	}
+	if srcAddr.To4() != nil {
+		return &net.IPNet{IP: srcAddr.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: srcAddr, Mask: net.CIDRMask(128, 128)}
+}
+
+// proximity returns the number of leading bits that the IP shares with the
+// client, at most the client's prefix length, e.g. 10.0.1.1 & 10.0.2.0/24 →
+// 22; it's 0 if they're of different families
+func proximity(client *net.IPNet, ip net.IP) int {
+	clientIP, addr := client.IP.To4(), ip.To4()
+	if clientIP == nil || addr == nil {
+		if clientIP != nil || addr != nil || client.IP.To16() == nil || ip.To16() == nil {
+			return 0
+		}
+		clientIP, addr = client.IP.To16(), ip.To16()
+	}
+	prefixLen, _ := client.Mask.Size()
+	common := 0
+	for i := range addr {
+		if diff := addr[i] ^ clientIP[i]; diff != 0 {
+			common += bits.LeadingZeros8(diff)
+			break
+		}
+		common += 8
+	}
+	if common > prefixLen {
+		return prefixLen
+	}
+	return common
+}
+
+// uniqueAResources returns the records minus any duplicates (e.g. a
+// customized domain that lists the same address twice); some strict resolvers
+// reject responses with duplicate records. The order is preserved.
+func uniqueAResources(records []dnsmessage.AResource) (unique []dnsmessage.AResource) {
+	seen := map[dnsmessage.AResource]bool{}
+	for _, record := range records {
+		if !seen[record] {
+			seen[record] = true
+			unique = append(unique, record)
+		}
+	}
+	return unique
+}
+
+// uniqueAAAAResources is uniqueAResources for AAAA records
+func uniqueAAAAResources(records []dnsmessage.AAAAResource) (unique []dnsmessage.AAAAResource) {
+	seen := map[dnsmessage.AAAAResource]bool{}
+	for _, record := range records {
+		if !seen[record] {
+			seen[record] = true
+			unique = append(unique, record)
+		}
+	}
+	return unique
+}
+
+// uniqueMXResources is uniqueAResources for MX records
+func uniqueMXResources(records []dnsmessage.MXResource) (unique []dnsmessage.MXResource) {
+	seen := map[dnsmessage.MXResource]bool{}
+	for _, record := range records {
+		if !seen[record] {
+			seen[record] = true
+			unique = append(unique, record)
+		}
+	}
+	return unique
+}
+
+// uniqueNSResources is uniqueAResources for NS records
+func uniqueNSResources(records []dnsmessage.NSResource) (unique []dnsmessage.NSResource) {
+	seen := map[dnsmessage.NSResource]bool{}
+	for _, record := range records {
+		if !seen[record] {
+			seen[record] = true
+			unique = append(unique, record)
+		}
+	}
+	return unique
+}
+
+// clientv3NewShards connects to each etcd cluster, one per endpoint. If any
+// fails, we fail: the keys of the missing shard would be routed to another.
+func clientv3NewShards(etcdEndpoints []string) ([]V3client, error) {
+	var shards []V3client
+	for _, etcdEndpoint := range etcdEndpoints {
+		etcdCli, err := clientv3New(etcdEndpoint)
+		if err != nil {
+			for _, shard := range shards {
+				_ = shard.Close()
+			}
+			return nil, fmt.Errorf("shard %s: %w", etcdEndpoint, err)
+		}
+		shards = append(shards, etcdCli)
+	}
+	return shards, nil
+}
+
 // clientv3New attempts to connect to local etcd and retrieve a key to make
 // sure the connection works. If for any reason it fails it returns nil +
 // error
@@ -1,15 +1,26 @@
 package xip_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
 	"math/rand"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"xip/xip"
+	"xip/xip/xipfakes"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	clientv3 "go.etcd.io/etcd/client/v3"
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -60,6 +71,2061 @@ var _ = Describe("Xip", func() {
 				delete(xip.Customizations, customizedDomain) // clean-up
 			})
 		})
+		When("a domain has been customized with a wildcard CNAME", func() {
+			var customizedDomain string
+			BeforeEach(func() {
+				customizedDomain = strings.ToLower(random8ByteString()) + ".com."
+				xip.Customizations["*."+customizedDomain] = xip.DomainCustomization{
+					CNAME: dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("google.com.")},
+				}
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, "*."+customizedDomain)
+				delete(xip.Customizations, "b."+customizedDomain)
+			})
+			It("returns the CNAME for a subdomain", func() {
+				cname := xip.CNAMEResource("AnyThing." + customizedDomain)
+				Expect(cname).ToNot(BeNil())
+				Expect(cname.CNAME.String()).To(Equal("google.com."))
+			})
+			It("returns the CNAME for a deeper subdomain", func() {
+				cname := xip.CNAMEResource("a.b." + customizedDomain)
+				Expect(cname).ToNot(BeNil())
+				Expect(cname.CNAME.String()).To(Equal("google.com."))
+			})
+			It("doesn't return the CNAME for the parent domain itself", func() {
+				Expect(xip.CNAMEResource(customizedDomain)).To(BeNil())
+			})
+			It("doesn't return the CNAME when a closer name exists (RFC 4592)", func() {
+				xip.Customizations["b."+customizedDomain] = xip.DomainCustomization{}
+				Expect(xip.CNAMEResource("a.b." + customizedDomain)).To(BeNil())
+				Expect(xip.CNAMEResource("b." + customizedDomain)).To(BeNil())
+			})
+			It("prefers an exact match to the wildcard", func() {
+				xip.Customizations["b."+customizedDomain] = xip.DomainCustomization{
+					CNAME: dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("example.com.")},
+				}
+				Expect(xip.CNAMEResource("b." + customizedDomain).CNAME.String()).To(Equal("example.com."))
+			})
+		})
+	})
+
+	Describe("QueryResponse()", func() {
+		var x, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137"})
+		var query []byte
+		BeforeEach(func() {
+			query = packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+		})
+		AfterEach(func() {
+			x.DebugWire = false
+			x.LogLevel = xip.LogLevelAll
+			x.BlocklistStrings = nil
+			x.BlocklistCDIRs = nil
+			x.BlocklistPrivateToo = false
+		})
+		It("answers the query", func() {
+			response, logMessage, err := x.QueryResponse(query, net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logMessage).To(Equal("TypeA 127-0-0-1.sslip.io. ? 127.0.0.1"))
+			var p dnsmessage.Parser
+			_, err = p.Start(response)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p.SkipAllQuestions()).To(Succeed())
+			answers, err := p.AllAnswers()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(answers)).To(Equal(1))
+			Expect(answers[0].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{127, 0, 0, 1}))
+		})
+		DescribeTable("queries for the root (\".\")",
+			func(qType dnsmessage.Type) {
+				response, logMessage, err := x.QueryResponse(packedQuery(".", qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(qType.String() + " . ? Refused"))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeRefused))
+				Expect(m.Authoritative).To(BeFalse())
+				Expect(m.Answers).To(BeEmpty())
+				Expect(m.Authorities).To(BeEmpty())
+			},
+			Entry("NS are refused", dnsmessage.TypeNS),
+			Entry("SOA are refused", dnsmessage.TypeSOA),
+			Entry("A are refused", dnsmessage.TypeA),
+		)
+		// Some clients mishandle an empty answer, so pin down exactly what a
+		// NODATA response for an address family the name doesn't encode looks like
+		DescribeTable("the name encodes one address family but not the other (NODATA)",
+			func(name string, answeredType, nodataType dnsmessage.Type, expectedAnswer string) {
+				response, logMessage, err := x.QueryResponse(packedQuery(name, answeredType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(answeredType.String() + " " + name + " ? " + expectedAnswer))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Authoritative).To(BeTrue())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Header.Type).To(Equal(answeredType))
+				Expect(m.Authorities).To(BeEmpty())
+
+				response, logMessage, err = x.QueryResponse(packedQuery(name, nodataType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HavePrefix(nodataType.String() + " " + name + " ? nil, SOA "))
+				m = dnsmessage.Message{}
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Authoritative).To(BeTrue())
+				Expect(m.Truncated).To(BeFalse())
+				Expect(m.Answers).To(BeEmpty())
+				Expect(m.Authorities).To(HaveLen(1))
+				Expect(m.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+				Expect(m.Authorities[0].Header.Name.String()).To(Equal("sslip.io."))
+				Expect(m.Authorities[0].Header.TTL).To(Equal(x.SOATimers.MinTTL))
+				Expect(m.Additionals).To(BeEmpty())
+			},
+			Entry("IPv4-only: A exists, AAAA is NODATA", "10-0-0-1.sslip.io.", dnsmessage.TypeA, dnsmessage.TypeAAAA, "10.0.0.1"),
+			Entry("IPv6-only: AAAA exists, A is NODATA", "2001-db8--1.sslip.io.", dnsmessage.TypeAAAA, dnsmessage.TypeA, "2001:db8::1"),
+		)
+		When("a customized domain has duplicate records", func() {
+			BeforeEach(func() {
+				mx := dnsmessage.MXResource{Pref: 10, MX: dnsmessage.MustNewName("mx.duplicates.sslip.io.")}
+				xip.Customizations["duplicates.sslip.io."] = xip.DomainCustomization{
+					A:    []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}, {A: [4]byte{10, 0, 0, 2}}, {A: [4]byte{10, 0, 0, 1}}},
+					AAAA: []dnsmessage.AAAAResource{{AAAA: [16]byte{1}}, {AAAA: [16]byte{1}}},
+					MX:   []dnsmessage.MXResource{mx, mx},
+				}
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, "duplicates.sslip.io.")
+			})
+			DescribeTable("collapses them",
+				func(qType dnsmessage.Type, expectedLogMessage string, expectedAnswers int) {
+					response, logMessage, err := x.QueryResponse(packedQuery("duplicates.sslip.io.", qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(Equal(expectedLogMessage))
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(len(m.Answers)).To(Equal(expectedAnswers))
+				},
+				Entry("A", dnsmessage.TypeA, "TypeA duplicates.sslip.io. ? 10.0.0.1, 10.0.0.2", 2),
+				Entry("AAAA", dnsmessage.TypeAAAA, "TypeAAAA duplicates.sslip.io. ? 100::", 1),
+				Entry("MX", dnsmessage.TypeMX, "TypeMX duplicates.sslip.io. ? 10 mx.duplicates.sslip.io.", 1),
+			)
+		})
+		When("a customized domain has more records than MaxAnswers", func() {
+			BeforeEach(func() {
+				var as []dnsmessage.AResource
+				for i := 1; i <= 20; i++ {
+					as = append(as, dnsmessage.AResource{A: [4]byte{10, 0, 0, byte(i)}})
+				}
+				xip.Customizations["twenty.sslip.io."] = xip.DomainCustomization{A: as}
+				x.MaxAnswers = 8
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, "twenty.sslip.io.")
+				x.MaxAnswers = xip.DefaultMaxAnswers
+				x.MaxAnswersTruncate = false
+			})
+			It("caps the answer", func() {
+				response, _, err := x.QueryResponse(packedQuery("twenty.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(8))
+				Expect(m.Answers[7].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{10, 0, 0, 8}))
+				Expect(m.Truncated).To(BeFalse())
+			})
+			It("sets TC if MaxAnswersTruncate is set", func() {
+				x.MaxAnswersTruncate = true
+				response, _, err := x.QueryResponse(packedQuery("twenty.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(8))
+				Expect(m.Truncated).To(BeTrue())
+			})
+			It("doesn't cap the answer by default", func() {
+				x.MaxAnswers = xip.DefaultMaxAnswers
+				response, _, err := x.QueryResponse(packedQuery("twenty.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(20))
+			})
+		})
+		When("a customized domain has records in several subnets", func() {
+			BeforeEach(func() {
+				xip.Customizations["subnets.sslip.io."] = xip.DomainCustomization{
+					A: []dnsmessage.AResource{{A: [4]byte{192, 168, 0, 1}}, {A: [4]byte{10, 0, 2, 1}}, {A: [4]byte{10, 0, 1, 1}}},
+					AAAA: []dnsmessage.AAAAResource{
+						{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 0, 1, 15: 1}},
+						{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 0, 2, 15: 1}},
+					},
+				}
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, "subnets.sslip.io.")
+				x.AnswerOrder = ""
+			})
+			// logMessageOf returns the log message of the query, which lists the answers in order
+			logMessageOf := func(query []byte, srcAddr net.IP) string {
+				_, logMessage, err := x.QueryResponse(query, srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				return logMessage
+			}
+			It("answers them in the order they're stored by default", func() {
+				Expect(logMessageOf(packedQuery("subnets.sslip.io.", dnsmessage.TypeA), net.IP{10, 0, 1, 5})).
+					To(Equal("TypeA subnets.sslip.io. ? 192.168.0.1, 10.0.2.1, 10.0.1.1"))
+			})
+			When("AnswerOrder is AnswerOrderClosestFirst", func() {
+				BeforeEach(func() {
+					x.AnswerOrder = xip.AnswerOrderClosestFirst
+				})
+				It("answers the ones closest to the querier first", func() {
+					Expect(logMessageOf(packedQuery("subnets.sslip.io.", dnsmessage.TypeA), net.IP{10, 0, 1, 5})).
+						To(Equal("TypeA subnets.sslip.io. ? 10.0.1.1, 10.0.2.1, 192.168.0.1"))
+					Expect(logMessageOf(packedQuery("subnets.sslip.io.", dnsmessage.TypeA), net.IP{192, 168, 7, 7})).
+						To(Equal("TypeA subnets.sslip.io. ? 192.168.0.1, 10.0.2.1, 10.0.1.1"))
+				})
+				It("prefers the client subnet (ECS) to the querier, i.e. the resolver", func() {
+					ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 1, 24, 0, 10, 0, 2}}
+					Expect(logMessageOf(packedEDNSQuery("subnets.sslip.io.", dnsmessage.TypeA, ecs), net.IP{10, 0, 1, 5})).
+						To(Equal("TypeA subnets.sslip.io. ? 10.0.2.1, 10.0.1.1, 192.168.0.1"))
+				})
+				It("orders the AAAA records, too", func() {
+					Expect(logMessageOf(packedQuery("subnets.sslip.io.", dnsmessage.TypeAAAA), net.ParseIP("2001:db8:2::5"))).
+						To(Equal("TypeAAAA subnets.sslip.io. ? 2001:db8:2::1, 2001:db8:1::1"))
+				})
+				It("keeps the stored order if the querier's of the other family", func() {
+					Expect(logMessageOf(packedQuery("subnets.sslip.io.", dnsmessage.TypeA), net.ParseIP("2001:db8:2::5"))).
+						To(Equal("TypeA subnets.sslip.io. ? 192.168.0.1, 10.0.2.1, 10.0.1.1"))
+				})
+			})
+		})
+		Describe("IPPositionStrict", func() {
+			answers := func(name string, qType dnsmessage.Type) int {
+				response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				return len(m.Answers)
+			}
+			AfterEach(func() {
+				x.IPPositionStrict = false
+			})
+			DescribeTable("when it's off (the default), matches IPs anywhere",
+				func(name string, qType dnsmessage.Type) {
+					Expect(answers(name, qType)).To(Equal(1))
+				},
+				Entry("leading dashed IPv4", "10-0-0-1.sslip.io.", dnsmessage.TypeA),
+				Entry("leading dotted IPv4", "10.0.0.1.sslip.io.", dnsmessage.TypeA),
+				Entry("embedded IPv4 label", "foo.10-0-0-1.sslip.io.", dnsmessage.TypeA),
+				Entry("IPv4 within a label", "foo-10-0-0-1.sslip.io.", dnsmessage.TypeA),
+				Entry("leading IPv6", "2001-db8--1.sslip.io.", dnsmessage.TypeAAAA),
+				Entry("embedded IPv6 label", "foo.2001-db8--1.sslip.io.", dnsmessage.TypeAAAA),
+			)
+			DescribeTable("when it's on, matches only leading IPs",
+				func(name string, qType dnsmessage.Type, expectedAnswers int) {
+					x.IPPositionStrict = true
+					Expect(answers(name, qType)).To(Equal(expectedAnswers))
+				},
+				Entry("leading dashed IPv4", "10-0-0-1.sslip.io.", dnsmessage.TypeA, 1),
+				Entry("leading dotted IPv4", "10.0.0.1.sslip.io.", dnsmessage.TypeA, 1),
+				Entry("leading IPv4 of a subdomain", "10-0-0-1.foo.sslip.io.", dnsmessage.TypeA, 1),
+				Entry("embedded IPv4 label", "foo.10-0-0-1.sslip.io.", dnsmessage.TypeA, 0),
+				Entry("embedded dotted IPv4", "foo.10.0.0.1.sslip.io.", dnsmessage.TypeA, 0),
+				Entry("IPv4 at the start of a label", "10-0-0-1-foo.sslip.io.", dnsmessage.TypeA, 0),
+				Entry("IPv4 at the end of a label", "foo-10-0-0-1.sslip.io.", dnsmessage.TypeA, 0),
+				Entry("leading IPv6", "2001-db8--1.sslip.io.", dnsmessage.TypeAAAA, 1),
+				Entry("embedded IPv6 label", "foo.2001-db8--1.sslip.io.", dnsmessage.TypeAAAA, 0),
+				Entry("customizations aren't affected", "ns-aws.sslip.io.", dnsmessage.TypeA, 1),
+			)
+		})
+		Describe("TestLocalZone", func() {
+			query := func(name string, qType dnsmessage.Type) (m dnsmessage.Message) {
+				response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.Unpack(response)).To(Succeed())
+				return m
+			}
+			AfterEach(func() {
+				x.TestLocalZone = false
+				x.RefuseOutOfZone = false
+			})
+			When("it's off (the default)", func() {
+				It("answers NODATA to the .local names", func() {
+					m := query("10-0-0-1.local.", dnsmessage.TypeA)
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Answers).To(BeEmpty())
+					Expect(m.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+					Expect(query("fe80--1.local.", dnsmessage.TypeAAAA).Answers).To(BeEmpty())
+				})
+				It("doesn't affect names that merely contain \"local\"", func() {
+					Expect(query("10-0-0-1.local.sslip.io.", dnsmessage.TypeA).Answers).To(HaveLen(1))
+				})
+			})
+			When("it's on", func() {
+				BeforeEach(func() {
+					x.TestLocalZone = true
+				})
+				It("resolves the .local names' embedded IPs", func() {
+					m := query("10-0-0-1.LOCAL.", dnsmessage.TypeA)
+					Expect(m.Answers).To(HaveLen(1))
+					Expect(m.Answers[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}))
+					m = query("fe80--1.local.", dnsmessage.TypeAAAA)
+					Expect(m.Answers).To(HaveLen(1))
+					Expect(m.Answers[0].Body).To(Equal(&dnsmessage.AAAAResource{AAAA: [16]byte{0xfe, 0x80, 15: 1}}))
+				})
+				It("serves them even if RefuseOutOfZone", func() {
+					x.RefuseOutOfZone = true
+					Expect(query("10-0-0-1.local.", dnsmessage.TypeA).Answers).To(HaveLen(1))
+				})
+			})
+		})
+		DescribeTable("QueryResponseVia() counts the query towards its transport",
+			func(transport string, counter func(xip.Metrics) int64) {
+				before := x.Metrics
+				_, _, err := x.QueryResponseVia(transport, query, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(counter(x.Metrics)).To(Equal(counter(before) + 1))
+				Expect(x.Metrics.Queries).To(Equal(before.Queries + 1))
+				Expect(x.Metrics.QueriesUDP + x.Metrics.QueriesTCP + x.Metrics.QueriesDoH).To(Equal(before.QueriesUDP + before.QueriesTCP + before.QueriesDoH + 1))
+			},
+			Entry("UDP", xip.TransportUDP, func(m xip.Metrics) int64 { return m.QueriesUDP }),
+			Entry("TCP", xip.TransportTCP, func(m xip.Metrics) int64 { return m.QueriesTCP }),
+			Entry("DoH", xip.TransportDoH, func(m xip.Metrics) int64 { return m.QueriesDoH }),
+		)
+		Describe("RefuseOutOfZone", func() {
+			BeforeEach(func() {
+				x.RefuseOutOfZone = true
+			})
+			AfterEach(func() {
+				x.RefuseOutOfZone = false
+			})
+			// query returns the unpacked response to the query, with or without RD
+			query := func(name string, recursionDesired bool) (response dnsmessage.Message) {
+				b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: recursionDesired})
+				Expect(b.StartQuestions()).To(Succeed())
+				Expect(b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})).To(Succeed())
+				queryBytes, err := b.Finish()
+				Expect(err).ToNot(HaveOccurred())
+				responseBytes, _, err := x.QueryResponse(queryBytes, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(response.Unpack(responseBytes)).To(Succeed())
+				Expect(response.RecursionAvailable).To(BeFalse())
+				Expect(response.RecursionDesired).To(Equal(recursionDesired))
+				return response
+			}
+			DescribeTable("answers in-zone names authoritatively, with or without RD",
+				func(recursionDesired bool) {
+					response := query("10-0-0-1.sslip.io.", recursionDesired)
+					Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(response.Authoritative).To(BeTrue())
+					Expect(response.Answers[0].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{10, 0, 0, 1}))
+				},
+				Entry("RD", true),
+				Entry("no RD", false),
+			)
+			DescribeTable("refuses out-of-zone names, with or without RD",
+				func(recursionDesired bool) {
+					response := query("10-0-0-1.example.com.", recursionDesired)
+					Expect(response.RCode).To(Equal(dnsmessage.RCodeRefused))
+					Expect(response.Authoritative).To(BeFalse())
+					Expect(response.Answers).To(BeEmpty())
+				},
+				Entry("RD", true),
+				Entry("no RD", false),
+			)
+			It("answers the special-purpose names outside our zones", func() {
+				for _, name := range []string{"k-v.io.", "my-key.k-v.io.", "1.0.0.127.in-addr.arpa.", "ns-aws.sslip.io."} {
+					Expect(query(name, true).RCode).To(Equal(dnsmessage.RCodeSuccess), name)
+				}
+			})
+			It("answers out-of-zone names by default (white-labeling)", func() {
+				x.RefuseOutOfZone = false
+				response := query("10-0-0-1.example.com.", true)
+				Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(response.Authoritative).To(BeTrue())
+			})
+		})
+		Describe("QueryTimeout", func() {
+			var fakeEtcd *xipfakes.FakeV3client
+			var canceled chan struct{}
+			BeforeEach(func() {
+				canceled = make(chan struct{})
+				fakeEtcd = &xipfakes.FakeV3client{}
+				fakeEtcd.GetStub = func(ctx context.Context, _ string, _ ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+					<-ctx.Done() // an etcd that never answers
+					close(canceled)
+					return nil, ctx.Err()
+				}
+				x.Etcd = fakeEtcd
+				x.QueryTimeout = 50 * time.Millisecond
+			})
+			AfterEach(func() {
+				x.Etcd = nil
+				x.QueryTimeout = 0
+			})
+			It("answers SERVFAIL after the budget, canceling the etcd call, and counts it", func() {
+				timedOut := x.Metrics.Snapshot().TimedOutQueries
+				start := time.Now()
+				response, logMessage, err := x.QueryResponse(packedQuery("slow.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second)) // well under the etcd timeout
+				Expect(logMessage).To(Equal("TypeTXT slow.k-v.io. ? ServFail (timed out)"))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeServerFailure))
+				Expect(m.Answers).To(BeEmpty())
+				Expect(x.Metrics.Snapshot().TimedOutQueries).To(Equal(timedOut + 1))
+				Eventually(canceled).Should(BeClosed())
+			})
+			// run with `go test -race` to catch the late processQuestion racing the next queries
+			It("lets the late processQuestion finish alongside the next queries", func() {
+				queries := x.Metrics.Snapshot().Queries
+				_, logMessage, err := x.QueryResponse(packedQuery("slow.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HaveSuffix("(timed out)"))
+				for i := 0; i < 10; i++ { // the late processQuestion is still running, bumping the Metrics
+					_, _, err = x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Eventually(canceled).Should(BeClosed())
+				Expect(x.Metrics.Snapshot().Queries).To(Equal(queries + 11))
+			})
+			It("doesn't let the late processQuestion write to the builtin key-value store", func() {
+				x.Etcd = nil
+				x.QueryTimeout = time.Nanosecond // expired before the put
+				_, _, _ = x.QueryResponse(packedQuery("put.stored.late-put.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				x.QueryTimeout = 0
+				Consistently(func() []dnsmessage.Resource {
+					response, _, err := x.QueryResponse(packedQuery("late-put.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					return m.Answers
+				}, 200*time.Millisecond).Should(BeEmpty())
+			})
+			It("answers the queries within the budget as usual", func() {
+				timedOut := x.Metrics.Snapshot().TimedOutQueries
+				response, _, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers[0].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{127, 0, 0, 1}))
+				Expect(x.Metrics.Snapshot().TimedOutQueries).To(Equal(timedOut))
+			})
+		})
+		Describe("QuerySemaphore", func() {
+			var fakeEtcd *xipfakes.FakeV3client
+			var unblock chan struct{}
+			BeforeEach(func() {
+				unblock = make(chan struct{})
+				fakeEtcd = &xipfakes.FakeV3client{}
+				fakeEtcd.GetStub = func(context.Context, string, ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+					<-unblock // a slow etcd keeps the queries in flight
+					return &clientv3.GetResponse{}, nil
+				}
+				x.Etcd = fakeEtcd
+				x.QuerySemaphore = make(chan struct{}, 3)
+			})
+			AfterEach(func() {
+				x.Etcd = nil
+				x.QuerySemaphore = nil
+			})
+			It("drops the queries over the limit and counts them", func() {
+				before := x.Metrics
+				errs := make(chan error, 5)
+				for i := 0; i < 5; i++ {
+					go func() {
+						_, _, err := x.QueryResponseVia(xip.TransportUDP, packedQuery("slow.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+						errs <- err
+					}()
+				}
+				// the 2 queries over the limit give up waiting for a slot
+				Expect(<-errs).To(MatchError(xip.ErrQueryDropped))
+				Expect(<-errs).To(MatchError(xip.ErrQueryDropped))
+				Expect(fakeEtcd.GetCallCount()).To(Equal(3))
+				close(unblock)
+				for i := 0; i < 3; i++ {
+					Expect(<-errs).ToNot(HaveOccurred())
+				}
+				Expect(x.Metrics.DroppedQueries).To(Equal(before.DroppedQueries + 2))
+				Expect(x.Metrics.QueriesUDP).To(Equal(before.QueriesUDP + 3))
+				Expect(len(x.QuerySemaphore)).To(Equal(0))
+			})
+			It("lets a query wait briefly for a slot", func() {
+				close(unblock)
+				for i := 0; i < 10; i++ {
+					_, _, err := x.QueryResponseVia(xip.TransportUDP, packedQuery("slow.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+				}
+			})
+		})
+		Describe("ReservedNames", func() {
+			BeforeEach(func() {
+				x.ReservedNames = []string{"www", "MAIL", "ns-aws"}
+			})
+			AfterEach(func() {
+				x.ReservedNames = nil
+			})
+			DescribeTable("doesn't resolve a reserved name to its embedded IP",
+				func(name string, qType dnsmessage.Type) {
+					response, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(ContainSubstring("? nil, SOA "))
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Answers).To(BeEmpty())
+					Expect(m.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+				},
+				Entry("A", "www.10-0-0-1.sslip.io.", dnsmessage.TypeA),
+				Entry("AAAA", "www.2001-db8--1.sslip.io.", dnsmessage.TypeAAAA),
+				Entry("case-insensitively", "Mail.10.0.0.1.sslip.io.", dnsmessage.TypeA),
+			)
+			It("resolves the other names", func() {
+				Expect(x.AResources("wwwx.10-0-0-1.sslip.io.", nil)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+				Expect(x.AResources("foo.www.10-0-0-1.sslip.io.", nil)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+			})
+			It("resolves a reserved name that's customized to its fixed records", func() {
+				Expect(x.AResources("ns-aws.sslip.io.", nil)).To(ContainElement(dnsmessage.AResource{A: [4]byte{52, 0, 56, 137}}))
+			})
+		})
+		Describe("DefaultCNAME", func() {
+			BeforeEach(func() {
+				x.DefaultCNAME = dnsmessage.MustNewName("landing.example.com.")
+			})
+			AfterEach(func() {
+				x.DefaultCNAME = dnsmessage.Name{}
+				x.ReservedNames = nil
+			})
+			// query returns the answers & the log message
+			query := func(name string, qType dnsmessage.Type) ([]dnsmessage.Resource, string) {
+				response, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				return m.Answers, logMessage
+			}
+			DescribeTable("answers the CNAME for a name under our zone that has no records",
+				func(qType dnsmessage.Type) {
+					name := "my-app-" + random8ByteString() + ".sslip.io."
+					answers, logMessage := query(name, qType)
+					Expect(logMessage).To(HaveSuffix(name + " ? landing.example.com."))
+					Expect(answers).To(HaveLen(1))
+					Expect(answers[0].Header.Name.String()).To(Equal(name))
+					Expect(answers[0].Header.Type).To(Equal(dnsmessage.TypeCNAME))
+					Expect(answers[0].Body.(*dnsmessage.CNAMEResource).CNAME.String()).To(Equal("landing.example.com."))
+				},
+				Entry("A", dnsmessage.TypeA),
+				Entry("AAAA", dnsmessage.TypeAAAA),
+				Entry("CNAME", dnsmessage.TypeCNAME),
+			)
+			It("doesn't affect names with an embedded IP, even reserved ones", func() {
+				answers, _ := query("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+				Expect(answers[0].Body.(*dnsmessage.AResource).A).To(Equal([4]byte{127, 0, 0, 1}))
+				x.ReservedNames = []string{"www"}
+				answers, _ = query("www.10-0-0-1.sslip.io.", dnsmessage.TypeA)
+				Expect(answers).To(BeEmpty())
+			})
+			It("doesn't affect customized names, the apex, or names outside our zones", func() {
+				answers, _ := query("ns-aws.sslip.io.", dnsmessage.TypeA)
+				Expect(answers[0].Header.Type).To(Equal(dnsmessage.TypeA))
+				for _, name := range []string{"sslip.io.", "landing.example.com.", "my-app.example.com."} {
+					answers, _ = query(name, dnsmessage.TypeA)
+					Expect(answers).To(BeEmpty())
+				}
+			})
+			It("is disabled by default", func() {
+				x.DefaultCNAME = dnsmessage.Name{}
+				answers, _ := query("my-app.sslip.io.", dnsmessage.TypeA)
+				Expect(answers).To(BeEmpty())
+			})
+		})
+		Describe("underscore-prefixed service names", func() {
+			const mtaSTS = "_mta-sts.example.com."
+			const smimea = "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.example.com."
+			// SMIMEA (RFC 8162): usage 3 (DANE-EE), selector 1 (SPKI), matching type 1 (SHA-256), & the digest
+			smimeaRdata := append([]byte{3, 1, 1}, bytes.Repeat([]byte{0xab}, 32)...)
+			BeforeEach(func() {
+				xip.Customizations[mtaSTS] = xip.DomainCustomization{
+					TXT: func(_ *xip.Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+						return []dnsmessage.TXTResource{{TXT: []string{"v=STSv1; id=20230101T000000"}}}, nil
+					},
+				}
+				xip.Customizations[smimea] = xip.DomainCustomization{
+					Raw: map[dnsmessage.Type][][]byte{53: {smimeaRdata}},
+				}
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, mtaSTS)
+				delete(xip.Customizations, smimea)
+			})
+			It("serves an MTA-STS TXT record", func() {
+				response, logMessage, err := x.QueryResponse(packedQuery("_MTA-STS.example.com.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(`TypeTXT _MTA-STS.example.com. ? ["v=STSv1; id=20230101T000000"]`))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.Authoritative).To(BeTrue())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Body).To(Equal(&dnsmessage.TXTResource{TXT: []string{"v=STSv1; id=20230101T000000"}}))
+			})
+			It("serves an SMIMEA record from the Raw records", func() {
+				response, logMessage, err := x.QueryResponse(packedQuery(smimea, dnsmessage.Type(53)), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("53 " + smimea + ` ? \# 35 030101` + strings.Repeat("ab", 32)))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Header.Type).To(Equal(dnsmessage.Type(53)))
+				Expect(m.Answers[0].Header.Name.String()).To(Equal(smimea))
+				Expect(m.Answers[0].Body.(*dnsmessage.UnknownResource).Data).To(Equal(smimeaRdata))
+			})
+			It("returns NODATA for the other types", func() {
+				for _, query := range []struct {
+					name  string
+					qType dnsmessage.Type
+				}{{mtaSTS, dnsmessage.TypeA}, {mtaSTS, dnsmessage.Type(53)}, {smimea, dnsmessage.TypeTXT}, {smimea, dnsmessage.Type(52)}} {
+					response, _, err := x.QueryResponse(packedQuery(query.name, query.qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Answers).To(BeEmpty())
+				}
+			})
+		})
+		Describe("UnsupportedTypes", func() {
+			AfterEach(func() {
+				x.UnsupportedTypes = xip.DefaultUnsupportedTypes
+			})
+			It("answers an obsolete type, e.g. A6 (38), NotImplemented rather than NODATA", func() {
+				response, logMessage, err := x.QueryResponse(packedEDNSQuery("127-0-0-1.sslip.io.", dnsmessage.Type(38)), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("38 127-0-0-1.sslip.io. ? NotImplemented"))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeNotImplemented))
+				Expect(m.Answers).To(BeEmpty())
+				Expect(m.Authorities).To(BeEmpty())
+			})
+			It("is configurable", func() {
+				x.UnsupportedTypes = []dnsmessage.Type{dnsmessage.TypeSRV}
+				for qType, expectedRCode := range map[dnsmessage.Type]dnsmessage.RCode{
+					dnsmessage.TypeSRV: dnsmessage.RCodeNotImplemented,
+					38:                 dnsmessage.RCodeSuccess,
+				} {
+					response, _, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(expectedRCode))
+				}
+			})
+		})
+		Describe("Delegates", func() {
+			BeforeEach(func() {
+				Expect(x.AddDelegate("Dev.sslip.io", "ns1.dev.sslip.io")).To(Succeed())
+				Expect(x.AddDelegate("dev.sslip.io.", "ns2.dev.sslip.io.")).To(Succeed())
+				xip.Customizations["ns1.dev.sslip.io."] = xip.DomainCustomization{
+					A:    []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 53}}},
+					AAAA: []dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x53}}},
+				}
+			})
+			AfterEach(func() {
+				x.Delegates = nil
+				delete(xip.Customizations, "ns1.dev.sslip.io.")
+			})
+			DescribeTable("refers every query under the delegated subdomain to its nameservers",
+				func(name string, qType dnsmessage.Type) {
+					response, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(HaveSuffix(" ? nil, NS ns1.dev.sslip.io., ns2.dev.sslip.io."))
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Authoritative).To(BeFalse())
+					Expect(m.Answers).To(BeEmpty())
+					Expect(m.Authorities).To(HaveLen(2))
+					for i, authority := range m.Authorities {
+						Expect(authority.Header.Name.String()).To(Equal("dev.sslip.io."))
+						Expect(authority.Header.Type).To(Equal(dnsmessage.TypeNS))
+						Expect(authority.Body.(*dnsmessage.NSResource).NS.String()).To(Equal(fmt.Sprintf("ns%d.dev.sslip.io.", i+1)))
+					}
+					Expect(m.Additionals).To(HaveLen(2))
+					Expect(m.Additionals[0].Header.Name.String()).To(Equal("ns1.dev.sslip.io."))
+					Expect(m.Additionals[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 53}}))
+					Expect(m.Additionals[1].Body).To(Equal(&dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 0x53}}))
+				},
+				Entry("A of an embedded IP", "10-0-0-1.dev.sslip.io.", dnsmessage.TypeA),
+				Entry("AAAA", "www.dev.sslip.io.", dnsmessage.TypeAAAA),
+				Entry("TXT", "_mta-sts.dev.sslip.io.", dnsmessage.TypeTXT),
+				Entry("MX", "DEV.sslip.io.", dnsmessage.TypeMX),
+				Entry("NS at the zone cut", "dev.sslip.io.", dnsmessage.TypeNS),
+				Entry("SOA", "dev.sslip.io.", dnsmessage.TypeSOA),
+				Entry("an unknown type", "a.b.dev.sslip.io.", dnsmessage.Type(65280)),
+			)
+			It("answers the names that aren't under the delegated subdomain", func() {
+				for _, name := range []string{"10-0-0-1.sslip.io.", "10-0-0-1.notdev.sslip.io."} {
+					response, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.Authoritative).To(BeTrue())
+					Expect(m.Answers).To(HaveLen(1))
+				}
+			})
+			It("rejects an invalid nameserver", func() {
+				tooLong := strings.Repeat("ns.", 100) + "dev.sslip.io."
+				Expect(x.AddDelegate("dev.sslip.io", tooLong)).To(MatchError(ContainSubstring(`invalid nameserver "` + tooLong + `"`)))
+			})
+		})
+		Describe("a compressed question", func() {
+			// the question's name "10-0-0-1.sslip.io" ends with a pointer to the
+			// header's QDCOUNT's high byte, 0, i.e. the root
+			compressedQuery := []byte{
+				0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				8, '1', '0', '-', '0', '-', '0', '-', '1', 5, 's', 's', 'l', 'i', 'p', 2, 'i', 'o', 0xc0, 0x04,
+				0x00, 0x01, 0x00, 0x01, // TypeA, ClassINET
+			}
+			It("is parseable", func() {
+				var m dnsmessage.Message
+				Expect(m.Unpack(compressedQuery)).To(Succeed())
+				Expect(m.Questions[0].Name.String()).To(Equal("10-0-0-1.sslip.io."))
+			})
+			It("is a format error", func() {
+				malformed := x.Metrics.MalformedQueries
+				response, logMessage, err := x.QueryResponse(compressedQuery, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.ID).To(Equal(uint16(0x1234)))
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeFormatError))
+				Expect(m.Answers).To(BeEmpty())
+				Expect(logMessage).To(Equal("TypeA 10-0-0-1.sslip.io. ? FormErr (compressed question)"))
+				Expect(x.Metrics.MalformedQueries).To(Equal(malformed + 1))
+			})
+			It("isn't confused with an uncompressed one", func() {
+				response, _, err := x.QueryResponse(packedQuery("10-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			})
+		})
+		Describe("a truncated question", func() {
+			// a valid header (QDCOUNT 1), but the question stops mid-name
+			truncatedQuery := []byte{
+				0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				8, '1', '0', '-', '0',
+			}
+			AfterEach(func() {
+				x.LogLevel = xip.LogLevelAll
+			})
+			It("is a format error, echoing the header's ID", func() {
+				malformed := x.Metrics.MalformedQueries
+				response, logMessage, err := x.QueryResponse(truncatedQuery, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.ID).To(Equal(uint16(0x1234)))
+				Expect(m.Response).To(BeTrue())
+				Expect(m.RecursionDesired).To(BeTrue())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeFormatError))
+				Expect(m.Questions).To(BeEmpty())
+				Expect(logMessage).To(Equal("? FormErr (truncated question)"))
+				Expect(x.Metrics.MalformedQueries).To(Equal(malformed + 1))
+			})
+			It("isn't logged if the LogLevel is \"errors\"", func() {
+				x.LogLevel = xip.LogLevelErrors
+				_, logMessage, err := x.QueryResponse(truncatedQuery, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(""))
+			})
+			It("is still an error if even the header is truncated", func() {
+				_, _, err := x.QueryResponse(truncatedQuery[:11], net.IP{127, 0, 0, 1})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("FloodInterval", func() {
+			AfterEach(func() {
+				x.FloodInterval = 0
+				delete(xip.Customizations, "flood.sslip.io.")
+			})
+			// floodQuery returns the query for "flood.sslip.io" A with that ID
+			floodQuery := func(id uint16) []byte {
+				query := packedQuery("flood.sslip.io.", dnsmessage.TypeA)
+				query[0], query[1] = byte(id>>8), byte(id)
+				return query
+			}
+			// answer returns the response's ID & its A record
+			answer := func(response []byte) (uint16, string) {
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(HaveLen(1))
+				return m.ID, net.IP(m.Answers[0].Body.(*dnsmessage.AResource).A[:]).String()
+			}
+			// customize points "flood.sslip.io" at the IP
+			customize := func(ip [4]byte) {
+				xip.Customizations["flood.sslip.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: ip}}}
+			}
+			BeforeEach(func() {
+				customize([4]byte{10, 0, 0, 1})
+			})
+
+			It("answers a flood's identical queries from the cache, with their own IDs", func() {
+				x.FloodInterval = time.Hour
+				hits := x.Metrics.AnsweredFromFloodCache
+				srcAddr := net.IP{198, 51, 100, 1}
+				response, logMessage, err := x.QueryResponse(floodQuery(1), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("TypeA flood.sslip.io. ? 10.0.0.1"))
+				customize([4]byte{10, 0, 0, 2}) // the cache answers without processing the query
+				for id := uint16(2); id <= 4; id++ {
+					response, logMessage, err = x.QueryResponse(floodQuery(id), srcAddr)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(Equal("TypeA flood.sslip.io. ? 10.0.0.1 (flood cache)"))
+					responseID, ip := answer(response)
+					Expect(responseID).To(Equal(id))
+					Expect(ip).To(Equal("10.0.0.1"))
+				}
+				Expect(x.Metrics.AnsweredFromFloodCache).To(Equal(hits + 3))
+			})
+			It("answers other queries & other sources' queries in full", func() {
+				x.FloodInterval = time.Hour
+				hits := x.Metrics.AnsweredFromFloodCache
+				_, _, err := x.QueryResponse(floodQuery(1), net.IP{198, 51, 100, 2})
+				Expect(err).ToNot(HaveOccurred())
+				customize([4]byte{10, 0, 0, 2})
+				response, _, err := x.QueryResponse(floodQuery(2), net.IP{198, 51, 100, 3})
+				Expect(err).ToNot(HaveOccurred())
+				_, ip := answer(response)
+				Expect(ip).To(Equal("10.0.0.2"))
+				_, _, err = x.QueryResponse(packedQuery("flood.sslip.io.", dnsmessage.TypeAAAA), net.IP{198, 51, 100, 2})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(x.Metrics.AnsweredFromFloodCache).To(Equal(hits))
+			})
+			It("answers the query in full once the interval has passed", func() {
+				x.FloodInterval = 20 * time.Millisecond
+				srcAddr := net.IP{198, 51, 100, 4}
+				_, _, err := x.QueryResponse(floodQuery(1), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				customize([4]byte{10, 0, 0, 2})
+				time.Sleep(30 * time.Millisecond)
+				response, logMessage, err := x.QueryResponse(floodQuery(2), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).ToNot(ContainSubstring("flood cache"))
+				_, ip := answer(response)
+				Expect(ip).To(Equal("10.0.0.2"))
+			})
+			It("answers the `k-v.io` queries in full, lest it miss the puts", func() {
+				x.FloodInterval = time.Hour
+				hits := x.Metrics.AnsweredFromFloodCache
+				srcAddr := net.IP{198, 51, 100, 6}
+				_, err := x.TXTResources("put.old.flood-key.k-v.io.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				_, _, err = x.QueryResponse(packedQuery("get.flood-key.k-v.io.", dnsmessage.TypeTXT), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = x.TXTResources("put.new.flood-key.k-v.io.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				response, _, err := x.QueryResponse(packedQuery("get.flood-key.k-v.io.", dnsmessage.TypeTXT), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers[0].Body.(*dnsmessage.TXTResource).TXT).To(Equal([]string{"new"}))
+				Expect(x.Metrics.AnsweredFromFloodCache).To(Equal(hits))
+				_, err = x.TXTResources("delete.flood-key.k-v.io.", nil)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			It("answers in full while we're drained", func() {
+				x.FloodInterval = time.Hour
+				srcAddr := net.IP{198, 51, 100, 7}
+				_, _, err := x.QueryResponse(floodQuery(1), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				x.Drain(true)
+				defer x.Drain(false)
+				_, logMessage, err := x.QueryResponse(floodQuery(2), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("TypeA flood.sslip.io. ? ServFail (draining)"))
+			})
+			It("is disabled by default", func() {
+				hits := x.Metrics.AnsweredFromFloodCache
+				srcAddr := net.IP{198, 51, 100, 5}
+				for id := uint16(1); id <= 3; id++ {
+					_, _, err := x.QueryResponse(floodQuery(id), srcAddr)
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(x.Metrics.AnsweredFromFloodCache).To(Equal(hits))
+			})
+		})
+		Describe("MaxLabels", func() {
+			AfterEach(func() {
+				x.MaxLabels = xip.DefaultMaxLabels
+			})
+			// deepName returns a name with that many labels, ending in "127-0-0-1.sslip.io."
+			deepName := func(labels int) string {
+				return strings.Repeat("a.", labels-3) + "127-0-0-1.sslip.io."
+			}
+			It("answers deep names by default", func() {
+				response, _, err := x.QueryResponse(packedQuery(deepName(100), dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Answers).To(HaveLen(1))
+			})
+			DescribeTable("refuses names with more labels than MaxLabels",
+				func(maxLabels int, labels int, expectedRCode dnsmessage.RCode, expectedRefusals int) {
+					x.MaxLabels = maxLabels
+					refused := x.Metrics.RefusedTooManyLabels
+					response, logMessage, err := x.QueryResponse(packedQuery(deepName(labels), dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(expectedRCode))
+					Expect(x.Metrics.RefusedTooManyLabels).To(Equal(refused + int64(expectedRefusals)))
+					if expectedRCode == dnsmessage.RCodeRefused {
+						Expect(logMessage).To(Equal(fmt.Sprintf("TypeA %s ? Refused (%d labels)", deepName(labels), labels)))
+						Expect(m.Answers).To(BeEmpty())
+						Expect(m.Questions).To(HaveLen(1))
+					} else {
+						Expect(m.Answers).To(HaveLen(1))
+					}
+				},
+				Entry("at the cap", 10, 10, dnsmessage.RCodeSuccess, 0),
+				Entry("over the cap", 10, 11, dnsmessage.RCodeRefused, 1),
+				Entry("no cap", 0, 120, dnsmessage.RCodeSuccess, 0),
+			)
+		})
+		Describe("RequireEDNS", func() {
+			AfterEach(func() {
+				x.RequireEDNS = false
+			})
+			DescribeTable("answers or refuses the query",
+				func(requireEDNS bool, edns bool, expectedRCode dnsmessage.RCode, expectedRefusals int) {
+					x.RequireEDNS = requireEDNS
+					query := packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+					if edns {
+						query = packedEDNSQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+					}
+					refused := x.Metrics.RefusedWithoutEDNS
+					response, logMessage, err := x.QueryResponse(query, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(expectedRCode))
+					Expect(x.Metrics.RefusedWithoutEDNS).To(Equal(refused + int64(expectedRefusals)))
+					if expectedRCode == dnsmessage.RCodeRefused {
+						Expect(logMessage).To(Equal("TypeA 127-0-0-1.sslip.io. ? Refused (no EDNS)"))
+						Expect(m.Authoritative).To(BeFalse())
+						Expect(m.Answers).To(BeEmpty())
+						Expect(m.Questions).To(HaveLen(1))
+					} else {
+						Expect(m.Answers).To(HaveLen(1))
+					}
+				},
+				Entry("off, with EDNS", false, true, dnsmessage.RCodeSuccess, 0),
+				Entry("off, without EDNS", false, false, dnsmessage.RCodeSuccess, 0),
+				Entry("on, with EDNS", true, true, dnsmessage.RCodeSuccess, 0),
+				Entry("on, without EDNS → refused", true, false, dnsmessage.RCodeRefused, 1),
+			)
+		})
+		Describe("QueryPolicy", func() {
+			BeforeEach(func() {
+				x.QueryPolicy = func(_ string, ip net.IP) bool { return ip.IsPrivate() }
+			})
+			AfterEach(func() {
+				x.QueryPolicy = nil
+			})
+			It("answers the names whose IPs the policy permits", func() {
+				m, _ := unpackedResponse(x, "10-0-0-1.sslip.io.", dnsmessage.TypeA)
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Answers).To(HaveLen(1))
+				m, _ = unpackedResponse(x, "fd00--1.sslip.io.", dnsmessage.TypeAAAA)
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Answers).To(HaveLen(1))
+			})
+			DescribeTable("refuses the names whose IPs the policy denies",
+				func(name string, qType dnsmessage.Type) {
+					denied := x.Metrics.DeniedByPolicy
+					m, logMessage := unpackedResponse(x, name, qType)
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeRefused))
+					Expect(m.Authoritative).To(BeFalse())
+					Expect(m.Answers).To(BeEmpty())
+					Expect(logMessage).To(Equal(qType.String() + " " + name + " ? Refused (policy)"))
+					Expect(x.Metrics.DeniedByPolicy).To(Equal(denied + 1))
+				},
+				Entry("a public IPv4", "8-8-8-8.sslip.io.", dnsmessage.TypeA),
+				Entry("a public IPv6", "2001-4860-4860--8888.sslip.io.", dnsmessage.TypeAAAA),
+			)
+			It("passes the policy the name & the IP", func() {
+				var names []string
+				var ips []net.IP
+				x.QueryPolicy = func(name string, ip net.IP) bool {
+					names, ips = append(names, name), append(ips, ip)
+					return true
+				}
+				unpackedResponse(x, "www.192-168-0-1.sslip.io.", dnsmessage.TypeA)
+				Expect(names).To(Equal([]string{"www.192-168-0-1.sslip.io."}))
+				Expect(ips).To(HaveLen(1))
+				Expect(ips[0].Equal(net.IP{192, 168, 0, 1})).To(BeTrue())
+			})
+			It("exempts the customized names", func() {
+				m, _ := unpackedResponse(x, "ns-aws.sslip.io.", dnsmessage.TypeA)
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Answers).To(HaveLen(1))
+			})
+		})
+		Describe("AllowlistOnly", func() {
+			BeforeEach(func() {
+				x.AllowlistOnly = true
+				x.Allowlist = []string{"*.internal.example.com", "ns-aws.sslip.io."}
+			})
+			AfterEach(func() {
+				x.AllowlistOnly = false
+				x.Allowlist = nil
+			})
+			DescribeTable("answers the names that match the Allowlist",
+				func(name string, qType dnsmessage.Type) {
+					response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Authoritative).To(BeTrue())
+					Expect(m.Answers).ToNot(BeEmpty())
+				},
+				Entry("an embedded IP under the wildcard's zone", "10-0-0-1.internal.example.com.", dnsmessage.TypeA),
+				Entry("a deeper name under the wildcard's zone", "foo.10-0-0-1.Internal.Example.com.", dnsmessage.TypeA),
+				Entry("an exact (customized) name", "NS-AWS.sslip.io.", dnsmessage.TypeA),
+			)
+			DescribeTable("refuses everything else, and counts it",
+				func(name string) {
+					denied := x.Metrics.DeniedByAllowlist
+					response, logMessage, err := x.QueryResponse(packedEDNSQuery(name, dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(HaveSuffix("? Refused (allowlist)"))
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeRefused))
+					Expect(m.Authoritative).To(BeFalse())
+					Expect(m.Answers).To(BeEmpty())
+					Expect(x.Metrics.DeniedByAllowlist).To(Equal(denied + 1))
+				},
+				Entry("an embedded IP under another zone", "10-0-0-1.sslip.io."),
+				Entry("the wildcard's zone itself", "internal.example.com."),
+				Entry("a name that merely ends in the wildcard's zone", "10-0-0-1.notinternal.example.com."),
+				Entry("a name under the exact name", "foo.ns-aws.sslip.io."),
+			)
+			It("includes the Extended DNS Error", func() {
+				x.ExtendedDNSErrors = true
+				defer func() { x.ExtendedDNSErrors = false }()
+				response, _, err := x.QueryResponse(packedEDNSQuery("10-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(responseOPT(response).Options).To(ContainElement(dnsmessage.Option{Code: 15, Data: append([]byte{0, xip.EDEProhibited}, "allowlist"...)}))
+			})
+			It("answers everything when it's off", func() {
+				x.AllowlistOnly = false
+				response, _, err := x.QueryResponse(packedQuery("10-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			})
+		})
+		Describe("private IPs & the blocklist", func() {
+			answerTo := func(name string) string {
+				response, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				return net.IP(m.Answers[0].Body.(*dnsmessage.AResource).A[:]).String()
+			}
+			BeforeEach(func() {
+				_, managementSubnet, err := net.ParseCIDR("10.9.0.0/16")
+				Expect(err).ToNot(HaveOccurred())
+				x.BlocklistCDIRs = []net.IPNet{*managementSubnet}
+				x.BlocklistStrings = []string{"raiffeisen"}
+			})
+			It("doesn't block private IPs by default, even if they match a rule", func() {
+				Expect(answerTo("10-9-0-1.sslip.io.")).To(Equal("10.9.0.1"))
+				Expect(answerTo("raiffeisen.10-0-0-1.sslip.io.")).To(Equal("10.0.0.1"))
+			})
+			It("blocks private IPs that match a rule when BlocklistPrivateToo is set", func() {
+				x.BlocklistPrivateToo = true
+				Expect(answerTo("10-9-0-1.sslip.io.")).To(Equal("52.0.56.137"))
+				Expect(answerTo("raiffeisen.10-0-0-1.sslip.io.")).To(Equal("52.0.56.137"))
+			})
+			It("doesn't block private IPs that don't match a rule when BlocklistPrivateToo is set", func() {
+				x.BlocklistPrivateToo = true
+				Expect(answerTo("10-8-0-1.sslip.io.")).To(Equal("10.8.0.1"))
+			})
+			Describe("internationalized (punycode) names", func() {
+				It("blocks a name whose decoded form matches a rule", func() {
+					// "xn---bank-cp33a2aaha5ad0e5bv" is a fullwidth "ｒａｉｆｆｅｉｓｅｎ-bank", NFKC "raiffeisen-bank"
+					Expect(answerTo("xn---bank-cp33a2aaha5ad0e5bv.1.2.3.4.sslip.io.")).To(Equal("52.0.56.137"))
+					Expect(answerTo("XN---BANK-CP33A2AAHA5AD0E5BV.1-2-3-4.sslip.io.")).To(Equal("52.0.56.137"))
+				})
+				It("still blocks the raw form", func() {
+					Expect(answerTo("xn--raiffeisen-poa.1.2.3.4.sslip.io.")).To(Equal("52.0.56.137"))
+				})
+				It("doesn't block a name whose decoded form doesn't match a rule", func() {
+					// "xn--bcher-kva" is "bücher"
+					Expect(answerTo("xn--bcher-kva.1.2.3.4.sslip.io.")).To(Equal("1.2.3.4"))
+					Expect(answerTo("xn--not-valid-punycode-.1.2.3.4.sslip.io.")).To(Equal("1.2.3.4"))
+				})
+			})
+			Describe("the TTL", func() {
+				AfterEach(func() {
+					x.BlockedTTL = 0
+				})
+				ttlOf := func(name string, qType dnsmessage.Type) uint32 {
+					response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.Answers).To(HaveLen(1))
+					return m.Answers[0].Header.TTL
+				}
+				It("is short for blocked answers, but long for the others", func() {
+					Expect(ttlOf("raiffeisen.1.2.3.4.sslip.io.", dnsmessage.TypeA)).To(Equal(uint32(xip.DefaultBlockedTTL)))
+					Expect(ttlOf("1.2.3.4.sslip.io.", dnsmessage.TypeA)).To(Equal(uint32(xip.AddressTTL)))
+					Expect(ttlOf("2600--1.sslip.io.", dnsmessage.TypeAAAA)).To(Equal(uint32(xip.AddressTTL)))
+				})
+				It("is configurable for blocked answers", func() {
+					x.BlockedTTL = 5
+					Expect(ttlOf("raiffeisen.1.2.3.4.sslip.io.", dnsmessage.TypeA)).To(Equal(uint32(5)))
+				})
+				It(`is what "ttl.<name>.sslip.io" reports, too`, func() {
+					txts, err := xip.TXTTTL(x, "raiffeisen.1.2.3.4.sslip.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txts[0].TXT[0]).To(Equal(fmt.Sprintf("A %d", xip.DefaultBlockedTTL)))
+				})
+			})
+			Describe(`"blocked.<name>.sslip.io" TXT`, func() {
+				BeforeEach(func() {
+					x.BlockedTXT = true
+					_, phishingSubnet, err := net.ParseCIDR("43.134.66.67/24")
+					Expect(err).ToNot(HaveOccurred())
+					x.BlocklistCDIRs = append(x.BlocklistCDIRs, *phishingSubnet)
+				})
+				AfterEach(func() {
+					x.BlockedTXT = false
+				})
+				DescribeTable("returns whether the name would be blocked, and why",
+					func(fqdn string, expected string) {
+						txts, err := x.TXTResources(fqdn, nil)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{expected}}}))
+					},
+					Entry("a blocked string", "blocked.raiffeisen.1.2.3.4.sslip.io.", "blocked: string raiffeisen"),
+					Entry("a blocked CIDR", "BLOCKED.nf-43-134-66-1.sslip.io.", "blocked: cidr 43.134.66.0/24"),
+					Entry("an allowed name", "blocked.1.2.3.4.sslip.io.", "allowed"),
+					Entry("a private IP", "blocked.raiffeisen.10-9-0-1.sslip.io.", "allowed"),
+					Entry("a name without an IP", "blocked.raiffeisen.sslip.io.", "allowed"),
+				)
+				It("works under our other zones, too", func() {
+					Expect(x.AddZone("example.com")).To(Succeed())
+					txts, err := x.TXTResources("blocked.raiffeisen.1.2.3.4.example.com.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"blocked: string raiffeisen"}}}))
+				})
+				It("is disabled by default", func() {
+					x.BlockedTXT = false
+					txts, err := x.TXTResources("blocked.raiffeisen.1.2.3.4.sslip.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txts).To(BeEmpty())
+				})
+			})
+		})
+		Describe(`"metrics.<page>.status.sslip.io"`, func() {
+			txtsOf := func(name string) (txts []string) {
+				response, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				for _, answer := range m.Answers {
+					txts = append(txts, answer.Body.(*dnsmessage.TXTResource).TXT...)
+				}
+				return txts
+			}
+			It("returns the first page of the metrics, preceded by the page count", func() {
+				all := txtsOf("metrics.status.sslip.io.")
+				pages := (len(all) + xip.MetricsPageSize - 1) / xip.MetricsPageSize
+				Expect(pages).To(BeNumerically(">", 1))
+				page := txtsOf("metrics.1.status.sslip.io.")
+				Expect(page[0]).To(Equal(fmt.Sprintf("Page: 1/%d", pages)))
+				Expect(len(page)).To(Equal(1 + xip.MetricsPageSize))
+				Expect(page[1]).To(MatchRegexp(`^Uptime: \d+$`))
+				Expect(page[2]).To(HavePrefix("KV Store: "))
+			})
+			It("returns the last page, which may be partial", func() {
+				all := txtsOf("metrics.status.sslip.io.")
+				pages := (len(all) + xip.MetricsPageSize - 1) / xip.MetricsPageSize
+				page := txtsOf(fmt.Sprintf("metrics.%d.STATUS.sslip.io.", pages))
+				Expect(page[0]).To(Equal(fmt.Sprintf("Page: %d/%d", pages, pages)))
+				Expect(len(page) - 1).To(Equal(len(all) - (pages-1)*xip.MetricsPageSize))
+				Expect(page[len(page)-1]).To(HavePrefix(strings.Split(all[len(all)-1], ":")[0]))
+			})
+			It("returns no records for an out-of-range page", func() {
+				Expect(txtsOf("metrics.0.status.sslip.io.")).To(BeEmpty())
+				Expect(txtsOf("metrics.99.status.sslip.io.")).To(BeEmpty())
+			})
+			It("truncates all the metrics over UDP to the querier's buffer, whole over TCP", func() {
+				var m dnsmessage.Message
+				response, logMessage, err := x.QueryResponseVia(xip.TransportUDP, packedQuery("metrics.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HaveSuffix(" (truncated)"))
+				Expect(len(response)).To(BeNumerically("<=", 512)) // no EDNS
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.Truncated).To(BeTrue())
+				Expect(m.Questions).To(HaveLen(1))
+				Expect(m.Answers).To(BeEmpty())
+
+				response, _, err = x.QueryResponseVia(xip.TransportUDP, packedEDNSQuery("metrics.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(response)).To(BeNumerically("<=", 1232))
+
+				response, _, err = x.QueryResponseVia(xip.TransportTCP, packedQuery("metrics.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.Truncated).To(BeFalse())
+				Expect(len(m.Answers)).To(BeNumerically(">", 2*xip.MetricsPageSize))
+			})
+		})
+		Describe("the CNAME, MX, NS, and SOA metrics", func() {
+			DescribeTable("count the answered queries of their type",
+				func(name string, qType dnsmessage.Type, counter func(xip.Metrics) int64, expectedIncrease int) {
+					before := x.Metrics
+					_, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(counter(x.Metrics)).To(Equal(counter(before) + int64(expectedIncrease)))
+					// and only their type
+					for _, other := range []func(xip.Metrics) int64{
+						func(m xip.Metrics) int64 { return m.AnsweredCNAMEQueries },
+						func(m xip.Metrics) int64 { return m.AnsweredMXQueries },
+						func(m xip.Metrics) int64 { return m.AnsweredNSQueries },
+						func(m xip.Metrics) int64 { return m.AnsweredSOAQueries },
+					} {
+						Expect(other(x.Metrics) - other(before)).To(BeNumerically("<=", int64(expectedIncrease)))
+					}
+				},
+				Entry("CNAME", "protonmail._domainkey.sslip.io.", dnsmessage.TypeCNAME, func(m xip.Metrics) int64 { return m.AnsweredCNAMEQueries }, 1),
+				Entry("no CNAME isn't counted", "127-0-0-1.sslip.io.", dnsmessage.TypeCNAME, func(m xip.Metrics) int64 { return m.AnsweredCNAMEQueries }, 0),
+				Entry("MX", "sslip.io.", dnsmessage.TypeMX, func(m xip.Metrics) int64 { return m.AnsweredMXQueries }, 1),
+				Entry("NS", "sslip.io.", dnsmessage.TypeNS, func(m xip.Metrics) int64 { return m.AnsweredNSQueries }, 1),
+				Entry("SOA", "sslip.io.", dnsmessage.TypeSOA, func(m xip.Metrics) int64 { return m.AnsweredSOAQueries }, 1),
+			)
+			It("shows them in the metrics", func() {
+				metrics, err := x.TXTResources("metrics.status.sslip.io.", net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(metrics).To(ContainElement(dnsmessage.TXTResource{TXT: []string{fmt.Sprintf("CNAME/MX/NS/SOA: %d/%d/%d/%d",
+					x.Metrics.AnsweredCNAMEQueries, x.Metrics.AnsweredMXQueries, x.Metrics.AnsweredNSQueries, x.Metrics.AnsweredSOAQueries)}}))
+			})
+		})
+		Describe(`"compact.metrics.status.sslip.io"`, func() {
+			It("returns the metrics as a single string of key=value pairs", func() {
+				_, _, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				metrics := x.Metrics
+				txts, err := xip.TXTMetricsCompact(x, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txts).To(HaveLen(1))
+				Expect(txts[0].TXT).To(HaveLen(1))
+				compact := txts[0].TXT[0]
+				Expect(len(compact)).To(BeNumerically("<=", 255))
+				Expect(compact).To(MatchRegexp(`^up=\d+(;[a-z]+=\d+)+$`))
+				fields := map[string]string{}
+				for _, pair := range strings.Split(compact, ";") {
+					keyValue := strings.SplitN(pair, "=", 2)
+					fields[keyValue[0]] = keyValue[1]
+				}
+				Expect(fields).To(HaveKeyWithValue("q", strconv.FormatInt(metrics.Queries, 10)))
+				Expect(fields).To(HaveKeyWithValue("aq", strconv.FormatInt(metrics.AnsweredQueries, 10)))
+				Expect(fields).To(HaveKeyWithValue("a", strconv.FormatInt(metrics.AnsweredAQueries, 10)))
+				Expect(fields).To(HaveKeyWithValue("aaaa", strconv.FormatInt(metrics.AnsweredAAAAQueries, 10)))
+				Expect(fields).To(HaveKeyWithValue("blk", strconv.FormatInt(metrics.AnsweredBlockedQueries, 10)))
+				for _, key := range []string{"up", "ptr", "kvg", "kvp", "kvd", "udp", "tcp", "doh", "drop", "tcpa"} {
+					Expect(fields).To(HaveKey(key))
+				}
+			})
+			It("is served as a TXT record", func() {
+				response, _, err := x.QueryResponse(packedQuery("compact.metrics.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Body.(*dnsmessage.TXTResource).TXT[0]).To(HavePrefix("up="))
+			})
+		})
+		Describe(`"runtime.status.sslip.io"`, func() {
+			It("returns the Go runtime's stats, and counts it", func() {
+				runtimeQueries := x.Metrics.AnsweredTXTRuntimeQueries
+				response, logMessage, err := x.QueryResponse(packedQuery("runtime.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HavePrefix(`TypeTXT runtime.status.sslip.io. ? ["Goroutines: `))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				var txts []string
+				for _, answer := range m.Answers {
+					txts = append(txts, answer.Body.(*dnsmessage.TXTResource).TXT...)
+				}
+				Expect(txts).To(HaveLen(6))
+				Expect(txts[0]).To(MatchRegexp(`^Goroutines: [1-9]\d*$`))
+				Expect(txts[1]).To(MatchRegexp(`^Heap Alloc: [1-9]\d*$`))
+				Expect(txts[2]).To(MatchRegexp(`^Heap Sys: [1-9]\d*$`))
+				Expect(txts[3]).To(MatchRegexp(`^GC Runs: \d+$`))
+				Expect(txts[4]).To(HavePrefix("GC Last Pause: "))
+				Expect(txts[5]).To(HavePrefix("GC Total Pause: "))
+				Expect(x.Metrics.AnsweredTXTRuntimeQueries).To(Equal(runtimeQueries + 1))
+			})
+		})
+		Describe(`"id.server.sslip.io"`, func() {
+			AfterEach(func() {
+				x.ServerID = ""
+			})
+			It("returns the server's ID, and counts it", func() {
+				x.ServerID = "ns-aws-1"
+				serverIDQueries := x.Metrics.AnsweredServerIDQueries
+				response, logMessage, err := x.QueryResponse(packedQuery("id.server.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(`TypeTXT id.server.sslip.io. ? ["ns-aws-1"]`))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Header.Class).To(Equal(dnsmessage.ClassINET))
+				Expect(m.Answers[0].Body.(*dnsmessage.TXTResource).TXT).To(Equal([]string{"ns-aws-1"}))
+				Expect(x.Metrics.AnsweredServerIDQueries).To(Equal(serverIDQueries + 1))
+			})
+			It("returns no records (not the hostname) if there's no ServerID", func() {
+				serverIDQueries := x.Metrics.AnsweredServerIDQueries
+				Expect(xip.TXTServerID(x, nil)).To(BeEmpty())
+				Expect(x.Metrics.AnsweredServerIDQueries).To(Equal(serverIDQueries))
+			})
+		})
+		Describe(`"net.<prefix>.sslip.io"`, func() {
+			netOf := func(prefix string) []string {
+				response, logMessage, err := x.QueryResponse(packedQuery("net."+prefix+".sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HavePrefix("TypeTXT net." + prefix + ".sslip.io. ? "))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				return m.Answers[0].Body.(*dnsmessage.TXTResource).TXT
+			}
+			It("returns a /24's network, broadcast & usable range", func() {
+				Expect(netOf("10-0-0-0-24")).To(Equal([]string{"network 10.0.0.0", "broadcast 10.0.0.255", "usable 10.0.0.1-10.0.0.254", "hosts 254"}))
+			})
+			It("returns a /30's, even if the address isn't the network's", func() {
+				Expect(netOf("192-168-1-5-30")).To(Equal([]string{"network 192.168.1.4", "broadcast 192.168.1.7", "usable 192.168.1.5-192.168.1.6", "hosts 2"}))
+			})
+			It("sets nothing aside in /31s & /32s", func() {
+				Expect(netOf("10-0-0-0-31")).To(Equal([]string{"network 10.0.0.0", "broadcast 10.0.0.1", "usable 10.0.0.0-10.0.0.1", "hosts 2"}))
+				Expect(netOf("10-0-0-1-32")).To(Equal([]string{"network 10.0.0.1", "broadcast 10.0.0.1", "usable 10.0.0.1-10.0.0.1", "hosts 1"}))
+			})
+			It("carries across octets", func() {
+				Expect(netOf("172-16-0-0-12")).To(Equal([]string{"network 172.16.0.0", "broadcast 172.31.255.255", "usable 172.16.0.1-172.31.255.254", "hosts 1048574"}))
+			})
+			DescribeTable("returns an error for invalid prefixes",
+				func(prefix string) {
+					Expect(netOf(prefix)).To(Equal([]string{`error: "` + prefix + `" isn't an IPv4 prefix, e.g. "10-0-0-0-24"`}))
+				},
+				Entry("a too-long prefix", "10-0-0-0-33"),
+				Entry("no prefix length", "10-0-0-0"),
+				Entry("an invalid address", "10-0-0-256-24"),
+				Entry("not an address at all", "www"),
+			)
+			It("works under our other zones, but not outside them", func() {
+				Expect(x.AddZone("example.com")).To(Succeed())
+				txts, err := x.TXTResources("net.10-0-0-0-24.example.com.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txts[0].TXT[0]).To(Equal("network 10.0.0.0"))
+				txts, err = x.TXTResources("net.10-0-0-0-24.example.net.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txts).To(BeEmpty())
+			})
+		})
+		Describe(`"ttl.<name>.sslip.io"`, func() {
+			ttlsOf := func(name string) []string {
+				response, _, err := x.QueryResponse(packedQuery("ttl."+name, dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				return m.Answers[0].Body.(*dnsmessage.TXTResource).TXT
+			}
+			// the TTL of the answer, e.g. "A 604800", or of the SOA if there's no answer
+			actualTTL := func(name string, qType dnsmessage.Type) string {
+				response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				recordType := strings.TrimPrefix(qType.String(), "Type")
+				if len(m.Answers) > 0 {
+					return fmt.Sprintf("%s %d", recordType, m.Answers[0].Header.TTL)
+				}
+				Expect(len(m.Authorities)).To(Equal(1))
+				return fmt.Sprintf("%s nil, SOA %d", recordType, m.Authorities[0].Header.TTL)
+			}
+			DescribeTable("matches the TTLs of the actual answers",
+				func(name string) {
+					Expect(ttlsOf(name)).To(Equal([]string{
+						actualTTL(name, dnsmessage.TypeA),
+						actualTTL(name, dnsmessage.TypeAAAA),
+					}))
+				},
+				Entry("an embedded IPv4", "127-0-0-1.sslip.io."),
+				Entry("an embedded IPv6", "--1.sslip.io."),
+				Entry("a customization", "ns-aws.sslip.io."),
+				Entry("no answers at all", "www.sslip.io."),
+			)
+			It("works under our other zones, too", func() {
+				Expect(x.AddZone("example.com")).To(Succeed())
+				Expect(ttlsOf("127-0-0-1.example.com.")).To(Equal([]string{
+					actualTTL("127-0-0-1.example.com.", dnsmessage.TypeA),
+					actualTTL("127-0-0-1.example.com.", dnsmessage.TypeAAAA),
+				}))
+			})
+			It("returns the A answer's TTL and the negative-caching TTL when there's no AAAA answer", func() {
+				Expect(ttlsOf("127-0-0-1.sslip.io.")).To(Equal([]string{"A 604800", "AAAA nil, SOA 180"}))
+			})
+		})
+		Describe(`"trace.sslip.io"`, func() {
+			traceOf := func(query []byte) []string {
+				response, _, err := x.QueryResponse(query, net.IP{8, 8, 8, 8})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				return m.Answers[0].Body.(*dnsmessage.TXTResource).TXT
+			}
+			It("returns the resolver and no client subnet when the query has no ECS option", func() {
+				before := x.Metrics.AnsweredTXTTraceQueries
+				Expect(traceOf(packedQuery("trace.sslip.io.", dnsmessage.TypeTXT))).To(Equal([]string{"resolver=8.8.8.8", "client-subnet=none"}))
+				Expect(traceOf(packedEDNSQuery("trace.sslip.io.", dnsmessage.TypeTXT))).To(Equal([]string{"resolver=8.8.8.8", "client-subnet=none"}))
+				Expect(x.Metrics.AnsweredTXTTraceQueries).To(Equal(before + 2))
+			})
+			It("returns the resolver and the client subnet of an IPv4 ECS option", func() {
+				ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 1, 24, 0, 203, 0, 113}}
+				Expect(traceOf(packedEDNSQuery("trace.sslip.io.", dnsmessage.TypeTXT, ecs))).To(Equal([]string{"resolver=8.8.8.8", "client-subnet=203.0.113.0/24"}))
+			})
+			It("returns the resolver and the client subnet of an IPv6 ECS option", func() {
+				ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0x12, 0x34, 0x56}}
+				Expect(traceOf(packedEDNSQuery("trace.sslip.io.", dnsmessage.TypeTXT, ecs))).To(Equal([]string{"resolver=8.8.8.8", "client-subnet=2001:db8:1234:5600::/56"}))
+			})
+			It("ignores a malformed ECS option", func() {
+				ecs := dnsmessage.Option{Code: 8, Data: []byte{0, 1, 24, 0, 203}} // ADDRESS is too short
+				Expect(traceOf(packedEDNSQuery("trace.sslip.io.", dnsmessage.TypeTXT, ecs))).To(Equal([]string{"resolver=8.8.8.8", "client-subnet=none"}))
+			})
+		})
+		Describe("QueryResponseResult()", func() {
+			It("returns the same response & log message as QueryResponse(), and a QueryResult", func() {
+				query := packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+				expectedResponse, expectedLogMessage, err := x.QueryResponse(query, net.IP{10, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				response, result, logMessage, err := x.QueryResponseResult(query, net.IP{10, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(response).To(Equal(expectedResponse))
+				Expect(logMessage).To(Equal(expectedLogMessage))
+				Expect(result).To(Equal(xip.QueryResult{
+					SrcIP:   net.IP{10, 0, 0, 1},
+					QType:   dnsmessage.TypeA,
+					QName:   "127-0-0-1.sslip.io.",
+					RCode:   dnsmessage.RCodeSuccess,
+					Answers: []string{"127.0.0.1"},
+				}))
+			})
+			It("returns the answers in presentation format", func() {
+				_, result, _, err := x.QueryResponseResult(packedQuery("sslip.io.", dnsmessage.TypeMX), net.IP{10, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Answers).To(Equal([]string{"10 mail.protonmail.ch.", "20 mailsec.protonmail.ch."}))
+			})
+			It("returns the RCode & no answers when there are none", func() {
+				_, result, _, err := x.QueryResponseResult(packedQuery("sslip.io.", dnsmessage.TypeALL), net.IP{10, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.RCode).To(Equal(dnsmessage.RCodeNotImplemented))
+				Expect(result.QType).To(Equal(dnsmessage.TypeALL))
+				Expect(result.Answers).To(BeEmpty())
+			})
+			It("returns an error if the query is malformed", func() {
+				_, _, _, err := x.QueryResponseResult([]byte{0x12}, net.IP{10, 0, 0, 1})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+		Describe("ANY queries", func() {
+			AfterEach(func() {
+				x.AnyMode = ""
+			})
+			It("returns NotImplemented by default", func() {
+				response, logMessage, err := x.QueryResponse(packedQuery("sslip.io.", dnsmessage.TypeALL), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeNotImplemented))
+				Expect(m.Answers).To(BeEmpty())
+				Expect(logMessage).To(Equal("TypeALL sslip.io. ? NotImplemented"))
+			})
+			It(`returns a single HINFO "RFC8482" record in AnyModeHINFO`, func() {
+				x.AnyMode = xip.AnyModeHINFO
+				response, logMessage, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeALL), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(m.Header.Authoritative).To(BeTrue())
+				Expect(len(m.Answers)).To(Equal(1))
+				Expect(m.Answers[0].Header.Type).To(Equal(dnsmessage.TypeHINFO))
+				Expect(m.Answers[0].Header.Name.String()).To(Equal("127-0-0-1.sslip.io."))
+				Expect(m.Answers[0].Body).To(Equal(&dnsmessage.UnknownResource{
+					Type: dnsmessage.TypeHINFO,
+					Data: []byte("\x07RFC8482\x00"),
+				}))
+				Expect(logMessage).To(Equal(`TypeALL 127-0-0-1.sslip.io. ? HINFO "RFC8482" ""`))
+			})
+		})
+		Describe("queries whose class isn't INET", func() {
+			AfterEach(func() {
+				delete(xip.Customizations, "harness.sslip.io.")
+			})
+			It("refuses a CHAOS-class A query rather than answering it as INET", func() {
+				response, logMessage, err := x.QueryResponse(packedClassQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA, dnsmessage.ClassCHAOS), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeRefused))
+				Expect(m.Header.Authoritative).To(BeFalse())
+				Expect(m.Answers).To(BeEmpty())
+				Expect(m.Questions[0].Class).To(Equal(dnsmessage.ClassCHAOS))
+				Expect(logMessage).To(HaveSuffix("ClassCHAOS Refused"))
+			})
+			It("refuses a HESIOD-class TXT query of a customization that didn't opt in", func() {
+				response, _, err := x.QueryResponse(packedClassQuery("ip.sslip.io.", dnsmessage.TypeTXT, dnsmessage.ClassHESIOD), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeRefused))
+			})
+			DescribeTable("refuses the meta-classes ANY & NONE, even if a customization opts in",
+				func(class dnsmessage.Class, suffix string) {
+					xip.Customizations["harness.sslip.io."] = xip.DomainCustomization{Class: class}
+					for _, name := range []string{"127-0-0-1.sslip.io.", "harness.sslip.io."} {
+						response, logMessage, err := x.QueryResponse(packedClassQuery(name, dnsmessage.TypeA, class), net.IP{127, 0, 0, 1})
+						Expect(err).ToNot(HaveOccurred())
+						var m dnsmessage.Message
+						Expect(m.Unpack(response)).To(Succeed())
+						Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeRefused))
+						Expect(m.Header.Authoritative).To(BeFalse())
+						Expect(m.Answers).To(BeEmpty())
+						Expect(logMessage).To(HaveSuffix(suffix))
+					}
+					Expect(x.Metrics.AnsweredUnsupportedClass).To(Equal(int64(2)))
+					x.Metrics.AnsweredUnsupportedClass = 0
+				},
+				Entry("class 255 (ANY)", dnsmessage.ClassANY, "ClassANY Refused"),
+				Entry("class 254 (NONE)", xip.ClassNONE, "254 Refused"),
+			)
+			When("a customization opts into the class", func() {
+				BeforeEach(func() {
+					xip.Customizations["harness.sslip.io."] = xip.DomainCustomization{
+						Class: dnsmessage.ClassCHAOS,
+						TXT: func(_ *xip.Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+							return []dnsmessage.TXTResource{{TXT: []string{"test-harness"}}}, nil
+						},
+					}
+				})
+				It("answers TXT queries with records of that class", func() {
+					response, logMessage, err := x.QueryResponse(packedClassQuery("harness.sslip.io.", dnsmessage.TypeTXT, dnsmessage.ClassCHAOS), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(len(m.Answers)).To(Equal(1))
+					Expect(m.Answers[0].Header.Class).To(Equal(dnsmessage.ClassCHAOS))
+					Expect(m.Answers[0].Body).To(Equal(&dnsmessage.TXTResource{TXT: []string{"test-harness"}}))
+					Expect(logMessage).To(HaveSuffix(`ClassCHAOS ["test-harness"]`))
+				})
+				It("returns no answer for other types of that class", func() {
+					response, _, err := x.QueryResponse(packedClassQuery("harness.sslip.io.", dnsmessage.TypeA, dnsmessage.ClassCHAOS), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeSuccess))
+					Expect(m.Answers).To(BeEmpty())
+				})
+				It("still answers INET TXT queries with INET records", func() {
+					response, _, err := x.QueryResponse(packedQuery("harness.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(len(m.Answers)).To(Equal(1))
+					Expect(m.Answers[0].Header.Class).To(Equal(dnsmessage.ClassINET))
+				})
+			})
+		})
+		Describe(`"chaos.sslip.io"`, func() {
+			var pool []net.IP
+			BeforeEach(func() {
+				pool = nil
+				for i := 1; i <= 10; i++ {
+					pool = append(pool, net.IPv4(10, 0, 0, byte(i)))
+				}
+				pool = append(pool, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"))
+			})
+			AfterEach(func() {
+				x.ChaosPool = nil
+			})
+			answersTo := func(qType dnsmessage.Type) (ips []string) {
+				response, _, err := x.QueryResponse(packedQuery("chaos.sslip.io.", qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				for _, answer := range m.Answers {
+					switch body := answer.Body.(type) {
+					case *dnsmessage.AResource:
+						ips = append(ips, net.IP(body.A[:]).String())
+					case *dnsmessage.AAAAResource:
+						ips = append(ips, net.IP(body.AAAA[:]).String())
+					}
+				}
+				return ips
+			}
+			It("returns a random IPv4 address from the pool, which varies", func() {
+				x.ChaosPool = pool
+				seen := map[string]bool{}
+				for i := 0; i < 50; i++ {
+					ips := answersTo(dnsmessage.TypeA)
+					Expect(len(ips)).To(Equal(1))
+					Expect(ips[0]).To(MatchRegexp(`^10\.0\.0\.([1-9]|10)$`))
+					seen[ips[0]] = true
+				}
+				Expect(len(seen)).To(BeNumerically(">", 1))
+			})
+			It("returns a random IPv6 address from the pool, which varies", func() {
+				x.ChaosPool = pool
+				seen := map[string]bool{}
+				for i := 0; i < 50; i++ {
+					ips := answersTo(dnsmessage.TypeAAAA)
+					Expect(len(ips)).To(Equal(1))
+					Expect(ips[0]).To(Or(Equal("2001:db8::1"), Equal("2001:db8::2")))
+					seen[ips[0]] = true
+				}
+				Expect(len(seen)).To(Equal(2))
+			})
+			It("returns no answer if the pool is empty", func() {
+				Expect(answersTo(dnsmessage.TypeA)).To(BeEmpty())
+				Expect(answersTo(dnsmessage.TypeAAAA)).To(BeEmpty())
+			})
+		})
+		Describe(`"geo.sslip.io"`, func() {
+			var fakeGeoResolver *xipfakes.FakeGeoResolver
+			BeforeEach(func() {
+				fakeGeoResolver = &xipfakes.FakeGeoResolver{}
+				fakeGeoResolver.RegionCalls(func(ip net.IP) string {
+					if ip.Equal(net.IP{10, 0, 0, 1}) {
+						return "eu"
+					}
+					if ip.Equal(net.IP{192, 168, 0, 1}) {
+						return "na"
+					}
+					return "antarctica"
+				})
+				x.GeoAnswers = map[string][]net.IP{
+					"eu":                 {net.IPv4(1, 1, 1, 1), net.ParseIP("2001:db8::e")},
+					"na":                 {net.IPv4(2, 2, 2, 2), net.IPv4(2, 2, 2, 3)},
+					xip.GeoRegionDefault: {net.IPv4(9, 9, 9, 9)},
+				}
+			})
+			AfterEach(func() {
+				x.GeoResolver = nil
+				x.GeoAnswers = nil
+			})
+			answersTo := func(qType dnsmessage.Type, srcAddr net.IP) (ips []string) {
+				response, _, err := x.QueryResponse(packedQuery("geo.sslip.io.", qType), srcAddr)
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				for _, answer := range m.Answers {
+					switch body := answer.Body.(type) {
+					case *dnsmessage.AResource:
+						ips = append(ips, net.IP(body.A[:]).String())
+					case *dnsmessage.AAAAResource:
+						ips = append(ips, net.IP(body.AAAA[:]).String())
+					}
+				}
+				return ips
+			}
+			It("returns the addresses of the querier's region", func() {
+				x.GeoResolver = fakeGeoResolver
+				Expect(answersTo(dnsmessage.TypeA, net.IP{10, 0, 0, 1})).To(Equal([]string{"1.1.1.1"}))
+				Expect(answersTo(dnsmessage.TypeA, net.IP{192, 168, 0, 1})).To(Equal([]string{"2.2.2.2", "2.2.2.3"}))
+				Expect(fakeGeoResolver.RegionCallCount()).To(Equal(2))
+				Expect(fakeGeoResolver.RegionArgsForCall(0)).To(Equal(net.IP{10, 0, 0, 1}))
+				Expect(fakeGeoResolver.RegionArgsForCall(1)).To(Equal(net.IP{192, 168, 0, 1}))
+			})
+			It("returns the IPv6 addresses of the querier's region", func() {
+				x.GeoResolver = fakeGeoResolver
+				Expect(answersTo(dnsmessage.TypeAAAA, net.IP{10, 0, 0, 1})).To(Equal([]string{"2001:db8::e"}))
+				Expect(answersTo(dnsmessage.TypeAAAA, net.IP{192, 168, 0, 1})).To(BeEmpty())
+			})
+			It("returns the default region's addresses if the querier's region has none", func() {
+				x.GeoResolver = fakeGeoResolver
+				Expect(answersTo(dnsmessage.TypeA, net.IP{172, 16, 0, 1})).To(Equal([]string{"9.9.9.9"}))
+			})
+			It("returns the default region's addresses if there's no GeoResolver", func() {
+				Expect(answersTo(dnsmessage.TypeA, net.IP{10, 0, 0, 1})).To(Equal([]string{"9.9.9.9"}))
+			})
+			It("maps the querier to a region with a CIDRGeoResolver", func() {
+				_, eu, _ := net.ParseCIDR("10.0.0.0/8")
+				_, na, _ := net.ParseCIDR("2001:db8::/32")
+				x.GeoResolver = xip.CIDRGeoResolver{{CIDR: *eu, Region: "eu"}, {CIDR: *na, Region: "na"}}
+				Expect(answersTo(dnsmessage.TypeA, net.IP{10, 0, 0, 1})).To(Equal([]string{"1.1.1.1"}))
+				Expect(answersTo(dnsmessage.TypeA, net.ParseIP("2001:db8::1"))).To(Equal([]string{"2.2.2.2", "2.2.2.3"}))
+				Expect(answersTo(dnsmessage.TypeA, net.IP{172, 16, 0, 1})).To(Equal([]string{"9.9.9.9"}))
+			})
+		})
+		Describe("Drain()", func() {
+			AfterEach(func() {
+				x.Drain(false)
+			})
+			// rCode returns the response's RCODE & the log message
+			rCode := func(name string, qType dnsmessage.Type) (dnsmessage.RCode, string) {
+				response, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				return m.Header.RCode, logMessage
+			}
+			It("answers every query SERVFAIL while draining", func() {
+				drainedQueries := x.Metrics.DrainedQueries
+				x.Drain(true)
+				Expect(x.Draining()).To(BeTrue())
+				for _, qType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeTXT, dnsmessage.TypeNS, dnsmessage.TypeSOA, dnsmessage.TypeMX} {
+					code, logMessage := rCode("127-0-0-1.sslip.io.", qType)
+					Expect(code).To(Equal(dnsmessage.RCodeServerFailure))
+					Expect(logMessage).To(Equal(qType.String() + " 127-0-0-1.sslip.io. ? ServFail (draining)"))
+				}
+				Expect(x.Metrics.DrainedQueries).To(Equal(drainedQueries + 6))
+			})
+			It("answers normally again once undrained", func() {
+				x.Drain(true)
+				x.Drain(false)
+				Expect(x.Draining()).To(BeFalse())
+				code, logMessage := rCode("127-0-0-1.sslip.io.", dnsmessage.TypeA)
+				Expect(code).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(logMessage).To(Equal("TypeA 127-0-0-1.sslip.io. ? 127.0.0.1"))
+			})
+		})
+		Describe("DisableVersionTXT & DisableMetricsTXT", func() {
+			AfterEach(func() {
+				x.DisableVersionTXT = false
+				x.DisableMetricsTXT = false
+			})
+			// txts returns the TXT answers' first strings
+			txts := func(name string) (firsts []string) {
+				response, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Header.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				for _, answer := range m.Answers {
+					firsts = append(firsts, answer.Body.(*dnsmessage.TXTResource).TXT[0])
+				}
+				return firsts
+			}
+			It("returns the info by default", func() {
+				Expect(txts("version.status.sslip.io.")).To(ContainElement(xip.VersionSemantic))
+				Expect(txts("metrics.status.sslip.io.")).ToNot(BeEmpty())
+				Expect(txts("compact.metrics.status.sslip.io.")).ToNot(BeEmpty())
+				Expect(txts("metrics.2.status.sslip.io.")).ToNot(BeEmpty())
+			})
+			It("withholds the version", func() {
+				x.DisableVersionTXT = true
+				Expect(txts("version.status.sslip.io.")).To(BeEmpty())
+				Expect(txts("Version.Status.sslip.io.")).To(BeEmpty())
+				Expect(txts("metrics.status.sslip.io.")).ToNot(BeEmpty())
+				Expect(x.SelfTest()).To(Succeed())
+			})
+			It("withholds the metrics, all their forms", func() {
+				x.DisableMetricsTXT = true
+				Expect(txts("metrics.status.sslip.io.")).To(BeEmpty())
+				Expect(txts("compact.metrics.status.sslip.io.")).To(BeEmpty())
+				Expect(txts("metrics.2.status.sslip.io.")).To(BeEmpty())
+				Expect(txts("version.status.sslip.io.")).To(ContainElement(xip.VersionSemantic))
+			})
+		})
+		Describe("SelfTest()", func() {
+			It("succeeds", func() {
+				Expect(x.SelfTest()).To(Succeed())
+			})
+			It("counts its queries, as any others", func() {
+				queries := x.Metrics.Snapshot().Queries
+				Expect(x.SelfTest()).To(Succeed())
+				Expect(x.Metrics.Snapshot().Queries).To(Equal(queries + 3))
+			})
+			When("the flags that refuse queries are set", func() {
+				AfterEach(func() {
+					x.RequireEDNS = false
+					x.AllowlistOnly = false
+					x.Allowlist = nil
+					x.QueryPolicy = nil
+					x.RefuseOutOfZone = false
+				})
+				DescribeTable("still succeeds",
+					func(set func()) {
+						set()
+						Expect(x.SelfTest()).To(Succeed())
+					},
+					Entry("-requireEDNS", func() { x.RequireEDNS = true }),
+					Entry("-allowlist", func() {
+						x.AllowlistOnly = true
+						x.Allowlist = []string{"*.example.com"}
+					}),
+					Entry("a QueryPolicy", func() {
+						x.QueryPolicy = func(_ string, ip net.IP) bool { return !ip.IsLoopback() }
+					}),
+					Entry("-refuseOutOfZone", func() { x.RefuseOutOfZone = true }),
+				)
+				It("still refuses the other queries", func() {
+					x.AllowlistOnly = true
+					x.Allowlist = []string{"*.example.com"}
+					response, _, err := x.QueryResponse(packedQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(m.RCode).To(Equal(dnsmessage.RCodeRefused))
+				})
+			})
+			When("the answers are wrong", func() {
+				BeforeEach(func() {
+					xip.Customizations["127-0-0-1.sslip.io."] = xip.DomainCustomization{
+						A: []dnsmessage.AResource{{A: [4]byte{10, 9, 8, 7}}},
+					}
+				})
+				AfterEach(func() {
+					delete(xip.Customizations, "127-0-0-1.sslip.io.")
+				})
+				It("returns an error", func() {
+					Expect(x.SelfTest()).To(MatchError("self-test: TypeA 127-0-0-1.sslip.io.: expected [127.0.0.1], got [10.9.8.7]"))
+				})
+			})
+		})
+		Describe("the SOA's TTL", func() {
+			It("is the MINIMUM in the Authority section of negative responses", func() {
+				response, _, err := x.QueryResponse(packedQuery("example.com.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(BeEmpty())
+				Expect(len(m.Authorities)).To(Equal(1))
+				soa := m.Authorities[0].Body.(*dnsmessage.SOAResource)
+				Expect(m.Authorities[0].Header.TTL).To(Equal(soa.MinTTL))
+				Expect(m.Authorities[0].Header.TTL).To(Equal(uint32(180)))
+			})
+			It("is long in SOA answers", func() {
+				response, _, err := x.QueryResponse(packedQuery("example.com.", dnsmessage.TypeSOA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				Expect(m.Answers[0].Header.TTL).To(Equal(uint32(604800)))
+			})
+		})
+		When("the SOA timers are configured", func() {
+			AfterEach(func() {
+				x.SOATimers = xip.DefaultSOATimers
+			})
+			It("returns them in SOA answers", func() {
+				x.SOATimers = xip.SOATimers{Refresh: 3600, Retry: 600, Expire: 604800, MinTTL: 60}
+				response, logMessage, err := x.QueryResponse(packedQuery("sslip.io.", dnsmessage.TypeSOA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(HaveSuffix(" 3600 600 604800 60"))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(len(m.Answers)).To(Equal(1))
+				soa := m.Answers[0].Body.(*dnsmessage.SOAResource)
+				Expect([]uint32{soa.Refresh, soa.Retry, soa.Expire, soa.MinTTL}).To(Equal([]uint32{3600, 600, 604800, 60}))
+			})
+		})
+		Describe("LogLevel", func() {
+			blockedQuery := packedQuery("raiffeisen.94.228.116.140.sslip.io.", dnsmessage.TypeA)
+			notImplementedQuery := packedQuery("sslip.io.", dnsmessage.TypeALL)
+			BeforeEach(func() {
+				x.BlocklistStrings = []string{"raiffeisen"}
+			})
+			logMessageOf := func(query []byte) string {
+				_, logMessage, err := x.QueryResponse(query, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				return logMessage
+			}
+			When(`it's "all" (the default)`, func() {
+				It("logs every query", func() {
+					Expect(logMessageOf(query)).To(Equal("TypeA 127-0-0-1.sslip.io. ? 127.0.0.1"))
+					Expect(logMessageOf(blockedQuery)).To(Equal("TypeA raiffeisen.94.228.116.140.sslip.io. ? 52.0.56.137"))
+					Expect(logMessageOf(notImplementedQuery)).To(Equal("TypeALL sslip.io. ? NotImplemented"))
+				})
+			})
+			When(`it's "anomalies"`, func() {
+				It("logs only the blocked and unsuccessful queries", func() {
+					x.LogLevel = xip.LogLevelAnomalies
+					Expect(logMessageOf(query)).To(Equal(""))
+					Expect(logMessageOf(blockedQuery)).To(Equal("TypeA raiffeisen.94.228.116.140.sslip.io. ? 52.0.56.137"))
+					Expect(logMessageOf(notImplementedQuery)).To(Equal("TypeALL sslip.io. ? NotImplemented"))
+				})
+			})
+			When(`it's "errors"`, func() {
+				It("doesn't log any queries", func() {
+					x.LogLevel = xip.LogLevelErrors
+					Expect(logMessageOf(query)).To(Equal(""))
+					Expect(logMessageOf(blockedQuery)).To(Equal(""))
+					Expect(logMessageOf(notImplementedQuery)).To(Equal(""))
+				})
+				It("still returns errors", func() {
+					x.LogLevel = xip.LogLevelErrors
+					_, _, err := x.QueryResponse([]byte{0}, net.IP{127, 0, 0, 1})
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		})
+		Describe("AcmeMode", func() {
+			acmeQuery := packedQuery("_acme-challenge.127-0-0-1.sslip.io.", dnsmessage.TypeTXT)
+			AfterEach(func() {
+				x.AcmeMode = xip.AcmeModeDelegate
+				delete(xip.TxtKvCustomizations, "127-0-0-1.sslip.io")
+			})
+			When(`it's "delegate" (the default)`, func() {
+				It("delegates the TXT query to the stripped hostname", func() {
+					response, logMessage, err := x.QueryResponse(acmeQuery, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(Equal("TypeTXT _acme-challenge.127-0-0-1.sslip.io. ? nil, NS 127-0-0-1.sslip.io."))
+					var p dnsmessage.Parser
+					header, err := p.Start(response)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(header.Authoritative).To(BeFalse())
+				})
+			})
+			When(`it's "kv"`, func() {
+				BeforeEach(func() {
+					x.AcmeMode = xip.AcmeModeKV
+				})
+				It("answers authoritatively with the token from the key-value store", func() {
+					xip.TxtKvCustomizations["127-0-0-1.sslip.io"] = []dnsmessage.TXTResource{{TXT: []string{"my-acme-token"}}}
+					response, logMessage, err := x.QueryResponse(acmeQuery, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(Equal(`TypeTXT _acme-challenge.127-0-0-1.sslip.io. ? ["my-acme-token"]`))
+					var p dnsmessage.Parser
+					header, err := p.Start(response)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(header.Authoritative).To(BeTrue())
+					Expect(p.SkipAllQuestions()).To(Succeed())
+					answers, err := p.AllAnswers()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(len(answers)).To(Equal(1))
+					Expect(answers[0].Body.(*dnsmessage.TXTResource).TXT).To(Equal([]string{"my-acme-token"}))
+				})
+				It("returns no answers when there's no token", func() {
+					_, logMessage, err := x.QueryResponse(acmeQuery, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(MatchRegexp(`^TypeTXT _acme-challenge.127-0-0-1.sslip.io. \? nil, SOA `))
+				})
+				It("still delegates queries of other types", func() {
+					_, logMessage, err := x.QueryResponse(packedQuery("_acme-challenge.127-0-0-1.sslip.io.", dnsmessage.TypeNS), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(Equal("TypeNS _acme-challenge.127-0-0-1.sslip.io. ? nil, NS 127-0-0-1.sslip.io."))
+				})
+			})
+		})
+		Describe("ExtendedDNSErrors", func() {
+			blockedQuery := packedEDNSQuery("raiffeisen.94.228.116.140.sslip.io.", dnsmessage.TypeA)
+			BeforeEach(func() {
+				x.BlocklistStrings = []string{"raiffeisen"}
+			})
+			AfterEach(func() {
+				x.ExtendedDNSErrors = false
+			})
+			When("it's disabled (the default)", func() {
+				It("doesn't include an OPT record", func() {
+					response, _, err := x.QueryResponse(blockedQuery, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(responseOPT(response)).To(BeNil())
+				})
+			})
+			When("it's enabled", func() {
+				BeforeEach(func() {
+					x.ExtendedDNSErrors = true
+				})
+				It(`includes the EDE "Filtered" when the query is blocked`, func() {
+					response, _, err := x.QueryResponse(blockedQuery, net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					opt := responseOPT(response)
+					Expect(opt).ToNot(BeNil())
+					Expect(len(opt.Options)).To(Equal(1))
+					Expect(opt.Options[0].Code).To(Equal(uint16(15)))
+					Expect(binary.BigEndian.Uint16(opt.Options[0].Data)).To(Equal(uint16(xip.EDEFiltered)))
+					Expect(string(opt.Options[0].Data[2:])).To(Equal("blocklist"))
+				})
+				It(`includes the EDE "Not Supported" for ANY queries`, func() {
+					response, _, err := x.QueryResponse(packedEDNSQuery("sslip.io.", dnsmessage.TypeALL), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					opt := responseOPT(response)
+					Expect(opt).ToNot(BeNil())
+					Expect(len(opt.Options)).To(Equal(1))
+					Expect(binary.BigEndian.Uint16(opt.Options[0].Data)).To(Equal(uint16(xip.EDENotSupported)))
+				})
+				It("includes an OPT record without an EDE when the query is answered normally", func() {
+					response, _, err := x.QueryResponse(packedEDNSQuery("127-0-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					opt := responseOPT(response)
+					Expect(opt).ToNot(BeNil())
+					Expect(opt.Options).To(BeEmpty())
+				})
+				It("doesn't include an OPT record when the query doesn't have one", func() {
+					response, _, err := x.QueryResponse(packedQuery("raiffeisen.94.228.116.140.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(responseOPT(response)).To(BeNil())
+				})
+			})
+		})
+		When("DebugWire is disabled (the default)", func() {
+			It("doesn't log the hex-encoded query or response", func() {
+				response, logMessage, err := x.QueryResponse(query, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).ToNot(ContainSubstring(hex.EncodeToString(query)))
+				Expect(logMessage).ToNot(ContainSubstring(hex.EncodeToString(response)))
+			})
+		})
+		When("DebugWire is enabled", func() {
+			It("logs the hex-encoded query and response", func() {
+				x.DebugWire = true
+				response, logMessage, err := x.QueryResponse(query, net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("TypeA 127-0-0-1.sslip.io. ? 127.0.0.1 (dash form at label 0)" +
+					" query: " + hex.EncodeToString(query) +
+					" response: " + hex.EncodeToString(response)))
+			})
+			DescribeTable("logs which form of the embedded IP matched, and at which label",
+				func(name string, qType dnsmessage.Type, expectedAnswer string) {
+					x.DebugWire = true
+					_, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(HavePrefix(qType.String() + " " + name + " ? " + expectedAnswer + " query: "))
+				},
+				Entry("the dash form wins over the dot form", "nono.io.127.0.0.1.192-168-0-1.sslip.io.", dnsmessage.TypeA, "192.168.0.1 (dash form at label 6)"),
+				Entry("the dot form", "www.10.0.0.1.sslip.io.", dnsmessage.TypeA, "10.0.0.1 (dot form at label 1)"),
+				Entry("an IPv6 dash form", "api.2001-db8--1.sslip.io.", dnsmessage.TypeAAAA, "2001:db8::1 (dash form at label 1)"),
+				Entry("an IPv6 mixed form", "2001-db8--1.2.3.4.sslip.io.", dnsmessage.TypeAAAA, "2001:db8::102:304 (mixed form at label 0)"),
+				Entry("nothing for a customization", "ns-aws.sslip.io.", dnsmessage.TypeA, "52.0.56.137"),
+			)
+		})
+		When("DebugWire is disabled (the default)", func() {
+			It("doesn't log the form of the embedded IP", func() {
+				_, logMessage, err := x.QueryResponse(packedQuery("nono.io.127.0.0.1.192-168-0-1.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal("TypeA nono.io.127.0.0.1.192-168-0-1.sslip.io. ? 192.168.0.1"))
+			})
+		})
 	})
 
 	Describe("MXResources()", func() {
@@ -124,15 +2190,315 @@ var _ = Describe("Xip", func() {
 			})
 
 		})
+		When("a zone has its own nameservers", func() {
+			var x, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137", "ns1.example.com=10.0.0.53", "ns2.example.com=10.0.0.54"})
+			BeforeEach(func() {
+				Expect(x.AddZoneNameServer("Example.COM", "ns1.example.com")).To(Succeed())
+				Expect(x.AddZoneNameServer("example.com.", "ns2.example.com.")).To(Succeed())
+			})
+			AfterEach(func() {
+				x.ZoneNameServers = nil
+			})
+			It("serves the zone", func() {
+				Expect(x.Zones).To(ContainElement("example.com."))
+			})
+			DescribeTable("returns the nameservers of the zone the name falls under",
+				func(fqdn string, expected []string) {
+					var nameServers []string
+					for _, ns := range x.NSResources(fqdn) {
+						nameServers = append(nameServers, ns.NS.String())
+					}
+					Expect(nameServers).To(Equal(expected))
+				},
+				Entry("the zone's apex", "example.com.", []string{"ns1.example.com.", "ns2.example.com."}),
+				Entry("a name under the zone", "10-0-0-1.ip.Example.com.", []string{"ns1.example.com.", "ns2.example.com."}),
+				Entry("a name under sslip.io", "10-0-0-1.sslip.io.", []string{"ns-aws.sslip.io."}),
+				Entry("a name that merely ends in the zone's name", "notexample.com.", []string{"ns-aws.sslip.io."}),
+			)
+			DescribeTable("answers NS queries with the zone's nameservers & their glue",
+				func(fqdn string, expectedNS []string, expectedGlue []string) {
+					response, _, err := x.QueryResponse(packedQuery(fqdn, dnsmessage.TypeNS), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					var nameServers, glue []string
+					for _, answer := range m.Answers {
+						nameServers = append(nameServers, answer.Body.(*dnsmessage.NSResource).NS.String())
+					}
+					for _, additional := range m.Additionals {
+						glue = append(glue, additional.Header.Name.String()+" "+net.IP(additional.Body.(*dnsmessage.AResource).A[:]).String())
+					}
+					Expect(nameServers).To(Equal(expectedNS))
+					Expect(glue).To(Equal(expectedGlue))
+				},
+				Entry("under example.com", "www.example.com.", []string{"ns1.example.com.", "ns2.example.com."}, []string{"ns1.example.com. 10.0.0.53", "ns2.example.com. 10.0.0.54"}),
+				Entry("under sslip.io", "www.sslip.io.", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io. 52.0.56.137"}),
+			)
+		})
+	})
+
+	Describe("AddZoneTTL()", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, Zones: []string{"sslip.io."}}
+			Expect(x.AddZoneTTL("Dev.Example.com", 60)).To(Succeed())
+			Expect(x.AddZoneTTL("stable.example.org.", 86400)).To(Succeed())
+		})
+		AfterEach(func() {
+			delete(xip.Customizations, "ip.dev.example.com.")
+			delete(xip.Customizations, "ip.stable.example.org.")
+		})
+		// ttl returns the TTL of the answer to the query
+		ttl := func(name string, qType dnsmessage.Type) uint32 {
+			response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			var m dnsmessage.Message
+			Expect(m.Unpack(response)).To(Succeed())
+			Expect(m.Answers).To(HaveLen(1))
+			return m.Answers[0].Header.TTL
+		}
+		It("serves the zones", func() {
+			Expect(x.Zones).To(Equal([]string{"sslip.io.", "dev.example.com.", "stable.example.org."}))
+		})
+		It("answers with the TTL of the zone the name falls under", func() {
+			Expect(ttl("10-0-0-1.dev.example.com.", dnsmessage.TypeA)).To(Equal(uint32(60)))
+			Expect(ttl("10-0-0-1.STABLE.example.org.", dnsmessage.TypeA)).To(Equal(uint32(86400)))
+			Expect(ttl("fe80--1.dev.example.com.", dnsmessage.TypeAAAA)).To(Equal(uint32(60)))
+		})
+		It("falls back to the AddressTTL for the other zones", func() {
+			Expect(ttl("10-0-0-1.sslip.io.", dnsmessage.TypeA)).To(Equal(uint32(xip.AddressTTL)))
+			Expect(ttl("10-0-0-1.example.com.", dnsmessage.TypeA)).To(Equal(uint32(xip.AddressTTL)))
+			Expect(ttl("10-0-0-1.notdev.example.com.", dnsmessage.TypeA)).To(Equal(uint32(xip.AddressTTL)))
+		})
+		It("uses the most specific zone's TTL", func() {
+			Expect(x.AddZoneTTL("fast.dev.example.com", 5)).To(Succeed())
+			defer delete(xip.Customizations, "ip.fast.dev.example.com.")
+			Expect(ttl("10-0-0-1.fast.dev.example.com.", dnsmessage.TypeA)).To(Equal(uint32(5)))
+			Expect(ttl("10-0-0-1.dev.example.com.", dnsmessage.TypeA)).To(Equal(uint32(60)))
+		})
+	})
+
+	Describe("FullerOverTCP", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, MaxAnswers: 2, FullerOverTCP: true, NameServers: []dnsmessage.NSResource{
+				{NS: dnsmessage.MustNewName("ns1.fuller.sslip.io.")},
+				{NS: dnsmessage.MustNewName("ns2.fuller.sslip.io.")},
+			}}
+			xip.Customizations["ns1.fuller.sslip.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 53}}}}
+			xip.Customizations["ns2.fuller.sslip.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 54}}}}
+			xip.Customizations["pool.fuller.sslip.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{
+				{A: [4]byte{10, 0, 0, 1}}, {A: [4]byte{10, 0, 0, 2}}, {A: [4]byte{10, 0, 0, 3}},
+			}}
+		})
+		AfterEach(func() {
+			delete(xip.Customizations, "ns1.fuller.sslip.io.")
+			delete(xip.Customizations, "ns2.fuller.sslip.io.")
+			delete(xip.Customizations, "pool.fuller.sslip.io.")
+		})
+		// via returns the response to the query over the transport
+		via := func(transport string, name string, qType dnsmessage.Type) (m dnsmessage.Message) {
+			response, _, err := x.QueryResponseVia(transport, packedQuery(name, qType), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.Unpack(response)).To(Succeed())
+			return m
+		}
+		It("trims an NS answer's glue over UDP, but not over TCP", func() {
+			udp := via(xip.TransportUDP, "fuller.sslip.io.", dnsmessage.TypeNS)
+			tcp := via(xip.TransportTCP, "fuller.sslip.io.", dnsmessage.TypeNS)
+			Expect(udp.Answers).To(Equal(tcp.Answers))
+			Expect(udp.Answers).To(HaveLen(2))
+			Expect(udp.Additionals).To(HaveLen(1))
+			Expect(udp.Additionals[0].Header.Name.String()).To(Equal("ns1.fuller.sslip.io."))
+			Expect(tcp.Additionals).To(HaveLen(2))
+			Expect(tcp.Additionals[1].Header.Name.String()).To(Equal("ns2.fuller.sslip.io."))
+			Expect(tcp.Additionals[1].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 54}}))
+		})
+		It("caps the answer at MaxAnswers over UDP, but not over TCP", func() {
+			Expect(via(xip.TransportUDP, "pool.fuller.sslip.io.", dnsmessage.TypeA).Answers).To(HaveLen(2))
+			Expect(via(xip.TransportTCP, "pool.fuller.sslip.io.", dnsmessage.TypeA).Answers).To(HaveLen(3))
+		})
+		It("answers identically over both by default", func() {
+			x.FullerOverTCP = false
+			for _, transport := range []string{xip.TransportUDP, xip.TransportTCP} {
+				m := via(transport, "fuller.sslip.io.", dnsmessage.TypeNS)
+				Expect(m.Additionals).To(HaveLen(2), transport)
+				Expect(via(transport, "pool.fuller.sslip.io.", dnsmessage.TypeA).Answers).To(HaveLen(2), transport)
+			}
+		})
+	})
+
+	Describe("AddZoneApexTXT()", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, Zones: []string{"sslip.io."}}
+			Expect(x.AddZoneApexTXT("Example.com", "Served by MyCorp")).To(Succeed())
+			Expect(x.AddZoneApexTXT("example.org.", "Served by MyOtherCorp")).To(Succeed())
+			Expect(x.AddZoneApexTXT("example.org.", "v=spf1 -all")).To(Succeed())
+		})
+		AfterEach(func() {
+			delete(xip.Customizations, "ip.example.com.")
+			delete(xip.Customizations, "ip.example.org.")
+		})
+		// txts returns the TXT answers
+		txts := func(name string) (txts [][]string) {
+			response, _, err := x.QueryResponse(packedQuery(name, dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			var m dnsmessage.Message
+			Expect(m.Unpack(response)).To(Succeed())
+			for _, answer := range m.Answers {
+				txts = append(txts, answer.Body.(*dnsmessage.TXTResource).TXT)
+			}
+			return txts
+		}
+		It("serves the zones", func() {
+			Expect(x.Zones).To(Equal([]string{"sslip.io.", "example.com.", "example.org."}))
+		})
+		It("answers each zone's apex with its own TXT records", func() {
+			Expect(txts("example.com.")).To(Equal([][]string{{"Served by MyCorp"}}))
+			Expect(txts("EXAMPLE.org.")).To(Equal([][]string{{"Served by MyOtherCorp"}, {"v=spf1 -all"}}))
+		})
+		It("doesn't add them to the names under the apex", func() {
+			Expect(txts("www.example.com.")).To(BeEmpty())
+			Expect(txts("ip.example.com.")).To(Equal([][]string{{"127.0.0.1"}}))
+		})
+		It("adds them after the apex's built-in records", func() {
+			Expect(x.AddZoneApexTXT("sslip.io", "Served by MyCorp")).To(Succeed())
+			sslipTXTs := txts("sslip.io.")
+			Expect(sslipTXTs).To(HaveLen(3))
+			Expect(sslipTXTs[0][0]).To(HavePrefix("protonmail-verification="))
+			Expect(sslipTXTs[2]).To(Equal([]string{"Served by MyCorp"}))
+		})
+		It("rejects a TXT record that doesn't fit in a string", func() {
+			Expect(x.AddZoneApexTXT("example.com", strings.Repeat("x", 256))).To(MatchError(ContainSubstring("longer than 255 bytes")))
+		})
+	})
+
+	Describe("NoCacheSubdomain", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, NoCacheSubdomain: "nocache.sslip.io."}
+		})
+		// answer returns the query's only answer
+		answer := func(name string, qType dnsmessage.Type) dnsmessage.Resource {
+			response, _, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			var m dnsmessage.Message
+			Expect(m.Unpack(response)).To(Succeed())
+			Expect(m.Answers).To(HaveLen(1))
+			return m.Answers[0]
+		}
+		It("resolves the embedded IPs under it with TTL 0", func() {
+			a := answer("10-0-0-1.nocache.sslip.io.", dnsmessage.TypeA)
+			Expect(a.Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}))
+			Expect(a.Header.TTL).To(Equal(uint32(0)))
+			aaaa := answer("fe80--1.NoCache.sslip.io.", dnsmessage.TypeAAAA)
+			Expect(aaaa.Body).To(Equal(&dnsmessage.AAAAResource{AAAA: [16]byte{0xfe, 0x80, 15: 1}}))
+			Expect(aaaa.Header.TTL).To(Equal(uint32(0)))
+		})
+		It("doesn't affect the names outside it", func() {
+			Expect(answer("10-0-0-1.sslip.io.", dnsmessage.TypeA).Header.TTL).To(Equal(uint32(xip.AddressTTL)))
+			Expect(answer("10-0-0-1.notnocache.sslip.io.", dnsmessage.TypeA).Header.TTL).To(Equal(uint32(xip.AddressTTL)))
+		})
+		It("trumps the zone's TTL", func() {
+			x.ZoneTTLs = map[string]uint32{"sslip.io.": 60}
+			Expect(answer("10-0-0-1.nocache.sslip.io.", dnsmessage.TypeA).Header.TTL).To(Equal(uint32(0)))
+		})
+		It("is disabled by default", func() {
+			x.NoCacheSubdomain = ""
+			Expect(answer("10-0-0-1.nocache.sslip.io.", dnsmessage.TypeA).Header.TTL).To(Equal(uint32(xip.AddressTTL)))
+		})
 	})
 
 	Describe("SOAResource()", func() {
-		It("returns the SOA resource for the domain in question", func() {
+		x := xip.Xip{SOATimers: xip.DefaultSOATimers}
+		It("uses the domain in question as the MNAME if there are no nameservers", func() {
 			randomDomain := random8ByteString() + ".com."
 			randomDomainName := dnsmessage.MustNewName(randomDomain)
-			soa := xip.SOAResource(randomDomainName)
+			soa := x.SOAResource(randomDomainName)
 			Expect(soa.NS.Data).To(Equal(randomDomainName.Data))
 		})
+		When("there are nameservers", func() {
+			var x xip.Xip
+			BeforeEach(func() {
+				x = xip.Xip{SOATimers: xip.DefaultSOATimers, NameServers: []dnsmessage.NSResource{
+					{NS: dnsmessage.MustNewName("ns-aws.sslip.io.")},
+					{NS: dnsmessage.MustNewName("ns-gce.sslip.io.")},
+				}}
+			})
+			It("uses the first as the MNAME, not the domain in question", func() {
+				soa := x.SOAResource(dnsmessage.MustNewName("127-0-0-1.sslip.io."))
+				Expect(soa.NS.String()).To(Equal("ns-aws.sslip.io."))
+			})
+			It("uses the first of the zone's nameservers for a zone with its own", func() {
+				Expect(x.AddZoneNameServer("example.com", "ns1.example.com")).To(Succeed())
+				soa := x.SOAResource(dnsmessage.MustNewName("www.example.com."))
+				Expect(soa.NS.String()).To(Equal("ns1.example.com."))
+				delete(xip.Customizations, "ip.example.com.")
+			})
+			It("uses the PrimaryNS if it's set", func() {
+				x.PrimaryNS = dnsmessage.MustNewName("ns-primary.sslip.io.")
+				soa := x.SOAResource(dnsmessage.MustNewName("127-0-0-1.sslip.io."))
+				Expect(soa.NS.String()).To(Equal("ns-primary.sslip.io."))
+			})
+		})
+		It("uses the default timers", func() {
+			soa := x.SOAResource(dnsmessage.MustNewName("sslip.io."))
+			Expect([]uint32{soa.Refresh, soa.Retry, soa.Expire, soa.MinTTL}).To(Equal([]uint32{900, 900, 1800, 180}))
+		})
+		When("the timers are configured", func() {
+			It("uses the configured timers", func() {
+				x := xip.Xip{SOATimers: xip.SOATimers{Refresh: 3600, Retry: 600, Expire: 604800, MinTTL: 60}}
+				soa := x.SOAResource(dnsmessage.MustNewName("sslip.io."))
+				Expect([]uint32{soa.Refresh, soa.Retry, soa.Expire, soa.MinTTL}).To(Equal([]uint32{3600, 600, 604800, 60}))
+			})
+		})
+	})
+
+	Describe("SOAAuthority()", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, Zones: []string{"sslip.io.", "example.com.", "sub.example.com."}}
+		})
+		DescribeTable("owns the SOA by the apex of the enclosing zone",
+			func(name string, expectedOwner string) {
+				soaHeader, _ := x.SOAAuthority(dnsmessage.MustNewName(name))
+				Expect(soaHeader.Name.String()).To(Equal(expectedOwner))
+				Expect(soaHeader.TTL).To(Equal(xip.DefaultSOATimers.MinTTL))
+			},
+			Entry("the apex", "sslip.io.", "sslip.io."),
+			Entry("a subdomain", "nonexistent.sslip.io.", "sslip.io."),
+			Entry("a deep subdomain, mixed case", "a.b.NonExistent.SSLIP.io.", "sslip.io."),
+			Entry("an embedded-IP name", "10-0-0-1.sslip.io.", "sslip.io."),
+			Entry("the most specific zone", "www.sub.example.com.", "sub.example.com."),
+			Entry("a less specific zone", "www.example.com.", "example.com."),
+			Entry("a name that merely ends like a zone", "notsslip.io.", "notsslip.io."),
+			Entry("a name outside our zones", "10-0-0-1.nip.io.", "10-0-0-1.nip.io."),
+		)
+		It("has the primary nameserver as the MNAME", func() {
+			x.PrimaryNS = dnsmessage.MustNewName("ns-aws.sslip.io.")
+			_, soa := x.SOAAuthority(dnsmessage.MustNewName("nonexistent.sslip.io."))
+			Expect(soa.NS.String()).To(Equal("ns-aws.sslip.io."))
+		})
+		It("treats every name as its own apex in DNSSEC's signing mode", func() {
+			x.DNSSEC = &xip.DNSSEC{}
+			soaHeader, _ := x.SOAAuthority(dnsmessage.MustNewName("nonexistent.sslip.io."))
+			Expect(soaHeader.Name.String()).To(Equal("nonexistent.sslip.io."))
+		})
+	})
+
+	Describe("SOATimers.Validate()", func() {
+		It("accepts the defaults", func() {
+			Expect(xip.DefaultSOATimers.Validate()).To(Succeed())
+		})
+		DescribeTable("rejects nonsensical timers",
+			func(timers xip.SOATimers, expectedError string) {
+				Expect(timers.Validate()).To(MatchError(ContainSubstring(expectedError)))
+			},
+			Entry("retry greater than refresh", xip.SOATimers{Refresh: 900, Retry: 901, Expire: 1800, MinTTL: 180}, "retry (901) must be less than or equal to the refresh (900)"),
+			Entry("expire less than refresh", xip.SOATimers{Refresh: 900, Retry: 900, Expire: 899, MinTTL: 180}, "expire (899) must be greater than or equal to the refresh (900)"),
+			Entry("a zero refresh", xip.SOATimers{Refresh: 0, Retry: 0, Expire: 1800, MinTTL: 180}, "must be greater than 0"),
+		)
 	})
 
 	Describe("TXTResources()", func() {
@@ -152,6 +2518,28 @@ var _ = Describe("Xip", func() {
 				Expect(txts[0].TXT[0]).To(MatchRegexp("protonmail-verification="))
 				Expect(txts[1].TXT[0]).To(MatchRegexp("v=spf1"))
 			})
+			When("there are ApexTXT records", func() {
+				BeforeEach(func() {
+					x.ApexTXT = []string{"google-site-verification=abc123", "some other token"}
+				})
+				AfterEach(func() {
+					x.ApexTXT = nil
+				})
+				It("returns both the built-in & the configured TXT resources", func() {
+					txts, err := x.TXTResources("sslip.io.", nil)
+					Expect(err).To(Not(HaveOccurred()))
+					Expect(txts).To(HaveLen(4))
+					Expect(txts[0].TXT[0]).To(MatchRegexp("protonmail-verification="))
+					Expect(txts[1].TXT[0]).To(MatchRegexp("v=spf1"))
+					Expect(txts[2].TXT).To(Equal([]string{"google-site-verification=abc123"}))
+					Expect(txts[3].TXT).To(Equal([]string{"some other token"}))
+				})
+				It("doesn't add them to other domains", func() {
+					txts, err := x.TXTResources("ns.sslip.io.", nil)
+					Expect(err).To(Not(HaveOccurred()))
+					Expect(txts).To(BeEmpty())
+				})
+			})
 		})
 		When("a random domain has been customized w/out any TXT defaults", func() { // Unnecessary, but confirms Golang's behavior for me, a doubting Thomas
 			customizedDomain := random8ByteString() + ".com."
@@ -164,12 +2552,100 @@ var _ = Describe("Xip", func() {
 			delete(xip.Customizations, customizedDomain) // clean-up
 		})
 		When(`the domain "ip.sslip.io" is queried`, func() {
+			BeforeEach(func() {
+				Expect(x.AddZone(xip.DefaultZone)).To(Succeed())
+			})
 			It("returns the IP address of the querier", func() {
 				txts, err := x.TXTResources("ip.sslip.io.", net.IP{1, 1, 1, 1})
 				Expect(err).To(Not(HaveOccurred()))
 				Expect(len(txts)).To(Equal(1))
 				Expect(txts[0].TXT[0]).To(MatchRegexp("^1.1.1.1$"))
 			})
+			// net.IP.String() already renders the canonical (RFC 5952) form; these lock it in
+			DescribeTable("returns the canonical form of the querier's IPv6 address",
+				func(srcAddr string, expectedTXT string) {
+					txts, err := x.TXTResources("ip.sslip.io.", net.ParseIP(srcAddr))
+					Expect(err).To(Not(HaveOccurred()))
+					Expect(len(txts)).To(Equal(1))
+					Expect(txts[0].TXT).To(Equal([]string{expectedTXT}))
+				},
+				Entry("already canonical", "2001:db8::1", "2001:db8::1"),
+				Entry("uppercase & leading zeroes", "2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::1"),
+				Entry("the longest run of zeroes is compressed", "2001:db8:0:0:1:0:0:0", "2001:db8:0:0:1::"),
+				Entry("a single zero isn't compressed", "2001:db8:0:1:1:1:1:1", "2001:db8:0:1:1:1:1:1"),
+				Entry("IPv4-mapped is rendered as IPv4", "::ffff:192.0.2.1", "192.0.2.1"),
+			)
+			When("a subdomain of it is queried", func() {
+				AfterEach(func() {
+					x.IPWildcard = false
+				})
+				It("returns no records by default", func() {
+					txts, err := x.TXTResources("foo.ip.sslip.io.", net.IP{1, 1, 1, 1})
+					Expect(err).To(Not(HaveOccurred()))
+					Expect(txts).To(BeEmpty())
+				})
+				It("returns the IP address of the querier if IPWildcard is set", func() {
+					x.IPWildcard = true
+					for _, name := range []string{"foo.ip.sslip.io.", "Bar.Foo.IP.sslip.io."} {
+						txts, err := x.TXTResources(name, net.IP{1, 1, 1, 1})
+						Expect(err).To(Not(HaveOccurred()))
+						Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"1.1.1.1"}}}))
+					}
+					txts, err := x.TXTResources("foo.notip.sslip.io.", net.IP{1, 1, 1, 1})
+					Expect(err).To(Not(HaveOccurred()))
+					Expect(txts).To(BeEmpty())
+				})
+			})
+		})
+		When(`the domain "whoami.sslip.io" is queried`, func() {
+			AfterEach(func() {
+				x.SetWhoamiAlias(false)
+			})
+			It("returns no records by default", func() {
+				Expect(xip.Customizations).ToNot(HaveKey("whoami.sslip.io."))
+				txts, err := x.TXTResources("whoami.sslip.io.", net.IP{1, 1, 1, 1})
+				Expect(err).To(Not(HaveOccurred()))
+				Expect(txts).To(BeEmpty())
+			})
+			It("returns the IP address of the querier if WhoamiAlias is set, as ip.sslip.io does", func() {
+				x.SetWhoamiAlias(true)
+				before := x.Metrics.AnsweredTXTSrcIPQueries
+				response, logMessage, err := x.QueryResponse(packedQuery("WhoAmI.sslip.io.", dnsmessage.TypeTXT), net.IP{1, 1, 1, 1})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logMessage).To(Equal(`TypeTXT WhoAmI.sslip.io. ? ["1.1.1.1"]`))
+				var m dnsmessage.Message
+				Expect(m.Unpack(response)).To(Succeed())
+				Expect(m.Answers).To(HaveLen(1))
+				Expect(m.Answers[0].Body).To(Equal(&dnsmessage.TXTResource{TXT: []string{"1.1.1.1"}}))
+				Expect(x.Metrics.AnsweredTXTSrcIPQueries).To(Equal(before + 1))
+			})
+		})
+		When("another zone is served", func() {
+			AfterEach(func() {
+				x.SetWhoamiAlias(false)
+				delete(xip.Customizations, "ip.example.com.")
+				delete(xip.Customizations, "ip.example.org.")
+			})
+			It(`"ip." + the zone returns the IP address of the querier`, func() {
+				Expect(x.AddZone("Example.COM")).To(Succeed())
+				Expect(x.Zones).To(ContainElement("example.com."))
+				txts, err := x.TXTResources("ip.example.com.", net.IP{1, 1, 1, 1})
+				Expect(err).To(Not(HaveOccurred()))
+				Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"1.1.1.1"}}}))
+			})
+			It(`"whoami." + the zone returns the IP address of the querier if WhoamiAlias is set`, func() {
+				Expect(x.AddZone("example.org")).To(Succeed())
+				Expect(xip.Customizations).ToNot(HaveKey("whoami.example.org."))
+				x.SetWhoamiAlias(true)
+				txts, err := x.TXTResources("whoami.example.org.", net.IP{1, 1, 1, 1})
+				Expect(err).To(Not(HaveOccurred()))
+				Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"1.1.1.1"}}}))
+				x.SetWhoamiAlias(false)
+				Expect(xip.Customizations).ToNot(HaveKey("whoami.example.org."))
+			})
+			It("rejects invalid zones", func() {
+				Expect(x.AddZone(strings.Repeat("a", 256) + ".com")).To(MatchError(ContainSubstring("invalid zone")))
+			})
 		})
 		When(`a customized domain without a TXT entry is queried`, func() {
 			It("returns no records (and doesn't panic, either)", func() {
@@ -202,15 +2678,17 @@ var _ = Describe("Xip", func() {
 					Entry("getting a non-existent key → empty array", "nonexistent.k-v.io.", []string{}),
 					Entry("putting but skipping the value → error txt", "put.my-key.k-v.io.", []string{"422: missing a value: put.value.key.k-v.io"}),
 					Entry("deleting a non-existent key → silently succeeds", "delete.non-existent.k-v.io.", []string{}),
-					Entry("using a garbage verb → error txt", "post.my-key.k-v.io.", []string{"422: valid verbs are get, put, delete"}),
+					Entry("using a garbage verb → error txt", "post.my-key.k-v.io.", []string{"422: valid verbs are get, put, delete, list"}),
 					// others
 					Entry("putting a multi-label value", "put.96.0.4664.55.chrome-version.k-v.io.", []string{"96.0.4664.55"}),
+					Entry("putting a value with the record separator → multiple records", "put.one\x00two.multi-record.k-v.io.", []string{"one", "two"}),
+					Entry("getting that value → multiple records", "multi-record.k-v.io.", []string{"one", "two"}),
 					Entry("putting a super-long multi-label value to use in a DNS amplification attack gets truncated to 63 characters",
 						"put"+
 							".IReturnedAndSawUnderTheSunThatTheRaceIsNotToTheSwiftNotThe"+
 							".BattleToTheStrongNeitherYetBreadToTheWiseNorYetRichesToMenOf"+
 							".amplify.k-v.io.",
-						[]string{"IReturnedAndSawUnderTheSunThatTheRaceIsNotToTheSwiftNotThe.Batt"},
+						[]string{"IReturnedAndSawUnderTheSunThatTheRaceIsNotToTheSwiftNotThe.Batt", "stored (truncated to 63 bytes)"},
 					),
 				)
 
@@ -218,6 +2696,318 @@ var _ = Describe("Xip", func() {
 			When("there's no etcd, just local, in-memory key-value", func() {
 				txtTests()
 			})
+			When("the KV store is exported", func() {
+				BeforeEach(func() {
+					xip.TxtKvCustomizations["export-key"] = []dnsmessage.TXTResource{{TXT: []string{"export-value"}}}
+					xip.TxtKvCustomizations["export-multi-record-key"] = []dnsmessage.TXTResource{{TXT: []string{"one"}}, {TXT: []string{"two"}}}
+				})
+				AfterEach(func() {
+					delete(xip.TxtKvCustomizations, "export-key")
+					delete(xip.TxtKvCustomizations, "export-multi-record-key")
+					x.KVExportToken = ""
+				})
+				It("round-trips through ExportKV() & ImportKV()", func() {
+					var exported bytes.Buffer
+					Expect(x.ExportKV(&exported)).To(Succeed())
+					Expect(exported.String()).To(ContainSubstring(`"export-key":"export-value"`))
+					Expect(exported.String()).To(ContainSubstring(`"export-multi-record-key":"one\u0000two"`))
+					original := xip.KvCustomizations{}
+					for key, value := range xip.TxtKvCustomizations {
+						original[key] = value
+						delete(xip.TxtKvCustomizations, key)
+					}
+					Expect(x.ImportKV(&exported)).To(Succeed())
+					Expect(xip.TxtKvCustomizations).To(Equal(original))
+				})
+				It("splits an imported value into 255-byte strings, lest it not pack", func() {
+					long := strings.Repeat("a", 300)
+					Expect(x.ImportKV(strings.NewReader(`{"export-long-key":"` + long + `"}`))).To(Succeed())
+					defer delete(xip.TxtKvCustomizations, "export-long-key")
+					Expect(xip.TxtKvCustomizations["export-long-key"]).To(Equal([]dnsmessage.TXTResource{{TXT: []string{long[:255], long[255:]}}}))
+					response, _, err := x.QueryResponse(packedQuery("get.export-long-key.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					var m dnsmessage.Message
+					Expect(m.Unpack(response)).To(Succeed())
+					Expect(strings.Join(m.Answers[0].Body.(*dnsmessage.TXTResource).TXT, "")).To(Equal(long))
+				})
+				It("rejects an import that isn't JSON", func() {
+					Expect(x.ImportKV(strings.NewReader("export-key=export-value"))).To(MatchError(ContainSubstring("couldn't decode the key-value JSON")))
+				})
+				It(`returns the key count & checksum for "<token>.export.k-v.io"`, func() {
+					x.KVExportToken = "S3cret"
+					txtResources, err := x.TXTResources("s3cret.export.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(len(txtResources)).To(Equal(2))
+					Expect(txtResources[0].TXT[0]).To(Equal(fmt.Sprintf("keys: %d", len(xip.TxtKvCustomizations))))
+					Expect(txtResources[1].TXT[0]).To(MatchRegexp(`^sha256: [[:xdigit:]]{64}$`))
+				})
+				It("refuses an invalid token", func() {
+					x.KVExportToken = "s3cret"
+					txtResources, err := x.TXTResources("guess.export.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: invalid export token"}}}))
+				})
+				It("keeps the token out of the log message", func() {
+					x.KVExportToken = "s3cret"
+					_, logMessage, err := x.QueryResponse(packedQuery("S3cret.export.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(HavePrefix("TypeTXT <token>.export.k-v.io. ? "))
+					Expect(strings.ToLower(logMessage)).ToNot(ContainSubstring("s3cret"))
+				})
+				It(`treats "export" as an ordinary key if there's no token`, func() {
+					txtResources, err := x.TXTResources("get.export.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(BeEmpty())
+				})
+			})
+			When("the value is JSON", func() {
+				BeforeEach(func() {
+					xip.TxtKvCustomizations["json-key"] = []dnsmessage.TXTResource{{TXT: []string{
+						`{"name":"web","port":8080,"tls":true,"owner":{"email":"ops@example.com","Team":"SRE"},"aliases":["www","app"]}`}}}
+					xip.TxtKvCustomizations["not-json-key"] = []dnsmessage.TXTResource{{TXT: []string{"plain-value"}}}
+				})
+				AfterEach(func() {
+					delete(xip.TxtKvCustomizations, "json-key")
+					delete(xip.TxtKvCustomizations, "not-json-key")
+				})
+				DescribeTable("get.<field>.<key>.k-v.io returns the field",
+					func(fqdn string, expected string) {
+						txtResources, err := x.TXTResources(fqdn, nil)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{expected}}}))
+					},
+					Entry("a string", "get.name.json-key.k-v.io.", "web"),
+					Entry("a number", "get.port.json-key.k-v.io.", "8080"),
+					Entry("a boolean", "get.tls.json-key.k-v.io.", "true"),
+					Entry("a nested field (dotted path)", "get.owner.email.json-key.k-v.io.", "ops@example.com"),
+					Entry("a field whose case doesn't match", "GET.OWNER.team.JSON-KEY.k-v.io.", "SRE"),
+					Entry("an array element", "get.aliases.1.json-key.k-v.io.", "app"),
+					Entry("an object, as JSON", "get.owner.json-key.k-v.io.", `{"Team":"SRE","email":"ops@example.com"}`),
+					Entry("a missing field → error txt", "get.owner.phone.json-key.k-v.io.", `404: no field "owner.phone"`),
+					Entry("an out-of-range index → error txt", "get.aliases.2.json-key.k-v.io.", `404: no field "aliases.2"`),
+					Entry("a non-JSON value → error txt", "get.name.not-json-key.k-v.io.", "422: the value isn't JSON"),
+				)
+				It("returns an empty array for a non-existent key", func() {
+					txtResources, err := x.TXTResources("get.name.nonexistent-json-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(BeEmpty())
+				})
+				It("still returns the whole value without a field", func() {
+					txtResources, err := x.TXTResources("get.json-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources[0].TXT[0]).To(HavePrefix(`{"name":"web"`))
+				})
+				It("reads the value from etcd, too", func() {
+					fakeEtcd := &xipfakes.FakeV3client{}
+					fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte(`{"a":{"b":[1,{"c":"deep"}]}}`)}}}, nil)
+					etcdX := xip.Xip{Etcd: fakeEtcd}
+					txtResources, err := etcdX.TXTResources("get.a.b.1.c.etcd-json-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"deep"}}}))
+					_, key, _ := fakeEtcd.GetArgsForCall(0)
+					Expect(key).To(Equal("etcd-json-key"))
+				})
+			})
+			When("the value is too long", func() {
+				AfterEach(func() {
+					x.KVMaxPutBytes = 0
+					x.KVStrictPuts = false
+					delete(xip.TxtKvCustomizations, "long-key")
+				})
+				DescribeTable("truncates it, says so, and counts it",
+					func(value string, expectedTXTs []string, expectedTruncations int) {
+						truncations := x.Metrics.TruncatedKVPuts
+						txtResources, err := x.TXTResources("put."+value+".long-key.k-v.io.", nil)
+						Expect(err).ToNot(HaveOccurred())
+						var txts []string
+						for _, txtResource := range txtResources {
+							txts = append(txts, txtResource.TXT...)
+						}
+						Expect(txts).To(Equal(expectedTXTs))
+						Expect(x.Metrics.TruncatedKVPuts).To(Equal(truncations + int64(expectedTruncations)))
+						Expect(xip.TxtKvCustomizations["long-key"]).To(Equal([]dnsmessage.TXTResource{{TXT: []string{expectedTXTs[0]}}}))
+					},
+					Entry("exactly at the limit", strings.Repeat("a", 63), []string{strings.Repeat("a", 63)}, 0),
+					Entry("just over the limit", strings.Repeat("a", 32)+"."+strings.Repeat("b", 31),
+						[]string{strings.Repeat("a", 32) + "." + strings.Repeat("b", 30), "stored (truncated to 63 bytes)"}, 1),
+					Entry("well over the limit", strings.Repeat("a", 63)+"."+strings.Repeat("b", 63)+"."+strings.Repeat("c", 63),
+						[]string{strings.Repeat("a", 63), "stored (truncated to 63 bytes)"}, 1),
+				)
+				It("truncates it to a configured limit", func() {
+					x.KVMaxPutBytes = 10
+					txtResources, err := x.TXTResources("put.0123456789abcdef.long-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"0123456789"}}, {TXT: []string{"stored (truncated to 10 bytes)"}}}))
+				})
+				It("rejects it in strict mode", func() {
+					x.KVMaxPutBytes = 10
+					x.KVStrictPuts = true
+					txtResources, err := x.TXTResources("put.0123456789abcdef.long-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"413: the value exceeds 10 bytes"}}}))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("long-key"))
+					txtResources, err = x.TXTResources("put.0123456789.long-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"0123456789"}}}))
+				})
+			})
+			When("the store has KVMaxEntries keys", func() {
+				var saved xip.KvCustomizations
+				put := func(key, value string) []dnsmessage.TXTResource {
+					txtResources, err := x.TXTResources("put."+value+"."+key+".k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					return txtResources
+				}
+				BeforeEach(func() {
+					saved = xip.TxtKvCustomizations
+					xip.TxtKvCustomizations = xip.KvCustomizations{}
+					x.KVMaxEntries = 3
+					for _, key := range []string{"first", "second", "third"} {
+						put(key, key+"-value")
+					}
+				})
+				AfterEach(func() {
+					x.KVMaxEntries = 0
+					x.KVStrictPuts = false
+					xip.TxtKvCustomizations = saved
+				})
+				It("evicts the least recently put key for a new key, and counts it", func() {
+					evictions := x.Metrics.EvictedKVEntries
+					put("second", "second-value-again")
+					Expect(put("fourth", "fourth-value")).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"fourth-value"}}}))
+					Expect(xip.TxtKvCustomizations).To(HaveLen(3))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("first"))
+					Expect(put("fifth", "fifth-value")).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"fifth-value"}}}))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("third"))
+					Expect(xip.TxtKvCustomizations).To(HaveKey("second"))
+					Expect(x.Metrics.EvictedKVEntries).To(Equal(evictions + 2))
+				})
+				It("doesn't evict to overwrite an existing key", func() {
+					put("third", "third-value-again")
+					Expect(xip.TxtKvCustomizations).To(HaveLen(3))
+					Expect(xip.TxtKvCustomizations["third"]).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"third-value-again"}}}))
+				})
+				It("makes room once a key's deleted", func() {
+					evictions := x.Metrics.EvictedKVEntries
+					_, err := x.TXTResources("delete.first.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("first"))
+					put("fourth", "fourth-value")
+					Expect(xip.TxtKvCustomizations).To(HaveLen(3))
+					Expect(x.Metrics.EvictedKVEntries).To(Equal(evictions))
+				})
+				It("rejects a new key in strict mode", func() {
+					x.KVStrictPuts = true
+					Expect(put("fourth", "fourth-value")).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"507: the key-value store is full (3 keys)"}}}))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("fourth"))
+					Expect(xip.TxtKvCustomizations).To(HaveKey("first"))
+					Expect(put("first", "first-value-again")).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"first-value-again"}}}))
+				})
+				It("caps the imports, too", func() {
+					Expect(x.ImportKV(strings.NewReader(`{"fourth":"fourth-value"}`))).To(Succeed())
+					Expect(xip.TxtKvCustomizations).To(HaveLen(3))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("first"))
+					put("fifth", "fifth-value") // the import counts as recently put
+					Expect(xip.TxtKvCustomizations).To(HaveKey("fourth"))
+					x.KVStrictPuts = true
+					Expect(x.ImportKV(strings.NewReader(`{"sixth":"sixth-value"}`))).To(MatchError(ContainSubstring("the key-value store is full (3 keys)")))
+					Expect(xip.TxtKvCustomizations).ToNot(HaveKey("sixth"))
+				})
+			})
+			When("listing the keys", func() {
+				BeforeEach(func() {
+					x.KVListToken = "list-token"
+					for _, key := range []string{"app-b", "app-a", "app-c", "other"} {
+						xip.TxtKvCustomizations[key] = []dnsmessage.TXTResource{{TXT: []string{key + "-value"}}}
+					}
+				})
+				AfterEach(func() {
+					x.KVListToken = ""
+					for key := range xip.TxtKvCustomizations {
+						if strings.HasPrefix(key, "app-") || key == "other" {
+							delete(xip.TxtKvCustomizations, key)
+						}
+					}
+				})
+				It("returns the keys starting with the prefix, sorted", func() {
+					txtResources, err := x.TXTResources("list.LIST-TOKEN.app-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"app-a", "app-b", "app-c"}}}))
+				})
+				It("returns an empty array if no keys start with the prefix", func() {
+					txtResources, err := x.TXTResources("list.list-token.nonexistent.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(BeEmpty())
+				})
+				It("caps the number of keys and says so", func() {
+					for i := 0; i < xip.KvMaxListKeys+5; i++ {
+						xip.TxtKvCustomizations[fmt.Sprintf("app-many-%02d", i)] = []dnsmessage.TXTResource{{TXT: []string{"value"}}}
+					}
+					txtResources, err := x.TXTResources("list.list-token.app-many-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources[0].TXT).To(HaveLen(xip.KvMaxListKeys + 1))
+					Expect(txtResources[0].TXT[0]).To(Equal("app-many-00"))
+					Expect(txtResources[0].TXT[xip.KvMaxListKeys]).To(Equal("(truncated)"))
+				})
+				It("refuses to list without the token", func() {
+					txtResources, err := x.TXTResources("list.wrong-token.app-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: invalid list token"}}}))
+					txtResources, err = x.TXTResources("list.app-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: invalid list token"}}}))
+				})
+				It("refuses to list if there's no token configured", func() {
+					x.KVListToken = ""
+					txtResources, err := x.TXTResources("list.list-token.app-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: listing is disabled"}}}))
+				})
+				It("keeps the token out of the log message", func() {
+					_, logMessage, err := x.QueryResponse(packedQuery("list.List-Token.app-.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(logMessage).To(HavePrefix("TypeTXT list.<token>.app-.k-v.io. ? "))
+					Expect(strings.ToLower(logMessage)).ToNot(ContainSubstring("list-token"))
+				})
+				It("lists the keys in etcd with a range query", func() {
+					fakeEtcd := &xipfakes.FakeV3client{}
+					fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("app-x")}, {Key: []byte("app-y")}}}, nil)
+					etcdX := xip.Xip{Etcd: fakeEtcd, KVListToken: "list-token"}
+					txtResources, err := etcdX.TXTResources("list.list-token.app-.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"app-x", "app-y"}}}))
+					_, key, opts := fakeEtcd.GetArgsForCall(0)
+					Expect(key).To(Equal("app-"))
+					Expect(opts).To(HaveLen(3)) // WithPrefix(), WithKeysOnly(), WithLimit()
+				})
+			})
+			When("the node is read-only", func() {
+				BeforeEach(func() {
+					xip.TxtKvCustomizations["read-only-key"] = []dnsmessage.TXTResource{{TXT: []string{"read-only-value"}}}
+					x.KVReadOnly = true
+				})
+				AfterEach(func() {
+					x.KVReadOnly = false
+					delete(xip.TxtKvCustomizations, "read-only-key")
+				})
+				It("still gets values", func() {
+					txtResources, err := x.TXTResources("get.read-only-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"read-only-value"}}}))
+				})
+				DescribeTable("refuses writes",
+					func(fqdn string) {
+						rejections := x.Metrics.AnsweredReadOnlyRejections
+						txtResources, err := x.TXTResources(fqdn, nil)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: read-only node"}}}))
+						Expect(x.Metrics.AnsweredReadOnlyRejections).To(Equal(rejections + 1))
+						Expect(xip.TxtKvCustomizations["read-only-key"]).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"read-only-value"}}}))
+					},
+					Entry("put", "put.new-value.read-only-key.k-v.io."),
+					Entry("delete", "delete.read-only-key.k-v.io."),
+				)
+			})
 			etcdURI := "localhost:2379"
 			// make sure there's an etcd listening before we run our tests
 			conn, err := net.DialTimeout("tcp", etcdURI, 250*time.Millisecond)
@@ -243,6 +3033,45 @@ var _ = Describe("Xip", func() {
 		})
 	})
 
+	Describe("AResources() & AAAAResources()", func() {
+		var x xip.Xip
+		// e.g. "me.sslip.io" returns the querier's address
+		echoA := func(_ *xip.Xip, srcAddr net.IP) []dnsmessage.AResource {
+			var aResource dnsmessage.AResource
+			copy(aResource.A[:], srcAddr.To4())
+			return []dnsmessage.AResource{aResource}
+		}
+		echoAAAA := func(_ *xip.Xip, srcAddr net.IP) []dnsmessage.AAAAResource {
+			var aaaaResource dnsmessage.AAAAResource
+			copy(aaaaResource.AAAA[:], srcAddr.To16())
+			return []dnsmessage.AAAAResource{aaaaResource}
+		}
+		BeforeEach(func() {
+			xip.Customizations["echo.sslip.io."] = xip.DomainCustomization{
+				A:        []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}},
+				AFunc:    echoA,
+				AAAAFunc: echoAAAA,
+			}
+		})
+		AfterEach(func() {
+			delete(xip.Customizations, "echo.sslip.io.")
+		})
+		It("calls the AFunc with the querier, preferring it to the static A records", func() {
+			Expect(x.AResources("echo.sslip.io.", net.IP{1, 2, 3, 4})).To(Equal([]dnsmessage.AResource{{A: [4]byte{1, 2, 3, 4}}}))
+			Expect(x.AResources("echo.sslip.io.", net.IP{5, 6, 7, 8})).To(Equal([]dnsmessage.AResource{{A: [4]byte{5, 6, 7, 8}}}))
+		})
+		It("calls the AAAAFunc with the querier", func() {
+			Expect(x.AAAAResources("ECHO.sslip.io.", net.ParseIP("2001:db8::1"))).To(Equal([]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}}))
+		})
+		It("doesn't call the AFunc in NameToA(), which has no querier", func() {
+			Expect(xip.NameToA("echo.sslip.io.")).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+		})
+		It("behaves like NameToA() & NameToAAAA() when there's no function", func() {
+			Expect(x.AResources("127-0-0-1.sslip.io.", net.IP{1, 2, 3, 4})).To(Equal(xip.NameToA("127-0-0-1.sslip.io.")))
+			Expect(x.AAAAResources("--1.sslip.io.", net.IP{1, 2, 3, 4})).To(Equal(xip.NameToAAAA("--1.sslip.io.")))
+		})
+	})
+
 	Describe("NameToA()", func() {
 		xip.Customizations["custom.record."] = xip.DomainCustomization{A: []dnsmessage.AResource{
 			{A: [4]byte{78, 46, 204, 247}},
@@ -259,6 +3088,10 @@ var _ = Describe("Xip", func() {
 			Entry("255 with domain", "255.254.253.252.com", dnsmessage.AResource{A: [4]byte{255, 254, 253, 252}}),
 			Entry(`"This" network, pre-and-post`, "nono.io.0.1.2.3.ssLIp.IO", dnsmessage.AResource{A: [4]byte{0, 1, 2, 3}}),
 			Entry("private network, two IPs, grabs the leftmost", "nono.io.172.16.0.30.172.31.255.255.sslip.io", dnsmessage.AResource{A: [4]byte{172, 16, 0, 30}}),
+			Entry("two adjacent IPs, grabs the leftmost", "1.2.3.4.5.6.7.8.sslip.io", dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}}),
+			Entry("two IPs separated by labels, grabs the leftmost", "a.1.2.3.4.b.5.6.7.8.c.sslip.io", dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}}),
+			Entry("five numeric labels, grabs the leftmost four", "0.1.2.3.4.sslip.io", dnsmessage.AResource{A: [4]byte{0, 1, 2, 3}}),
+			Entry("an out-of-range leading label is skipped", "256.1.2.3.4.sslip.io", dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}}),
 			// dashes
 			Entry("shared address with dashes", "100-64-1-2", dnsmessage.AResource{A: [4]byte{100, 64, 1, 2}}),
 			Entry("link-local with domain", "169-254-168-253-com", dnsmessage.AResource{A: [4]byte{169, 254, 168, 253}}),
@@ -277,13 +3110,26 @@ var _ = Describe("Xip", func() {
 			Entry("www", "www.sslip.io"),
 			Entry("a lone number", "538.sslip.io"),
 			Entry("too big", "256.254.253.252"),
-			Entry("NS but no dot", "ns-aws.sslip.io"),
+			Entry("NS as the subdomain of another domain", "ns-aws.sslip.io.example.com"),
 			Entry("NS + cruft at beginning", "p-ns-aws.sslip.io"),
 			Entry("test-net address with dots-and-dashes mixed", "www-192.0-2.3.example-me.com"),
 		)
+		When("there's a wildcard customization", func() {
+			It("returns the wildcard's A records for subdomains", func() {
+				fqdn := strings.ToLower(random8ByteString()) + ".com."
+				xip.Customizations["*."+fqdn] = xip.DomainCustomization{
+					A: []dnsmessage.AResource{{A: [4]byte{10, 9, 8, 7}}},
+				}
+				ipv4Answers := xip.NameToA("www." + fqdn)
+				Expect(len(ipv4Answers)).To(Equal(1))
+				Expect(ipv4Answers[0].A).To(Equal([4]byte{10, 9, 8, 7}))
+				Expect(len(xip.NameToA(fqdn))).To(Equal(0))
+				delete(xip.Customizations, "*."+fqdn)
+			})
+		})
 		When("There is more than one A record", func() {
 			It("returns them all", func() {
-				fqdn := random8ByteString()
+				fqdn := random8ByteString() + "."
 				xip.Customizations[strings.ToLower(fqdn)] = xip.DomainCustomization{
 					A: []dnsmessage.AResource{
 						{A: [4]byte{1}},
@@ -295,7 +3141,7 @@ var _ = Describe("Xip", func() {
 				Expect(len(ipv4Answers)).To(Equal(2))
 				Expect(ipv4Answers[0].A).To(Equal([4]byte{1}))
 				Expect(ipv4Answers[1].A).To(Equal([4]byte{2}))
-				delete(xip.Customizations, fqdn)
+				delete(xip.Customizations, strings.ToLower(fqdn))
 			})
 		})
 		When("There are multiple matches", func() {
@@ -369,6 +3215,34 @@ var _ = Describe("Xip", func() {
 			Entry("Browsing the logs", "1-2-3--4-5-6.sSLIP.io.", dnsmessage.AAAAResource{AAAA: [16]byte{0, 1, 0, 2, 0, 3, 0, 0, 0, 0, 0, 4, 0, 5, 0, 6}}),
 			Entry("Browsing the logs", "1--2-3-4-5-6.sSLIP.io.", dnsmessage.AAAAResource{AAAA: [16]byte{0, 1, 0, 0, 0, 0, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6}}),
 		)
+		Describe("mixed dash/dot forms (the last 32 bits as a dotted IPv4)", func() {
+			var logs bytes.Buffer
+			BeforeEach(func() {
+				logs.Reset()
+				log.SetOutput(&logs)
+			})
+			AfterEach(func() {
+				log.SetOutput(os.Stderr)
+			})
+			DescribeTable("parses them",
+				func(fqdn string, expected string) {
+					ipv6Answers := xip.NameToAAAA(fqdn)
+					Expect(len(ipv6Answers)).To(Equal(1))
+					Expect(net.IP(ipv6Answers[0].AAAA[:]).Equal(net.ParseIP(expected))).To(BeTrue(), net.IP(ipv6Answers[0].AAAA[:]).String())
+					Expect(logs.String()).ToNot(ContainSubstring("Should be valid AAAA"))
+				},
+				Entry("six groups, uncompressed", "1-2-3-4-5-6-1.2.3.4.sslip.io.", "1:2:3:4:5:6:1.2.3.4"),
+				Entry("compressed in the middle", "2001-db8--1.2.3.4.sslip.io.", "2001:db8::1.2.3.4"),
+				Entry("compressed, with groups on both sides", "2001-db8--ffff-10.0.0.1.sslip.io.", "2001:db8::ffff:10.0.0.1"),
+				Entry("five groups, compressed", "1-2-3-4-5--1.2.3.4.sslip.io.", "1:2:3:4:5::1.2.3.4"),
+				Entry("compressed at the start", "--1.2.3.4.sslip.io.", "::1.2.3.4"),
+				Entry("IPv4-mapped", "--ffff-10.0.0.1.sslip.io.", "::ffff:10.0.0.1"),
+				Entry("IPv4-translated", "--ffff-0-10.0.0.1.sslip.io.", "::ffff:0:10.0.0.1"),
+				Entry("NAT64", "64-ff9b--192.0.2.33.sslip.io.", "64:ff9b::192.0.2.33"),
+				Entry("with a leading label", "www.2001-db8-0-0-0-0-1.2.3.4.sslip.io.", "2001:db8::1.2.3.4"),
+				Entry("uppercase", "2001-DB8--1.2.3.4.SSLIP.IO.", "2001:db8::1.2.3.4"),
+			)
+		})
 		DescribeTable("when it does not match an IP address",
 			func(fqdn string) {
 				ipv6Answers := xip.NameToAAAA(fqdn)
@@ -391,9 +3265,32 @@ var _ = Describe("Xip", func() {
 				}
 			})
 		})
+		When("the IPv6 separator isn't the default dash", func() {
+			BeforeEach(func() {
+				xip.V6Separator = "x"
+			})
+			AfterEach(func() {
+				xip.V6Separator = "-"
+			})
+			It("resolves hostnames that use the separator", func() {
+				ipv6Answers := xip.NameToAAAA("www.2001xdb8xx1.sslip.io.")
+				Expect(len(ipv6Answers)).To(Equal(1))
+				Expect(net.IP(ipv6Answers[0].AAAA[:]).String()).To(Equal("2001:db8::1"))
+			})
+			It("ignores the separator's case", func() {
+				ipv6Answers := xip.NameToAAAA("2001XDB8XX1.sslip.io.")
+				Expect(len(ipv6Answers)).To(Equal(1))
+				Expect(net.IP(ipv6Answers[0].AAAA[:]).String()).To(Equal("2001:db8::1"))
+			})
+			It("still resolves hostnames that use dashes", func() {
+				ipv6Answers := xip.NameToAAAA("2001-db8--1.sslip.io.")
+				Expect(len(ipv6Answers)).To(Equal(1))
+				Expect(net.IP(ipv6Answers[0].AAAA[:]).String()).To(Equal("2001:db8::1"))
+			})
+		})
 		When("There is more than one AAAA record", func() {
 			It("returns them all", func() {
-				fqdn := random8ByteString()
+				fqdn := random8ByteString() + "."
 				xip.Customizations[strings.ToLower(fqdn)] = xip.DomainCustomization{
 					AAAA: []dnsmessage.AAAAResource{
 						{AAAA: [16]byte{1}},
@@ -404,9 +3301,878 @@ var _ = Describe("Xip", func() {
 				Expect(len(ipv6Addrs)).To(Equal(2))
 				Expect(ipv6Addrs[0].AAAA).To(Equal([16]byte{1}))
 				Expect(ipv6Addrs[1].AAAA).To(Equal([16]byte{2}))
-				delete(xip.Customizations, fqdn)
+				delete(xip.Customizations, strings.ToLower(fqdn))
+			})
+		})
+	})
+
+	Describe("NormalizeCustomizations()", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			xip.Customizations["undotted.sslip.io"] = xip.DomainCustomization{
+				A:     []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}},
+				CNAME: dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("target.sslip.io.")},
+				MX:    []dnsmessage.MXResource{{Pref: 5, MX: dnsmessage.MustNewName("mx.sslip.io.")}},
+				TXT: func(_ *xip.Xip, _ net.IP) ([]dnsmessage.TXTResource, error) {
+					return []dnsmessage.TXTResource{{TXT: []string{"undotted"}}}, nil
+				},
+			}
+			xip.Customizations["Dotted.SSLIP.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 2}}}}
+			xip.Customizations["both.sslip.io"] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 3}}}}
+			xip.Customizations["both.sslip.io."] = xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 4}}}}
+			xip.NormalizeCustomizations()
+		})
+		AfterEach(func() {
+			for _, key := range []string{"undotted.sslip.io.", "dotted.sslip.io.", "both.sslip.io."} {
+				delete(xip.Customizations, key)
+			}
+		})
+		It("normalizes the keys to lower-cased & ending in a dot", func() {
+			Expect(xip.Customizations).To(HaveKey("undotted.sslip.io."))
+			Expect(xip.Customizations).To(HaveKey("dotted.sslip.io."))
+			Expect(xip.Customizations).ToNot(HaveKey("undotted.sslip.io"))
+			Expect(xip.Customizations).ToNot(HaveKey("Dotted.SSLIP.io."))
+		})
+		DescribeTable("resolves an undotted customization key, whether or not the lookup is dotted",
+			func(fqdn string) {
+				Expect(xip.NameToA(fqdn)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+				Expect(xip.CNAMEResource(fqdn).CNAME.String()).To(Equal("target.sslip.io."))
+				Expect(xip.MXResources(fqdn)).To(Equal([]dnsmessage.MXResource{{Pref: 5, MX: dnsmessage.MustNewName("mx.sslip.io.")}}))
+				txts, err := x.TXTResources(fqdn, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txts).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"undotted"}}}))
+			},
+			Entry("dotted", "undotted.sslip.io."),
+			Entry("undotted", "undotted.sslip.io"),
+			Entry("mixed case", "UNDOTTED.sslip.io"),
+		)
+		DescribeTable("resolves a dotted customization key, whether or not the lookup is dotted",
+			func(fqdn string) {
+				Expect(xip.NameToA(fqdn)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 2}}}))
+			},
+			Entry("dotted", "dotted.sslip.io."),
+			Entry("undotted", "dotted.sslip.io"),
+		)
+		It("prefers the dotted key when both forms are customized", func() {
+			Expect(xip.NameToA("both.sslip.io")).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 4}}}))
+		})
+		It("normalizes the keys of the -addresses, which NewXip() adds afterwards", func() {
+			_, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137", "Mixed.SSLIP.io=10.0.0.5"})
+			defer delete(xip.Customizations, "mixed.sslip.io.")
+			Expect(xip.Customizations).ToNot(HaveKey("Mixed.SSLIP.io."))
+			Expect(xip.NameToA("mixed.sslip.io.")).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 5}}}))
+		})
+	})
+
+	Describe("RetryEtcd() & Ready()", func() {
+		var x xip.Xip
+		It("is Ready when it isn't retrying", func() {
+			Expect(x.Ready()).To(BeTrue())
+		})
+		It("switches to etcd once it's reachable, and becomes Ready", func() {
+			fakeEtcd := &xipfakes.FakeV3client{}
+			fakeEtcd.GetReturns(&clientv3.GetResponse{}, nil)
+			var attempts int32
+			connect := func() (xip.V3client, error) {
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					return nil, errors.New("connection refused")
+				}
+				return fakeEtcd, nil
+			}
+			x.RetryEtcd(connect, 10*time.Millisecond)
+			Expect(x.Ready()).To(BeFalse())
+			// still the builtin key-value store
+			_, err := x.TXTResources("retry.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEtcd.GetCallCount()).To(Equal(0))
+
+			Eventually(x.Ready).Should(BeTrue())
+			Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(3)))
+			_, err = x.TXTResources("retry.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeEtcd.GetCallCount()).To(Equal(1))
+			_, key, _ := fakeEtcd.GetArgsForCall(0)
+			Expect(key).To(Equal("retry"))
+			Consistently(func() int32 { return atomic.LoadInt32(&attempts) }, 50*time.Millisecond).Should(Equal(int32(3)))
+		})
+	})
+
+	Describe("SlowEtcdThreshold", func() {
+		var x xip.Xip
+		var fakeEtcd *xipfakes.FakeV3client
+		BeforeEach(func() {
+			fakeEtcd = &xipfakes.FakeV3client{}
+			fakeEtcd.GetStub = func(context.Context, string, ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+				time.Sleep(20 * time.Millisecond)
+				return &clientv3.GetResponse{}, nil
+			}
+			fakeEtcd.PutStub = func(context.Context, string, string, ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+				time.Sleep(20 * time.Millisecond)
+				return &clientv3.PutResponse{}, nil
+			}
+			fakeEtcd.DeleteReturns(&clientv3.DeleteResponse{}, nil) // fast
+			x = xip.Xip{Etcd: fakeEtcd, SlowEtcdThreshold: 10 * time.Millisecond}
+		})
+		It("counts the etcd calls that exceed it", func() {
+			_, err := x.TXTResources("slow.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(x.Metrics.SlowEtcdQueries).To(Equal(int64(1)))
+			_, err = x.TXTResources("put.value.slow.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(x.Metrics.SlowEtcdQueries).To(Equal(int64(2)))
+			_, err = x.TXTResources("delete.slow.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(x.Metrics.SlowEtcdQueries).To(Equal(int64(2)))
+		})
+		It("is disabled when zero", func() {
+			x.SlowEtcdThreshold = 0
+			_, err := x.TXTResources("slow.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(x.Metrics.SlowEtcdQueries).To(Equal(int64(0)))
+		})
+	})
+
+	Describe("ShardFor()", func() {
+		var x xip.Xip
+		var shards []*xipfakes.FakeV3client
+		BeforeEach(func() {
+			shards = nil
+			x = xip.Xip{}
+			for i := 0; i < 3; i++ {
+				shard := &xipfakes.FakeV3client{}
+				shard.GetReturns(&clientv3.GetResponse{}, nil)
+				shard.DeleteReturns(&clientv3.DeleteResponse{Deleted: 1}, nil)
+				shards = append(shards, shard)
+				x.EtcdShards = append(x.EtcdShards, shard)
+			}
+		})
+		// shardIndex returns the index of the shard for the key
+		shardIndex := func(key string) int {
+			for i, shard := range shards {
+				if x.ShardFor(key) == xip.V3client(shard) {
+					return i
+				}
+			}
+			return -1
+		}
+		It("routes each key to the same shard, every time", func() {
+			counts := make([]int, len(shards))
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				index := shardIndex(key)
+				Expect(index).ToNot(Equal(-1))
+				Expect(shardIndex(key)).To(Equal(index))
+				counts[index]++
+			}
+			for _, count := range counts {
+				Expect(count).To(BeNumerically(">", 50)) // roughly evenly
+			}
+		})
+		It("moves only the new shard's keys when a shard is added", func() {
+			before := map[string]int{}
+			for i := 0; i < 300; i++ {
+				before[fmt.Sprintf("key-%d", i)] = shardIndex(fmt.Sprintf("key-%d", i))
+			}
+			newShard := &xipfakes.FakeV3client{}
+			shards = append(shards, newShard)
+			x.EtcdShards = append(x.EtcdShards, newShard)
+			for key, index := range before {
+				if after := shardIndex(key); after != index {
+					Expect(after).To(Equal(3))
+				}
+			}
+		})
+		It("gets, puts & deletes a key on its shard", func() {
+			index := shardIndex("my-key")
+			for _, name := range []string{"put.my-value.my-key.k-v.io.", "my-key.k-v.io.", "delete.my-key.k-v.io."} {
+				_, err := x.TXTResources(name, nil)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			for i, shard := range shards {
+				calls := 0
+				if i == index {
+					calls = 1
+				}
+				Expect(shard.PutCallCount()).To(Equal(calls))
+				Expect(shard.GetCallCount()).To(Equal(calls))
+				Expect(shard.DeleteCallCount()).To(Equal(calls))
+			}
+		})
+		It("lists the keys of every shard", func() {
+			x.KVListToken = "s3cret"
+			shards[0].GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("app-z")}}}, nil)
+			shards[2].GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Key: []byte("app-a")}}}, nil)
+			Expect(x.TXTResources("list.s3cret.app.k-v.io.", nil)).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"app-a", "app-z"}}}))
+		})
+		It("returns Etcd if there are no shards", func() {
+			fakeEtcd := &xipfakes.FakeV3client{}
+			x = xip.Xip{Etcd: fakeEtcd}
+			Expect(x.ShardFor("my-key")).To(Equal(xip.V3client(fakeEtcd)))
+		})
+	})
+
+	Describe(`the "k-v.io" apex`, func() {
+		var x, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137"})
+		AfterEach(func() {
+			x.RefuseOutOfZone = false
+		})
+		It("answers SOA authoritatively", func() {
+			response, logMessage := unpackedResponse(x, xip.KVZone, dnsmessage.TypeSOA)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Authoritative).To(BeTrue())
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Header.Name.String()).To(Equal("k-v.io."))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.SOAResource{
+				NS:      dnsmessage.MustNewName("ns-aws.sslip.io."),
+				MBox:    dnsmessage.MustNewName("briancunnie.gmail.com."),
+				Serial:  2022110900,
+				Refresh: xip.DefaultSOATimers.Refresh,
+				Retry:   xip.DefaultSOATimers.Retry,
+				Expire:  xip.DefaultSOATimers.Expire,
+				MinTTL:  xip.DefaultSOATimers.MinTTL,
+			}))
+			Expect(logMessage).To(HavePrefix("TypeSOA k-v.io. ? ns-aws.sslip.io. briancunnie.gmail.com. 2022110900"))
+		})
+		It("answers NS authoritatively, with the nameservers' addresses", func() {
+			response, logMessage := unpackedResponse(x, "K-V.io.", dnsmessage.TypeNS)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Authoritative).To(BeTrue())
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns-aws.sslip.io.")}))
+			Expect(response.Additionals).To(HaveLen(1))
+			Expect(response.Additionals[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{52, 0, 56, 137}}))
+			Expect(logMessage).To(Equal("TypeNS K-V.io. ? ns-aws.sslip.io."))
+		})
+		It("answers the other types with no records but the SOA", func() {
+			response, _ := unpackedResponse(x, xip.KVZone, dnsmessage.TypeA)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Answers).To(BeEmpty())
+			Expect(response.Authorities).To(HaveLen(1))
+			Expect(response.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+		})
+		It("answers even if we refuse the names outside our zones", func() {
+			x.RefuseOutOfZone = true
+			response, _ := unpackedResponse(x, xip.KVZone, dnsmessage.TypeSOA)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Answers).To(HaveLen(1))
+		})
+	})
+
+	Describe("modifying the customizations while answering queries", func() {
+		// run with `go test -race` to catch unguarded reads & writes
+		It("is safe via SetCustomization(), DeleteCustomization() & the k-v.io puts, and so are the Metrics", func() {
+			unthrottled := make(chan struct{})
+			close(unthrottled) // metrics.status.sslip.io needn't wait its turn
+			x := xip.Xip{SOATimers: xip.DefaultSOATimers, DnsAmplificationAttackDelay: unthrottled}
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				for i := 0; i < 200; i++ {
+					xip.SetCustomization("Racy.sslip.io", xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, byte(i)}}}})
+					xip.DeleteCustomization("racy.sslip.io.")
+					_, err := x.TXTResources(fmt.Sprintf("put.value-%d.racy-key.k-v.io.", i), nil)
+					Expect(err).ToNot(HaveOccurred())
+					_, err = x.TXTResources("delete.racy-key.k-v.io.", nil)
+					Expect(err).ToNot(HaveOccurred())
+				}
+			}()
+			for i := 0; i < 200; i++ {
+				_, _, err := x.QueryResponse(packedQuery("racy.sslip.io.", dnsmessage.TypeA), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				_, _, err = x.QueryResponse(packedQuery("get.racy-key.k-v.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+				_, _, err = x.QueryResponse(packedQuery("metrics.status.sslip.io.", dnsmessage.TypeTXT), net.IP{127, 0, 0, 1})
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Eventually(done).Should(BeClosed())
+			Expect(x.Metrics.Snapshot().AnsweredTXTPutKvQueries).To(Equal(int64(200)))
+			Expect(x.Metrics.Snapshot().Queries).To(Equal(int64(600)))
+			Expect(xip.Customizations).ToNot(HaveKey("racy.sslip.io."))
+			Expect(xip.TxtKvCustomizations).ToNot(HaveKey("racy-key"))
+		})
+		It("normalizes the host", func() {
+			xip.SetCustomization("Set.SSLIP.io", xip.DomainCustomization{A: []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}})
+			Expect(xip.NameToA("set.sslip.io.")).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+			xip.DeleteCustomization("SET.sslip.io")
+			Expect(xip.Customizations).ToNot(HaveKey("set.sslip.io."))
+		})
+	})
+
+	Describe("the reverse zones", func() {
+		var x, _ = xip.NewXip("localhost:2379", "file:///", []string{"ns-aws.sslip.io."}, []string{"ns-aws.sslip.io=52.0.56.137"})
+		AfterEach(func() {
+			x.RefuseOutOfZone = false
+		})
+		DescribeTable("answer SOA & NS at their apexes authoritatively",
+			func(zone string) {
+				response, _ := unpackedResponse(x, zone, dnsmessage.TypeSOA)
+				Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(response.Authoritative).To(BeTrue())
+				Expect(response.Answers).To(HaveLen(1))
+				Expect(response.Answers[0].Header.Name.String()).To(Equal(zone))
+				Expect(response.Answers[0].Body.(*dnsmessage.SOAResource).NS.String()).To(Equal("ns-aws.sslip.io."))
+				response, _ = unpackedResponse(x, zone, dnsmessage.TypeNS)
+				Expect(response.Answers).To(HaveLen(1))
+				Expect(response.Answers[0].Body).To(Equal(&dnsmessage.NSResource{NS: dnsmessage.MustNewName("ns-aws.sslip.io.")}))
+			},
+			Entry("in-addr.arpa", xip.IPv4ReverseZone),
+			Entry("ip6.arpa", xip.IPv6ReverseZone),
+		)
+		It("answers even if we refuse the names outside our zones", func() {
+			x.RefuseOutOfZone = true
+			response, _ := unpackedResponse(x, "IN-ADDR.ARPA.", dnsmessage.TypeSOA)
+			Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+			Expect(response.Answers).To(HaveLen(1))
+		})
+		It("still answers PTR, e.g. 0.0.0.0", func() {
+			response, logMessage := unpackedResponse(x, "0.0.0.0.in-addr.arpa.", dnsmessage.TypePTR)
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(logMessage).To(Equal("TypePTR 0.0.0.0.in-addr.arpa. ? 0-0-0-0.sslip.io."))
+		})
+		DescribeTable("answer a malformed reverse name NODATA, with the reverse zone's SOA",
+			func(name string, zone string) {
+				response, logMessage := unpackedResponse(x, name, dnsmessage.TypePTR)
+				Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(response.Answers).To(BeEmpty())
+				Expect(response.Authorities).To(HaveLen(1))
+				Expect(response.Authorities[0].Header.Type).To(Equal(dnsmessage.TypeSOA))
+				Expect(response.Authorities[0].Header.Name.String()).To(Equal(zone))
+				Expect(logMessage).To(HavePrefix("TypePTR " + name + " ? nil, SOA"))
+			},
+			Entry("not an IP", "foo.in-addr.arpa.", "in-addr.arpa."),
+			Entry("an octet out of range", "256.0.0.10.in-addr.arpa.", "in-addr.arpa."),
+			Entry("too few octets", "0.10.in-addr.arpa.", "in-addr.arpa."),
+			Entry("too few nibbles", "1.0.ip6.arpa.", "ip6.arpa."),
+		)
+		DescribeTable("don't extract embedded IPs from the reverse names",
+			func(name string, qType dnsmessage.Type) {
+				response, _ := unpackedResponse(x, name, qType)
+				Expect(response.RCode).To(Equal(dnsmessage.RCodeSuccess))
+				Expect(response.Answers).To(BeEmpty())
+				Expect(response.Authorities[0].Header.Name.String()).To(Equal(xip.IPv4ReverseZone))
+			},
+			Entry("a reversed IPv4 (which would resolve backwards)", "1.0.0.10.in-addr.arpa.", dnsmessage.TypeA),
+			Entry("a dashed IPv4", "10-0-0-1.in-addr.arpa.", dnsmessage.TypeA),
+			Entry("a dashed IPv6", "fe80--1.in-addr.arpa.", dnsmessage.TypeAAAA),
+		)
+	})
+
+	Describe("weighted KV pools", func() {
+		var x xip.Xip
+		var fakeEtcd *xipfakes.FakeV3client
+		BeforeEach(func() {
+			fakeEtcd = &xipfakes.FakeV3client{}
+			fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte("10.0.0.1=3,10.0.0.2=1,fe80::1=1")}}}, nil)
+			x = xip.Xip{Etcd: fakeEtcd, SOATimers: xip.DefaultSOATimers, RandIntn: rand.New(rand.NewSource(1)).Intn}
+		})
+		// answer returns the answer to the query (nil if there's none) & the log message
+		answer := func(name string, qType dnsmessage.Type) (*dnsmessage.Resource, string) {
+			response, logMessage, err := x.QueryResponse(packedQuery(name, qType), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			var m dnsmessage.Message
+			Expect(m.Unpack(response)).To(Succeed())
+			if len(m.Answers) == 0 {
+				return nil, logMessage
+			}
+			Expect(m.Answers).To(HaveLen(1))
+			return &m.Answers[0], logMessage
+		}
+		It("picks an IP per query, by weight", func() {
+			picks := map[[4]byte]int{}
+			for i := 0; i < 4000; i++ {
+				a, _ := answer("pool.k-v.io.", dnsmessage.TypeA)
+				picks[a.Body.(*dnsmessage.AResource).A]++
+			}
+			Expect(picks).To(HaveLen(2))
+			Expect(picks[[4]byte{10, 0, 0, 1}]).To(BeNumerically("~", 3000, 100))
+			Expect(picks[[4]byte{10, 0, 0, 2}]).To(BeNumerically("~", 1000, 100))
+			_, key, _ := fakeEtcd.GetArgsForCall(0)
+			Expect(key).To(Equal("pool"))
+			Expect(x.Metrics.AnsweredKvPoolQueries).To(Equal(int64(4000)))
+		})
+		It("picks exactly by weight", func() {
+			next := 0
+			x.RandIntn = func(n int) int {
+				Expect(n).To(Equal(4)) // the IPv4 addresses' total weight
+				next++
+				return (next - 1) % n
+			}
+			var ips []string
+			for i := 0; i < 8; i++ {
+				_, logMessage := answer("pool.k-v.io.", dnsmessage.TypeA)
+				ips = append(ips, strings.TrimPrefix(logMessage, "TypeA pool.k-v.io. ? "))
+			}
+			Expect(ips).To(Equal([]string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2"}))
+		})
+		It("picks from the IPv6 addresses for AAAA queries, uncached", func() {
+			aaaa, logMessage := answer("Pool.K-V.io.", dnsmessage.TypeAAAA)
+			Expect(logMessage).To(Equal("TypeAAAA Pool.K-V.io. ? fe80::1"))
+			Expect(aaaa.Body).To(Equal(&dnsmessage.AAAAResource{AAAA: [16]byte{0xfe, 0x80, 15: 1}}))
+			Expect(aaaa.Header.TTL).To(Equal(uint32(0)))
+		})
+		It("returns no answer if the pool has no IP of the family", func() {
+			fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte("10.0.0.1=1")}}}, nil)
+			aaaa, _ := answer("pool.k-v.io.", dnsmessage.TypeAAAA)
+			Expect(aaaa).To(BeNil())
+		})
+		It("returns no answer if the value isn't a weighted pool, or there's none", func() {
+			fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte("my-value")}}}, nil)
+			a, _ := answer("pool.k-v.io.", dnsmessage.TypeA)
+			Expect(a).To(BeNil())
+			fakeEtcd.GetReturns(&clientv3.GetResponse{}, nil)
+			a, _ = answer("pool.k-v.io.", dnsmessage.TypeA)
+			Expect(a).To(BeNil())
+			Expect(x.Metrics.AnsweredKvPoolQueries).To(Equal(int64(0)))
+		})
+		It("stores a weighted pool via a put", func() {
+			fakeEtcd.PutReturns(&clientv3.PutResponse{}, nil)
+			Expect(x.TXTResources("put.10.0.0.1=3,10.0.0.2=1.pool.k-v.io.", nil)).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"10.0.0.1=3,10.0.0.2=1"}}}))
+			_, key, value, _ := fakeEtcd.PutArgsForCall(0)
+			Expect(key + " " + value).To(Equal("pool 10.0.0.1=3,10.0.0.2=1"))
+		})
+		DescribeTable("ParseWeightedPool() rejects an invalid pool",
+			func(pool, message string) {
+				_, err := xip.ParseWeightedPool(pool)
+				Expect(err).To(MatchError(message))
+			},
+			Entry("no weight", "10.0.0.1", `"10.0.0.1" isn't in the format "ip=weight"`),
+			Entry("an invalid IP", "10.0.0.256=1", `"10.0.0.256" isn't a valid IP`),
+			Entry("a zero weight", "10.0.0.1=0", `"0" isn't a weight between 1 and 1000`),
+			Entry("a non-numeric weight", "10.0.0.1=3,10.0.0.2=heavy", `"heavy" isn't a weight between 1 and 1000`),
+			Entry("too heavy a weight", "10.0.0.1=1001", `"1001" isn't a weight between 1 and 1000`),
+		)
+	})
+	Describe("KV errors", func() {
+		var x xip.Xip
+		var fakeEtcd *xipfakes.FakeV3client
+		var logger *capturingLogger
+		BeforeEach(func() {
+			fakeEtcd = &xipfakes.FakeV3client{}
+			logger = &capturingLogger{}
+			x = xip.Xip{Etcd: fakeEtcd, Logger: logger}
+		})
+		It("returns ErrKVNotFound for a missing key", func() {
+			fakeEtcd.GetReturns(&clientv3.GetResponse{}, nil)
+			_, err := x.GetKV("missing")
+			Expect(errors.Is(err, xip.ErrKVNotFound)).To(BeTrue())
+			Expect(err).To(MatchError(`couldn't GET "missing": key not found`))
+			Expect(x.TXTResources("missing.k-v.io.", nil)).To(BeEmpty())
+		})
+		It("returns ErrKVBackendUnavailable, wrapping etcd's error, when etcd is down", func() {
+			fakeEtcd.GetReturns(nil, context.DeadlineExceeded)
+			_, err := x.GetKV("my-key")
+			Expect(errors.Is(err, xip.ErrKVBackendUnavailable)).To(BeTrue())
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(errors.Is(err, xip.ErrKVNotFound)).To(BeFalse())
+			Expect(x.TXTResources("my-key.k-v.io.", nil)).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"503: the key-value store is unavailable"}}}))
+			Expect(logger.lines).To(Equal([]string{`couldn't GET "my-key": context deadline exceeded`}))
+		})
+		It("returns a 503 when a PUT or DELETE fails, too", func() {
+			fakeEtcd.PutReturns(nil, errors.New("etcd is down"))
+			fakeEtcd.DeleteReturns(nil, errors.New("etcd is down"))
+			for _, name := range []string{"put.my-value.my-key.k-v.io.", "delete.my-key.k-v.io."} {
+				Expect(x.TXTResources(name, nil)).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"503: the key-value store is unavailable"}}}))
+			}
+		})
+		It("returns ErrKVBackendUnavailable when ImportKV's PUT fails", func() {
+			fakeEtcd.PutReturns(nil, errors.New("etcd is down"))
+			err := x.ImportKV(strings.NewReader(`{"my-key":"my-value"}`))
+			Expect(errors.Is(err, xip.ErrKVBackendUnavailable)).To(BeTrue())
+			Expect(err).To(MatchError("couldn't PUT (my-key: my-value): etcd is down"))
+		})
+		It("returns ErrKVInvalidKey for a key with control characters", func() {
+			_, err := x.GetKV("my\x00key")
+			Expect(errors.Is(err, xip.ErrKVInvalidKey)).To(BeTrue())
+			Expect(x.TXTResources("put.my-value.my\x01key.k-v.io.", nil)).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"422: invalid key"}}}))
+			Expect(fakeEtcd.PutCallCount()).To(Equal(0))
+			Expect(xip.ValidKVKey("")).To(BeFalse())
+			Expect(xip.ValidKVKey("my-key")).To(BeTrue())
+		})
+		It("returns the value of a key", func() {
+			fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte("my-value")}}}, nil)
+			Expect(x.GetKV("my-key")).To(Equal("my-value"))
+		})
+	})
+
+	Describe("Logger", func() {
+		var x xip.Xip
+		var logger *capturingLogger
+		BeforeEach(func() {
+			fakeEtcd := &xipfakes.FakeV3client{}
+			fakeEtcd.GetReturns(nil, errors.New("etcd is down"))
+			logger = &capturingLogger{}
+			x = xip.Xip{Etcd: fakeEtcd, Logger: logger}
+		})
+		It("logs through the Xip's Logger", func() {
+			x.PTRResource([]byte("1.0.0.10.in-addr.arpa."))
+			Expect(logger.lines).To(Equal([]string{`couldn't GET "ptr-10-0-0-1": etcd is down`}))
+		})
+		It("logs through the DefaultLogger if the Xip has none", func() {
+			originalDefaultLogger := xip.DefaultLogger
+			defer func() { xip.DefaultLogger = originalDefaultLogger }()
+			xip.DefaultLogger = logger
+			x.Logger = nil
+			x.PTRResource([]byte("1.0.0.10.in-addr.arpa."))
+			Expect(logger.lines).To(HaveLen(1))
+		})
+	})
+
+	Describe("Base36 IPs", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x.AllowBase36IP = true
+			x.Zones = []string{"sslip.io.", "example.com."}
+		})
+		It("round-trips IPv4 addresses", func() {
+			for _, ip := range []net.IP{{0, 0, 0, 0}, {0, 0, 0, 35}, {0, 0, 0, 36}, {10, 0, 0, 1}, {127, 0, 0, 1}, {192, 168, 255, 254}, {255, 255, 255, 255}} {
+				label := xip.EncodeBase36IP(ip)
+				Expect(len(label)).To(BeNumerically("<=", 7))
+				decoded, err := xip.DecodeBase36IP(label)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded.Equal(ip)).To(BeTrue(), ip.String())
+			}
+			for i := 0; i < 1000; i++ {
+				ip := make(net.IP, 4)
+				binary.BigEndian.PutUint32(ip, rand.Uint32())
+				decoded, err := xip.DecodeBase36IP(xip.EncodeBase36IP(ip))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded.Equal(ip)).To(BeTrue(), ip.String())
+			}
+		})
+		It("encodes & decodes known values", func() {
+			Expect(xip.EncodeBase36IP(net.IP{127, 0, 0, 1})).To(Equal("z8kflt"))
+			Expect(xip.EncodeBase36IP(net.IP{255, 255, 255, 255})).To(Equal("1z141z3"))
+			Expect(xip.DecodeBase36IP("Z8KFLT")).To(Equal(net.IP{127, 0, 0, 1}))
+		})
+		DescribeTable("DecodeBase36IP() rejects",
+			func(label string, errSubstring string) {
+				_, err := xip.DecodeBase36IP(label)
+				Expect(err).To(MatchError(ContainSubstring(errSubstring)))
+			},
+			Entry("an empty label", "", "1-7 characters"),
+			Entry("more than 7 characters", "00000001", "1-7 characters"),
+			Entry("non-Base36 characters", "z8k-lt", "isn't Base36"),
+			Entry("one more than 255.255.255.255", "1z141z4", "greater than 255.255.255.255"),
+			Entry("the largest 7-character value", "zzzzzzz", "greater than 255.255.255.255"),
+		)
+		DescribeTable("AResources()",
+			func(fqdn string, expected []dnsmessage.AResource) {
+				Expect(x.AResources(fqdn, nil)).To(Equal(expected))
+			},
+			Entry("decodes a label under b36.sslip.io", "z8kflt.b36.sslip.io.", []dnsmessage.AResource{{A: [4]byte{127, 0, 0, 1}}}),
+			Entry("is case-insensitive", "Z8kFlT.B36.sslip.IO.", []dnsmessage.AResource{{A: [4]byte{127, 0, 0, 1}}}),
+			Entry("decodes a short label", "a.b36.sslip.io.", []dnsmessage.AResource{{A: [4]byte{0, 0, 0, 10}}}),
+			Entry("doesn't answer an out-of-range label", "zzzzzzz.b36.sslip.io.", []dnsmessage.AResource{}),
+			Entry("doesn't decode a label outside b36.sslip.io", "z8kflt.sslip.io.", []dnsmessage.AResource{}),
+			Entry("doesn't decode a subdomain's label", "z8kflt.foo.b36.sslip.io.", []dnsmessage.AResource{}),
+			Entry("still answers embedded IPs", "10-0-0-1.b36.sslip.io.", []dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}),
+			Entry("decodes a label under b36. another zone", "z8kflt.b36.example.com.", []dnsmessage.AResource{{A: [4]byte{127, 0, 0, 1}}}),
+			Entry("doesn't decode a label outside our zones", "z8kflt.b36.example.org.", []dnsmessage.AResource{}),
+		)
+		It("is opt-in", func() {
+			x.AllowBase36IP = false
+			Expect(x.AResources("z8kflt.b36.sslip.io.", nil)).To(Equal([]dnsmessage.AResource{}))
+		})
+	})
+
+	Describe("6to4", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x.SixToFour = true
+			x.Zones = []string{"sslip.io.", "example.com."}
+		})
+		DescribeTable("AAAAResources()",
+			func(fqdn string, expected []dnsmessage.AAAAResource) {
+				Expect(x.AAAAResources(fqdn, nil)).To(Equal(expected))
+			},
+			Entry("maps a dashed IPv4 into 2002::/16", "10-0-0-1.6to4.sslip.io.",
+				[]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x02, 10, 0, 0, 1}}}),
+			Entry("maps a dotted IPv4", "www.192.168.0.1.6to4.sslip.io.",
+				[]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x02, 192, 168, 0, 1}}}),
+			Entry("is case-insensitive", "10-0-0-1.6TO4.SSLIP.io.",
+				[]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x02, 10, 0, 0, 1}}}),
+			Entry("doesn't answer a name without an IPv4", "foo.6to4.sslip.io.", []dnsmessage.AAAAResource{}),
+			Entry("doesn't answer an embedded IPv6", "2001-db8--1.6to4.sslip.io.", []dnsmessage.AAAAResource{}),
+			Entry("doesn't map outside 6to4.sslip.io", "10-0-0-1.sslip.io.", []dnsmessage.AAAAResource{}),
+			Entry("maps under 6to4. another zone", "10-0-0-1.6to4.example.com.",
+				[]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x02, 10, 0, 0, 1}}}),
+			Entry("doesn't map outside our zones", "10-0-0-1.6to4.example.org.", []dnsmessage.AAAAResource{}),
+		)
+		It("returns the address in the answer", func() {
+			responseBytes, logMessage, err := x.QueryResponse(packedQuery("10-0-0-1.6to4.sslip.io.", dnsmessage.TypeAAAA), net.IP{127, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			var response dnsmessage.Message
+			Expect(response.Unpack(responseBytes)).To(Succeed())
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(logMessage).To(Equal("TypeAAAA 10-0-0-1.6to4.sslip.io. ? 2002:a00:1::"))
+		})
+		It("still answers A with the IPv4", func() {
+			Expect(x.AResources("10-0-0-1.6to4.sslip.io.", nil)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+		})
+		It("is opt-in", func() {
+			x.SixToFour = false
+			Expect(x.AAAAResources("10-0-0-1.6to4.sslip.io.", nil)).To(Equal([]dnsmessage.AAAAResource{}))
+		})
+	})
+
+	Describe("Schedule", func() {
+		var schedule xip.Schedule
+		var now time.Time
+		maintenance := net.IP{10, 0, 0, 99}
+		normal := net.IP{10, 0, 0, 1}
+		at := func(hour, minute int) time.Time {
+			return time.Date(2022, time.March, 1, hour, minute, 0, 0, time.UTC)
+		}
+		BeforeEach(func() {
+			schedule = xip.Schedule{
+				Start:     2 * time.Hour,
+				End:       4 * time.Hour,
+				During:    []net.IP{maintenance},
+				Otherwise: []net.IP{normal},
+				Now:       func() time.Time { return now },
+			}
+		})
+		DescribeTable("IPs()",
+			func(hour, minute int, expected net.IP) {
+				now = at(hour, minute)
+				Expect(schedule.IPs()).To(Equal([]net.IP{expected}))
+			},
+			Entry("before the window", 1, 59, normal),
+			Entry("at the start of the window", 2, 0, maintenance),
+			Entry("during the window", 3, 30, maintenance),
+			Entry("at the end of the window", 4, 0, normal),
+			Entry("after the window", 23, 0, normal),
+		)
+		DescribeTable("IPs() when the window spans midnight",
+			func(hour, minute int, expected net.IP) {
+				schedule.Start = 23 * time.Hour
+				schedule.End = 1 * time.Hour
+				now = at(hour, minute)
+				Expect(schedule.IPs()).To(Equal([]net.IP{expected}))
+			},
+			Entry("before the window", 22, 59, normal),
+			Entry("before midnight", 23, 30, maintenance),
+			Entry("after midnight", 0, 30, maintenance),
+			Entry("after the window", 1, 0, normal),
+		)
+		It("honors the Location", func() {
+			schedule.Location = time.FixedZone("UTC+2", 2*60*60)
+			now = at(1, 0) // 03:00 in UTC+2
+			Expect(schedule.InWindow()).To(BeTrue())
+			now = at(3, 0) // 05:00 in UTC+2
+			Expect(schedule.InWindow()).To(BeFalse())
+		})
+		When("it's added to a host", func() {
+			var x xip.Xip
+			var host string
+			BeforeEach(func() {
+				host = random8ByteString() + ".com."
+				schedule.During = append(schedule.During, net.ParseIP("2001:db8::99"))
+				schedule.Otherwise = append(schedule.Otherwise, net.ParseIP("2001:db8::1"))
+				x.AddSchedule(strings.ToUpper(strings.TrimSuffix(host, ".")), schedule)
+			})
+			AfterEach(func() {
+				delete(xip.Customizations, host)
+			})
+			It("returns the maintenance IPs during the window", func() {
+				now = at(3, 0)
+				Expect(x.AResources(host, nil)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 99}}}))
+				Expect(x.AAAAResources(host, nil)).To(Equal([]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 14: 0, 15: 0x99}}}))
+			})
+			It("returns the normal IPs outside the window", func() {
+				now = at(5, 0)
+				Expect(x.AResources(host, nil)).To(Equal([]dnsmessage.AResource{{A: [4]byte{10, 0, 0, 1}}}))
+				Expect(x.AAAAResources(host, nil)).To(Equal([]dnsmessage.AAAAResource{{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 14: 0, 15: 0x01}}}))
+			})
+		})
+	})
+
+	Describe(`the "dhcp.k-v.io" namespace`, func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{SOATimers: xip.DefaultSOATimers, KVPTRPuts: true}
+		})
+		AfterEach(func() {
+			for _, key := range []string{"dhcp-myhost", "ptr-10-0-0-5", "ptr-10-0-0-6", "ptr-fe80--5"} {
+				delete(xip.TxtKvCustomizations, key)
+			}
+		})
+		It("resolves both forward (A) & reverse (PTR) after a single put", func() {
+			txtResources, err := x.TXTResources("put.10.0.0.5.MyHost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"myhost.dhcp.k-v.io."}}}))
+			response, logMessage := unpackedResponse(&x, "myhost.dhcp.k-v.io.", dnsmessage.TypeA)
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 5}}))
+			Expect(response.Answers[0].Header.TTL).To(Equal(uint32(0)))
+			Expect(logMessage).To(Equal("TypeA myhost.dhcp.k-v.io. ? 10.0.0.5"))
+			response, _ = unpackedResponse(&x, "5.0.0.10.in-addr.arpa.", dnsmessage.TypePTR)
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("myhost.dhcp.k-v.io.")}))
+			response, _ = unpackedResponse(&x, "myhost.dhcp.k-v.io.", dnsmessage.TypeAAAA)
+			Expect(response.Answers).To(BeEmpty())
+		})
+		It("leases IPv6 addresses, too", func() {
+			_, err := x.TXTResources("put.fe80--5.myhost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			response, _ := unpackedResponse(&x, "myhost.dhcp.k-v.io.", dnsmessage.TypeAAAA)
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.AAAAResource{AAAA: [16]byte{0xfe, 0x80, 15: 5}}))
+			Expect(x.PTRResource([]byte("5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.e.f.ip6.arpa.")).PTR.String()).To(Equal("myhost.dhcp.k-v.io."))
+		})
+		It("deletes the previous lease's reverse record when the host's IP changes", func() {
+			_, err := x.TXTResources("put.10.0.0.5.myhost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = x.TXTResources("put.10.0.0.6.myhost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			response, _ := unpackedResponse(&x, "myhost.dhcp.k-v.io.", dnsmessage.TypeA)
+			Expect(response.Answers).To(HaveLen(1))
+			Expect(response.Answers[0].Body).To(Equal(&dnsmessage.AResource{A: [4]byte{10, 0, 0, 6}}))
+			Expect(x.PTRResource([]byte("6.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("myhost.dhcp.k-v.io."))
+			Expect(x.PTRResource([]byte("5.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("10-0-0-5.sslip.io."))
+		})
+		It("deletes the previous host's lease when another host leases its IP", func() {
+			_, err := x.TXTResources("put.10.0.0.5.hosta.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer delete(xip.TxtKvCustomizations, "dhcp-hosta")
+			_, err = x.TXTResources("put.10.0.0.5.myhost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(xip.TxtKvCustomizations).ToNot(HaveKey("dhcp-hosta"))
+			response, _ := unpackedResponse(&x, "hosta.dhcp.k-v.io.", dnsmessage.TypeA)
+			Expect(response.Answers).To(BeEmpty())
+			Expect(x.PTRResource([]byte("5.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("myhost.dhcp.k-v.io."))
+		})
+		It("returns NODATA for a host without a lease", func() {
+			response, logMessage := unpackedResponse(&x, "nohost.dhcp.k-v.io.", dnsmessage.TypeA)
+			Expect(response.Answers).To(BeEmpty())
+			Expect(logMessage).To(HavePrefix("TypeA nohost.dhcp.k-v.io. ? nil, SOA"))
+		})
+		DescribeTable("rejects malformed leases",
+			func(name string, message string) {
+				txtResources, err := x.TXTResources(name, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{message}}}))
+				Expect(xip.TxtKvCustomizations).ToNot(HaveKey("dhcp-myhost"))
+			},
+			Entry("no IP", "put.myhost.dhcp.k-v.io.", "422: missing an IP: put.10.0.0.5.myhost.dhcp.k-v.io"),
+			Entry("an invalid IP", "put.10.0.0.256.myhost.dhcp.k-v.io.", `422: "10.0.0.256.myhost" isn't an IP & a hostname`),
+			Entry("an invalid hostname", "put.10.0.0.5.-myhost.dhcp.k-v.io.", `422: "10.0.0.5.-myhost" isn't an IP & a hostname`),
+		)
+	})
+
+	Describe("PTRResource()", func() {
+		var x xip.Xip
+		BeforeEach(func() {
+			x = xip.Xip{KVPTRPuts: true}
+		})
+		AfterEach(func() {
+			delete(xip.TxtKvCustomizations, "ptr-10-0-0-1")
+			delete(xip.TxtKvCustomizations, "ptr-2001-db8--1")
+		})
+
+		It("synthesizes the hostname", func() {
+			Expect(x.PTRResource([]byte("1.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("10-0-0-1.sslip.io."))
+		})
+		When("there's a custom PTR record in the key-value store", func() {
+			It("returns the custom hostname instead of the synthesized one", func() {
+				txtResources, err := x.TXTResources("put.myhost.example.com.ptr-10-0-0-1.k-v.io.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"myhost.example.com"}}}))
+				Expect(x.PTRResource([]byte("1.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("myhost.example.com."))
+				Expect(x.PTRResource([]byte("2.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("10-0-0-2.sslip.io."))
+				Expect(x.Metrics.AnsweredPTRQueriesIPv4).To(Equal(int64(2)))
+			})
+			It("returns the custom hostname for IPv6, too", func() {
+				_, err := x.TXTResources("put.v6.example.com.ptr-2001-db8--1.k-v.io.", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(x.PTRResource([]byte("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")).PTR.String()).To(Equal("v6.example.com."))
+			})
+			It("reads the hostname from etcd", func() {
+				fakeEtcd := &xipfakes.FakeV3client{}
+				fakeEtcd.GetReturns(&clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{{Value: []byte("etcd.example.com")}}}, nil)
+				etcdX := xip.Xip{Etcd: fakeEtcd}
+				Expect(etcdX.PTRResource([]byte("1.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("etcd.example.com."))
+				_, key, _ := fakeEtcd.GetArgsForCall(0)
+				Expect(key).To(Equal("ptr-10-0-0-1"))
 			})
+			It("falls back to the synthesized hostname if etcd fails", func() {
+				fakeEtcd := &xipfakes.FakeV3client{}
+				fakeEtcd.GetReturns(nil, errors.New("etcd is down"))
+				etcdX := xip.Xip{Etcd: fakeEtcd}
+				Expect(etcdX.PTRResource([]byte("1.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("10-0-0-1.sslip.io."))
+			})
+		})
+		It("refuses to store a value that isn't a legal hostname", func() {
+			txtResources, err := x.TXTResources("put.bad_host.ptr-10-0-0-1.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{`422: "bad_host" isn't a valid hostname for a PTR record`}}}))
+			Expect(xip.TxtKvCustomizations).ToNot(HaveKey("ptr-10-0-0-1"))
+		})
+		It("refuses the PTR puts & deletes by default", func() {
+			_, err := x.TXTResources("put.10.0.0.2.myhost.dhcp.k-v.io.", nil)
+			Expect(err).ToNot(HaveOccurred())
+			defer func() {
+				delete(xip.TxtKvCustomizations, "dhcp-myhost")
+				delete(xip.TxtKvCustomizations, "ptr-10-0-0-2")
+			}()
+			x.KVPTRPuts = false
+			for _, name := range []string{
+				"put.myhost.example.com.ptr-10-0-0-1.k-v.io.",
+				"put.10.0.0.1.myhost.dhcp.k-v.io.",
+				"put.10.0.0.99.dhcp-myhost.k-v.io.",
+				"delete.dhcp-myhost.k-v.io.",
+				"delete.ptr-10-0-0-2.k-v.io.",
+			} {
+				txtResources, err := x.TXTResources(name, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(txtResources).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"403: PTR writes are disabled"}}}), name)
+			}
+			Expect(xip.TxtKvCustomizations).ToNot(HaveKey("ptr-10-0-0-1"))
+			Expect(xip.TxtKvCustomizations["dhcp-myhost"]).To(Equal([]dnsmessage.TXTResource{{TXT: []string{"10.0.0.2"}}}))
+			Expect(xip.TxtKvCustomizations).To(HaveKey("ptr-10-0-0-2"))
+			Expect(x.PTRResource([]byte("1.0.0.10.in-addr.arpa.")).PTR.String()).To(Equal("10-0-0-1.sslip.io."))
 		})
+		DescribeTable("ValidHostname()",
+			func(name string, expected bool) {
+				Expect(xip.ValidHostname(name)).To(Equal(expected))
+			},
+			Entry("a hostname", "myhost.example.com", true),
+			Entry("a fully-qualified hostname", "myhost.example.com.", true),
+			Entry("a single label", "localhost", true),
+			Entry("digits & hyphens", "10-0-0-1.sslip.io", true),
+			Entry("empty", "", false),
+			Entry("an empty label", "myhost..example.com", false),
+			Entry("a leading hyphen", "-myhost.example.com", false),
+			Entry("a trailing hyphen", "myhost-.example.com", false),
+			Entry("an underscore", "my_host.example.com", false),
+			Entry("a 64-character label", strings.Repeat("a", 64)+".com", false),
+			Entry("over 253 characters", strings.Repeat("a.", 127)+"a", false),
+		)
+	})
+
+	Describe("ValidV6Separator()", func() {
+		DescribeTable("accepts",
+			func(separator string) {
+				Expect(xip.ValidV6Separator(separator)).To(Succeed())
+			},
+			Entry("the default dash", "-"),
+			Entry("a non-hex letter", "x"),
+			Entry("the first non-hex letter", "g"),
+		)
+		DescribeTable("rejects",
+			func(separator string) {
+				Expect(xip.ValidV6Separator(separator)).To(MatchError(ContainSubstring("IPv6 separator")))
+			},
+			Entry("an empty separator", ""),
+			Entry("more than one character", "xx"),
+			Entry("a hex letter", "f"),
+			Entry("a digit", "0"),
+			Entry("a dot", "."),
+			Entry("a colon", ":"),
+			Entry("an underscore", "_"),
+			Entry("an uppercase letter", "X"),
+		)
 	})
 
 	Describe("ReadBlocklist()", func() {
@@ -445,6 +4211,28 @@ var _ = Describe("Xip", func() {
 			Expect(bls).To(BeNil())
 			Expect(blIPs).To(Equal([]net.IPNet{{IP: net.IP{43, 134, 66, 0}, Mask: net.IPMask{255, 255, 255, 0}}}))
 		})
+		It("reads in hosts files' hostnames", func() {
+			input := strings.NewReader("127.0.0.1 localhost\n::1 localhost ip6-localhost\n0.0.0.0 0.0.0.0\n" +
+				"0.0.0.0 Bad.Example.com # phishing\n127.0.0.1\tbad.example.org  worse.example.org.\n")
+			bls, blIPs, err := xip.ReadBlocklist(input)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bls).To(Equal([]string{"bad.example.com", "bad.example.org", "worse.example.org"}))
+			Expect(blIPs).To(BeNil())
+		})
+		It("reads in domain lists' domains", func() {
+			input := strings.NewReader("bad.example.com\n  phishing.example.net. # comment\n")
+			bls, blIPs, err := xip.ReadBlocklist(input)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bls).To(Equal([]string{"bad.example.com", "phishing.example.net"}))
+			Expect(blIPs).To(BeNil())
+		})
+		It("reads in all the formats in one list", func() {
+			input := strings.NewReader("raiffeisen\n0.0.0.0 bad.example.com\nbad.example.org\n43.134.66.67/24\n")
+			bls, blIPs, err := xip.ReadBlocklist(input)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(bls).To(Equal([]string{"raiffeisen", "bad.example.com", "bad.example.org"}))
+			Expect(blIPs).To(HaveLen(1))
+		})
 		It("reads in IPv6 CIDRs", func() {
 			input := strings.NewReader("\n 2600::/64 #asdfasdf")
 			bls, blIPs, err := xip.ReadBlocklist(input)
@@ -486,3 +4274,81 @@ func random8ByteString() string {
 	}
 	return string(randomString)
 }
+
+// packedQuery returns a raw (packed) DNS query for the name & type, which is what QueryResponse() expects
+func packedQuery(name string, qtype dnsmessage.Type) []byte {
+	b := queryBuilder(name, qtype)
+	query, err := b.Finish()
+	Expect(err).ToNot(HaveOccurred())
+	return query
+}
+
+// unpackedResponse returns x's unpacked response to the query & the log message
+func unpackedResponse(x *xip.Xip, name string, qtype dnsmessage.Type) (response dnsmessage.Message, logMessage string) {
+	responseBytes, logMessage, err := x.QueryResponse(packedQuery(name, qtype), net.IP{127, 0, 0, 1})
+	Expect(err).ToNot(HaveOccurred())
+	Expect(response.Unpack(responseBytes)).To(Succeed())
+	return response, logMessage
+}
+
+// packedEDNSQuery is like packedQuery, but includes an OPT record with the options, if any
+func packedEDNSQuery(name string, qtype dnsmessage.Type, options ...dnsmessage.Option) []byte {
+	b := queryBuilder(name, qtype)
+	Expect(b.StartAdditionals()).To(Succeed())
+	var optHeader dnsmessage.ResourceHeader
+	Expect(optHeader.SetEDNS0(1232, dnsmessage.RCodeSuccess, false)).To(Succeed())
+	Expect(b.OPTResource(optHeader, dnsmessage.OPTResource{Options: options})).To(Succeed())
+	query, err := b.Finish()
+	Expect(err).ToNot(HaveOccurred())
+	return query
+}
+
+func queryBuilder(name string, qtype dnsmessage.Type) dnsmessage.Builder {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true})
+	Expect(b.StartQuestions()).To(Succeed())
+	Expect(b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	})).To(Succeed())
+	return b
+}
+
+// packedClassQuery is like packedQuery, but of the class, e.g. ClassCHAOS
+func packedClassQuery(name string, qtype dnsmessage.Type, qclass dnsmessage.Class) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(65536)), RecursionDesired: true})
+	Expect(b.StartQuestions()).To(Succeed())
+	Expect(b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: qclass,
+	})).To(Succeed())
+	query, err := b.Finish()
+	Expect(err).ToNot(HaveOccurred())
+	return query
+}
+
+// responseOPT returns the OPT record of the raw (packed) DNS response, nil if none
+func responseOPT(response []byte) *dnsmessage.OPTResource {
+	var m dnsmessage.Message
+	Expect(m.Unpack(response)).To(Succeed())
+	for _, additional := range m.Additionals {
+		if opt, ok := additional.Body.(*dnsmessage.OPTResource); ok {
+			return opt
+		}
+	}
+	return nil
+}
+
+// capturingLogger is an xip.Logger that records the lines it's asked to log
+type capturingLogger struct {
+	lines []string
+}
+
+func (c *capturingLogger) Printf(format string, v ...interface{}) {
+	c.lines = append(c.lines, fmt.Sprintf(format, v...))
+}
+
+func (c *capturingLogger) Println(v ...interface{}) {
+	c.lines = append(c.lines, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}